@@ -0,0 +1,154 @@
+package paymentsapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// APIKey is the stored form of an API key. Only the SHA-256 hash of the key is kept, the key itself is shown once
+// when it is issued. Keys look like "<prefix>.<secret>", the prefix is used to look the key up
+type APIKey struct {
+	ModelBase
+	ID             uint       `json:"-" gorm:"primary_key"`
+	Prefix         string     `json:"prefix" gorm:"unique_index"`
+	Hash           string     `json:"-"`
+	Name           string     `json:"name"`
+	OrganisationID uuid.UUID  `json:"organisation_id" gorm:"type:uuid"`
+	Scopes         string     `json:"scopes"`
+	Roles          string     `json:"roles"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+}
+
+// APIKeyStore persists API keys
+type APIKeyStore interface {
+	FindAPIKey(prefix string) (APIKey, error)
+	CreateAPIKey(k *APIKey) error
+}
+
+type apiKeyStore struct {
+	db *gorm.DB
+}
+
+// NewAPIKeyStore returns an APIKeyStore backed by the database
+func NewAPIKeyStore(db *gorm.DB) APIKeyStore {
+	return &apiKeyStore{
+		db: db,
+	}
+}
+
+// FindAPIKey retrieves an API key based on its prefix
+func (s *apiKeyStore) FindAPIKey(prefix string) (APIKey, error) {
+	k := APIKey{}
+	err := s.db.Where("prefix = ?", prefix).First(&k).Error
+	return k, err
+}
+
+// CreateAPIKey stores a new API key
+func (s *apiKeyStore) CreateAPIKey(k *APIKey) error {
+	return s.db.Create(k).Error
+}
+
+// IssueAPIKey generates a new API key for the organisation, stores its hash and returns the key.
+// A ttl of 0 issues a key that never expires
+func IssueAPIKey(store APIKeyStore, name string, organisationID uuid.UUID, scopes, roles []string, ttl time.Duration) (string, error) {
+	for _, r := range roles {
+		if !ValidRole(r) {
+			return "", errors.New("err: unknown role " + r)
+		}
+	}
+	prefix, err := randomHex(6)
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+	key := prefix + "." + secret
+	k := &APIKey{
+		Prefix:         prefix,
+		Hash:           hashAPIKey(key),
+		Name:           name,
+		OrganisationID: organisationID,
+		Scopes:         strings.Join(scopes, " "),
+		Roles:          strings.Join(roles, " "),
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().UTC().Add(ttl)
+		k.ExpiresAt = &expiresAt
+	}
+	if err := store.CreateAPIKey(k); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// APIKeyAuthenticator authenticates requests carrying an API key in the X-API-Key header
+// or in an "Authorization: ApiKey <key>" header
+type APIKeyAuthenticator struct {
+	store APIKeyStore
+	now   func() time.Time
+}
+
+// NewAPIKeyAuthenticator returns an Authenticator checking API keys against the store
+func NewAPIKeyAuthenticator(store APIKeyStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// Authenticate implements Authenticator
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r, "ApiKey")
+	}
+	if key == "" {
+		return Principal{}, errNoCredentials
+	}
+	var ErrKey = errors.New("err: invalid API key")
+	s := strings.SplitN(key, ".", 2)
+	if len(s) != 2 {
+		return Principal{}, ErrKey
+	}
+	k, err := a.store.FindAPIKey(s[0])
+	if err != nil {
+		return Principal{}, ErrKey
+	}
+	if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashAPIKey(key))) != 1 {
+		return Principal{}, ErrKey
+	}
+	if k.ExpiresAt != nil && !a.now().Before(*k.ExpiresAt) {
+		return Principal{}, errors.New("err: API key expired")
+	}
+	return Principal{
+		Subject:        "apikey:" + k.Prefix,
+		OrganisationID: k.OrganisationID,
+		Scopes:         strings.Fields(k.Scopes),
+		Roles:          strings.Fields(k.Roles),
+		Method:         AuthMethodAPIKey,
+	}, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,88 @@
+package paymentsapi
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryAPIKeyStore struct {
+	keys map[string]APIKey
+}
+
+func (m *memoryAPIKeyStore) FindAPIKey(prefix string) (APIKey, error) {
+	k, ok := m.keys[prefix]
+	if !ok {
+		return APIKey{}, errors.New("record not found")
+	}
+	return k, nil
+}
+
+func (m *memoryAPIKeyStore) CreateAPIKey(k *APIKey) error {
+	m.keys[k.Prefix] = *k
+	return nil
+}
+
+func TestIssueAPIKey(t *testing.T) {
+	store := &memoryAPIKeyStore{keys: map[string]APIKey{}}
+	org, _ := uuid.NewV4()
+	key, err := IssueAPIKey(store, "integrator", org, []string{ScopePaymentsRead}, []string{RoleViewer}, time.Hour)
+	assert.NoError(t, err)
+	prefix := strings.SplitN(key, ".", 2)[0]
+	stored, err := store.FindAPIKey(prefix)
+	assert.NoError(t, err)
+	// only the hash of the key is stored
+	assert.NotContains(t, stored.Hash, key)
+	assert.Equal(t, hashAPIKey(key), stored.Hash)
+	assert.Equal(t, org, stored.OrganisationID)
+	assert.NotNil(t, stored.ExpiresAt)
+
+	key, err = IssueAPIKey(store, "forever", org, nil, nil, 0)
+	assert.NoError(t, err)
+	stored, _ = store.FindAPIKey(strings.SplitN(key, ".", 2)[0])
+	assert.Nil(t, stored.ExpiresAt)
+
+	_, err = IssueAPIKey(store, "bad role", org, nil, []string{"superuser"}, 0)
+	assert.Error(t, err)
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	store := &memoryAPIKeyStore{keys: map[string]APIKey{}}
+	org, _ := uuid.NewV4()
+	key, _ := IssueAPIKey(store, "integrator", org, []string{ScopePaymentsRead, ScopePaymentsWrite}, []string{RoleCreator}, time.Hour)
+	a := NewAPIKeyAuthenticator(store)
+
+	r := httptest.NewRequest("GET", "/v1/payments", nil)
+	_, err := a.Authenticate(r)
+	assert.Equal(t, errNoCredentials, err)
+
+	r.Header.Set("X-API-Key", key)
+	p, err := a.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, org, p.OrganisationID)
+	assert.Equal(t, AuthMethodAPIKey, p.Method)
+	assert.True(t, p.HasScope(ScopePaymentsWrite))
+	assert.Equal(t, []string{RoleCreator}, p.Roles)
+
+	r = httptest.NewRequest("GET", "/v1/payments", nil)
+	r.Header.Set("Authorization", "ApiKey "+key)
+	_, err = a.Authenticate(r)
+	assert.NoError(t, err)
+
+	r.Header.Set("Authorization", "ApiKey "+key+"x")
+	_, err = a.Authenticate(r)
+	assert.Error(t, err)
+	r.Header.Set("Authorization", "ApiKey nodot")
+	_, err = a.Authenticate(r)
+	assert.Error(t, err)
+
+	a.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	r.Header.Set("Authorization", "ApiKey "+key)
+	_, err = a.Authenticate(r)
+	assert.EqualError(t, err, "err: API key expired")
+}
@@ -0,0 +1,519 @@
+package paymentsapi
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ApprovalPolicy describes when the payments of an organisation need to be approved. Payments whose amount is above
+// Threshold stay pending until RequiredApprovals users other than the requester approved them. When Approvers is not
+// empty only the subjects it lists (space separated) can approve, which gives "N of M approvers" policies
+type ApprovalPolicy struct {
+	ModelBase
+	ID                uint      `json:"-" gorm:"primary_key"`
+	OrganisationID    uuid.UUID `json:"organisation_id" gorm:"type:uuid; unique_index"`
+	Threshold         string    `json:"threshold"`
+	RequiredApprovals int       `json:"required_approvals"`
+	Approvers         string    `json:"approvers"`
+}
+
+// ApprovalRequest records who asked for a payment to be approved and the policy in force at that time
+type ApprovalRequest struct {
+	ModelBase
+	PaymentID         uuid.UUID `json:"payment_id" gorm:"type:uuid; primary_key"`
+	RequestedBy       string    `json:"requested_by"`
+	RequestID         string    `json:"request_id"`
+	RequiredApprovals int       `json:"required_approvals"`
+	Approvers         string    `json:"approvers"`
+}
+
+// Approval records who approved a payment and when
+type Approval struct {
+	ModelBase
+	ID         uint      `json:"-" gorm:"primary_key"`
+	PaymentID  uuid.UUID `json:"-" gorm:"type:uuid; unique_index:idx_approval_payment_approver"`
+	Approver   string    `json:"approver" gorm:"unique_index:idx_approval_payment_approver"`
+	ApprovedAt time.Time `json:"approved_at"`
+	RequestID  string    `json:"request_id"`
+}
+
+// PaymentApprovals is the approval status of a payment
+type PaymentApprovals struct {
+	PaymentID         uuid.UUID  `json:"payment_id"`
+	Status            string     `json:"status"`
+	RequestedBy       string     `json:"requested_by"`
+	RequiredApprovals int        `json:"required_approvals"`
+	Approvals         []Approval `json:"approvals"`
+}
+
+// ApprovalStore persists approval policies, approval requests and approvals
+type ApprovalStore interface {
+	FindApprovalPolicy(organisationID uuid.UUID) (ApprovalPolicy, error)
+	SaveApprovalPolicy(p *ApprovalPolicy) error
+	// LockPayment locks the payment of the organisation until the end of the transaction of ctx, so that its
+	// approvals are made one at a time
+	LockPayment(ctx context.Context, organisationID, id uuid.UUID) error
+	// FindApprovalRequest retrieves the approval request of the payment, in the transaction of ctx if there is one
+	FindApprovalRequest(ctx context.Context, paymentID uuid.UUID) (ApprovalRequest, error)
+	// SaveApprovalRequest stores a new approval request for the payment and discards the approvals of the previous one,
+	// in the transaction of ctx if there is one
+	SaveApprovalRequest(ctx context.Context, r *ApprovalRequest) error
+	// ListApprovals lists the approvals of the payment, in the transaction of ctx if there is one
+	ListApprovals(ctx context.Context, paymentID uuid.UUID) ([]Approval, error)
+	// CreateApproval stores an approval, in the transaction of ctx if there is one
+	CreateApproval(ctx context.Context, a *Approval) error
+	// SetPaymentStatus changes the status of the payment if it is still pending approval, in the transaction of ctx if
+	// there is one
+	SetPaymentStatus(ctx context.Context, paymentID uuid.UUID, status string) (bool, error)
+	Transactor
+}
+
+type approvalStore struct {
+	txStore
+}
+
+// NewApprovalStore returns an ApprovalStore backed by the database
+func NewApprovalStore(db *gorm.DB) ApprovalStore {
+	return &approvalStore{
+		txStore{db: db},
+	}
+}
+
+// FindApprovalPolicy retrieves the approval policy of an organisation
+func (s *approvalStore) FindApprovalPolicy(organisationID uuid.UUID) (ApprovalPolicy, error) {
+	p := ApprovalPolicy{}
+	err := s.db.Where("organisation_id = ?", organisationID).First(&p).Error
+	return p, err
+}
+
+// SaveApprovalPolicy creates or replaces the approval policy of an organisation
+func (s *approvalStore) SaveApprovalPolicy(p *ApprovalPolicy) error {
+	existing := ApprovalPolicy{}
+	err := s.db.Where("organisation_id = ?", p.OrganisationID).First(&existing).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	p.ID = existing.ID
+	return s.db.Save(p).Error
+}
+
+// LockPayment selects the payment for update, a payment of another organisation is not found
+func (s *approvalStore) LockPayment(ctx context.Context, organisationID, id uuid.UUID) error {
+	return lockPayment(withContext(s.db, ctx), organisationID, id)
+}
+
+// lockPayment selects the payment of the organisation for update
+func lockPayment(db *gorm.DB, organisationID, id uuid.UUID) error {
+	err := db.Set("gorm:query_option", "FOR UPDATE").Where("id = ? AND organisation_id = ?", id, organisationID).First(&Payment{}).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return errPaymentNotFound
+	}
+	return err
+}
+
+// FindApprovalRequest retrieves the approval request of a payment
+func (s *approvalStore) FindApprovalRequest(ctx context.Context, paymentID uuid.UUID) (ApprovalRequest, error) {
+	r := ApprovalRequest{}
+	err := withContext(s.db, ctx).Where("payment_id = ?", paymentID).First(&r).Error
+	return r, err
+}
+
+// SaveApprovalRequest replaces the approval request of a payment and discards its approvals
+func (s *approvalStore) SaveApprovalRequest(ctx context.Context, r *ApprovalRequest) error {
+	return s.joinTransaction(ctx, func(ctx context.Context) error {
+		tx := withContext(s.db, ctx)
+		if err := tx.Unscoped().Where("payment_id = ?", r.PaymentID).Delete(&Approval{}).Error; err != nil {
+			return err
+		}
+		return tx.Save(r).Error
+	})
+}
+
+// ListApprovals retrieves the approvals of a payment, oldest first
+func (s *approvalStore) ListApprovals(ctx context.Context, paymentID uuid.UUID) ([]Approval, error) {
+	var approvals []Approval
+	err := withContext(s.db, ctx).Where("payment_id = ?", paymentID).Order("approved_at").Find(&approvals).Error
+	return approvals, err
+}
+
+// CreateApproval stores a new approval
+func (s *approvalStore) CreateApproval(ctx context.Context, a *Approval) error {
+	return withContext(s.db, ctx).Create(a).Error
+}
+
+// SetPaymentStatus updates the status of a payment if it is still pending approval, so that a payment accepted or
+// changed in the meantime is left alone
+func (s *approvalStore) SetPaymentStatus(ctx context.Context, paymentID uuid.UUID, status string) (bool, error) {
+	res := withContext(s.db, ctx).Model(&Payment{}).Where("id = ? AND status = ?", paymentID, PaymentStatusPendingApproval).
+		Update("status", status)
+	return res.RowsAffected == 1, res.Error
+}
+
+// requiresApproval reports whether the amount of the payment is above the threshold of the policy
+func requiresApproval(policy ApprovalPolicy, payment Payment) bool {
+	threshold, ok := new(big.Rat).SetString(policy.Threshold)
+	if !ok {
+		return false
+	}
+	amount, ok := new(big.Rat).SetString(payment.Attributes.Amount)
+	// amounts that cannot be read are held for approval rather than let through
+	return !ok || amount.Cmp(threshold) > 0
+}
+
+// The approval middleware holds the payments above the threshold of their organisation's policy for approval
+
+// approvalMiddleware is the type of the wrapper around the core service and any other functionality layers
+type approvalMiddleware struct {
+	store ApprovalStore
+	next  PaymentService
+}
+
+// NewApprovalWorkflow returns a new instance of PaymentService that marks the payments above the threshold of their
+// organisation's approval policy as pending approval when they are created or updated
+func NewApprovalWorkflow(store ApprovalStore, next PaymentService) PaymentService {
+	return &approvalMiddleware{
+		store: store,
+		next:  next,
+	}
+}
+
+// approvalRequest returns the approval request to record for the payment, or nil if it does not need to be approved
+func (mw approvalMiddleware) approvalRequest(ctx context.Context, payment Payment) (*ApprovalRequest, error) {
+	policy, err := mw.store.FindApprovalPolicy(payment.OrganisationID)
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !requiresApproval(policy, payment) {
+		return nil, nil
+	}
+	p, _ := PrincipalFromContext(ctx)
+	return &ApprovalRequest{
+		RequestedBy:       p.Subject,
+		RequestID:         RequestIDFromContext(ctx),
+		RequiredApprovals: policy.RequiredApprovals,
+		Approvers:         policy.Approvers,
+	}, nil
+}
+
+// GetPayment is passed through
+func (mw approvalMiddleware) GetPayment(ctx context.Context, id string) (Payment, error) {
+	return mw.next.GetPayment(ctx, id)
+}
+
+// GetListPayments is passed through
+func (mw approvalMiddleware) GetListPayments(ctx context.Context) ([]Payment, error) {
+	return mw.next.GetListPayments(ctx)
+}
+
+// CreatePayment creates the payment as pending approval when its amount is above the threshold
+func (mw approvalMiddleware) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
+	r, err := mw.approvalRequest(ctx, p)
+	if err != nil {
+		return CreatePaymentResponse{}, err
+	}
+	p.Status = PaymentStatusAccepted
+	if r != nil {
+		p.Status = PaymentStatusPendingApproval
+	}
+	resp, err := mw.next.CreatePayment(ctx, p)
+	if err != nil || r == nil {
+		return resp, err
+	}
+	r.PaymentID = resp.PaymentID
+	return resp, mw.store.SaveApprovalRequest(ctx, r)
+}
+
+// UpdatePayment puts the payment back to pending approval when its new amount is above the threshold,
+// the approvals given to the previous version of the payment are discarded. The payments in a final status cannot
+// be updated
+func (mw approvalMiddleware) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	current, err := mw.next.GetPayment(ctx, req.PaymentID)
+	if err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	if err := checkPaymentUpdatable(current.Status); err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	switch current.Status {
+	case PaymentStatusAccepted, PaymentStatusPendingApproval, PaymentStatusScheduled:
+	default:
+		// the approval is only decided again for the payments that have not been sent
+		req.Payment.Status = current.Status
+		return mw.next.UpdatePayment(ctx, req)
+	}
+	r, err := mw.approvalRequest(ctx, req.Payment)
+	if err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	req.Payment.Status = PaymentStatusAccepted
+	if r != nil {
+		req.Payment.Status = PaymentStatusPendingApproval
+	}
+	resp, err := mw.next.UpdatePayment(ctx, req)
+	if err != nil || r == nil {
+		return resp, err
+	}
+	r.PaymentID = resp.PaymentID
+	return resp, mw.store.SaveApprovalRequest(ctx, r)
+}
+
+// DeletePayment is passed through
+func (mw approvalMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	return mw.next.DeletePayment(ctx, id)
+}
+
+// ApprovalService is the interface of the approval workflow
+type ApprovalService interface {
+	ApprovePayment(ctx context.Context, id uuid.UUID) (PaymentApprovals, error)
+	GetApprovals(ctx context.Context, id uuid.UUID) (PaymentApprovals, error)
+	GetApprovalPolicy(ctx context.Context) (ApprovalPolicy, error)
+	SetApprovalPolicy(ctx context.Context, p ApprovalPolicy) (ApprovalPolicy, error)
+}
+
+// errNotPendingApproval is returned when a payment is approved while it is not, or no longer, pending approval
+var errNotPendingApproval = StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: payment is not pending approval"}
+
+type approvalService struct {
+	store    ApprovalStore
+	payments PaymentService
+	now      func() time.Time
+}
+
+// NewApprovalService returns the ApprovalService approving the payments retrieved through the PaymentService
+func NewApprovalService(store ApprovalStore, payments PaymentService) ApprovalService {
+	return &approvalService{
+		store:    store,
+		payments: payments,
+		now:      time.Now,
+	}
+}
+
+// payment retrieves a payment of the caller's organisation
+func (s *approvalService) payment(ctx context.Context, p Principal, id uuid.UUID) (Payment, error) {
+	payment, err := s.payments.GetPayment(ctx, id.String())
+	if err != nil {
+		return Payment{}, err
+	}
+	if payment.OrganisationID != p.OrganisationID {
+		return Payment{}, errPaymentNotFound
+	}
+	return payment, nil
+}
+
+// approvals builds the approval status of a payment
+func (s *approvalService) approvals(ctx context.Context, payment Payment) (PaymentApprovals, error) {
+	a := PaymentApprovals{PaymentID: payment.ID, Status: payment.Status, Approvals: []Approval{}}
+	r, err := s.store.FindApprovalRequest(ctx, payment.ID)
+	if gorm.IsRecordNotFoundError(err) {
+		return a, nil
+	}
+	if err != nil {
+		return PaymentApprovals{}, err
+	}
+	a.RequestedBy = r.RequestedBy
+	a.RequiredApprovals = r.RequiredApprovals
+	approvals, err := s.store.ListApprovals(ctx, payment.ID)
+	if err != nil {
+		return PaymentApprovals{}, err
+	}
+	a.Approvals = append(a.Approvals, approvals...)
+	return a, nil
+}
+
+// ApprovePayment records the approval of the caller and accepts the payment once it collected enough approvals.
+// The user who requested the approval cannot approve the payment, and nobody can approve it twice
+func (s *approvalService) ApprovePayment(ctx context.Context, id uuid.UUID) (PaymentApprovals, error) {
+	p, err := checkPermission(ctx, PermissionApprovePayments)
+	if err != nil {
+		return PaymentApprovals{}, err
+	}
+	var payment Payment
+	// the payment is locked while its approvals are counted, so that concurrent approvals cannot both miss each
+	// other, and the approval, the status and the postings of an accepted payment are recorded together
+	err = s.store.InTransaction(ctx, func(ctx context.Context) error {
+		if err := s.store.LockPayment(ctx, p.OrganisationID, id); err != nil {
+			return err
+		}
+		if payment, err = s.payment(ctx, p, id); err != nil {
+			return err
+		}
+		if payment.Status != PaymentStatusPendingApproval {
+			return errNotPendingApproval
+		}
+		r, err := s.store.FindApprovalRequest(ctx, id)
+		if err != nil {
+			return err
+		}
+		if r.RequestedBy == p.Subject {
+			return ErrSelfApproval
+		}
+		if r.Approvers != "" && !contains(strings.Fields(r.Approvers), p.Subject) {
+			return ErrForbidden
+		}
+		approvals, err := s.store.ListApprovals(ctx, id)
+		if err != nil {
+			return err
+		}
+		for _, a := range approvals {
+			if a.Approver == p.Subject {
+				return StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: payment already approved by " + p.Subject}
+			}
+		}
+		approval := &Approval{
+			PaymentID:  id,
+			Approver:   p.Subject,
+			ApprovedAt: s.now().UTC(),
+			RequestID:  RequestIDFromContext(ctx),
+		}
+		if err := s.store.CreateApproval(ctx, approval); err != nil {
+			return err
+		}
+		if len(approvals)+1 < r.RequiredApprovals {
+			return nil
+		}
+		// a payment processed on a later day is held until then
+		payment.Status = acceptedStatus(payment.Attributes.ProcessingDate, s.now())
+		accepted, err := s.store.SetPaymentStatus(ctx, id, payment.Status)
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			return errNotPendingApproval
+		}
+		return nil
+	})
+	if err != nil {
+		return PaymentApprovals{}, err
+	}
+	return s.approvals(ctx, payment)
+}
+
+// GetApprovals returns the approval status of a payment of the caller's organisation
+func (s *approvalService) GetApprovals(ctx context.Context, id uuid.UUID) (PaymentApprovals, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return PaymentApprovals{}, err
+	}
+	payment, err := s.payment(ctx, p, id)
+	if err != nil {
+		return PaymentApprovals{}, err
+	}
+	return s.approvals(ctx, payment)
+}
+
+// GetApprovalPolicy returns the approval policy of the caller's organisation
+func (s *approvalService) GetApprovalPolicy(ctx context.Context) (ApprovalPolicy, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return ApprovalPolicy{}, err
+	}
+	policy, err := s.store.FindApprovalPolicy(p.OrganisationID)
+	if gorm.IsRecordNotFoundError(err) {
+		return ApprovalPolicy{}, StatusError{Status: http.StatusNotFound, Kind: KindNotFound, Message: "err: no approval policy"}
+	}
+	return policy, err
+}
+
+// SetApprovalPolicy creates or replaces the approval policy of the caller's organisation
+func (s *approvalService) SetApprovalPolicy(ctx context.Context, policy ApprovalPolicy) (ApprovalPolicy, error) {
+	p, err := checkPermission(ctx, PermissionManagePolicies)
+	if err != nil {
+		return ApprovalPolicy{}, err
+	}
+	if err := validateApprovalPolicy(policy); err != nil {
+		return ApprovalPolicy{}, err
+	}
+	policy.OrganisationID = p.OrganisationID
+	policy.Approvers = strings.Join(strings.Fields(policy.Approvers), " ")
+	if err := s.store.SaveApprovalPolicy(&policy); err != nil {
+		return ApprovalPolicy{}, err
+	}
+	return policy, nil
+}
+
+func validateApprovalPolicy(p ApprovalPolicy) error {
+	invalid := func(msg string) error {
+		return StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: "err: " + msg}
+	}
+	if t, ok := new(big.Rat).SetString(p.Threshold); !ok || t.Sign() < 0 {
+		return invalid("threshold must be a positive amount")
+	}
+	if p.RequiredApprovals < 1 {
+		return invalid("at least one approval must be required")
+	}
+	if approvers := strings.Fields(p.Approvers); len(approvers) > 0 && len(approvers) < p.RequiredApprovals {
+		return invalid("the policy requires more approvals than it lists approvers")
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ApprovePaymentRequest is the request type used to approve a payment or retrieve its approvals
+type ApprovePaymentRequest struct {
+	PaymentID uuid.UUID
+}
+
+// MakeApprovePaymentEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ApprovePayment method
+func MakeApprovePaymentEndpoint(svc ApprovalService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ApprovePaymentRequest)
+		v, err := svc.ApprovePayment(ctx, req.PaymentID)
+		if err != nil {
+			return nil, newStatusError("err: Could not approve payment \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeGetApprovalsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the GetApprovals method
+func MakeGetApprovalsEndpoint(svc ApprovalService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ApprovePaymentRequest)
+		v, err := svc.GetApprovals(ctx, req.PaymentID)
+		if err != nil {
+			return nil, newStatusError("err: Could not retrieve approvals \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeGetApprovalPolicyEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the GetApprovalPolicy method
+func MakeGetApprovalPolicyEndpoint(svc ApprovalService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		v, err := svc.GetApprovalPolicy(ctx)
+		if err != nil {
+			return nil, newStatusError("err: Could not retrieve approval policy \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeSetApprovalPolicyEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the SetApprovalPolicy method
+func MakeSetApprovalPolicyEndpoint(svc ApprovalService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ApprovalPolicy)
+		v, err := svc.SetApprovalPolicy(ctx, req)
+		if err != nil {
+			return nil, newStatusError("err: Could not set approval policy \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,333 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	mocket "github.com/Selvatico/go-mocket"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type memoryApprovalStore struct {
+	policies  map[uuid.UUID]ApprovalPolicy
+	requests  map[uuid.UUID]ApprovalRequest
+	approvals map[uuid.UUID][]Approval
+	statuses  map[uuid.UUID]string
+	// onLock is called when a payment is locked, as another approval committed while waiting for the lock
+	onLock func()
+}
+
+func newMemoryApprovalStore() *memoryApprovalStore {
+	return &memoryApprovalStore{
+		policies:  map[uuid.UUID]ApprovalPolicy{},
+		requests:  map[uuid.UUID]ApprovalRequest{},
+		approvals: map[uuid.UUID][]Approval{},
+		statuses:  map[uuid.UUID]string{},
+	}
+}
+
+func (m *memoryApprovalStore) FindApprovalPolicy(org uuid.UUID) (ApprovalPolicy, error) {
+	p, ok := m.policies[org]
+	if !ok {
+		return ApprovalPolicy{}, gorm.ErrRecordNotFound
+	}
+	return p, nil
+}
+
+func (m *memoryApprovalStore) SaveApprovalPolicy(p *ApprovalPolicy) error {
+	m.policies[p.OrganisationID] = *p
+	return nil
+}
+
+func (m *memoryApprovalStore) LockPayment(_ context.Context, _, _ uuid.UUID) error {
+	if m.onLock != nil {
+		m.onLock()
+	}
+	return nil
+}
+
+func (m *memoryApprovalStore) FindApprovalRequest(_ context.Context, id uuid.UUID) (ApprovalRequest, error) {
+	r, ok := m.requests[id]
+	if !ok {
+		return ApprovalRequest{}, gorm.ErrRecordNotFound
+	}
+	return r, nil
+}
+
+func (m *memoryApprovalStore) SaveApprovalRequest(_ context.Context, r *ApprovalRequest) error {
+	m.requests[r.PaymentID] = *r
+	delete(m.approvals, r.PaymentID)
+	return nil
+}
+
+func (m *memoryApprovalStore) ListApprovals(_ context.Context, id uuid.UUID) ([]Approval, error) {
+	return m.approvals[id], nil
+}
+
+func (m *memoryApprovalStore) CreateApproval(_ context.Context, a *Approval) error {
+	m.approvals[a.PaymentID] = append(m.approvals[a.PaymentID], *a)
+	return nil
+}
+
+func (m *memoryApprovalStore) SetPaymentStatus(_ context.Context, id uuid.UUID, status string) (bool, error) {
+	if m.statuses[id] != PaymentStatusPendingApproval {
+		return false, nil
+	}
+	m.statuses[id] = status
+	return true, nil
+}
+
+func (m *memoryApprovalStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func TestRequiresApproval(t *testing.T) {
+	policy := ApprovalPolicy{Threshold: "10000.00", RequiredApprovals: 1}
+	payment := func(amount string) Payment {
+		return Payment{Attributes: Attributes{Amount: amount}}
+	}
+	assert.False(t, requiresApproval(policy, payment("100.21")))
+	assert.False(t, requiresApproval(policy, payment("10000")))
+	assert.True(t, requiresApproval(policy, payment("10000.01")))
+	assert.True(t, requiresApproval(policy, payment("not an amount")))
+}
+
+func TestApprovalWorkflowCreatePayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	store := newMemoryApprovalStore()
+	store.policies[org] = ApprovalPolicy{OrganisationID: org, Threshold: "1000", RequiredApprovals: 2}
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{PaymentID: id}, nil)
+	s := NewApprovalWorkflow(store, mockService)
+	ctx := roleContext(org, "alice", RoleCreator)
+
+	_, err := s.CreatePayment(ctx, Payment{OrganisationID: org, Attributes: Attributes{Amount: "999.99"}})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusAccepted, mockService.Calls[0].Arguments.Get(1).(Payment).Status)
+	assert.Empty(t, store.requests)
+
+	_, err = s.CreatePayment(ctx, Payment{OrganisationID: org, Attributes: Attributes{Amount: "1000.01"}})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusPendingApproval, mockService.Calls[1].Arguments.Get(1).(Payment).Status)
+	assert.Equal(t, ApprovalRequest{PaymentID: id, RequestedBy: "alice", RequiredApprovals: 2}, store.requests[id])
+}
+
+func TestApprovalWorkflowUpdatePayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	store := newMemoryApprovalStore()
+	store.policies[org] = ApprovalPolicy{OrganisationID: org, Threshold: "1000", RequiredApprovals: 1}
+	store.approvals[id] = []Approval{{PaymentID: id, Approver: "bob"}}
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org, Status: PaymentStatusAccepted}, nil)
+	mockService.On("UpdatePayment", mock.Anything, mock.Anything).Return(UpdatePaymentResponse{PaymentID: id}, nil)
+	s := NewApprovalWorkflow(store, mockService)
+
+	_, err := s.UpdatePayment(roleContext(org, "carol", RoleCreator), UpdatePaymentRequest{PaymentID: id.String(), Payment: Payment{OrganisationID: org, Attributes: Attributes{Amount: "5000"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusPendingApproval, mockService.Calls[1].Arguments.Get(1).(UpdatePaymentRequest).Payment.Status)
+	// the approvals given to the previous version are discarded
+	assert.Empty(t, store.approvals[id])
+	assert.Equal(t, "carol", store.requests[id].RequestedBy)
+}
+
+func TestApprovalWorkflowUpdateFinalPayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	store := newMemoryApprovalStore()
+	for _, status := range []string{PaymentStatusSettled, PaymentStatusRejected, PaymentStatusReturned, PaymentStatusCancelled} {
+		mockService := &MockPaymentService{}
+		mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org, Status: status}, nil)
+		s := NewApprovalWorkflow(store, mockService)
+
+		_, err := s.UpdatePayment(roleContext(org, "carol", RoleCreator), UpdatePaymentRequest{PaymentID: id.String(), Payment: Payment{OrganisationID: org, Attributes: Attributes{Amount: "5"}}})
+		assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+		assert.Equal(t, "err: the payment is "+status+" and can no longer be updated", err.Error())
+		mockService.AssertNotCalled(t, "UpdatePayment", mock.Anything, mock.Anything)
+	}
+}
+
+func TestApprovePayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	otherOrg, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	store := newMemoryApprovalStore()
+	store.requests[id] = ApprovalRequest{PaymentID: id, RequestedBy: "alice", RequiredApprovals: 2, Approvers: "alice bob carol"}
+	store.statuses[id] = PaymentStatusPendingApproval
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org, Status: PaymentStatusPendingApproval}, nil)
+	s := NewApprovalService(store, mockService)
+
+	_, err := s.ApprovePayment(roleContext(org, "bob", RoleCreator), id)
+	assert.Equal(t, ErrForbidden, err)
+
+	_, err = s.ApprovePayment(roleContext(org, "alice", RoleApprover), id)
+	assert.Equal(t, ErrSelfApproval, err)
+
+	_, err = s.ApprovePayment(roleContext(org, "dave", RoleApprover), id)
+	assert.Equal(t, ErrForbidden, err)
+
+	_, err = s.ApprovePayment(roleContext(otherOrg, "bob", RoleApprover), id)
+	assert.True(t, IsNotFound(err))
+
+	a, err := s.ApprovePayment(NewContextWithRequestID(roleContext(org, "bob", RoleApprover), "req-1"), id)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusPendingApproval, a.Status)
+	assert.Len(t, a.Approvals, 1)
+	assert.Equal(t, "bob", a.Approvals[0].Approver)
+	assert.Equal(t, "req-1", a.Approvals[0].RequestID)
+	assert.False(t, a.Approvals[0].ApprovedAt.IsZero())
+
+	_, err = s.ApprovePayment(roleContext(org, "bob", RoleApprover), id)
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+
+	a, err = s.ApprovePayment(roleContext(org, "carol", RoleAdmin), id)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusAccepted, a.Status)
+	assert.Equal(t, PaymentStatusAccepted, store.statuses[id])
+	assert.Len(t, a.Approvals, 2)
+}
+
+func TestApprovePaymentScheduled(t *testing.T) {
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	store := newMemoryApprovalStore()
+	store.requests[id] = ApprovalRequest{PaymentID: id, RequestedBy: "alice", RequiredApprovals: 1}
+	store.statuses[id] = PaymentStatusPendingApproval
+	payment := Payment{ID: id, OrganisationID: org, Status: PaymentStatusPendingApproval}
+	payment.Attributes.ProcessingDate = mustDate("2019-04-10")
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(payment, nil)
+	s := NewApprovalService(store, mockService)
+	s.(*approvalService).now = func() time.Time { return time.Date(2019, 4, 3, 10, 0, 0, 0, time.UTC) }
+
+	// the approved payment waits for its processing date
+	a, err := s.ApprovePayment(roleContext(org, "bob", RoleApprover), id)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusScheduled, a.Status)
+	assert.Equal(t, PaymentStatusScheduled, store.statuses[id])
+}
+
+func TestApprovePaymentCountsConcurrentApprovals(t *testing.T) {
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	store := newMemoryApprovalStore()
+	store.requests[id] = ApprovalRequest{PaymentID: id, RequestedBy: "alice", RequiredApprovals: 2}
+	store.statuses[id] = PaymentStatusPendingApproval
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org, Status: PaymentStatusPendingApproval}, nil)
+	s := NewApprovalService(store, mockService)
+	// carol's approval is committed while bob waits for the lock
+	store.onLock = func() {
+		store.approvals[id] = []Approval{{PaymentID: id, Approver: "carol"}}
+	}
+
+	a, err := s.ApprovePayment(roleContext(org, "bob", RoleApprover), id)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusAccepted, a.Status)
+	assert.Equal(t, PaymentStatusAccepted, store.statuses[id])
+	assert.Len(t, a.Approvals, 2)
+}
+
+func TestApprovePaymentAcceptedConcurrently(t *testing.T) {
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	store := newMemoryApprovalStore()
+	store.requests[id] = ApprovalRequest{PaymentID: id, RequestedBy: "alice", RequiredApprovals: 1}
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org, Status: PaymentStatusPendingApproval}, nil)
+	s := NewApprovalService(store, mockService)
+	// the payment was accepted by carol before bob's approval changes its status
+	store.statuses[id] = PaymentStatusAccepted
+
+	_, err := s.ApprovePayment(roleContext(org, "bob", RoleApprover), id)
+	assert.Equal(t, errNotPendingApproval, err)
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+	assert.Equal(t, PaymentStatusAccepted, store.statuses[id])
+}
+
+func TestApprovalStoreSetPaymentStatus(t *testing.T) {
+	db := setupTests()
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	store := NewApprovalStore(db)
+
+	// the lock only finds the payments of the organisation
+	mocket.Catcher.Reset().NewMock().WithQuery(`AND organisation_id = `)
+	assert.Equal(t, errPaymentNotFound, store.LockPayment(context.Background(), org, id))
+
+	mocket.Catcher.Reset().NewMock().WithQuery(`(id = ? AND status = ?)`).WithRowsNum(1)
+	accepted, err := store.SetPaymentStatus(context.Background(), id, PaymentStatusAccepted)
+	assert.NoError(t, err)
+	assert.True(t, accepted)
+
+	// a payment no longer pending approval is not updated
+	mocket.Catcher.Reset().NewMock().WithQuery(`UPDATE "payments" SET "status" = ?`).WithRowsNum(0)
+	accepted, err = store.SetPaymentStatus(context.Background(), id, PaymentStatusAccepted)
+	assert.NoError(t, err)
+	assert.False(t, accepted)
+}
+
+func TestApprovePaymentNotPending(t *testing.T) {
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org, Status: PaymentStatusAccepted}, nil)
+	s := NewApprovalService(newMemoryApprovalStore(), mockService)
+
+	_, err := s.ApprovePayment(roleContext(org, "bob", RoleApprover), id)
+	assert.Equal(t, KindConflict, err.(StatusError).Kind)
+
+	mockService = &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{}, errors.New("db down"))
+	s = NewApprovalService(newMemoryApprovalStore(), mockService)
+	_, err = s.ApprovePayment(roleContext(org, "bob", RoleApprover), id)
+	assert.EqualError(t, err, "db down")
+}
+
+func TestSetApprovalPolicy(t *testing.T) {
+	org, _ := uuid.NewV4()
+	store := newMemoryApprovalStore()
+	s := NewApprovalService(store, &MockPaymentService{})
+
+	_, err := s.SetApprovalPolicy(roleContext(org, "bob", RoleApprover), ApprovalPolicy{Threshold: "100", RequiredApprovals: 1})
+	assert.Equal(t, ErrForbidden, err)
+
+	admin := roleContext(org, "root", RoleAdmin)
+	tests := []struct {
+		name   string
+		policy ApprovalPolicy
+	}{
+		{"no threshold", ApprovalPolicy{RequiredApprovals: 1}},
+		{"negative threshold", ApprovalPolicy{Threshold: "-1", RequiredApprovals: 1}},
+		{"no approvals", ApprovalPolicy{Threshold: "100"}},
+		{"not enough approvers", ApprovalPolicy{Threshold: "100", RequiredApprovals: 3, Approvers: "bob carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.SetApprovalPolicy(admin, tt.policy)
+			assert.Equal(t, KindInvalidRequest, err.(StatusError).Kind)
+		})
+	}
+
+	otherOrg, _ := uuid.NewV4()
+	p, err := s.SetApprovalPolicy(admin, ApprovalPolicy{OrganisationID: otherOrg, Threshold: "100", RequiredApprovals: 2, Approvers: " bob  carol dave"})
+	assert.NoError(t, err)
+	// the policy always applies to the caller's organisation
+	assert.Equal(t, org, p.OrganisationID)
+	assert.Equal(t, "bob carol dave", p.Approvers)
+
+	got, err := s.GetApprovalPolicy(roleContext(org, "v", RoleViewer))
+	assert.NoError(t, err)
+	assert.Equal(t, p, got)
+
+	_, err = s.GetApprovalPolicy(roleContext(otherOrg, "v", RoleViewer))
+	assert.True(t, IsNotFound(err))
+}
@@ -0,0 +1,108 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Scopes that can be granted to API keys and JWT bearer tokens
+const (
+	ScopePaymentsRead  = "payments:read"
+	ScopePaymentsWrite = "payments:write"
+)
+
+// Authentication methods a Principal can be authenticated with
+const (
+	AuthMethodAPIKey     = "api_key"
+	AuthMethodJWT        = "jwt"
+	AuthMethodClientCert = "client_cert"
+)
+
+// errNoCredentials is returned by an Authenticator when the request does not carry the kind of credentials it checks
+var errNoCredentials = errors.New("err: no credentials")
+
+// Principal is the authenticated caller of the API
+type Principal struct {
+	Subject        string
+	OrganisationID uuid.UUID
+	Scopes         []string
+	Roles          []string
+	Method         string
+}
+
+// HasScope reports whether the principal was granted the scope
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalContextKey struct{}
+
+// NewContextWithPrincipal returns a copy of ctx carrying the authenticated principal
+func NewContextWithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+// PrincipalFromContext returns the authenticated principal carried by ctx, if any
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	if ctx == nil {
+		return Principal{}, false
+	}
+	p, ok := ctx.Value(principalContextKey{}).(Principal)
+	return p, ok
+}
+
+// Authenticator checks the credentials of an HTTP request and returns the principal they belong to.
+// It returns errNoCredentials when the request does not carry the kind of credentials it knows about
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// authenticationMiddleware is the HTTP handler wrapping the router with authentication
+type authenticationMiddleware struct {
+	authenticators []Authenticator
+	next           http.Handler
+}
+
+// NewAuthentication returns an HTTP handler that authenticates every request with the first authenticator
+// that recognises its credentials and passes the principal to the next handler through the request's context.
+// Requests without valid credentials are rejected with a 401 status code
+func NewAuthentication(next http.Handler, authenticators ...Authenticator) http.Handler {
+	return &authenticationMiddleware{
+		authenticators: authenticators,
+		next:           next,
+	}
+}
+
+func (mw *authenticationMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, a := range mw.authenticators {
+		p, err := a.Authenticate(r)
+		if err == errNoCredentials {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		mw.next.ServeHTTP(w, r.WithContext(NewContextWithPrincipal(r.Context(), p)))
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="paymentsapi"`)
+	EncodeError(r.Context(), ErrUnauthorised, w)
+}
+
+// bearerToken returns the token of an "Authorization: <scheme> <token>" header when the scheme matches
+func bearerToken(r *http.Request, scheme string) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > len(scheme)+1 && strings.EqualFold(h[:len(scheme)], scheme) && h[len(scheme)] == ' ' {
+		return strings.TrimSpace(h[len(scheme)+1:])
+	}
+	return ""
+}
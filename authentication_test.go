@@ -0,0 +1,86 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAuthenticator struct {
+	header    string
+	principal Principal
+	err       error
+}
+
+func (m mockAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if r.Header.Get(m.header) == "" {
+		return Principal{}, errNoCredentials
+	}
+	return m.principal, m.err
+}
+
+func TestPrincipalContext(t *testing.T) {
+	_, ok := PrincipalFromContext(context.Background())
+	assert.False(t, ok)
+	org, _ := uuid.NewV4()
+	ctx := NewContextWithPrincipal(context.Background(), Principal{Subject: "user", OrganisationID: org, Scopes: []string{ScopePaymentsRead}})
+	p, ok := PrincipalFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, org, p.OrganisationID)
+	assert.True(t, p.HasScope(ScopePaymentsRead))
+	assert.False(t, p.HasScope(ScopePaymentsWrite))
+}
+
+func TestNewAuthentication(t *testing.T) {
+	org, _ := uuid.NewV4()
+	var got Principal
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = PrincipalFromContext(r.Context())
+	})
+	h := NewAuthentication(next,
+		mockAuthenticator{header: "X-API-Key", principal: Principal{Subject: "key", OrganisationID: org}},
+		mockAuthenticator{header: "Authorization", err: errors.New("err: invalid token")},
+	)
+
+	tests := []struct {
+		name     string
+		header   string
+		wantCode int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"valid credentials", "X-API-Key", http.StatusOK},
+		{"invalid credentials", "Authorization", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = Principal{}
+			r := httptest.NewRequest("GET", "/v1/payments", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, "something")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			assert.Equal(t, tt.wantCode, rec.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, org, got.OrganisationID)
+				return
+			}
+			assert.Equal(t, "", got.Subject)
+			assert.Contains(t, rec.Body.String(), KindUnauthorised)
+			assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/payments", nil)
+	assert.Equal(t, "", bearerToken(r, "Bearer"))
+	r.Header.Set("Authorization", "bearer abc.def")
+	assert.Equal(t, "abc.def", bearerToken(r, "Bearer"))
+	assert.Equal(t, "", bearerToken(r, "ApiKey"))
+}
@@ -0,0 +1,122 @@
+package paymentsapi
+
+import (
+	"context"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// The authorisation middleware makes sure callers only see and change the payments of their own organisation
+
+// authorisationMiddleware is the type of the wrapper around the core service and any other functionality layers
+type authorisationMiddleware struct {
+	next PaymentService
+}
+
+// NewAuthorisation returns a new instance of PaymentService that checks the scopes of the principal carried by the
+// context and restricts every operation to the payments of the principal's organisation
+func NewAuthorisation(next PaymentService) PaymentService {
+	return &authorisationMiddleware{
+		next: next,
+	}
+}
+
+// authorise returns the principal carried by ctx if it was granted the scope
+func authorise(ctx context.Context, scope string) (Principal, error) {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return Principal{}, ErrUnauthorised
+	}
+	if !p.HasScope(scope) {
+		return Principal{}, ErrForbidden
+	}
+	return p, nil
+}
+
+// GetPayment only returns the payment if it belongs to the caller's organisation
+func (mw authorisationMiddleware) GetPayment(ctx context.Context, id string) (Payment, error) {
+	p, err := authorise(ctx, ScopePaymentsRead)
+	if err != nil {
+		return Payment{}, err
+	}
+	payment, err := mw.next.GetPayment(ctx, id)
+	if err != nil {
+		return Payment{}, err
+	}
+	if payment.OrganisationID != p.OrganisationID {
+		return Payment{}, errPaymentNotFound
+	}
+	return payment, nil
+}
+
+// GetListPayments only lists the payments of the caller's organisation. The store only queries them, the payments of
+// the other organisations are still dropped in case a service below lists them
+func (mw authorisationMiddleware) GetListPayments(ctx context.Context) ([]Payment, error) {
+	p, err := authorise(ctx, ScopePaymentsRead)
+	if err != nil {
+		return nil, err
+	}
+	all, err := mw.next.GetListPayments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payments := []Payment{}
+	for _, payment := range all {
+		if payment.OrganisationID == p.OrganisationID {
+			payments = append(payments, payment)
+		}
+	}
+	return payments, nil
+}
+
+// CreatePayment only creates payments on behalf of the caller's organisation
+func (mw authorisationMiddleware) CreatePayment(ctx context.Context, payment Payment) (CreatePaymentResponse, error) {
+	p, err := authorise(ctx, ScopePaymentsWrite)
+	if err != nil {
+		return CreatePaymentResponse{}, err
+	}
+	if payment.OrganisationID != p.OrganisationID {
+		return CreatePaymentResponse{}, ErrForbidden
+	}
+	return mw.next.CreatePayment(ctx, payment)
+}
+
+// UpdatePayment only updates payments of the caller's organisation and does not let them move to another organisation
+func (mw authorisationMiddleware) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	p, err := authorise(ctx, ScopePaymentsWrite)
+	if err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	if err := mw.checkOwnership(ctx, p, req.PaymentID); err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	if req.Payment.OrganisationID != p.OrganisationID {
+		return UpdatePaymentResponse{}, ErrForbidden
+	}
+	return mw.next.UpdatePayment(ctx, req)
+}
+
+// DeletePayment only deletes payments of the caller's organisation
+func (mw authorisationMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	p, err := authorise(ctx, ScopePaymentsWrite)
+	if err != nil {
+		return nil, err
+	}
+	if err := mw.checkOwnership(ctx, p, id.String()); err != nil {
+		return nil, err
+	}
+	return mw.next.DeletePayment(ctx, id)
+}
+
+// checkOwnership makes sure the existing payment belongs to the principal's organisation
+func (mw authorisationMiddleware) checkOwnership(ctx context.Context, p Principal, id string) error {
+	existing, err := mw.next.GetPayment(ctx, id)
+	if err != nil {
+		return err
+	}
+	if existing.OrganisationID != p.OrganisationID {
+		return errPaymentNotFound
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package paymentsapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func principalContext(org uuid.UUID, scopes ...string) context.Context {
+	return NewContextWithPrincipal(context.Background(), Principal{Subject: "test", OrganisationID: org, Scopes: scopes})
+}
+
+func TestAuthorisationGetPayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	otherOrg, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org}, nil)
+	s := NewAuthorisation(mockService)
+
+	p, err := s.GetPayment(principalContext(org, ScopePaymentsRead), id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, id, p.ID)
+
+	_, err = s.GetPayment(principalContext(otherOrg, ScopePaymentsRead), id.String())
+	assert.True(t, IsNotFound(err))
+
+	_, err = s.GetPayment(principalContext(org, ScopePaymentsWrite), id.String())
+	assert.Equal(t, ErrForbidden, err)
+
+	_, err = s.GetPayment(context.Background(), id.String())
+	assert.Equal(t, ErrUnauthorised, err)
+}
+
+func TestAuthorisationGetListPayments(t *testing.T) {
+	org, _ := uuid.NewV4()
+	otherOrg, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{{OrganisationID: org}, {OrganisationID: otherOrg}, {OrganisationID: org}}, nil)
+	s := NewAuthorisation(mockService)
+
+	list, err := s.GetListPayments(principalContext(org, ScopePaymentsRead))
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+
+	_, err = s.GetListPayments(context.Background())
+	assert.Equal(t, ErrUnauthorised, err)
+}
+
+func TestAuthorisationCreatePayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	otherOrg, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{}, nil)
+	s := NewAuthorisation(mockService)
+
+	_, err := s.CreatePayment(principalContext(org, ScopePaymentsWrite), Payment{OrganisationID: org})
+	assert.NoError(t, err)
+	_, err = s.CreatePayment(principalContext(org, ScopePaymentsWrite), Payment{OrganisationID: otherOrg})
+	assert.Equal(t, ErrForbidden, err)
+	_, err = s.CreatePayment(principalContext(org, ScopePaymentsRead), Payment{OrganisationID: org})
+	assert.Equal(t, ErrForbidden, err)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 1)
+}
+
+func TestAuthorisationUpdatePayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	otherOrg, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	otherID, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org}, nil)
+	mockService.On("GetPayment", mock.Anything, otherID.String()).Return(Payment{ID: otherID, OrganisationID: otherOrg}, nil)
+	mockService.On("UpdatePayment", mock.Anything, mock.Anything).Return(UpdatePaymentResponse{PaymentID: id}, nil)
+	s := NewAuthorisation(mockService)
+	ctx := principalContext(org, ScopePaymentsWrite)
+
+	_, err := s.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: id.String(), Payment: Payment{OrganisationID: org}})
+	assert.NoError(t, err)
+	// payments cannot be moved to another organisation
+	_, err = s.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: id.String(), Payment: Payment{OrganisationID: otherOrg}})
+	assert.Equal(t, ErrForbidden, err)
+	// nor can payments of other organisations be updated
+	_, err = s.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: otherID.String(), Payment: Payment{OrganisationID: org}})
+	assert.True(t, IsNotFound(err))
+	mockService.AssertNumberOfCalls(t, "UpdatePayment", 1)
+}
+
+func TestAuthorisationDeletePayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	otherOrg, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	now := time.Now()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id, OrganisationID: org}, nil)
+	mockService.On("DeletePayment", mock.Anything, id).Return(&now, nil)
+	s := NewAuthorisation(mockService)
+
+	_, err := s.DeletePayment(principalContext(otherOrg, ScopePaymentsWrite), id)
+	assert.True(t, IsNotFound(err))
+	_, err = s.DeletePayment(principalContext(org, ScopePaymentsRead), id)
+	assert.Equal(t, ErrForbidden, err)
+	d, err := s.DeletePayment(principalContext(org, ScopePaymentsWrite), id)
+	assert.NoError(t, err)
+	assert.Equal(t, &now, d)
+	mockService.AssertNumberOfCalls(t, "DeletePayment", 1)
+}
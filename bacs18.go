@@ -0,0 +1,285 @@
+package paymentsapi
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// FormatBACS18 is the BACS Standard 18 file of UK direct credits, exported with the service user number set up with
+// NewBACS18Exporter
+const FormatBACS18 = "bacs18"
+
+// BACSPaymentScheme is the payment_scheme of the payments sent through BACS
+const BACSPaymentScheme = "BACS"
+
+// bankIDCodeSortCode is the bank_id_code of the banks identified by their UK sort code
+const bankIDCodeSortCode = "GBDSC"
+
+// Lengths of the records of a Standard 18 file
+const (
+	bacsLabelLength  = 80
+	bacsRecordLength = 100
+)
+
+// Transaction codes of the data records: the direct credits and the debit contra balancing them
+const (
+	bacsCreditCode = "99"
+	bacsContraCode = "17"
+)
+
+// bacsDataRecord is the line of a transaction, or of the contra of the transactions of an originating account
+type bacsDataRecord struct {
+	DestinationSortCode string
+	DestinationAccount  string
+	TransactionCode     string
+	OriginatingSortCode string
+	OriginatingAccount  string
+	// Amount is in pence
+	Amount          int64
+	OriginatorName  string
+	Reference       string
+	DestinationName string
+}
+
+// String renders the 100 characters of the record
+func (r bacsDataRecord) String() string {
+	return r.DestinationSortCode + r.DestinationAccount + "0" + r.TransactionCode + r.OriginatingSortCode +
+		r.OriginatingAccount + "    " + fmt.Sprintf("%011d", r.Amount) + bacsText(r.OriginatorName, 18) +
+		bacsText(r.Reference, 18) + bacsText(r.DestinationName, 18)
+}
+
+// NewBACS18Exporter returns the exporter of the BACS payments to Standard 18 files submitted under the service user
+// number. A file holds the payments of a single processing day
+func NewBACS18Exporter(serviceUserNumber string) PaymentExporter {
+	return PaymentExporter{
+		ContentType: "text/plain",
+		Extension:   "txt",
+		Export: func(payments []Payment) ([]byte, error) {
+			return exportBACS18(serviceUserNumber, time.Now().UTC(), payments)
+		},
+		Select: func(p Payment) bool {
+			return p.Attributes.PaymentScheme == BACSPaymentScheme
+		},
+	}
+}
+
+// bacsText transliterates the text to the characters BACS accepts, upper case letters, digits, space and . & / -,
+// and pads or cuts it to the width
+func bacsText(s string, width int) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToUpper(s)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune(" .&/-", r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return bacsPad(b.String(), width)
+}
+
+// bacsPad pads the text with spaces, or cuts it, to the width
+func bacsPad(s string, width int) string {
+	if len(s) > width {
+		return s[:width]
+	}
+	return s + strings.Repeat(" ", width-len(s))
+}
+
+// bacsDate formats a day as the Julian dates of the labels, a space followed by the year and the day of the year
+func bacsDate(t time.Time) string {
+	return fmt.Sprintf(" %02d%03d", t.Year()%100, t.YearDay())
+}
+
+// bacsPence converts a decimal amount to pence
+func bacsPence(amount string) (int64, bool) {
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok || r.Sign() <= 0 {
+		return 0, false
+	}
+	r.Mul(r, big.NewRat(100, 1))
+	if !r.IsInt() || !r.Num().IsInt64() {
+		return 0, false
+	}
+	return r.Num().Int64(), true
+}
+
+// allDigits reports whether s has n digits
+func allDigits(s string, n int) bool {
+	return len(s) == n && strings.Trim(s, "0123456789") == ""
+}
+
+// bacsRecordOf returns the data record of a payment, the originating account is the debtor's when it is held at a
+// sort code and the sponsor's otherwise
+func bacsRecordOf(c *isoChecker, path string, p Payment) bacsDataRecord {
+	a := p.Attributes
+	r := bacsDataRecord{
+		DestinationSortCode: a.BeneficiaryParty.BankID,
+		DestinationAccount:  a.BeneficiaryParty.AccountNumber,
+		TransactionCode:     bacsCreditCode,
+		OriginatingSortCode: a.DebtorParty.BankID,
+		OriginatingAccount:  a.DebtorParty.AccountNumber,
+		OriginatorName:      a.DebtorParty.Name,
+		Reference:           a.Reference,
+		DestinationName:     a.BeneficiaryParty.AccountName,
+	}
+	if a.DebtorParty.BankIDCode != bankIDCodeSortCode {
+		c.check(a.SponsorParty.BankIDCode == bankIDCodeSortCode, path+"/sponsor_party", "the debtor or the sponsor needs an account at a UK sort code")
+		r.OriginatingSortCode, r.OriginatingAccount = a.SponsorParty.BankID, a.SponsorParty.AccountNumber
+	}
+	if r.DestinationName == "" {
+		r.DestinationName = a.BeneficiaryParty.Name
+	}
+	c.check(p.Status != PaymentStatusPendingApproval, path+"/status", "the payment is pending approval")
+	c.check(a.PaymentType == "Credit", path+"/payment_type", "must be Credit, the files only hold direct credits")
+	c.check(a.Currency == "GBP", path+"/currency", "must be GBP")
+	pence, ok := bacsPence(a.Amount)
+	c.check(ok && pence < 1e11, path+"/amount", "must be a positive amount in pence of at most 11 digits")
+	r.Amount = pence
+	c.check(a.BeneficiaryParty.BankIDCode == bankIDCodeSortCode, path+"/beneficiary_party/bank_id_code", "must be "+bankIDCodeSortCode)
+	c.check(allDigits(r.DestinationSortCode, 6), path+"/beneficiary_party/bank_id", "must be a sort code of 6 digits")
+	c.check(allDigits(r.DestinationAccount, 8), path+"/beneficiary_party/account_number", "must be an account number of 8 digits")
+	c.check(allDigits(r.OriginatingSortCode, 6), path+"/debtor_party/bank_id", "the originating sort code must have 6 digits")
+	c.check(allDigits(r.OriginatingAccount, 8), path+"/debtor_party/account_number", "the originating account number must have 8 digits")
+	// the banks reject the references that are too short or repeat a single character
+	ref := strings.TrimSpace(bacsText(r.Reference, 18))
+	c.check(len(ref) >= 6 && strings.Trim(ref, ref[:1]) != "", path+"/reference", "must have at least 6 characters that are not all the same")
+	return r
+}
+
+// exportBACS18 renders the payments as a Standard 18 file processed on their processing date. The transactions are
+// grouped by originating account, every group is balanced by a contra record debiting the account
+func exportBACS18(serviceUserNumber string, now time.Time, payments []Payment) ([]byte, error) {
+	if len(payments) == 0 {
+		return nil, errNothingToExport
+	}
+	c := &isoChecker{}
+	c.check(allDigits(serviceUserNumber, 6), "service user number", "must have 6 digits")
+	day := payments[0].Attributes.ProcessingDate
+	c.check(!day.IsZero(), "payment[0]/processing_date", "is required")
+	var groups [][]bacsDataRecord
+	index := map[string]int{}
+	for i, p := range payments {
+		path := "payment[" + strconv.Itoa(i) + "]"
+		c.check(p.Attributes.ProcessingDate.Equal(day.Time), path+"/processing_date", "differs from the other payments, a file is processed on a single day")
+		r := bacsRecordOf(c, path, p)
+		key := r.OriginatingSortCode + r.OriginatingAccount
+		if _, ok := index[key]; !ok {
+			index[key] = len(groups)
+			groups = append(groups, nil)
+		}
+		groups[index[key]] = append(groups[index[key]], r)
+	}
+	if len(c.problems) > 0 {
+		return nil, exportError(FormatBACS18, c.problems)
+	}
+
+	fileID := "A" + serviceUserNumber + "S  1" + serviceUserNumber
+	hdr1 := fileID + now.Format("150405") + "0001" + "0001" + "    " + "  " + bacsDate(now) + bacsDate(now) + " " + "000000" + strings.Repeat(" ", 20)
+	hdr2 := "F" + "02000" + "00100" + strings.Repeat(" ", 35) + "00" + strings.Repeat(" ", 28)
+	lines := []string{
+		"VOL1" + now.Format("150405") + " " + strings.Repeat(" ", 26) + "    " + serviceUserNumber + "    " + strings.Repeat(" ", 28) + "1",
+		"HDR1" + hdr1,
+		"HDR2" + hdr2,
+		"UHL1" + bacsDate(day.Time) + "999999    " + "00" + "000000" + "1 DAILY  " + "001" + strings.Repeat(" ", 40),
+	}
+	var credits, debits, creditCount, debitCount int64
+	for _, group := range groups {
+		var total int64
+		for _, r := range group {
+			lines = append(lines, r.String())
+			total += r.Amount
+		}
+		lines = append(lines, bacsDataRecord{
+			DestinationSortCode: group[0].OriginatingSortCode,
+			DestinationAccount:  group[0].OriginatingAccount,
+			TransactionCode:     bacsContraCode,
+			OriginatingSortCode: group[0].OriginatingSortCode,
+			OriginatingAccount:  group[0].OriginatingAccount,
+			Amount:              total,
+			OriginatorName:      group[0].OriginatorName,
+			Reference:           "BACS CREDITS",
+			DestinationName:     "CONTRA",
+		}.String())
+		credits, creditCount = credits+total, creditCount+int64(len(group))
+		debits, debitCount = debits+total, debitCount+1
+	}
+	lines = append(lines, "EOF1"+hdr1, "EOF2"+hdr2,
+		"UTL1"+fmt.Sprintf("%013d%013d%07d%07d", debits, credits, debitCount, creditCount)+strings.Repeat(" ", 36))
+	data := []byte(strings.Join(lines, "\r\n") + "\r\n")
+	if problems := validateBACS18(data); len(problems) > 0 {
+		return nil, exportError(FormatBACS18, problems)
+	}
+	return data, nil
+}
+
+// validateBACS18 returns the problems of a Standard 18 file: the order and the length of the labels and the records,
+// the fields of the data records, the contra records balancing the credits of their originating account and the
+// counts and the totals of the UTL1 trailer
+func validateBACS18(data []byte) []string {
+	c := &isoChecker{}
+	lines := strings.Split(strings.TrimRight(strings.Replace(string(data), "\r\n", "\n", -1), "\n"), "\n")
+	if len(lines) < 8 {
+		return []string{"the file needs the VOL1, HDR1, HDR2, UHL1 labels, data records and the EOF1, EOF2, UTL1 labels"}
+	}
+	labels := append(append([]string{}, lines[:4]...), lines[len(lines)-3:]...)
+	for i, name := range []string{"VOL1", "HDR1", "HDR2", "UHL1", "EOF1", "EOF2", "UTL1"} {
+		l := labels[i]
+		c.check(strings.HasPrefix(l, name), name, "is missing")
+		c.check(len(l) == bacsLabelLength, name, "must have "+strconv.Itoa(bacsLabelLength)+" characters")
+	}
+	if len(c.problems) > 0 {
+		return c.problems
+	}
+	hdr1, eof1 := labels[1], labels[4]
+	c.check(hdr1[4:54] == eof1[4:54] && hdr1[60:] == eof1[60:], "EOF1", "does not match HDR1")
+	c.check(labels[2][4:] == labels[5][4:], "EOF2", "does not match HDR2")
+	c.check(labels[0][41:47] == hdr1[5:11], "VOL1", "the service user number does not match HDR1")
+	_, err := time.Parse("06002", strings.TrimSpace(labels[3][4:10]))
+	c.check(err == nil, "UHL1", "the processing date is not a Julian date")
+
+	var credits, debits, creditCount, debitCount, pending int64
+	pendingAccount := ""
+	for i, l := range lines[4 : len(lines)-3] {
+		path := "record " + strconv.Itoa(i+1)
+		if len(l) != bacsRecordLength {
+			c.check(false, path, "must have "+strconv.Itoa(bacsRecordLength)+" characters")
+			continue
+		}
+		c.check(allDigits(l[0:6], 6) && allDigits(l[17:23], 6), path, "the sort codes must have 6 digits")
+		c.check(allDigits(l[6:14], 8) && allDigits(l[23:31], 8), path, "the account numbers must have 8 digits")
+		c.check(l[14] == '0', path, "the account type must be 0")
+		amount, err := strconv.ParseInt(l[35:46], 10, 64)
+		c.check(err == nil && allDigits(l[35:46], 11), path, "the amount must have 11 digits")
+		c.check(strings.TrimSpace(bacsText(l[46:], 54)) == strings.TrimSpace(l[46:]), path, "the names and the reference hold characters BACS does not accept")
+		switch l[15:17] {
+		case bacsCreditCode:
+			account := l[17:31]
+			c.check(pendingAccount == "" || pendingAccount == account, path, "the credits of another originating account are not balanced by a contra")
+			pendingAccount = account
+			pending += amount
+			credits, creditCount = credits+amount, creditCount+1
+		case bacsContraCode:
+			c.check(l[0:14] == l[17:31], path, "the contra must debit the originating account")
+			c.check(pendingAccount == l[17:31] && pending == amount, path, "the contra does not balance the credits of its originating account")
+			pending, pendingAccount = 0, ""
+			debits, debitCount = debits+amount, debitCount+1
+		default:
+			c.check(false, path, "the transaction code must be "+bacsCreditCode+" or "+bacsContraCode)
+		}
+	}
+	c.check(pendingAccount == "", "UTL1", "the last credits are not balanced by a contra")
+	utl1 := labels[6]
+	c.check(utl1[4:17] == fmt.Sprintf("%013d", debits), "UTL1", "the debit value total does not match the records")
+	c.check(utl1[17:30] == fmt.Sprintf("%013d", credits), "UTL1", "the credit value total does not match the records")
+	c.check(utl1[30:37] == fmt.Sprintf("%07d", debitCount), "UTL1", "the debit item count does not match the records")
+	c.check(utl1[37:44] == fmt.Sprintf("%07d", creditCount), "UTL1", "the credit item count does not match the records")
+	return c.problems
+}
@@ -0,0 +1,105 @@
+package paymentsapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// bacsPayment returns a direct credit from an account at a sort code
+func bacsPayment(amount, account string) Payment {
+	p := isoPayment()
+	a := &p.Attributes
+	a.PaymentScheme, a.Amount = BACSPaymentScheme, amount
+	a.DebtorParty.BankID, a.DebtorParty.BankIDCode, a.DebtorParty.AccountNumber = "200000", "GBDSC", account
+	a.DebtorParty.Name = "Acmé Ltd"
+	return p
+}
+
+func TestExportBACS18(t *testing.T) {
+	now := time.Date(2017, 1, 16, 9, 30, 0, 0, time.UTC)
+	payments := []Payment{bacsPayment("100.21", "55779911"), bacsPayment("20", "11223344"), bacsPayment("0.79", "55779911")}
+	data, err := exportBACS18("123456", now, payments)
+	assert.NoError(t, err)
+	assert.Empty(t, validateBACS18(data))
+	lines := strings.Split(strings.TrimSuffix(string(data), "\r\n"), "\r\n")
+	assert.Len(t, lines, 4+3+2+3)
+	assert.Equal(t, "VOL1093000 "+strings.Repeat(" ", 30)+"123456", strings.TrimRight(lines[0], " 1"))
+	assert.True(t, strings.HasPrefix(lines[1], "HDR1A123456S  1123456"+"093000"+"0001"+"0001"+"      "+" 17016"+" 17016"+" 000000"))
+	assert.True(t, strings.HasPrefix(lines[3], "UHL1 17018999999    000000001 DAILY  001"))
+	// the credits of an originating account are followed by their contra
+	assert.Equal(t, "4030003192681909920000055779911    00000010021ACME LTD          PAYMEN            ", lines[4][:82])
+	assert.Equal(t, "00000000079", lines[5][35:46])
+	assert.Equal(t, "2000005577991101720000055779911    00000010100ACME LTD          BACS CREDITS      CONTRA            ", lines[6])
+	assert.Equal(t, "00000002000", lines[7][35:46])
+	assert.Equal(t, "00000002000", lines[8][35:46])
+	assert.Equal(t, "UTL1"+"0000000012100"+"0000000012100"+"0000002"+"0000003", strings.TrimRight(lines[11], " "))
+	for _, l := range lines {
+		if strings.HasPrefix(l, "VOL1") || strings.HasPrefix(l, "HDR") || strings.HasPrefix(l, "UHL") || strings.HasPrefix(l, "EOF") || strings.HasPrefix(l, "UTL") {
+			assert.Len(t, l, 80)
+		} else {
+			assert.Len(t, l, 100)
+		}
+	}
+}
+
+func TestExportBACS18Checks(t *testing.T) {
+	euros := bacsPayment("10", "55779911")
+	euros.Attributes.Currency = "EUR"
+	later := bacsPayment("10", "55779911")
+	later.Attributes.ProcessingDate = mustDate("2017-01-19")
+	short := bacsPayment("10.001", "5577")
+	short.Attributes.Reference = "AAAAAAAA"
+	_, err := exportBACS18("123456", time.Now(), []Payment{euros, later, short})
+	assert.Equal(t, KindInvalidPayload, err.(StatusError).Kind)
+	for _, problem := range []string{
+		"payment[0]/currency: must be GBP",
+		"payment[1]/processing_date: differs from the other payments",
+		"payment[2]/amount: must be a positive amount in pence",
+		"payment[2]/debtor_party/account_number: the originating account number must have 8 digits",
+		"payment[2]/reference: must have at least 6 characters that are not all the same",
+	} {
+		assert.Contains(t, err.Error(), problem)
+	}
+	_, err = exportBACS18("12345", time.Now(), []Payment{bacsPayment("10", "55779911")})
+	assert.Contains(t, err.Error(), "service user number: must have 6 digits")
+}
+
+func TestValidateBACS18(t *testing.T) {
+	data, _ := exportBACS18("123456", time.Now(), []Payment{bacsPayment("100.21", "55779911")})
+	file := string(data)
+	assert.Empty(t, validateBACS18(data))
+	broken := strings.Replace(file, "00000010021ACME", "00000010022ACME", 1)
+	assert.Contains(t, validateBACS18([]byte(broken)), "record 2: the contra does not balance the credits of its originating account")
+	assert.Contains(t, validateBACS18([]byte(broken)), "UTL1: the credit value total does not match the records")
+	assert.Contains(t, validateBACS18([]byte(strings.Replace(file, "UTL1", "UTL9", 1))), "UTL1: is missing")
+	assert.Contains(t, validateBACS18([]byte(strings.Replace(file, "PAYMEN ", "PAYMEN", 1))), "record 1: must have 100 characters")
+	assert.NotEmpty(t, validateBACS18([]byte("VOL1")))
+}
+
+func TestExportBACS18HTTP(t *testing.T) {
+	RegisterPaymentExporter(FormatBACS18, NewBACS18Exporter("123456"))
+	defer delete(paymentExporters, FormatBACS18)
+	other := bacsPayment("5", "55779911")
+	other.Attributes.PaymentScheme = "FPS"
+	mockService := &MockPaymentService{}
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{bacsPayment("10", "55779911"), other, bacsPayment("20", "55779911")}, nil)
+	router := NewHTTPTransport(mockService)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+
+	// the payments of other schemes are left out
+	rec := get("/v1/payments?format=bacs18&processing_date=2017-01-18")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "UTL1"+"0000000003000"+"0000000003000"+"0000001"+"0000002")
+	rec = get("/v1/payments?format=bacs18&processing_date=2017-01-19")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
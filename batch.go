@@ -0,0 +1,453 @@
+package paymentsapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	valid "gopkg.in/go-playground/validator.v9"
+)
+
+// Modes a batch of payments can be created in
+const (
+	// BatchModeAllOrNothing creates every payment of the batch in a single transaction, or none of them
+	BatchModeAllOrNothing = "all_or_nothing"
+	// BatchModeBestEffort creates every valid payment of the batch and reports the others as failed
+	BatchModeBestEffort = "best_effort"
+)
+
+// Statuses of the items of a batch
+const (
+	BatchItemCreated    = "created"
+	BatchItemFailed     = "failed"
+	BatchItemNotCreated = "not_created"
+)
+
+// States of a batch recorded for its idempotency key
+const (
+	batchInProgress  = "in_progress"
+	batchCompleted   = "completed"
+	batchInterrupted = "interrupted"
+)
+
+// batchLease is how long a batch stays reserved by a request, a request that stopped before completing its batch
+// leaves it to be taken over afterwards
+const batchLease = 15 * time.Minute
+
+// IdempotencyKeyHeader is the header carrying the key a batch is created once for
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Limits of a batch
+const (
+	MaxBatchItems          = 10000
+	maxIdempotencyKeyBytes = 255
+)
+
+// BatchRequest is the request type used to create a batch of payments
+type BatchRequest struct {
+	IdempotencyKey string
+	Mode           string
+	Payments       []Payment
+}
+
+// hash identifies the content of the request, a key can only be reused for the same batch
+func (r BatchRequest) hash() (string, error) {
+	b, err := json.Marshal(struct {
+		Mode     string    `json:"mode"`
+		Payments []Payment `json:"payments"`
+	}{r.Mode, r.Payments})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// BatchItemResult is the outcome of the creation of a payment of a batch
+type BatchItemResult struct {
+	Index  int        `json:"index"`
+	Status string     `json:"status"`
+	ID     *uuid.UUID `json:"id,omitempty"`
+	Kind   string     `json:"kind,omitempty"`
+	Errors []string   `json:"errors,omitempty"`
+}
+
+// BatchResponse reports the outcome of every payment of a batch
+type BatchResponse struct {
+	Mode    string            `json:"mode"`
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []BatchItemResult `json:"results"`
+	// HTTPStatus is the status code the response is sent with
+	HTTPStatus int `json:"-"`
+	// Replayed is true when the response was recorded by a previous request with the same idempotency key
+	Replayed bool `json:"-"`
+}
+
+// Batch records the outcome of a batch for its idempotency key, so that a retried batch is not created twice
+type Batch struct {
+	ModelBase
+	OrganisationID uuid.UUID `json:"organisation_id" gorm:"type:uuid; primary_key"`
+	IdempotencyKey string    `json:"idempotency_key" gorm:"primary_key"`
+	RequestHash    string    `json:"-"`
+	RequestID      string    `json:"request_id"`
+	Mode           string    `json:"mode"`
+	State          string    `json:"state"`
+	HTTPStatus     int       `json:"-"`
+	Response       string    `json:"-" gorm:"type:text"`
+	// Owner is the request creating the batch until LeaseUntil, another request can take the batch over afterwards
+	Owner      string     `json:"-"`
+	LeaseUntil *time.Time `json:"-"`
+}
+
+// stale reports whether the request creating the batch stopped before completing it
+func (b Batch) stale(now time.Time) bool {
+	return b.State == batchInProgress && (b.LeaseUntil == nil || b.LeaseUntil.Before(now))
+}
+
+// errBatchInterrupted is returned for a best-effort batch whose request stopped before completing it
+var errBatchInterrupted = StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the creation of the batch was interrupted, some of its payments may have been created"}
+
+// errBatchLost is returned when a request completes a batch that another request took over
+var errBatchLost = errors.New("batch taken over by another request")
+
+// BatchStore persists the batches and runs the all-or-nothing batches in a transaction
+type BatchStore interface {
+	// ReserveBatch records b as in progress unless the organisation already used its idempotency key, the batch
+	// recorded for the key is returned then along with false
+	ReserveBatch(b *Batch) (Batch, bool, error)
+	// ClaimBatch makes the owner of b the owner of the batch with the state of b, it fails when the lease of the
+	// previous owner has not expired
+	ClaimBatch(b *Batch) (bool, error)
+	// CompleteBatch records the response of a batch, it returns errBatchLost when the batch has another owner
+	CompleteBatch(b *Batch) error
+	// ReleaseBatch forgets a batch that could not be completed, so that it can be retried with the same key
+	ReleaseBatch(b *Batch) error
+	Transactor
+}
+
+type batchStore struct {
+	txStore
+}
+
+// NewBatchStore returns a BatchStore backed by the database
+func NewBatchStore(db *gorm.DB) BatchStore {
+	return &batchStore{
+		txStore{db: db},
+	}
+}
+
+// ReserveBatch inserts the batch, the primary key on the organisation and the key lets a single request reserve it
+func (s *batchStore) ReserveBatch(b *Batch) (Batch, bool, error) {
+	now := time.Now().UTC()
+	res := s.db.Exec("INSERT INTO batches (organisation_id, idempotency_key, request_hash, request_id, mode, state, http_status, response, owner, lease_until, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, 0, '', ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		b.OrganisationID, b.IdempotencyKey, b.RequestHash, b.RequestID, b.Mode, b.State, b.Owner, b.LeaseUntil, now, now)
+	if res.Error != nil {
+		return Batch{}, false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return *b, true, nil
+	}
+	existing := Batch{}
+	err := s.db.Where("organisation_id = ? AND idempotency_key = ?", b.OrganisationID, b.IdempotencyKey).First(&existing).Error
+	return existing, false, err
+}
+
+// ClaimBatch updates the owner of the batch only if its lease expired, so that a single request takes it over
+func (s *batchStore) ClaimBatch(b *Batch) (bool, error) {
+	res := s.db.Model(&Batch{}).
+		Where("organisation_id = ? AND idempotency_key = ? AND request_hash = ? AND state = ? AND (lease_until IS NULL OR lease_until < ?)",
+			b.OrganisationID, b.IdempotencyKey, b.RequestHash, batchInProgress, time.Now().UTC()).
+		Updates(map[string]interface{}{"state": b.State, "request_id": b.RequestID, "owner": b.Owner, "lease_until": b.LeaseUntil})
+	return res.RowsAffected == 1, res.Error
+}
+
+// CompleteBatch saves the state and the response of a batch still reserved by its owner
+func (s *batchStore) CompleteBatch(b *Batch) error {
+	res := s.db.Model(&Batch{}).Where("organisation_id = ? AND idempotency_key = ? AND owner = ?", b.OrganisationID, b.IdempotencyKey, b.Owner).
+		Updates(map[string]interface{}{"state": b.State, "http_status": b.HTTPStatus, "response": b.Response, "lease_until": nil})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errBatchLost
+	}
+	return nil
+}
+
+// ReleaseBatch deletes the batch if it is still reserved by its owner
+func (s *batchStore) ReleaseBatch(b *Batch) error {
+	return s.db.Unscoped().Where("organisation_id = ? AND idempotency_key = ? AND owner = ?", b.OrganisationID, b.IdempotencyKey, b.Owner).
+		Delete(&Batch{}).Error
+}
+
+// BatchService creates batches of payments
+type BatchService interface {
+	CreateBatch(ctx context.Context, req BatchRequest) (BatchResponse, error)
+}
+
+type batchService struct {
+	store    BatchStore
+	payments PaymentService
+	now      func() time.Time
+}
+
+// NewBatchService returns a BatchService creating every payment with payments, which should be the fully decorated
+// PaymentService so that the payments of a batch are authorised, held for approval and counted against the quotas
+// like the others. The approval requests and the quota usage of an all-or-nothing batch are recorded in its
+// transaction, a batch that was rolled back leaves neither behind
+func NewBatchService(store BatchStore, payments PaymentService) BatchService {
+	return &batchService{
+		store:    store,
+		payments: payments,
+		now:      time.Now,
+	}
+}
+
+// retryable reports whether a payment that failed with err can succeed if it is sent again as it is
+func retryable(err error) bool {
+	e := newStatusError(err.Error(), err)
+	return e.Status >= http.StatusInternalServerError || e.Status == http.StatusTooManyRequests
+}
+
+// CreateBatch creates the payments of the batch, or returns the response recorded for its idempotency key
+func (s *batchService) CreateBatch(ctx context.Context, req BatchRequest) (BatchResponse, error) {
+	p, err := checkPermission(ctx, PermissionWritePayments)
+	if err != nil {
+		return BatchResponse{}, err
+	}
+	if err := validateBatchRequest(req); err != nil {
+		return BatchResponse{}, err
+	}
+	hash, err := req.hash()
+	if err != nil {
+		return BatchResponse{}, err
+	}
+	owner, err := uuid.NewV4()
+	if err != nil {
+		return BatchResponse{}, err
+	}
+	now := s.now().UTC()
+	lease := now.Add(batchLease)
+	b := &Batch{
+		OrganisationID: p.OrganisationID,
+		IdempotencyKey: req.IdempotencyKey,
+		RequestHash:    hash,
+		RequestID:      RequestIDFromContext(ctx),
+		Mode:           req.Mode,
+		State:          batchInProgress,
+		Owner:          owner.String(),
+		LeaseUntil:     &lease,
+	}
+	existing, reserved, err := s.store.ReserveBatch(b)
+	if err != nil {
+		return BatchResponse{}, err
+	}
+	if !reserved && existing.RequestHash == hash && existing.stale(now) {
+		if reserved, err = s.takeOver(b); err != nil {
+			return BatchResponse{}, err
+		}
+	}
+	if !reserved {
+		return replayBatch(existing, hash)
+	}
+
+	var res BatchResponse
+	if req.Mode == BatchModeAllOrNothing {
+		res, err = s.createAllOrNothing(ctx, req.Payments)
+	} else {
+		res, err = s.createBestEffort(ctx, req.Payments)
+	}
+	if err != nil {
+		// nothing was created, the batch can be sent again with the same key
+		_ = s.store.ReleaseBatch(b)
+		return BatchResponse{}, err
+	}
+	body, err := json.Marshal(res)
+	if err != nil {
+		return BatchResponse{}, err
+	}
+	b.State, b.HTTPStatus, b.Response = batchCompleted, res.HTTPStatus, string(body)
+	if err := s.store.CompleteBatch(b); err != nil {
+		return BatchResponse{}, err
+	}
+	return res, nil
+}
+
+// takeOver reserves a batch left in progress by a request that stopped. The transaction of an all-or-nothing batch
+// was rolled back with it so the batch is created again, but the payments of a best-effort batch may have been
+// partly created and the batch is recorded as interrupted instead
+func (s *batchService) takeOver(b *Batch) (bool, error) {
+	if b.Mode == BatchModeAllOrNothing {
+		return s.store.ClaimBatch(b)
+	}
+	interrupted := *b
+	interrupted.State, interrupted.LeaseUntil = batchInterrupted, nil
+	claimed, err := s.store.ClaimBatch(&interrupted)
+	if err != nil || !claimed {
+		return false, err
+	}
+	return false, errBatchInterrupted
+}
+
+// validateBatchRequest checks the mode, the idempotency key and the number of payments of the batch
+func validateBatchRequest(req BatchRequest) error {
+	invalid := func(msg string) error {
+		return StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: msg}
+	}
+	switch {
+	case req.Mode != BatchModeAllOrNothing && req.Mode != BatchModeBestEffort:
+		return invalid("err: the mode of a batch must be " + BatchModeAllOrNothing + " or " + BatchModeBestEffort)
+	case req.IdempotencyKey == "" || len(req.IdempotencyKey) > maxIdempotencyKeyBytes:
+		return invalid("err: a batch needs an " + IdempotencyKeyHeader + " header of at most 255 characters")
+	case len(req.Payments) == 0:
+		return invalid("err: the batch has no payment")
+	case len(req.Payments) > MaxBatchItems:
+		return invalid("err: a batch cannot have more than 10000 payments")
+	}
+	return nil
+}
+
+// replayBatch returns the response recorded for a batch sent again with the same idempotency key
+func replayBatch(b Batch, hash string) (BatchResponse, error) {
+	switch {
+	case b.RequestHash != hash:
+		return BatchResponse{}, StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the idempotency key was already used for another batch"}
+	case b.State == batchInterrupted:
+		return BatchResponse{}, errBatchInterrupted
+	case b.State != batchCompleted:
+		return BatchResponse{}, StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the batch is still being created"}
+	}
+	res := BatchResponse{}
+	if err := json.Unmarshal([]byte(b.Response), &res); err != nil {
+		return BatchResponse{}, err
+	}
+	res.HTTPStatus, res.Replayed = b.HTTPStatus, true
+	return res, nil
+}
+
+// validateItems checks every payment with the rules of the Validator, the results of the invalid payments are failed
+func validateItems(payments []Payment) ([]BatchItemResult, bool) {
+	results := make([]BatchItemResult, len(payments))
+	ok := true
+	for i, p := range payments {
+		results[i] = BatchItemResult{Index: i}
+		if err := ValidatePayload(p); err != nil {
+			results[i].Status, results[i].Kind, results[i].Errors = BatchItemFailed, KindInvalidPayload, validationErrors(err)
+			ok = false
+		}
+	}
+	return results, ok
+}
+
+// validationErrors lists the fields that failed validation
+func validationErrors(err error) []string {
+	fields, ok := err.(valid.ValidationErrors)
+	if !ok {
+		return []string{err.Error()}
+	}
+	var errs []string
+	for _, f := range fields {
+		errs = append(errs, f.Namespace()+": "+f.Tag())
+	}
+	return errs
+}
+
+// itemFailed records the error a payment could not be created with
+func itemFailed(r *BatchItemResult, err error) {
+	e := newStatusError(err.Error(), err)
+	r.Status, r.Kind, r.Errors = BatchItemFailed, e.Kind, []string{e.Message}
+}
+
+// createAllOrNothing creates the payments in a transaction when they are all valid. The batch is recorded as failed
+// when a payment cannot be created, unless the failure is worth retrying
+func (s *batchService) createAllOrNothing(ctx context.Context, payments []Payment) (BatchResponse, error) {
+	res := BatchResponse{Mode: BatchModeAllOrNothing}
+	results, ok := validateItems(payments)
+	if ok {
+		itemErr := false
+		err := s.store.InTransaction(ctx, func(ctx context.Context) error {
+			for i, p := range payments {
+				p.Status = ""
+				created, err := s.payments.CreatePayment(ctx, p)
+				if err != nil {
+					if !retryable(err) {
+						itemFailed(&results[i], err)
+						itemErr = true
+					}
+					return err
+				}
+				results[i].Status, results[i].ID = BatchItemCreated, &created.PaymentID
+			}
+			return nil
+		})
+		// the batch is not recorded when it failed because of the database or of the rate limits
+		if err != nil && !itemErr {
+			return res, err
+		}
+		ok = err == nil
+	}
+	for i := range results {
+		switch {
+		case !ok && results[i].Status != BatchItemFailed:
+			results[i].Status, results[i].ID = BatchItemNotCreated, nil
+			fallthrough
+		case results[i].Status == BatchItemFailed:
+			res.Failed++
+		default:
+			res.Created++
+		}
+	}
+	res.Results, res.HTTPStatus = results, http.StatusCreated
+	if !ok {
+		res.HTTPStatus = http.StatusUnprocessableEntity
+	}
+	return res, nil
+}
+
+// createBestEffort creates every valid payment, one after the other
+func (s *batchService) createBestEffort(ctx context.Context, payments []Payment) (BatchResponse, error) {
+	res := BatchResponse{Mode: BatchModeBestEffort}
+	results, _ := validateItems(payments)
+	for i, p := range payments {
+		if results[i].Status == BatchItemFailed {
+			res.Failed++
+			continue
+		}
+		p.Status = ""
+		created, err := s.payments.CreatePayment(ctx, p)
+		if err != nil {
+			itemFailed(&results[i], err)
+			res.Failed++
+			continue
+		}
+		results[i].Status, results[i].ID = BatchItemCreated, &created.PaymentID
+		res.Created++
+	}
+	res.Results, res.HTTPStatus = results, http.StatusCreated
+	if res.Failed > 0 {
+		res.HTTPStatus = http.StatusMultiStatus
+	}
+	return res, nil
+}
+
+// MakeCreateBatchEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the CreateBatch method
+func MakeCreateBatchEndpoint(svc BatchService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BatchRequest)
+		v, err := svc.CreateBatch(ctx, req)
+		if err != nil {
+			var ErrAcc = errors.New("err: Could not create the batch")
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
+			return nil, cErr
+		}
+		return v, nil
+	}
+}
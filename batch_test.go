@@ -0,0 +1,273 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type memoryBatchStore struct {
+	batches    map[string]Batch
+	committed  int
+	rolledBack int
+}
+
+func newMemoryBatchStore() *memoryBatchStore {
+	return &memoryBatchStore{batches: map[string]Batch{}}
+}
+
+func (m *memoryBatchStore) ReserveBatch(b *Batch) (Batch, bool, error) {
+	key := b.OrganisationID.String() + b.IdempotencyKey
+	if existing, ok := m.batches[key]; ok {
+		return existing, false, nil
+	}
+	m.batches[key] = *b
+	return *b, true, nil
+}
+
+func (m *memoryBatchStore) ClaimBatch(b *Batch) (bool, error) {
+	key := b.OrganisationID.String() + b.IdempotencyKey
+	if existing, ok := m.batches[key]; !ok || existing.RequestHash != b.RequestHash || !existing.stale(time.Now()) {
+		return false, nil
+	}
+	m.batches[key] = *b
+	return true, nil
+}
+
+func (m *memoryBatchStore) CompleteBatch(b *Batch) error {
+	key := b.OrganisationID.String() + b.IdempotencyKey
+	if m.batches[key].Owner != b.Owner {
+		return errBatchLost
+	}
+	m.batches[key] = *b
+	return nil
+}
+
+func (m *memoryBatchStore) ReleaseBatch(b *Batch) error {
+	delete(m.batches, b.OrganisationID.String()+b.IdempotencyKey)
+	return nil
+}
+
+func (m *memoryBatchStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := fn(ctx); err != nil {
+		m.rolledBack++
+		return err
+	}
+	m.committed++
+	return nil
+}
+
+// batchPayments returns valid payments with the amounts, an empty amount gives a payment that is not valid
+func batchPayments(amounts ...string) []Payment {
+	var payments []Payment
+	for _, a := range amounts {
+		p := Payment{}
+		if a != "" {
+			id, _ := uuid.NewV4()
+			p = mockPayment(id.String())
+			p.Attributes.Amount = a
+		}
+		payments = append(payments, p)
+	}
+	return payments
+}
+
+// batchMockService fails the payments of 13 with failure and creates the others
+func batchMockService(failure error) (*MockPaymentService, uuid.UUID) {
+	created, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.MatchedBy(func(p Payment) bool { return p.Attributes.Amount == "13" })).
+		Return(CreatePaymentResponse{}, failure)
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{PaymentID: created}, nil)
+	return mockService, created
+}
+
+func TestBatchBestEffort(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService, created := batchMockService(ErrForbidden)
+	s := NewBatchService(newMemoryBatchStore(), mockService)
+	ctx := roleContext(org, "bob", RoleCreator)
+
+	res, err := s.CreateBatch(ctx, BatchRequest{IdempotencyKey: "k1", Mode: BatchModeBestEffort, Payments: batchPayments("10", "", "13", "11")})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, res.HTTPStatus)
+	assert.Equal(t, 2, res.Created)
+	assert.Equal(t, 2, res.Failed)
+	assert.Equal(t, BatchItemResult{Index: 0, Status: BatchItemCreated, ID: &created}, res.Results[0])
+	assert.Equal(t, BatchItemFailed, res.Results[1].Status)
+	assert.Equal(t, KindInvalidPayload, res.Results[1].Kind)
+	assert.Contains(t, res.Results[1].Errors, "Payment.Type: required")
+	assert.Equal(t, BatchItemResult{Index: 2, Status: BatchItemFailed, Kind: KindForbidden, Errors: []string{ErrForbidden.Message}}, res.Results[2])
+	assert.Equal(t, BatchItemCreated, res.Results[3].Status)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 3)
+}
+
+func TestBatchAllOrNothing(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService, _ := batchMockService(ErrForbidden)
+	store := newMemoryBatchStore()
+	s := NewBatchService(store, mockService)
+	ctx := roleContext(org, "bob", RoleCreator)
+
+	res, err := s.CreateBatch(ctx, BatchRequest{IdempotencyKey: "k1", Mode: BatchModeAllOrNothing, Payments: batchPayments("10", "11")})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.HTTPStatus)
+	assert.Equal(t, 2, res.Created)
+	assert.Equal(t, 1, store.committed)
+
+	// nothing is created when a payment is not valid
+	res, err = s.CreateBatch(ctx, BatchRequest{IdempotencyKey: "k2", Mode: BatchModeAllOrNothing, Payments: batchPayments("10", "")})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.HTTPStatus)
+	assert.Equal(t, BatchItemResult{Index: 0, Status: BatchItemNotCreated}, res.Results[0])
+	assert.Equal(t, BatchItemFailed, res.Results[1].Status)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 2)
+
+	// the payments created before a failure are rolled back
+	res, err = s.CreateBatch(ctx, BatchRequest{IdempotencyKey: "k3", Mode: BatchModeAllOrNothing, Payments: batchPayments("10", "13", "11")})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.HTTPStatus)
+	assert.Equal(t, 0, res.Created)
+	assert.Equal(t, 3, res.Failed)
+	assert.Equal(t, BatchItemResult{Index: 0, Status: BatchItemNotCreated}, res.Results[0])
+	assert.Equal(t, KindForbidden, res.Results[1].Kind)
+	assert.Equal(t, BatchItemNotCreated, res.Results[2].Status)
+	assert.Equal(t, 1, store.rolledBack)
+}
+
+func TestBatchRetryableFailure(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService, _ := batchMockService(errors.New("db down"))
+	store := newMemoryBatchStore()
+	s := NewBatchService(store, mockService)
+	ctx := roleContext(org, "bob", RoleCreator)
+
+	_, err := s.CreateBatch(ctx, BatchRequest{IdempotencyKey: "k1", Mode: BatchModeAllOrNothing, Payments: batchPayments("10", "13")})
+	assert.EqualError(t, err, "db down")
+	// the key can be used again
+	assert.Empty(t, store.batches)
+}
+
+func TestBatchIdempotency(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService, _ := batchMockService(ErrForbidden)
+	store := newMemoryBatchStore()
+	s := NewBatchService(store, mockService)
+	ctx := roleContext(org, "bob", RoleCreator)
+	req := BatchRequest{IdempotencyKey: "k1", Mode: BatchModeBestEffort, Payments: batchPayments("10", "13")}
+
+	first, err := s.CreateBatch(ctx, req)
+	assert.NoError(t, err)
+	again, err := s.CreateBatch(ctx, req)
+	assert.NoError(t, err)
+	assert.True(t, again.Replayed)
+	assert.Equal(t, first.Results, again.Results)
+	assert.Equal(t, first.HTTPStatus, again.HTTPStatus)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 2)
+
+	// the key belongs to the batch it was first used with, and to the organisation
+	req.Payments = req.Payments[:1]
+	_, err = s.CreateBatch(ctx, req)
+	assert.Equal(t, KindConflict, err.(StatusError).Kind)
+	otherOrg, _ := uuid.NewV4()
+	res, err := s.CreateBatch(roleContext(otherOrg, "alice", RoleCreator), req)
+	assert.NoError(t, err)
+	assert.False(t, res.Replayed)
+
+	lease := time.Now().Add(time.Minute)
+	store.batches[org.String()+"k2"] = Batch{OrganisationID: org, IdempotencyKey: "k2", State: batchInProgress, LeaseUntil: &lease}
+	req.IdempotencyKey = "k2"
+	_, err = s.CreateBatch(ctx, req)
+	assert.Equal(t, KindConflict, err.(StatusError).Kind)
+}
+
+func TestBatchTakeOver(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService, _ := batchMockService(ErrForbidden)
+	store := newMemoryBatchStore()
+	s := NewBatchService(store, mockService)
+	ctx := roleContext(org, "bob", RoleCreator)
+	req := BatchRequest{IdempotencyKey: "k1", Mode: BatchModeAllOrNothing, Payments: batchPayments("10")}
+	hash, _ := req.hash()
+	expired := time.Now().Add(-time.Minute)
+	store.batches[org.String()+"k1"] = Batch{OrganisationID: org, IdempotencyKey: "k1", RequestHash: hash, State: batchInProgress, Owner: "gone", LeaseUntil: &expired}
+
+	// the transaction of the request that stopped was rolled back, the retry creates the batch
+	res, err := s.CreateBatch(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Created)
+	assert.Equal(t, batchCompleted, store.batches[org.String()+"k1"].State)
+	assert.NotEqual(t, "gone", store.batches[org.String()+"k1"].Owner)
+
+	// the payments of a best-effort batch may have been created, the retries are told so
+	req = BatchRequest{IdempotencyKey: "k2", Mode: BatchModeBestEffort, Payments: batchPayments("10")}
+	hash, _ = req.hash()
+	store.batches[org.String()+"k2"] = Batch{OrganisationID: org, IdempotencyKey: "k2", RequestHash: hash, State: batchInProgress, Owner: "gone", LeaseUntil: &expired}
+	for i := 0; i < 2; i++ {
+		_, err = s.CreateBatch(ctx, req)
+		assert.Equal(t, errBatchInterrupted, err)
+	}
+	assert.Equal(t, batchInterrupted, store.batches[org.String()+"k2"].State)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 1)
+
+	// the request that stopped cannot complete the batch it lost
+	assert.Equal(t, errBatchLost, store.CompleteBatch(&Batch{OrganisationID: org, IdempotencyKey: "k1", Owner: "gone"}))
+}
+
+func TestBatchRequestChecks(t *testing.T) {
+	org, _ := uuid.NewV4()
+	s := NewBatchService(newMemoryBatchStore(), &MockPaymentService{})
+	ctx := roleContext(org, "bob", RoleCreator)
+
+	_, err := s.CreateBatch(roleContext(org, "eve", RoleViewer), BatchRequest{IdempotencyKey: "k", Mode: BatchModeBestEffort, Payments: batchPayments("1")})
+	assert.Equal(t, ErrForbidden, err)
+	for _, req := range []BatchRequest{
+		{Mode: BatchModeBestEffort, Payments: batchPayments("1")},
+		{IdempotencyKey: "k", Mode: "some", Payments: batchPayments("1")},
+		{IdempotencyKey: "k", Mode: BatchModeBestEffort},
+		{IdempotencyKey: "k", Mode: BatchModeBestEffort, Payments: make([]Payment, MaxBatchItems+1)},
+	} {
+		_, err := s.CreateBatch(ctx, req)
+		assert.Equal(t, KindInvalidRequest, err.(StatusError).Kind)
+	}
+}
+
+func TestBatchHTTP(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService, _ := batchMockService(ErrForbidden)
+	router := NewHTTPTransport(mockService)
+	RegisterBatchRoutes(router, NewBatchService(newMemoryBatchStore(), mockService))
+	post := func(key, contentType, query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/payments/batch"+query, strings.NewReader(body))
+		req = req.WithContext(roleContext(org, "bob", RoleCreator))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(IdempotencyKeyHeader, key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	payment := `{"type": "Payment", "organisation_id": "` + org.String() + `", "attributes": {"amount": "10"}}`
+
+	rec := post("k1", "application/json", "", "["+payment+"]")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"mode":"all_or_nothing"`)
+
+	rec = post("k2", "application/x-ndjson", "?mode=best_effort", payment+"\n"+payment+"\n")
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"index":1`)
+	rec = post("k2", "application/x-ndjson", "?mode=best_effort", payment+"\n"+payment+"\n")
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+
+	rec = post("k3", "application/x-ndjson", "", payment+"\n{")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = post("k3", "application/json", "", payment)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
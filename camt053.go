@@ -0,0 +1,141 @@
+package paymentsapi
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// FormatCamt053 is the ISO 20022 bank to customer statement, any version of camt.053 is read
+const FormatCamt053 = "camt.053"
+
+// camt053Namespace is the start of the namespaces of the camt.053 versions
+const camt053Namespace = "urn:iso:std:iso:20022:tech:xsd:camt.053."
+
+type camt053Document struct {
+	XMLName    xml.Name           `xml:"Document"`
+	GrpHdr     camt053GroupHeader `xml:"BkToCstmrStmt>GrpHdr"`
+	Statements []camt053Statement `xml:"BkToCstmrStmt>Stmt"`
+}
+
+type camt053GroupHeader struct {
+	MsgID string `xml:"MsgId"`
+}
+
+type camt053Statement struct {
+	ID      string         `xml:"Id"`
+	FrToDt  camt053Period  `xml:"FrToDt"`
+	Acct    isoAccount     `xml:"Acct"`
+	Entries []camt053Entry `xml:"Ntry"`
+}
+
+type camt053Period struct {
+	FrDtTm string `xml:"FrDtTm"`
+	ToDtTm string `xml:"ToDtTm"`
+}
+
+type camt053Entry struct {
+	NtryRef     string               `xml:"NtryRef"`
+	Amt         isoAmount            `xml:"Amt"`
+	CdtDbtInd   string               `xml:"CdtDbtInd"`
+	Sts         camt053EntryStatus   `xml:"Sts"`
+	BookgDt     isoDate              `xml:"BookgDt"`
+	ValDt       isoDate              `xml:"ValDt"`
+	AcctSvcrRef string               `xml:"AcctSvcrRef"`
+	TxDtls      []camt053Transaction `xml:"NtryDtls>TxDtls"`
+}
+
+// camt053EntryStatus is the status of an entry, a code since camt.053.001.07 and the code itself before
+type camt053EntryStatus struct {
+	Cd    string `xml:"Cd"`
+	Value string `xml:",chardata"`
+}
+
+func (s camt053EntryStatus) code() string {
+	if s.Cd != "" {
+		return s.Cd
+	}
+	return strings.TrimSpace(s.Value)
+}
+
+type camt053Transaction struct {
+	Refs   camt053References `xml:"Refs"`
+	Amt    *isoAmount        `xml:"Amt"`
+	RmtInf *isoRemittance    `xml:"RmtInf"`
+}
+
+type camt053References struct {
+	InstrID    string `xml:"InstrId"`
+	EndToEndID string `xml:"EndToEndId"`
+	UETR       string `xml:"UETR"`
+}
+
+// parseCamt053 reads the booked entries of the statements of a camt.053 message. An entry batching several
+// transactions gives a statement entry per transaction
+func parseCamt053(data []byte) (Statement, error) {
+	doc := camt053Document{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return Statement{}, errors.New("err: Could not read the camt.053 message: " + err.Error())
+	}
+	if !strings.HasPrefix(doc.XMLName.Space, camt053Namespace) {
+		return Statement{}, errors.New("err: the file is not a camt.053 message but " + doc.XMLName.Space)
+	}
+	c := &isoChecker{}
+	c.check(len(doc.Statements) > 0, "BkToCstmrStmt/Stmt", "is required")
+	s := Statement{ID: doc.GrpHdr.MsgID}
+	for i, stmt := range doc.Statements {
+		path := "Stmt[" + strconv.Itoa(i) + "]"
+		if s.Account == "" {
+			s.Account, _ = stmt.Acct.number()
+		}
+		s.FromDate = earliestDate(s.FromDate, isoDate{DtTm: stmt.FrToDt.FrDtTm}.date())
+		s.ToDate = latestDate(s.ToDate, isoDate{DtTm: stmt.FrToDt.ToDtTm}.date())
+		for j, e := range stmt.Entries {
+			entryPath := path + "/Ntry[" + strconv.Itoa(j) + "]"
+			c.amount(entryPath+"/Amt", &e.Amt)
+			c.oneOf(entryPath+"/CdtDbtInd", e.CdtDbtInd, "CRDT", "DBIT")
+			if e.Sts.code() != "BOOK" {
+				s.Ignored++
+				continue
+			}
+			date := e.BookgDt.date()
+			c.date(entryPath+"/BookgDt", date)
+			entry := StatementEntry{
+				Reference:   e.AcctSvcrRef,
+				Amount:      e.Amt.Value,
+				Currency:    e.Amt.Ccy,
+				Debit:       e.CdtDbtInd == "DBIT",
+				BookingDate: date,
+			}
+			if entry.Reference == "" {
+				entry.Reference = e.NtryRef
+			}
+			if len(e.TxDtls) == 0 {
+				s.Entries = append(s.Entries, entry)
+				continue
+			}
+			for _, tx := range e.TxDtls {
+				txEntry := entry
+				txEntry.EndToEndReference = tx.Refs.EndToEndID
+				// several transactions share the amount of the entry, they carry their own
+				if tx.Amt != nil {
+					txEntry.Amount, txEntry.Currency = tx.Amt.Value, tx.Amt.Ccy
+				}
+				if tx.RmtInf != nil {
+					txEntry.Description = strings.Join(tx.RmtInf.Ustrd, " ")
+					for _, r := range tx.RmtInf.Strd {
+						if r.CdtrRefInf != nil && txEntry.NumericReference == "" {
+							txEntry.NumericReference = r.CdtrRefInf.Ref
+						}
+					}
+				}
+				s.Entries = append(s.Entries, txEntry)
+			}
+		}
+	}
+	if len(c.problems) > 0 {
+		return Statement{}, errors.New("err: the file is not a valid camt.053 message: " + strings.Join(c.problems, "; "))
+	}
+	return s, nil
+}
@@ -0,0 +1,411 @@
+// Package client implements the PaymentService interface over HTTP, so that a remote paymentsapi
+// can be used in place of a local one
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	uuid "github.com/satori/go.uuid"
+	payments "github.com/vstoianovici/paymentsapi"
+)
+
+const (
+	// DefaultTimeout is the time allowed for a single call (including its retries) when none is configured
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetries is the number of times a failed idempotent call is retried when none is configured
+	DefaultRetries = 2
+	// DefaultRetryBackoff is the delay before the first retry, doubled for every subsequent one
+	DefaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Option sets an optional parameter of the client
+type Option func(*options)
+
+type options struct {
+	timeout      time.Duration
+	retries      int
+	retryBackoff time.Duration
+	httpClient   httptransport.HTTPClient
+	before       []httptransport.RequestFunc
+}
+
+// Timeout sets the time allowed for a single call to the remote service, retries included
+func Timeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// Retries sets how many times a call that failed because of the network or a 5xx response is retried.
+// Only idempotent calls (GET, PUT and DELETE) are retried, a payment creation is never sent twice
+func Retries(n int) Option {
+	return func(o *options) { o.retries = n }
+}
+
+// RetryBackoff sets the delay before the first retry, the delay is doubled for every subsequent retry
+func RetryBackoff(d time.Duration) Option {
+	return func(o *options) { o.retryBackoff = d }
+}
+
+// HTTPClient sets the HTTP client used to reach the remote service (http.DefaultClient by default)
+func HTTPClient(c httptransport.HTTPClient) Option {
+	return func(o *options) { o.httpClient = c }
+}
+
+// Before adds functions that are applied to every outgoing HTTP request (e.g. to set headers)
+func Before(before ...httptransport.RequestFunc) Option {
+	return func(o *options) { o.before = append(o.before, before...) }
+}
+
+// APIKey authenticates every request with the API key
+func APIKey(key string) Option {
+	return Before(httptransport.SetRequestHeader("X-API-Key", key))
+}
+
+// BearerToken authenticates every request with the JWT bearer token
+func BearerToken(token string) Option {
+	return Before(httptransport.SetRequestHeader("Authorization", "Bearer "+token))
+}
+
+// setRequestID forwards the request ID of the context, so that the calls to the remote service can be correlated with
+// the request that caused them
+func setRequestID(ctx context.Context, r *http.Request) context.Context {
+	if id := payments.RequestIDFromContext(ctx); id != "" {
+		r.Header.Set(payments.RequestIDHeader, id)
+	}
+	return ctx
+}
+
+// Client is a PaymentService that forwards every call to a remote paymentsapi
+type Client struct {
+	timeout                 time.Duration
+	getPaymentEndpoint      endpoint.Endpoint
+	getListPaymentsEndpoint endpoint.Endpoint
+	createPaymentEndpoint   endpoint.Endpoint
+	updatePaymentEndpoint   endpoint.Endpoint
+	deletePaymentEndpoint   endpoint.Endpoint
+	restorePaymentEndpoint  endpoint.Endpoint
+	getApprovalsEndpoint    endpoint.Endpoint
+	listPostingsEndpoint    endpoint.Endpoint
+}
+
+// New returns a PaymentService backed by the paymentsapi listening at instance (e.g. "http://127.0.0.1:8080")
+func New(instance string, opts ...Option) (payments.PaymentService, error) {
+	return NewClient(instance, opts...)
+}
+
+// NewClient returns a Client of the paymentsapi listening at instance, which also reaches the endpoints of the API
+// beyond the PaymentService
+func NewClient(instance string, opts ...Option) (*Client, error) {
+	if !strings.HasPrefix(instance, "http") {
+		instance = "http://" + instance
+	}
+	tgt, err := url.Parse(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	o := options{
+		timeout:      DefaultTimeout,
+		retries:      DefaultRetries,
+		retryBackoff: DefaultRetryBackoff,
+		httpClient:   http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	clientOptions := []httptransport.ClientOption{
+		httptransport.SetClient(o.httpClient),
+		httptransport.ClientBefore(append([]httptransport.RequestFunc{setRequestID}, o.before...)...),
+	}
+	retry := retryMiddleware(o.retries, o.retryBackoff)
+
+	return &Client{
+		timeout: o.timeout,
+		getPaymentEndpoint: retry(httptransport.NewClient(
+			"GET", tgt, EncodeGetPaymentRequest, DecodeGetPaymentResponse, clientOptions...,
+		).Endpoint()),
+		getListPaymentsEndpoint: retry(httptransport.NewClient(
+			"GET", tgt, EncodeGetListPaymentsRequest, DecodeGetListPaymentsResponse, clientOptions...,
+		).Endpoint()),
+		createPaymentEndpoint: httptransport.NewClient(
+			"POST", tgt, EncodeCreatePaymentRequest, DecodeCreatePaymentResponse, clientOptions...,
+		).Endpoint(),
+		updatePaymentEndpoint: retry(httptransport.NewClient(
+			"PUT", tgt, EncodeUpdatePaymentRequest, DecodeUpdatePaymentResponse, clientOptions...,
+		).Endpoint()),
+		deletePaymentEndpoint: retry(httptransport.NewClient(
+			"DELETE", tgt, EncodeDeletePaymentRequest, DecodeDeletePaymentResponse, clientOptions...,
+		).Endpoint()),
+		restorePaymentEndpoint: httptransport.NewClient(
+			"POST", tgt, EncodeRestorePaymentRequest, DecodeGetPaymentResponse, clientOptions...,
+		).Endpoint(),
+		getApprovalsEndpoint: retry(httptransport.NewClient(
+			"GET", tgt, EncodeGetApprovalsRequest, DecodeGetApprovalsResponse, clientOptions...,
+		).Endpoint()),
+		listPostingsEndpoint: retry(httptransport.NewClient(
+			"GET", tgt, EncodeListPostingsRequest, DecodeListPostingsResponse, clientOptions...,
+		).Endpoint()),
+	}, nil
+}
+
+// GetPayment retrieves a payment from the remote service based on its ID
+func (c *Client) GetPayment(ctx context.Context, id string) (payments.Payment, error) {
+	resp, err := c.call(ctx, c.getPaymentEndpoint, payments.GetPaymentRequest{PaymentID: id})
+	if err != nil {
+		return payments.Payment{}, err
+	}
+	return resp.(payments.Payment), nil
+}
+
+// GetListPayments retrieves the list of all the payments from the remote service
+func (c *Client) GetListPayments(ctx context.Context) ([]payments.Payment, error) {
+	resp, err := c.call(ctx, c.getListPaymentsEndpoint, payments.GetListPaymentRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.([]payments.Payment), nil
+}
+
+// CreatePayment creates a payment on the remote service and returns its ID
+func (c *Client) CreatePayment(ctx context.Context, p payments.Payment) (payments.CreatePaymentResponse, error) {
+	resp, err := c.call(ctx, c.createPaymentEndpoint, payments.CreatePaymentRequest{Payment: p})
+	if err != nil {
+		return payments.CreatePaymentResponse{}, err
+	}
+	return resp.(payments.CreatePaymentResponse), nil
+}
+
+// UpdatePayment replaces an existing payment on the remote service
+func (c *Client) UpdatePayment(ctx context.Context, req payments.UpdatePaymentRequest) (payments.UpdatePaymentResponse, error) {
+	resp, err := c.call(ctx, c.updatePaymentEndpoint, req)
+	if err != nil {
+		return payments.UpdatePaymentResponse{}, err
+	}
+	return resp.(payments.UpdatePaymentResponse), nil
+}
+
+// DeletePayment soft deletes a payment on the remote service and returns the time of the deletion
+func (c *Client) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	resp, err := c.call(ctx, c.deletePaymentEndpoint, payments.DeletePaymentRequest{PaymentID: id})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(payments.DeletePaymentResponse).DeletedAt, nil
+}
+
+// RestorePayment undeletes a soft deleted payment on the remote service and returns it
+func (c *Client) RestorePayment(ctx context.Context, id uuid.UUID) (payments.Payment, error) {
+	resp, err := c.call(ctx, c.restorePaymentEndpoint, payments.RestorePaymentRequest{PaymentID: id})
+	if err != nil {
+		return payments.Payment{}, err
+	}
+	return resp.(payments.Payment), nil
+}
+
+// GetApprovals retrieves the approval status of a payment from the remote service
+func (c *Client) GetApprovals(ctx context.Context, id uuid.UUID) (payments.PaymentApprovals, error) {
+	resp, err := c.call(ctx, c.getApprovalsEndpoint, payments.ApprovePaymentRequest{PaymentID: id})
+	if err != nil {
+		return payments.PaymentApprovals{}, err
+	}
+	return resp.(payments.PaymentApprovals), nil
+}
+
+// ListPostings retrieves the ledger postings of a payment from the remote service, in the order they were posted
+func (c *Client) ListPostings(ctx context.Context, paymentID uuid.UUID) ([]payments.LedgerPosting, error) {
+	resp, err := c.call(ctx, c.listPostingsEndpoint, payments.ListPostingsRequest{PaymentID: paymentID})
+	if err != nil {
+		return nil, err
+	}
+	return resp.([]payments.LedgerPosting), nil
+}
+
+// call invokes the endpoint within the configured timeout, or the deadline of ctx if it is sooner
+func (c *Client) call(ctx context.Context, e endpoint.Endpoint, request interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return e(ctx, request)
+}
+
+// retryMiddleware retries calls that failed because of the network or because the server answered with a 5xx status,
+// waiting between attempts for a delay that doubles every time
+func retryMiddleware(retries int, backoff time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			delay := backoff
+			for attempt := 0; ; attempt++ {
+				response, err = next(ctx, request)
+				if err == nil || attempt >= retries || !retryable(err) {
+					return response, err
+				}
+				select {
+				case <-ctx.Done():
+					return nil, err
+				case <-time.After(delay):
+				}
+				delay *= 2
+			}
+		}
+	}
+}
+
+// retryable reports whether a failed call is worth retrying. Errors returned by the server for the request itself
+// (bad payload, unknown ID...) will not go away when retried
+func retryable(err error) bool {
+	if e, ok := err.(payments.StatusError); ok {
+		return e.Status >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// EncodeGetPaymentRequest sets the path of the request for the GetPayment call
+func EncodeGetPaymentRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(payments.GetPaymentRequest)
+	r.URL.Path = path.Join(r.URL.Path, "/v1/payments", req.PaymentID)
+	return nil
+}
+
+// EncodeGetListPaymentsRequest sets the path of the request for the GetListPayments call
+func EncodeGetListPaymentsRequest(_ context.Context, r *http.Request, _ interface{}) error {
+	r.URL.Path = path.Join(r.URL.Path, "/v1/payments")
+	return nil
+}
+
+// EncodeCreatePaymentRequest sets the path of the request for the CreatePayment call and adds the payment as JSON body
+func EncodeCreatePaymentRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(payments.CreatePaymentRequest)
+	r.URL.Path = path.Join(r.URL.Path, "/v1/payments")
+	return httptransport.EncodeJSONRequest(ctx, r, req.Payment)
+}
+
+// EncodeUpdatePaymentRequest sets the path of the request for the UpdatePayment call and adds the payment as JSON body
+func EncodeUpdatePaymentRequest(ctx context.Context, r *http.Request, request interface{}) error {
+	req := request.(payments.UpdatePaymentRequest)
+	r.URL.Path = path.Join(r.URL.Path, "/v1/payments", req.PaymentID)
+	return httptransport.EncodeJSONRequest(ctx, r, req.Payment)
+}
+
+// EncodeDeletePaymentRequest sets the path of the request for the DeletePayment call
+func EncodeDeletePaymentRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(payments.DeletePaymentRequest)
+	r.URL.Path = path.Join(r.URL.Path, "/v1/payments", req.PaymentID.String())
+	return nil
+}
+
+// EncodeRestorePaymentRequest sets the path of the request for the RestorePayment call
+func EncodeRestorePaymentRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(payments.RestorePaymentRequest)
+	r.URL.Path = path.Join(r.URL.Path, "/v1/payments", req.PaymentID.String(), "restore")
+	return nil
+}
+
+// EncodeGetApprovalsRequest sets the path of the request for the GetApprovals call
+func EncodeGetApprovalsRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(payments.ApprovePaymentRequest)
+	r.URL.Path = path.Join(r.URL.Path, "/v1/payments", req.PaymentID.String(), "approvals")
+	return nil
+}
+
+// EncodeListPostingsRequest sets the path and the query of the request for the ListPostings call
+func EncodeListPostingsRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req := request.(payments.ListPostingsRequest)
+	r.URL.Path = path.Join(r.URL.Path, "/v1/ledger/postings")
+	q := r.URL.Query()
+	q.Set("payment_id", req.PaymentID.String())
+	if req.Account != "" {
+		q.Set("account", req.Account)
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+// DecodeGetPaymentResponse decodes the payment returned by the GetPayment call
+func DecodeGetPaymentResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	var p payments.Payment
+	err := decodeResponse(r, &p)
+	return p, err
+}
+
+// DecodeGetListPaymentsResponse decodes the list of payments returned by the GetListPayments call
+func DecodeGetListPaymentsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	var p []payments.Payment
+	err := decodeResponse(r, &p)
+	return p, err
+}
+
+// DecodeCreatePaymentResponse decodes the ID returned by the CreatePayment call
+func DecodeCreatePaymentResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	var c payments.CreatePaymentResponse
+	err := decodeResponse(r, &c)
+	return c, err
+}
+
+// DecodeUpdatePaymentResponse decodes the ID returned by the UpdatePayment call
+func DecodeUpdatePaymentResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	var u payments.UpdatePaymentResponse
+	err := decodeResponse(r, &u)
+	return u, err
+}
+
+// DecodeDeletePaymentResponse decodes the deletion time returned by the DeletePayment call
+func DecodeDeletePaymentResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	var d payments.DeletePaymentResponse
+	err := decodeResponse(r, &d)
+	return d, err
+}
+
+// DecodeGetApprovalsResponse decodes the approval status returned by the GetApprovals call
+func DecodeGetApprovalsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	var a payments.PaymentApprovals
+	err := decodeResponse(r, &a)
+	return a, err
+}
+
+// DecodeListPostingsResponse decodes the postings returned by the ListPostings call
+func DecodeListPostingsResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	var p []payments.LedgerPosting
+	err := decodeResponse(r, &p)
+	return p, err
+}
+
+// decodeResponse decodes a successful response into v, or turns an error response back into a payments.StatusError
+func decodeResponse(r *http.Response, v interface{}) error {
+	if r.StatusCode < http.StatusOK || r.StatusCode >= http.StatusMultipleChoices {
+		return decodeError(r)
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// decodeError rebuilds the error sent by the server. Bodies that are not a JSON StatusError (e.g. sent by a proxy)
+// are kept as the message of an error whose kind is derived from the status code
+func decodeError(r *http.Response) error {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var e payments.StatusError
+	if json.Unmarshal(b, &e) == nil && e.Kind != "" {
+		e.Status = r.StatusCode
+		return e
+	}
+	msg := strings.TrimSpace(string(b))
+	if msg == "" {
+		msg = http.StatusText(r.StatusCode)
+	}
+	kind := payments.KindInternal
+	switch {
+	case r.StatusCode == http.StatusNotFound:
+		kind = payments.KindNotFound
+	case r.StatusCode < http.StatusInternalServerError:
+		kind = payments.KindInvalidRequest
+	}
+	return payments.StatusError{Status: r.StatusCode, Kind: kind, Message: msg}
+}
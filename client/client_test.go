@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	payments "github.com/vstoianovici/paymentsapi"
+)
+
+func newTestClient(t *testing.T, svc payments.PaymentService, opts ...Option) (payments.PaymentService, func()) {
+	srv := httptest.NewServer(payments.NewHTTPTransport(svc))
+	c, err := New(srv.URL, opts...)
+	assert.NoError(t, err)
+	return c, srv.Close
+}
+
+func TestClientGetPayment(t *testing.T) {
+	id, _ := uuid.NewV4()
+	p := payments.Payment{ID: id, Type: "Payment"}
+	p.Attributes.Amount = "130.21"
+	mockSvc := &payments.MockPaymentService{}
+	mockSvc.On("GetPayment", mock.Anything, id.String()).Return(p, nil)
+	c, stop := newTestClient(t, mockSvc)
+	defer stop()
+
+	got, err := c.GetPayment(context.Background(), id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, p.ID, got.ID)
+	assert.Equal(t, "130.21", got.Attributes.Amount)
+}
+
+func TestClientGetListPayments(t *testing.T) {
+	mockSvc := &payments.MockPaymentService{}
+	mockSvc.On("GetListPayments", mock.Anything).Return([]payments.Payment{{Type: "Payment"}, {Type: "Payment"}}, nil)
+	c, stop := newTestClient(t, mockSvc)
+	defer stop()
+
+	got, err := c.GetListPayments(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+}
+
+func TestClientCreateUpdateDeletePayment(t *testing.T) {
+	id, _ := uuid.NewV4()
+	deletedAt := time.Date(2019, 4, 22, 11, 45, 26, 0, time.UTC)
+	mockSvc := &payments.MockPaymentService{}
+	mockSvc.On("CreatePayment", mock.Anything, mock.Anything).Return(payments.CreatePaymentResponse{PaymentID: id}, nil)
+	mockSvc.On("UpdatePayment", mock.Anything, mock.Anything).Return(payments.UpdatePaymentResponse{PaymentID: id}, nil)
+	mockSvc.On("DeletePayment", mock.Anything, id).Return(&deletedAt, nil)
+	c, stop := newTestClient(t, mockSvc)
+	defer stop()
+
+	created, err := c.CreatePayment(context.Background(), payments.Payment{Type: "Payment"})
+	assert.NoError(t, err)
+	assert.Equal(t, id, created.PaymentID)
+
+	updated, err := c.UpdatePayment(context.Background(), payments.UpdatePaymentRequest{PaymentID: id.String(), Payment: payments.Payment{Type: "Payment"}})
+	assert.NoError(t, err)
+	assert.Equal(t, id, updated.PaymentID)
+	req := mockSvc.Calls[1].Arguments.Get(1).(payments.UpdatePaymentRequest)
+	assert.Equal(t, id.String(), req.PaymentID)
+	assert.Equal(t, "Payment", req.Payment.Type)
+
+	deleted, err := c.DeletePayment(context.Background(), id)
+	assert.NoError(t, err)
+	assert.True(t, deletedAt.Equal(*deleted))
+}
+
+func TestClientTypedErrors(t *testing.T) {
+	mockSvc := &payments.MockPaymentService{}
+	mockSvc.On("GetPayment", mock.Anything, "missing").Return(payments.Payment{}, gorm.ErrRecordNotFound)
+	mockSvc.On("CreatePayment", mock.Anything, mock.Anything).Return(payments.CreatePaymentResponse{}, payments.ErrPayloadNotValid)
+	c, stop := newTestClient(t, mockSvc)
+	defer stop()
+
+	_, err := c.GetPayment(context.Background(), "missing")
+	assert.True(t, payments.IsNotFound(err))
+	assert.Equal(t, http.StatusNotFound, err.(payments.StatusError).StatusCode())
+
+	_, err = c.CreatePayment(context.Background(), payments.Payment{})
+	e, ok := err.(payments.StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, payments.KindInvalidPayload, e.Kind)
+	assert.Equal(t, http.StatusBadRequest, e.Status)
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, Retries(2), RetryBackoff(time.Millisecond))
+	assert.NoError(t, err)
+	_, err = c.GetListPayments(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// creations are never retried
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.CreatePayment(context.Background(), payments.Payment{})
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// client errors are not retried either
+	srv404 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.NotFound(w, r)
+	}))
+	defer srv404.Close()
+	atomic.StoreInt32(&calls, 0)
+	c, _ = New(srv404.URL, Retries(2), RetryBackoff(time.Millisecond))
+	_, err = c.GetPayment(context.Background(), "abc")
+	assert.True(t, payments.IsNotFound(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestClientTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, Timeout(20*time.Millisecond), Retries(0))
+	assert.NoError(t, err)
+	_, err = c.GetListPayments(context.Background())
+	assert.Error(t, err)
+}
+
+func TestClientCredentials(t *testing.T) {
+	var apiKey, authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, authorization = r.Header.Get("X-API-Key"), r.Header.Get("Authorization")
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c, _ := New(srv.URL, APIKey("abc.def"))
+	_, err := c.GetListPayments(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "abc.def", apiKey)
+
+	c, _ = New(srv.URL, BearerToken("header.payload.signature"))
+	_, err = c.GetListPayments(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer header.payload.signature", authorization)
+}
+
+func TestClientRequestID(t *testing.T) {
+	var requestID string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get(payments.RequestIDHeader)
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c, _ := New(srv.URL)
+	_, err := c.GetListPayments(payments.NewContextWithRequestID(context.Background(), "req-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "req-1", requestID)
+
+	_, err = c.GetListPayments(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, requestID)
+}
+
+func TestClientRestoreAndHistory(t *testing.T) {
+	id, _ := uuid.NewV4()
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		switch r.URL.Path {
+		case "/v1/payments/" + id.String() + "/restore":
+			w.Write([]byte(`{"id":"` + id.String() + `","status":"accepted"}`))
+		case "/v1/payments/" + id.String() + "/approvals":
+			w.Write([]byte(`{"payment_id":"` + id.String() + `","requested_by":"alice","required_approvals":1,"approvals":[{"approver":"bob"}]}`))
+		default:
+			w.Write([]byte(`[{"event":"created","account":"clearing:FPS","currency":"GBP","amount":"-10"}]`))
+		}
+	}))
+	defer srv.Close()
+	c, err := NewClient(srv.URL)
+	assert.NoError(t, err)
+
+	p, err := c.RestorePayment(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.PaymentStatusAccepted, p.Status)
+	a, err := c.GetApprovals(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", a.Approvals[0].Approver)
+	postings, err := c.ListPostings(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "clearing:FPS", postings[0].Account)
+	assert.Equal(t, []string{
+		"POST /v1/payments/" + id.String() + "/restore",
+		"GET /v1/payments/" + id.String() + "/approvals",
+		"GET /v1/ledger/postings?payment_id=" + id.String(),
+	}, requests)
+}
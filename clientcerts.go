@@ -0,0 +1,67 @@
+package paymentsapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ClientCertPrincipal is the principal a client certificate is authenticated as
+type ClientCertPrincipal struct {
+	CommonName     string    `json:"common_name"`
+	OrganisationID uuid.UUID `json:"organisation_id"`
+	Scopes         []string  `json:"scopes"`
+	Roles          []string  `json:"roles"`
+}
+
+// ClientCertAuthenticator authenticates the requests sent over a TLS connection with a verified client certificate.
+// The common name of the certificate subject is mapped to an organisation, scopes and roles by a JSON file of the form
+// {"clients": [{"common_name": "...", "organisation_id": "...", "scopes": [...], "roles": [...]}]}
+type ClientCertAuthenticator struct {
+	clients map[string]ClientCertPrincipal
+}
+
+// NewClientCertAuthenticator reads the file mapping the client certificates to principals
+func NewClientCertAuthenticator(file string) (*ClientCertAuthenticator, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var mapping struct {
+		Clients []ClientCertPrincipal `json:"clients"`
+	}
+	if err := json.Unmarshal(b, &mapping); err != nil {
+		return nil, errors.New("err: Could not read the client certificates: " + err.Error())
+	}
+	a := &ClientCertAuthenticator{clients: map[string]ClientCertPrincipal{}}
+	for _, c := range mapping.Clients {
+		if c.CommonName == "" || uuid.Equal(c.OrganisationID, uuid.Nil) {
+			return nil, errors.New("err: every client certificate needs a common name and an organisation ID")
+		}
+		a.clients[c.CommonName] = c
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator. The certificate was verified by the TLS handshake, a certificate whose
+// common name is not mapped is rejected
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Principal{}, errNoCredentials
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	c, ok := a.clients[cn]
+	if !ok {
+		return Principal{}, errors.New("err: unknown client certificate " + cn)
+	}
+	return Principal{
+		Subject:        "cert:" + cn,
+		OrganisationID: c.OrganisationID,
+		Scopes:         c.Scopes,
+		Roles:          c.Roles,
+		Method:         AuthMethodClientCert,
+	}, nil
+}
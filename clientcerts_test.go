@@ -0,0 +1,51 @@
+package paymentsapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCertAuthenticator(t *testing.T) {
+	org, _ := uuid.NewV4()
+	f, err := ioutil.TempFile("", "clients")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"clients": [{"common_name": "acme", "organisation_id": "` + org.String() + `", "scopes": ["payments:read"], "roles": ["viewer"]}]}`)
+	f.Close()
+	a, err := NewClientCertAuthenticator(f.Name())
+	assert.NoError(t, err)
+
+	withCert := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+	req := httptest.NewRequest("GET", "/v1/payments", nil)
+	req.TLS = withCert("acme")
+	p, err := a.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, Principal{Subject: "cert:acme", OrganisationID: org, Scopes: []string{ScopePaymentsRead}, Roles: []string{RoleViewer}, Method: AuthMethodClientCert}, p)
+
+	req.TLS = withCert("unknown")
+	_, err = a.Authenticate(req)
+	assert.Error(t, err)
+	assert.NotEqual(t, errNoCredentials, err)
+
+	// the requests without a verified certificate are left to the other authenticators
+	req.TLS = &tls.ConnectionState{}
+	_, err = a.Authenticate(req)
+	assert.Equal(t, errNoCredentials, err)
+	req.TLS = nil
+	_, err = a.Authenticate(req)
+	assert.Equal(t, errNoCredentials, err)
+
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte(`{"clients": [{"common_name": "acme"}]}`), 0600))
+	_, err = NewClientCertAuthenticator(f.Name())
+	assert.Error(t, err)
+}
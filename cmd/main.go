@@ -2,44 +2,77 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
 
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	uuid "github.com/satori/go.uuid"
 	payments "github.com/vstoianovici/paymentsapi"
 	config "github.com/vstoianovici/paymentsapi/config"
+	"github.com/vstoianovici/paymentsapi/metrics"
+	"github.com/vstoianovici/paymentsapi/tracing"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 func main() {
 
-	// Define a cutom logger with the specified format
-	logger := createLogger()
-	startLogger := log.With(logger, "tag", "start")
-	startLogger.Log("msg", "created logger")
+	// `paymentsAPI config print` shows the effective configuration with the secrets masked
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		printConfig(os.Args[3:])
+		return
+	}
 
 	// define channel to monitor signals from os and handle gracefully any kind of shutdown
-	var gracefulStopC = make(chan os.Signal)
-	signal.Notify(gracefulStopC, syscall.SIGKILL)
+	var gracefulStopC = make(chan os.Signal, 1)
 	signal.Notify(gracefulStopC, syscall.SIGINT)
 	signal.Notify(gracefulStopC, syscall.SIGQUIT)
 	signal.Notify(gracefulStopC, syscall.SIGTERM)
-	signal.Notify(gracefulStopC, syscall.SIGHUP)
+
+	// SIGHUP reloads the configuration instead
+	var reloadC = make(chan os.Signal, 1)
+	signal.Notify(reloadC, syscall.SIGHUP)
 
 	// define a monitor channel for http server errors
 	monC := make(chan error)
 
-	// get the postgres DB config and the application port number (can be passed in command line)
-	dbConfigFile, appPort := config.ParseArgs()
+	// define the flags used to issue an API key (can be passed in command line) and read the configuration from the
+	// -config file, the PAYMENTSAPI_* environment variables and the command line
+	apiKeyConfig := config.RegisterAPIKeyFlags(flag.CommandLine)
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Define a cutom logger with the specified format
+	logger, err := payments.NewLogger(os.Stdout, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	startLogger := log.With(logger, "tag", "start")
+	startLogger.Log("msg", "created logger")
 
 	// create a new postgres DB connection
-	db, err := payments.NewDBConnection(dbConfigFile)
+	db, err := payments.NewDBConnectionFromConfig(cfg.DB)
 	if err != nil {
 		m, _ := fmt.Println("error when connecting to postgres:", err)
 		startLogger.Log("err", m)
@@ -51,8 +84,75 @@ func main() {
 	// make sure the right tables exist in the database
 	payments.MigrateDB(db)
 
+	// API keys are stored (hashed) in the database
+	apiKeyStore := payments.NewAPIKeyStore(db)
+
+	// issue an API key and exit if requested
+	if apiKeyConfig.Name != "" {
+		orgID, err := uuid.FromString(apiKeyConfig.OrganisationID)
+		if err != nil {
+			startLogger.Log("err", "err: -api-key-org must be a valid organisation ID: "+err.Error())
+			return
+		}
+		key, err := payments.IssueAPIKey(apiKeyStore, apiKeyConfig.Name, orgID, strings.Fields(apiKeyConfig.Scopes), strings.Fields(apiKeyConfig.Roles), apiKeyConfig.TTL)
+		if err != nil {
+			startLogger.Log("err", err)
+			return
+		}
+		fmt.Println(key)
+		return
+	}
+
+	// requests are authenticated with API keys, or with JWT bearer tokens if a JWKS file is configured, or with TLS
+	// client certificates if they are mapped to organisations
+	authenticators := []payments.Authenticator{payments.NewAPIKeyAuthenticator(apiKeyStore)}
+	if cfg.Auth.ClientCertsFile != "" {
+		clientCertAuthenticator, err := payments.NewClientCertAuthenticator(cfg.Auth.ClientCertsFile)
+		if err != nil {
+			startLogger.Log("err", err)
+			os.Exit(1)
+		}
+		authenticators = append(authenticators, clientCertAuthenticator)
+	}
+	if cfg.Auth.JWKSFile != "" {
+		jwtAuthenticator, err := payments.NewJWTAuthenticator(cfg.Auth.JWKSFile, cfg.Auth.Issuer, cfg.Auth.Audience, cfg.Auth.OrganisationClaim)
+		if err != nil {
+			startLogger.Log("err", err)
+			os.Exit(1)
+		}
+		authenticators = append(authenticators, jwtAuthenticator)
+	}
+
+	// trace spans are exported over OTLP and/or written to a file
+	tracer, err := createTracer(cfg.Tracing)
+	if err != nil {
+		startLogger.Log("err", err)
+		os.Exit(1)
+	}
+	tracer.OnError(func(err error) { startLogger.Log("err", err) })
+	payments.RegisterDBTracing(db)
+
+	// metrics are exposed on /metrics in the Prometheus text format
+	registry := metrics.NewRegistry()
+	payments.RegisterDBMetrics(registry, db)
+
 	// create a new Payments API service
 	svc := payments.NewPaymentService(db)
+	svc = payments.NewTracing("core", svc)
+
+	// post the payments to the ledger in the transactions that create, update and delete them
+	ledgerStore := payments.NewLedgerStore(db)
+	svc = payments.NewLedgerPostings(ledgerStore, svc)
+	svc = payments.NewTracing("ledger", svc)
+
+	// show the refunds of the payments along with them
+	refundStore := payments.NewRefundStore(db)
+	svc = payments.NewRefundSummaries(refundStore, svc)
+	svc = payments.NewTracing("refunds", svc)
+
+	// hold the payments processed on a later day until the scheduler releases them
+	svc = payments.NewPaymentScheduling(svc)
+	svc = payments.NewTracing("scheduling", svc)
 
 	// add validator service
 	svc, err = payments.NewValidator(svc)
@@ -60,28 +160,229 @@ func main() {
 		startLogger.Log("err", err)
 		os.Exit(0)
 	}
+	svc = payments.NewTracing("validator", svc)
+
+	// hold the payments above the approval threshold of their organisation until they are approved, the payments
+	// held before the feature is switched off can still be approved
+	approvalSwitch := payments.NewSwitch(cfg.Features.Approvals)
+	approvalStore := payments.NewApprovalLedger(payments.NewApprovalStore(db), ledgerStore)
+	approvalSvc := payments.NewApprovalService(approvalStore, svc)
+	svc = payments.NewFeatureSwitch(approvalSwitch, payments.NewTracing("approval", payments.NewApprovalWorkflow(approvalStore, svc)), svc)
+
+	// restrict every operation to the payments of the caller's organisation
+	svc = payments.NewAuthorisation(svc)
+	svc = payments.NewTracing("authorisation", svc)
+
+	// reject the payments over the daily quotas of the caller's organisation
+	rateLimitSwitch := payments.NewSwitch(cfg.Features.RateLimiting)
+	quotas, err := payments.ParseQuotas(cfg.RateLimit.DailyPayments, cfg.RateLimit.DailyAmount)
+	if err != nil {
+		startLogger.Log("err", err)
+		os.Exit(1)
+	}
+	quotaLimiting := payments.NewQuotas(payments.NewQuotaStore(db), quotas, svc)
+	svc = payments.NewFeatureSwitch(rateLimitSwitch, payments.NewTracing("quotas", quotaLimiting), svc)
+
+	// check that the roles of the caller grant the permission needed by every operation
+	svc = payments.NewAccessControl(svc)
+	svc = payments.NewTracing("access_control", svc)
+
+	// record request counts, errors and latencies of every operation
+	svc = payments.NewServiceMetrics(registry)(svc)
 
 	// add a layer of logging on top of the core wallet service
-	svc = payments.NewLogging(logger, svc)
+	svc = payments.NewLoggingWithRedactor(logger, payments.NewRedactor(strings.Split(cfg.Log.Redact, ",")...), svc)
+	svc = payments.NewTracing("logging", svc)
 
-	// create string for server address
-	port := ":" + strconv.Itoa(appPort)
+	// the BACS files are submitted under the service user number of the deployment
+	if cfg.BACS.ServiceUserNumber != "" {
+		payments.RegisterPaymentExporter(payments.FormatBACS18, payments.NewBACS18Exporter(cfg.BACS.ServiceUserNumber))
+	}
 
 	// create a router
 	router := payments.NewHTTPTransport(svc)
+	payments.RegisterApprovalRoutes(router, approvalSvc)
+	// batches of payments are created through the same layers as the single payments
+	payments.RegisterBatchRoutes(router, payments.NewBatchService(payments.NewBatchStore(db), svc))
+	// the files of payments are imported in the background, the jobs left unfinished by a stopped instance are resumed
+	importStore := payments.NewImportStore(db)
+	importer := payments.NewImporter(importStore, svc, cfg.Imports.Workers, log.With(logger, "tag", "imports"))
+	importer.Start()
+	payments.RegisterImportRoutes(router, payments.NewImportService(importStore, importer), int64(cfg.Imports.MaxFileSizeMB)<<20)
+	// apply the pacs.002 status reports of the banks to the payments they were sent to
+	payments.RegisterStatusReportRoutes(router, payments.NewStatusReportService(payments.NewStatusReportLedger(payments.NewStatusReportStore(db), ledgerStore)), int64(cfg.Imports.MaxFileSizeMB)<<20)
+	// reconcile the bank statements with the payments, the payments found on the statements are settled
+	reconciliationOptions, err := payments.ParseReconciliationOptions(cfg.Reconciliation)
+	if err != nil {
+		startLogger.Log("err", err)
+		os.Exit(1)
+	}
+	payments.RegisterReconciliationRoutes(router, payments.NewReconciliationService(payments.NewReconciliationLedger(payments.NewReconciliationStore(db), ledgerStore), svc, reconciliationOptions), int64(cfg.Imports.MaxFileSizeMB)<<20)
+
+	// the refunds are created through the same layers as the other payments
+	payments.RegisterRefundRoutes(router, payments.NewRefundService(refundStore, svc))
+	// the balances of the ledger and its check are read from the postings of the caller's organisation
+	payments.RegisterLedgerRoutes(router, payments.NewLedgerService(ledgerStore))
+	// record the returns of the schemes, by hand or from files, the returned payments are posted back to the debtors
+	payments.RegisterReturnRoutes(router, payments.NewReturnService(payments.NewReturnLedger(payments.NewReturnStore(db), ledgerStore), svc), int64(cfg.Imports.MaxFileSizeMB)<<20)
+	// release the scheduled payments on their processing date, starting with the ones missed while the service was down
+	scheduleStore := payments.NewScheduleLedger(payments.NewScheduleStore(db), ledgerStore)
+	scheduler := payments.NewScheduler(scheduleStore, log.With(logger, "tag", "scheduler"))
+	scheduler.Start()
+	payments.RegisterScheduleRoutes(router, payments.NewScheduleService(scheduleStore, svc))
+	// bring back the payments deleted by mistake, with their postings
+	payments.RegisterRestoreRoutes(router, payments.NewRestoreService(payments.NewRestoreLedger(payments.NewRestoreStore(db), ledgerStore), svc))
+
+	// throttle the requests of every organisation or API key once they are authenticated
+	rateLimitRules, err := payments.ParseRateLimitRules(cfg.RateLimit.Limits)
+	if err != nil {
+		startLogger.Log("err", err)
+		os.Exit(1)
+	}
+	rateLimiting, err := payments.NewRateLimiting(router, router, payments.NewRateLimiter(), cfg.RateLimit.By, rateLimitRules)
+	if err != nil {
+		startLogger.Log("err", err)
+		os.Exit(1)
+	}
+	limited := payments.NewHandlerSwitch(rateLimitSwitch, rateLimiting, router)
+
+	// every request is given an ID inside its trace, so that its spans, log lines and errors can be correlated
+	api := payments.NewHTTPMetrics(registry, payments.NewAuthentication(limited, authenticators...), router)
+	// the service is ready when the database can be reached and its schema is up to date
+	health := payments.NewHealth(payments.BuildInfo{Version: version, Commit: commit, BuildDate: buildDate}, db,
+		payments.DBPingCheck(db), payments.DBSchemaCheck(db, log.With(logger, "tag", "health")))
+
+	// /healthz, /readyz, /status and /metrics are not authenticated, /status and /metrics are served on the admin port
+	// when one is configured
+	handler := http.NewServeMux()
+	handler.Handle("/", payments.NewHTTPTracing(payments.NewRequestID(api), router, tracer))
+	handler.Handle("/healthz", health.LivenessHandler())
+	handler.Handle("/readyz", health.ReadinessHandler())
+	adminHandler := handler
+	if cfg.Admin.Port != 0 {
+		adminHandler = http.NewServeMux()
+	}
+	adminHandler.Handle("/status", health.StatusHandler())
+	metricsSwitch := payments.NewSwitch(cfg.Features.Metrics)
+	adminHandler.Handle("/metrics", payments.NewHandlerSwitch(metricsSwitch, registry.Handler(), nil))
+
+	// the log level, the rate limits, the quotas and the feature flags are reloaded on SIGHUP and when the
+	// configuration file changes, the other settings need a restart
+	reloader := config.NewReloader(cfg, func() (config.AppConfig, error) {
+		fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		config.RegisterAPIKeyFlags(fs)
+		c, err := config.Load(fs, os.Args[1:])
+		if err != nil {
+			return c, err
+		}
+		// the rate limits and the quotas are checked before anything is applied
+		if _, err := payments.ParseRateLimitRules(c.RateLimit.Limits); err != nil {
+			return c, err
+		}
+		_, err = payments.ParseQuotas(c.RateLimit.DailyPayments, c.RateLimit.DailyAmount)
+		return c, err
+	})
+	reloader.OnReload(func(c config.AppConfig) {
+		applyConfig(c, logger, rateLimiting, quotaLimiting)
+		approvalSwitch.Set(c.Features.Approvals)
+		rateLimitSwitch.Set(c.Features.RateLimiting)
+		metricsSwitch.Set(c.Features.Metrics)
+	})
+	reloadLogger := log.With(logger, "tag", "reload")
+	reload := func(trigger string) {
+		res, err := reloader.Reload()
+		if err != nil {
+			reloadLogger.Log("level", payments.LevelError, "trigger", trigger, "err", err)
+			return
+		}
+		reloadLogger.Log("msg", "reloaded the configuration", "trigger", trigger,
+			"applied", strings.Join(res.Applied, ","), "restart_required", strings.Join(res.RestartRequired, ","))
+	}
+	if file := config.ConfigFile(os.Args[1:]); file != "" {
+		stopWatching, err := config.WatchFile(file, func() { reload("file") })
+		if err != nil {
+			startLogger.Log("level", payments.LevelWarn, "msg", "the configuration file is not watched", "err", err)
+		} else {
+			defer stopWatching()
+		}
+	}
+	go func() {
+		for range reloadC {
+			reload("SIGHUP")
+		}
+	}()
+	if cfg.Admin.Port != 0 {
+		adminServer := &http.Server{
+			Addr:    ":" + strconv.Itoa(cfg.Admin.Port),
+			Handler: adminHandler,
+		}
+		startLogger.Log("msg", "Admin serving locally...", "port", adminServer.Addr)
+		go func() {
+			monC <- adminServer.ListenAndServe()
+		}()
+		defer adminServer.Close()
+	}
 
 	// define http server
 	server := &http.Server{
-		Addr:    port,
-		Handler: router,
+		Addr:              cfg.Server.Address(),
+		Handler:           handler,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	// serve HTTPS when a certificate is configured, the certificate and the client CAs are reloaded when their files
+	// change so that they can be renewed without a restart
+	scheme := "http"
+	if cfg.TLS.CertFile != "" {
+		serverTLS, err := payments.NewServerTLS(payments.TLSOptions{
+			CertFile:     cfg.TLS.CertFile,
+			KeyFile:      cfg.TLS.KeyFile,
+			MinVersion:   cfg.TLS.MinVersion,
+			CipherSuites: strings.Split(cfg.TLS.CipherSuites, ","),
+			ClientCAFile: cfg.TLS.ClientCAFile,
+			ClientAuth:   cfg.TLS.ClientAuth,
+		})
+		if err != nil {
+			startLogger.Log("err", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = serverTLS.Config()
+		scheme = "https"
+		tlsLogger := log.With(logger, "tag", "tls")
+		for _, file := range serverTLS.Files() {
+			stopWatching, err := config.WatchFile(file, func() {
+				// the certificate and its key are often replaced one after the other, the reload only succeeds once
+				// both are written
+				if err := serverTLS.Reload(); err != nil {
+					tlsLogger.Log("level", payments.LevelWarn, "msg", "the TLS files were not reloaded", "err", err)
+					return
+				}
+				cert, err := serverTLS.Certificate()
+				if err == nil {
+					tlsLogger.Log("msg", "reloaded the TLS files", "subject", cert.Subject.CommonName, "not_after", cert.NotAfter)
+				}
+			})
+			if err != nil {
+				startLogger.Log("level", payments.LevelWarn, "msg", "the TLS files are not watched", "err", err)
+				continue
+			}
+			defer stopWatching()
+		}
 	}
 
 	startLogger.Log("msg", "Welcome to the 'Payments REST API'")
-	startLogger.Log("msg", "Payments API Endpoint: http://127.0.0.1"+port+"/v1/payments/")
-	startLogger.Log("msg", "HTTP serving locally...", "port", port)
+	startLogger.Log("msg", "Payments API Endpoint: "+scheme+"://127.0.0.1:"+strconv.Itoa(cfg.Server.Port)+"/v1/payments/")
+	startLogger.Log("msg", strings.ToUpper(scheme)+" serving locally...", "address", server.Addr)
 
 	// launch server in a go routine
 	go func() {
+		if server.TLSConfig != nil {
+			monC <- server.ListenAndServeTLS("", "")
+			return
+		}
 		monC <- server.ListenAndServe()
 	}()
 
@@ -91,8 +392,10 @@ func main() {
 	case sig := <-gracefulStopC:
 		m := fmt.Sprintf("Caught sig: %+v ", sig)
 		startLogger.Log("msg", m)
-		const timeout = 5 * time.Second
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		// fail the readiness checks first, so that load balancers stop sending requests before the server stops
+		health.SetShuttingDown()
+		time.Sleep(cfg.Admin.DrainDelay)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 		defer cancel()
 		if err := server.Shutdown(ctx); err != nil {
 			m := fmt.Sprintf("HTTP server could not be stopped gracefully: %v", err)
@@ -104,6 +407,10 @@ func main() {
 		} else {
 			startLogger.Log("msg", "Gracefully shutdown HTTP server.")
 		}
+		// the imports stop after their current row and are resumed on the next start
+		importer.Stop()
+		scheduler.Stop()
+		tracer.Shutdown(ctx)
 		os.Exit(0)
 
 	// monitor http server launch errors
@@ -113,8 +420,63 @@ func main() {
 	}
 }
 
-// createLogger implements the disred log format
-func createLogger() log.Logger {
-	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
-	return log.With(logger, "time", log.DefaultTimestampUTC())
+// applyConfig applies the reloadable settings of c that are not feature flags. The settings were validated, the
+// errors are only logged
+func applyConfig(c config.AppConfig, logger log.Logger, rateLimiting *payments.RateLimiting, quotaLimiting *payments.QuotaLimiting) {
+	errs := []error{payments.SetLogLevel(logger, c.Log.Level)}
+	rules, err := payments.ParseRateLimitRules(c.RateLimit.Limits)
+	if err == nil {
+		err = rateLimiting.Update(c.RateLimit.By, rules)
+	}
+	errs = append(errs, err)
+	quotas, err := payments.ParseQuotas(c.RateLimit.DailyPayments, c.RateLimit.DailyAmount)
+	if err == nil {
+		quotaLimiting.Update(quotas)
+	}
+	errs = append(errs, err)
+	for _, err := range errs {
+		if err != nil {
+			logger.Log("level", payments.LevelError, "tag", "reload", "err", err)
+		}
+	}
+}
+
+// createTracer creates the tracer exporting spans to the configured OTLP endpoint and file
+func createTracer(c config.TracingConfig) (*tracing.Tracer, error) {
+	var exporters []tracing.Exporter
+	if c.OTLPEndpoint != "" {
+		exporters = append(exporters, tracing.NewOTLPExporter(c.OTLPEndpoint, nil))
+	}
+	switch c.File {
+	case "":
+	case "stdout":
+		exporters = append(exporters, tracing.NewWriterExporter(os.Stdout))
+	default:
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, tracing.NewWriterExporter(f))
+	}
+	return tracing.NewTracer("paymentsapi", 5*time.Second, 512, exporters...), nil
+}
+
+// printConfig prints the configuration read from the args, the environment and the configuration file with its
+// secrets masked, and exits with an error when the configuration is not valid
+func printConfig(args []string) {
+	fs := flag.NewFlagSet("config print", flag.ExitOnError)
+	config.RegisterAPIKeyFlags(fs)
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := cfg.Print(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	payments "github.com/vstoianovici/paymentsapi"
+	"github.com/vstoianovici/paymentsapi/client"
+	valid "gopkg.in/go-playground/validator.v9"
+)
+
+// globalFlags are the flags accepted by every command
+type globalFlags struct {
+	config  string
+	profile string
+	url     string
+	output  string
+}
+
+func newFlagSet(name string, g *globalFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&g.config, "config", "", "Path of the profiles file.")
+	fs.StringVar(&g.profile, "profile", "", "Profile to use.")
+	fs.StringVar(&g.url, "url", "", "URL of the Payments API, overrides the one of the profile.")
+	fs.StringVar(&g.output, "o", "", "Output format: table, json or yaml.")
+	return fs
+}
+
+// setup resolves the profile and output format and builds the client used to reach the API
+func (g globalFlags) setup() (*client.Client, string, error) {
+	p, err := loadProfile(configFilePath(g.config), g.profile)
+	if err != nil {
+		return nil, "", err
+	}
+	if g.url != "" {
+		p.URL = g.url
+	}
+	format := g.output
+	if format == "" {
+		format = p.Output
+	}
+	if format == "" {
+		format = outputTable
+	}
+	if !validOutput(format) {
+		return nil, "", errors.New("err: unknown output format " + format)
+	}
+	opts := []client.Option{client.Timeout(p.Timeout), client.Retries(p.Retries)}
+	// credentials can be kept out of the profiles file
+	if key := os.Getenv("PAYMENTSCTL_API_KEY"); key != "" {
+		p.APIKey = key
+	}
+	if token := os.Getenv("PAYMENTSCTL_TOKEN"); token != "" {
+		p.Token = token
+	}
+	if p.APIKey != "" {
+		opts = append(opts, client.APIKey(p.APIKey))
+	}
+	if p.Token != "" {
+		opts = append(opts, client.BearerToken(p.Token))
+	}
+	svc, err := client.NewClient(p.URL, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	return svc, format, nil
+}
+
+func runGet(args []string, _ io.Reader, stdout io.Writer) error {
+	var g globalFlags
+	fs := newFlagSet("get", &g)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := singleArg(fs, "payment ID")
+	if err != nil {
+		return err
+	}
+	svc, format, err := g.setup()
+	if err != nil {
+		return err
+	}
+	p, err := svc.GetPayment(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	if format == outputTable {
+		return printPayments(stdout, format, []payments.Payment{p})
+	}
+	return printValue(stdout, format, p)
+}
+
+// listFilters are applied to the list of payments returned by the API
+type listFilters struct {
+	organisation string
+	currency     string
+	scheme       string
+	paymentType  string
+	from         string
+	to           string
+	reference    string
+	minAmount    float64
+	maxAmount    float64
+}
+
+func (f listFilters) match(p payments.Payment) bool {
+	a := p.Attributes
+	if f.organisation != "" && p.OrganisationID.String() != f.organisation {
+		return false
+	}
+	if f.currency != "" && !strings.EqualFold(a.Currency, f.currency) {
+		return false
+	}
+	if f.scheme != "" && !strings.EqualFold(a.PaymentScheme, f.scheme) {
+		return false
+	}
+	if f.paymentType != "" && !strings.EqualFold(a.PaymentType, f.paymentType) {
+		return false
+	}
+	// processing dates are formatted as YYYY-MM-DD so they can be compared as strings
+	if f.from != "" && a.ProcessingDate.String() < f.from {
+		return false
+	}
+	if f.to != "" && a.ProcessingDate.String() > f.to {
+		return false
+	}
+	if f.reference != "" && !strings.Contains(strings.ToLower(a.Reference), strings.ToLower(f.reference)) {
+		return false
+	}
+	if f.minAmount > 0 || f.maxAmount > 0 {
+		amount, err := strconv.ParseFloat(a.Amount, 64)
+		if err != nil {
+			return false
+		}
+		if f.minAmount > 0 && amount < f.minAmount {
+			return false
+		}
+		if f.maxAmount > 0 && amount > f.maxAmount {
+			return false
+		}
+	}
+	return true
+}
+
+func runList(args []string, _ io.Reader, stdout io.Writer) error {
+	var g globalFlags
+	var f listFilters
+	fs := newFlagSet("list", &g)
+	fs.StringVar(&f.organisation, "organisation", "", "Only list the payments of this organisation ID.")
+	fs.StringVar(&f.currency, "currency", "", "Only list the payments in this currency.")
+	fs.StringVar(&f.scheme, "scheme", "", "Only list the payments using this payment scheme (e.g. FPS).")
+	fs.StringVar(&f.paymentType, "type", "", "Only list the payments of this payment type (e.g. Credit).")
+	fs.StringVar(&f.from, "from", "", "Only list the payments processed on or after this date (YYYY-MM-DD).")
+	fs.StringVar(&f.to, "to", "", "Only list the payments processed on or before this date (YYYY-MM-DD).")
+	fs.StringVar(&f.reference, "reference", "", "Only list the payments whose reference contains this text.")
+	fs.Float64Var(&f.minAmount, "min-amount", 0, "Only list the payments of at least this amount.")
+	fs.Float64Var(&f.maxAmount, "max-amount", 0, "Only list the payments of at most this amount.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("err: list does not take any argument")
+	}
+	svc, format, err := g.setup()
+	if err != nil {
+		return err
+	}
+	all, err := svc.GetListPayments(context.Background())
+	if err != nil {
+		return err
+	}
+	filtered := []payments.Payment{}
+	for _, p := range all {
+		if f.match(p) {
+			filtered = append(filtered, p)
+		}
+	}
+	return printPayments(stdout, format, filtered)
+}
+
+func runCreate(args []string, stdin io.Reader, stdout io.Writer) error {
+	var g globalFlags
+	fs := newFlagSet("create", &g)
+	file := fs.String("f", "-", "JSON file holding the payment, - reads it from stdin.")
+	dryRun := fs.Bool("dry-run", false, "Only validate the payment locally, nothing is sent to the API.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("err: create does not take any argument, use -f")
+	}
+	p, err := readPayment(*file, stdin)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return dryRunValidation(stdout, p)
+	}
+	svc, format, err := g.setup()
+	if err != nil {
+		return err
+	}
+	resp, err := svc.CreatePayment(context.Background(), p)
+	if err != nil {
+		return err
+	}
+	return printValue(stdout, format, resp)
+}
+
+func runUpdate(args []string, stdin io.Reader, stdout io.Writer) error {
+	var g globalFlags
+	fs := newFlagSet("update", &g)
+	file := fs.String("f", "-", "JSON file holding the new payment, - reads it from stdin.")
+	dryRun := fs.Bool("dry-run", false, "Only validate the payment locally, nothing is sent to the API.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := singleArg(fs, "payment ID")
+	if err != nil {
+		return err
+	}
+	p, err := readPayment(*file, stdin)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		if _, err := uuid.FromString(id); err != nil {
+			return err
+		}
+		return dryRunValidation(stdout, p)
+	}
+	svc, format, err := g.setup()
+	if err != nil {
+		return err
+	}
+	resp, err := svc.UpdatePayment(context.Background(), payments.UpdatePaymentRequest{PaymentID: id, Payment: p})
+	if err != nil {
+		return err
+	}
+	return printValue(stdout, format, resp)
+}
+
+func runDelete(args []string, _ io.Reader, stdout io.Writer) error {
+	var g globalFlags
+	fs := newFlagSet("delete", &g)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	arg, err := singleArg(fs, "payment ID")
+	if err != nil {
+		return err
+	}
+	id, err := uuid.FromString(arg)
+	if err != nil {
+		return err
+	}
+	svc, format, err := g.setup()
+	if err != nil {
+		return err
+	}
+	t, err := svc.DeletePayment(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	return printValue(stdout, format, payments.DeletePaymentResponse{DeletedAt: t})
+}
+
+func runRestore(args []string, _ io.Reader, stdout io.Writer) error {
+	var g globalFlags
+	fs := newFlagSet("restore", &g)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	arg, err := singleArg(fs, "payment ID")
+	if err != nil {
+		return err
+	}
+	id, err := uuid.FromString(arg)
+	if err != nil {
+		return err
+	}
+	svc, format, err := g.setup()
+	if err != nil {
+		return err
+	}
+	p, err := svc.RestorePayment(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	if format == outputTable {
+		return printPayments(stdout, format, []payments.Payment{p})
+	}
+	return printValue(stdout, format, p)
+}
+
+// historyEvent is a change of a payment, from its approvals or its ledger postings
+type historyEvent struct {
+	Time      *time.Time `json:"time,omitempty"`
+	Event     string     `json:"event"`
+	By        string     `json:"by,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+	Details   string     `json:"details,omitempty"`
+}
+
+// paymentHistory merges the approvals and the ledger entries of a payment, oldest first. The approval request has no
+// time and comes first
+func paymentHistory(approvals payments.PaymentApprovals, postings []payments.LedgerPosting) []historyEvent {
+	history := []historyEvent{}
+	if approvals.RequestedBy != "" {
+		history = append(history, historyEvent{Event: "approval_requested", By: approvals.RequestedBy,
+			Details: strconv.Itoa(approvals.RequiredApprovals) + " approval(s) required"})
+	}
+	for _, a := range approvals.Approvals {
+		at := a.ApprovedAt
+		history = append(history, historyEvent{Time: &at, Event: "approved", By: a.Approver, RequestID: a.RequestID})
+	}
+	// the postings of an entry are posted together
+	entries := map[uuid.UUID]int{}
+	for _, p := range postings {
+		line := p.Account + " " + p.Currency + " " + p.Amount
+		if i, ok := entries[p.EntryID]; ok {
+			history[i].Details += ", " + line
+			continue
+		}
+		at := p.PostedAt
+		entries[p.EntryID] = len(history)
+		history = append(history, historyEvent{Time: &at, Event: "ledger_" + p.Event, RequestID: p.RequestID, Details: line})
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		if history[i].Time == nil || history[j].Time == nil {
+			return history[i].Time == nil && history[j].Time != nil
+		}
+		return history[i].Time.Before(*history[j].Time)
+	})
+	return history
+}
+
+func runHistory(args []string, _ io.Reader, stdout io.Writer) error {
+	var g globalFlags
+	fs := newFlagSet("history", &g)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	arg, err := singleArg(fs, "payment ID")
+	if err != nil {
+		return err
+	}
+	id, err := uuid.FromString(arg)
+	if err != nil {
+		return err
+	}
+	svc, format, err := g.setup()
+	if err != nil {
+		return err
+	}
+	// the approvals of a deleted payment cannot be read, its postings can
+	approvals, err := svc.GetApprovals(context.Background(), id)
+	if err != nil && !payments.IsNotFound(err) {
+		return err
+	}
+	postings, err := svc.ListPostings(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	history := paymentHistory(approvals, postings)
+	if format == outputTable {
+		return printHistoryTable(stdout, history)
+	}
+	return printValue(stdout, format, history)
+}
+
+func runProfiles(args []string, _ io.Reader, stdout io.Writer) error {
+	var g globalFlags
+	fs := newFlagSet("profiles", &g)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	profiles, current, err := readProfiles(configFilePath(g.config))
+	if err != nil {
+		return err
+	}
+	for _, name := range profileNames(profiles) {
+		marker := " "
+		if name == current {
+			marker = "*"
+		}
+		fmt.Fprintf(stdout, "%s %s\t%s\n", marker, name, profiles[name].URL)
+	}
+	return nil
+}
+
+// singleArg returns the only positional argument of the command
+func singleArg(fs *flag.FlagSet, what string) (string, error) {
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("err: %s expects exactly one argument: the %s", fs.Name(), what)
+	}
+	return fs.Arg(0), nil
+}
+
+// readPayment decodes a payment from a JSON file, or from stdin when file is "-"
+func readPayment(file string, stdin io.Reader) (payments.Payment, error) {
+	var p payments.Payment
+	r := stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return p, err
+		}
+		defer f.Close()
+		r = f
+	}
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return p, errors.New("err: Could not read payment: " + err.Error())
+	}
+	return p, nil
+}
+
+// dryRunValidation validates the payment with the rules used by the API's Validator and reports every failing field
+func dryRunValidation(stdout io.Writer, p payments.Payment) error {
+	err := payments.ValidatePayload(p)
+	if err == nil {
+		fmt.Fprintln(stdout, "payload is valid")
+		return nil
+	}
+	fieldErrs, ok := err.(valid.ValidationErrors)
+	if !ok {
+		fmt.Fprintln(stdout, err)
+	}
+	for _, fe := range fieldErrs {
+		fmt.Fprintf(stdout, "%s: failed on the '%s' rule\n", fe.Namespace(), fe.Tag())
+	}
+	return payments.ErrPayloadNotValid
+}
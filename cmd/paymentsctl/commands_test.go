@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	payments "github.com/vstoianovici/paymentsapi"
+)
+
+func newTestServer(svc payments.PaymentService) (*httptest.Server, []string) {
+	srv := httptest.NewServer(payments.NewHTTPTransport(svc))
+	// point to a missing profiles file so the tests do not depend on the user's home directory
+	return srv, []string{"-config", filepath.Join(os.TempDir(), "paymentsctl-missing.toml"), "-url", srv.URL}
+}
+
+func TestRunGetOutputs(t *testing.T) {
+	id, _ := uuid.NewV4()
+	p := payments.Payment{ID: id, Type: "Payment"}
+	p.Attributes.Amount = "130.21"
+	p.Attributes.Currency = "GBP"
+	mockSvc := &payments.MockPaymentService{}
+	mockSvc.On("GetPayment", mock.Anything, id.String()).Return(p, nil)
+	srv, flags := newTestServer(mockSvc)
+	defer srv.Close()
+
+	var out bytes.Buffer
+	assert.NoError(t, runGet(append(flags, id.String()), nil, &out))
+	assert.Contains(t, out.String(), "AMOUNT")
+	assert.Contains(t, out.String(), "130.21")
+
+	out.Reset()
+	assert.NoError(t, runGet(append(flags, "-o", "json", id.String()), nil, &out))
+	var got payments.Payment
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &got))
+	assert.Equal(t, id, got.ID)
+
+	out.Reset()
+	assert.NoError(t, runGet(append(flags, "-o", "yaml", id.String()), nil, &out))
+	assert.Contains(t, out.String(), "amount: \"130.21\"")
+
+	assert.Error(t, runGet(append(flags, "-o", "xml", id.String()), nil, &out))
+	assert.Error(t, runGet(flags, nil, &out))
+}
+
+func TestRunListFilters(t *testing.T) {
+	gbp := payments.Payment{Type: "Payment"}
+	gbp.Attributes.Currency = "GBP"
+	gbp.Attributes.Amount = "10.00"
+	gbp.Attributes.ProcessingDate, _ = payments.ParseDate("2017-01-18")
+	usd := payments.Payment{Type: "Payment"}
+	usd.Attributes.Currency = "USD"
+	usd.Attributes.Amount = "1000.00"
+	usd.Attributes.ProcessingDate, _ = payments.ParseDate("2017-02-01")
+	mockSvc := &payments.MockPaymentService{}
+	mockSvc.On("GetListPayments", mock.Anything).Return([]payments.Payment{gbp, usd}, nil)
+	srv, flags := newTestServer(mockSvc)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		filters []string
+		want    int
+	}{
+		{"no filter", nil, 2},
+		{"currency", []string{"-currency", "gbp"}, 1},
+		{"dates", []string{"-from", "2017-01-20", "-to", "2017-12-31"}, 1},
+		{"amount", []string{"-min-amount", "50"}, 1},
+		{"nothing matches", []string{"-currency", "EUR"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			args := append(append([]string{}, flags...), "-o", "json")
+			assert.NoError(t, runList(append(args, tt.filters...), nil, &out))
+			var got []payments.Payment
+			assert.NoError(t, json.Unmarshal(out.Bytes(), &got))
+			assert.Len(t, got, tt.want)
+		})
+	}
+}
+
+func TestRunCreateFromStdin(t *testing.T) {
+	id, _ := uuid.NewV4()
+	mockSvc := &payments.MockPaymentService{}
+	mockSvc.On("CreatePayment", mock.Anything, mock.Anything).Return(payments.CreatePaymentResponse{PaymentID: id}, nil)
+	srv, flags := newTestServer(mockSvc)
+	defer srv.Close()
+
+	payment, err := ioutil.ReadFile("../payment1.json")
+	assert.NoError(t, err)
+	var out bytes.Buffer
+	assert.NoError(t, runCreate(append(flags, "-o", "json"), bytes.NewReader(payment), &out))
+	assert.Contains(t, out.String(), id.String())
+	created := mockSvc.Calls[0].Arguments.Get(1).(payments.Payment)
+	assert.Equal(t, "130.21", created.Attributes.Amount)
+}
+
+func TestRunCreateDryRun(t *testing.T) {
+	var out bytes.Buffer
+	// nothing is listening on this URL, a dry run must not call the API
+	flags := []string{"-url", "http://127.0.0.1:1", "-dry-run"}
+	assert.NoError(t, runCreate(append(flags, "-f", "../payment1.json"), nil, &out))
+	assert.Equal(t, "payload is valid\n", out.String())
+
+	out.Reset()
+	err := runCreate(flags, strings.NewReader(`{"type":"Payment"}`), &out)
+	assert.Equal(t, payments.ErrPayloadNotValid, err)
+	assert.Contains(t, out.String(), "Payment.OrganisationID: failed on the 'required' rule")
+	assert.Contains(t, out.String(), "Payment.Attributes.ProcessingDate: failed on the 'required' rule")
+
+	// a malformed processing date is reported when the payment is read
+	err = runCreate(flags, strings.NewReader(`{"type":"Payment","attributes":{"processing_date":"18/01/2017"}}`), &out)
+	assert.Contains(t, err.Error(), `"18/01/2017" is not a date formatted as YYYY-MM-DD`)
+}
+
+func TestRunUpdateAndDelete(t *testing.T) {
+	id, _ := uuid.NewV4()
+	deletedAt := time.Date(2019, 4, 22, 11, 45, 26, 0, time.UTC)
+	mockSvc := &payments.MockPaymentService{}
+	mockSvc.On("UpdatePayment", mock.Anything, mock.Anything).Return(payments.UpdatePaymentResponse{PaymentID: id}, nil)
+	mockSvc.On("DeletePayment", mock.Anything, id).Return(&deletedAt, nil)
+	srv, flags := newTestServer(mockSvc)
+	defer srv.Close()
+
+	var out bytes.Buffer
+	assert.NoError(t, runUpdate(append(flags, "-f", "../payment0.json", id.String()), nil, &out))
+	assert.Contains(t, out.String(), id.String())
+
+	out.Reset()
+	assert.NoError(t, runDelete(append(flags, "-o", "yaml", id.String()), nil, &out))
+	assert.Contains(t, out.String(), "DeletedAt: \"2019-04-22T11:45:26Z\"")
+	assert.Error(t, runDelete(append(flags, "not-a-uuid"), nil, &out))
+}
+
+func TestRunRestoreAndHistory(t *testing.T) {
+	id, _ := uuid.NewV4()
+	approvalsFound := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/payments/" + id.String() + "/restore":
+			w.Write([]byte(`{"id":"` + id.String() + `","attributes":{"amount":"130.21","currency":"GBP"}}`))
+		case "/v1/payments/" + id.String() + "/approvals":
+			if !approvalsFound {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"kind":"not_found","error":"record not found"}`))
+				return
+			}
+			w.Write([]byte(`{"requested_by":"alice","required_approvals":1,"approvals":[{"approver":"bob","approved_at":"2019-04-22T10:00:00Z","request_id":"req-2"}]}`))
+		case "/v1/ledger/postings":
+			w.Write([]byte(`[{"entry_id":"` + id.String() + `","event":"created","account":"debtor:1","currency":"GBP","amount":"130.21","posted_at":"2019-04-22T10:00:01Z","request_id":"req-2"},` +
+				`{"entry_id":"` + id.String() + `","event":"created","account":"clearing:FPS","currency":"GBP","amount":"-130.21","posted_at":"2019-04-22T10:00:01Z","request_id":"req-2"}]`))
+		}
+	}))
+	defer srv.Close()
+	flags := []string{"-config", filepath.Join(os.TempDir(), "paymentsctl-missing.toml"), "-url", srv.URL}
+
+	var out bytes.Buffer
+	assert.NoError(t, runRestore(append(flags, id.String()), nil, &out))
+	assert.Contains(t, out.String(), "130.21")
+	assert.Error(t, runRestore(append(flags, "not-a-uuid"), nil, &out))
+
+	out.Reset()
+	assert.NoError(t, runHistory(append(flags, id.String()), nil, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 4)
+	assert.Contains(t, lines[1], "approval_requested  alice")
+	assert.Contains(t, lines[2], "2019-04-22T10:00:00Z  approved")
+	assert.Contains(t, lines[3], "ledger_created")
+	assert.Contains(t, lines[3], "debtor:1 GBP 130.21, clearing:FPS GBP -130.21")
+
+	// a deleted payment has no approvals to read, only its postings
+	approvalsFound = false
+	out.Reset()
+	assert.NoError(t, runHistory(append(flags, "-o", "json", id.String()), nil, &out))
+	var history []historyEvent
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &history))
+	assert.Len(t, history, 1)
+	assert.Equal(t, "req-2", history[0].RequestID)
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paymentsctl")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "profiles.toml")
+	content := `current_profile = "staging"
+
+[profiles.staging]
+url = "https://staging.example.com"
+timeout = "3s"
+
+[profiles.prod]
+url = "https://prod.example.com"
+output = "json"
+`
+	assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+
+	p, err := loadProfile(file, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://staging.example.com", p.URL)
+	assert.Equal(t, 3*time.Second, p.Timeout)
+	assert.Equal(t, defaultProfile.Retries, p.Retries)
+
+	p, err = loadProfile(file, "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, "json", p.Output)
+
+	_, err = loadProfile(file, "unknown")
+	assert.Error(t, err)
+
+	p, err = loadProfile(filepath.Join(dir, "missing.toml"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultProfile, p)
+}
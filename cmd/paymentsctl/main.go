@@ -0,0 +1,67 @@
+// paymentsctl is a command-line client for operators of the Payments REST API
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = `Usage: paymentsctl <command> [flags] [arguments]
+
+Commands:
+  get <id>          display a payment
+  list              list payments, optionally filtered
+  create            create a payment from a JSON file or stdin
+  update <id>       replace a payment with the content of a JSON file or stdin
+  delete <id>       soft delete a payment
+  restore <id>      restore a soft deleted payment
+  history <id>      display the approvals and the ledger entries of a payment
+  profiles          list the profiles defined in the profiles file
+
+Every command accepts the following flags:
+  -config string    path of the profiles file (default $PAYMENTSCTL_CONFIG or ~/.paymentsctl.toml)
+  -profile string   profile to use (default $PAYMENTSCTL_PROFILE or the current_profile of the profiles file)
+  -url string       URL of the Payments API, overrides the one of the profile
+  -o string         output format: table, json or yaml (default from the profile, otherwise table)
+
+Credentials are read from the api_key or token settings of the profile, or from
+$PAYMENTSCTL_API_KEY or $PAYMENTSCTL_TOKEN.
+
+Run 'paymentsctl <command> -h' for the flags specific to a command.
+`
+
+// command is the signature shared by all subcommands
+type command func(args []string, stdin io.Reader, stdout io.Writer) error
+
+var commands = map[string]command{
+	"get":      runGet,
+	"list":     runList,
+	"create":   runCreate,
+	"update":   runUpdate,
+	"delete":   runDelete,
+	"restore":  runRestore,
+	"history":  runHistory,
+	"profiles": runProfiles,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		fmt.Fprint(os.Stdout, usage)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "paymentsctl: unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+	if err := cmd(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "paymentsctl:", err)
+		os.Exit(1)
+	}
+}
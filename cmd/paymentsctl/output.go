@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	payments "github.com/vstoianovici/paymentsapi"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// output formats supported by every command
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// printPayments writes the payments to w in the requested format
+func printPayments(w io.Writer, format string, p []payments.Payment) error {
+	if format == outputTable {
+		return printPaymentsTable(w, p)
+	}
+	return printValue(w, format, p)
+}
+
+// printValue writes any JSON serialisable value to w in the requested format. A table is only meaningful
+// for payments so other values are printed as JSON when a table is requested
+func printValue(w io.Writer, format string, v interface{}) error {
+	switch format {
+	case outputTable, outputJSON:
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case outputYAML:
+		// go through JSON first so that the field names match the ones of the API
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := yaml.Unmarshal(b, &generic); err != nil {
+			return err
+		}
+		b, err = yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	return errors.New("err: unknown output format " + format)
+}
+
+func printPaymentsTable(w io.Writer, p []payments.Payment) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tORGANISATION\tAMOUNT\tCURRENCY\tSCHEME\tPROCESSING DATE\tREFERENCE")
+	for _, py := range p {
+		a := py.Attributes
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			py.ID, py.OrganisationID, a.Amount, a.Currency, a.PaymentScheme, a.ProcessingDate, a.Reference)
+	}
+	return tw.Flush()
+}
+
+func printHistoryTable(w io.Writer, history []historyEvent) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tBY\tREQUEST ID\tDETAILS")
+	for _, e := range history {
+		at := "-"
+		if e.Time != nil {
+			at = e.Time.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", at, e.Event, e.By, e.RequestID, e.Details)
+	}
+	return tw.Flush()
+}
+
+// validOutput reports whether format is one of the supported output formats
+func validOutput(format string) bool {
+	return format == outputTable || format == outputJSON || format == outputYAML
+}
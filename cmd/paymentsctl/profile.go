@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// defaultConfigFile is the name of the profiles file looked up in the user's home directory
+const defaultConfigFile = ".paymentsctl.toml"
+
+// Profile holds the settings used to reach one paymentsAPI environment
+type Profile struct {
+	URL     string        `mapstructure:"url"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	Retries int           `mapstructure:"retries"`
+	Output  string        `mapstructure:"output"`
+	APIKey  string        `mapstructure:"api_key"`
+	Token   string        `mapstructure:"token"`
+}
+
+// defaultProfile is used when no profiles file exists, it targets a paymentsAPI running locally with the default port
+var defaultProfile = Profile{
+	URL:     "http://127.0.0.1:8080",
+	Timeout: 10 * time.Second,
+	Retries: 2,
+	Output:  "table",
+}
+
+// configFilePath returns the path of the profiles file: the one passed on the command line, then $PAYMENTSCTL_CONFIG,
+// then ~/.paymentsctl.toml
+func configFilePath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv("PAYMENTSCTL_CONFIG"); env != "" {
+		return env
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, defaultConfigFile)
+}
+
+// readProfiles reads every profile defined in the profiles file along with the name of the current profile.
+// A missing file is not an error, the default profile is used instead
+func readProfiles(file string) (map[string]Profile, string, error) {
+	profiles := map[string]Profile{"default": defaultProfile}
+	if file == "" {
+		return profiles, "default", nil
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return profiles, "default", nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, "", err
+	}
+	for name := range v.GetStringMap("profiles") {
+		p := defaultProfile
+		if err := v.UnmarshalKey("profiles."+name, &p); err != nil {
+			return nil, "", err
+		}
+		profiles[name] = p
+	}
+	current := v.GetString("current_profile")
+	if current == "" {
+		current = "default"
+	}
+	return profiles, current, nil
+}
+
+// loadProfile returns the profile to use: the one passed on the command line, then $PAYMENTSCTL_PROFILE,
+// then the current_profile of the profiles file
+func loadProfile(file, name string) (Profile, error) {
+	profiles, current, err := readProfiles(file)
+	if err != nil {
+		return Profile{}, err
+	}
+	if name == "" {
+		name = os.Getenv("PAYMENTSCTL_PROFILE")
+	}
+	if name == "" {
+		name = current
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, errors.New("err: unknown profile " + name)
+	}
+	return p, nil
+}
+
+// profileNames returns the sorted names of the profiles available in the profiles file
+func profileNames(profiles map[string]Profile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
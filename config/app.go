@@ -0,0 +1,448 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the settings, e.g. PAYMENTSAPI_DB_HOST overrides
+// db.host. A variable suffixed with _FILE names a file holding the value, e.g. PAYMENTSAPI_DB_PASSWORD_FILE
+const EnvPrefix = "PAYMENTSAPI"
+
+// DefaultConfigFile is the configuration file read when -config is not given, if it exists. It is relative to /cmd
+// like the other paths of the default configuration
+const DefaultConfigFile = "../config/paymentsapi.toml"
+
+// maskedValue replaces the secrets when the configuration is printed
+const maskedValue = "********"
+
+// ServerConfig holds the settings of the HTTP server
+type ServerConfig struct {
+	Host              string        `mapstructure:"host"`
+	Port              int           `mapstructure:"port"`
+	ReadTimeout       time.Duration `mapstructure:"read_timeout"`
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	WriteTimeout      time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+	ShutdownTimeout   time.Duration `mapstructure:"shutdown_timeout"`
+}
+
+// Address returns the address the server listens on
+func (c ServerConfig) Address() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// RegisterFlags defines the flags of the HTTP server on fs, the current settings are the defaults
+func (c *ServerConfig) RegisterFlags(fs *flag.FlagSet) {
+	// Parse the port number that the server uses to listen and serve. If none is defined the default is 8080
+	fs.IntVar(&c.Port, "port", c.Port, "Port on which the server will listen and serve.")
+	fs.StringVar(&c.Host, "host", c.Host, "Host or IP address the server listens on, all interfaces if empty.")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "Time allowed to read a whole request, 0 for no limit.")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "Time allowed to write a response, 0 for no limit.")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "Time an idle keep-alive connection is kept open for.")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "Time allowed to the requests in flight to complete when the server is shut down.")
+}
+
+// TLSConfig holds the certificate the HTTP server is served with, the server uses plain HTTP when none is set.
+// The certificate and the client CAs are reloaded when their files change
+type TLSConfig struct {
+	CertFile     string `mapstructure:"cert_file"`
+	KeyFile      string `mapstructure:"key_file"`
+	MinVersion   string `mapstructure:"min_version"`
+	CipherSuites string `mapstructure:"cipher_suites"`
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	ClientAuth   string `mapstructure:"client_auth"`
+}
+
+// RegisterFlags defines the TLS flags on fs, the current settings are the defaults
+func (c *TLSConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.CertFile, "tls-cert", c.CertFile, "Path of the PEM certificate (chain) of the server, plain HTTP is served if empty.")
+	fs.StringVar(&c.KeyFile, "tls-key", c.KeyFile, "Path of the PEM private key of the server certificate.")
+	fs.StringVar(&c.MinVersion, "tls-min-version", c.MinVersion, "Minimum TLS version accepted: 1.2 or 1.3.")
+	fs.StringVar(&c.CipherSuites, "tls-cipher-suites", c.CipherSuites, "Comma separated TLS 1.2 cipher suites accepted, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. The secure suites of Go if empty.")
+	fs.StringVar(&c.ClientCAFile, "tls-client-ca", c.ClientCAFile, "Path of the PEM certificates of the CAs client certificates are verified with.")
+	fs.StringVar(&c.ClientAuth, "tls-client-auth", c.ClientAuth, "Client certificates asked for: none, optional (verified when sent) or require.")
+}
+
+// FeatureConfig switches optional features of the service on and off
+type FeatureConfig struct {
+	Approvals    bool `mapstructure:"approvals" reload:"true"`
+	RateLimiting bool `mapstructure:"rate_limiting" reload:"true"`
+	Metrics      bool `mapstructure:"metrics" reload:"true"`
+}
+
+// RegisterFlags defines the feature flags on fs, the current settings are the defaults
+func (c *FeatureConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.Approvals, "feature-approvals", c.Approvals, "Hold the payments above the approval policy of their organisation until they are approved.")
+	fs.BoolVar(&c.RateLimiting, "feature-rate-limiting", c.RateLimiting, "Rate limit the requests and enforce the daily quotas.")
+	fs.BoolVar(&c.Metrics, "feature-metrics", c.Metrics, "Expose the metrics on /metrics.")
+}
+
+// ImportConfig sets up the imports of files of payments
+type ImportConfig struct {
+	Workers       int `mapstructure:"workers"`
+	MaxFileSizeMB int `mapstructure:"max_file_size_mb"`
+}
+
+// RegisterFlags defines the flags of the imports on fs, the current settings are the defaults
+func (c *ImportConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.Workers, "import-workers", c.Workers, "Number of imports run at the same time by this instance.")
+	fs.IntVar(&c.MaxFileSizeMB, "import-max-file-size", c.MaxFileSizeMB, "Largest file that can be imported, in MB.")
+}
+
+// BACSConfig sets up the BACS Standard 18 files
+type BACSConfig struct {
+	// ServiceUserNumber is the number the files are submitted under, the files cannot be exported without it
+	ServiceUserNumber string `mapstructure:"service_user_number"`
+}
+
+// RegisterFlags defines the flags of the BACS files on fs, the current settings are the defaults
+func (c *BACSConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ServiceUserNumber, "bacs-service-user-number", c.ServiceUserNumber, "Service user number the BACS Standard 18 files are submitted under, they cannot be exported without it.")
+}
+
+// ReconciliationConfig sets up how the entries of the bank statements are matched to the payments
+type ReconciliationConfig struct {
+	// AmountTolerance is the largest difference between the amount of an entry and the amount of its payment
+	AmountTolerance string `mapstructure:"amount_tolerance"`
+	// DateToleranceDays is the number of days the booking date of an entry can be away from the processing date
+	DateToleranceDays int `mapstructure:"date_tolerance_days"`
+	// CSVColumns renames the columns of the CSV statements, e.g. "amount=Betrag,booking_date=Buchungstag". The
+	// columns that are not renamed have the name of their field
+	CSVColumns string `mapstructure:"csv_columns"`
+	// CSVDateFormat is the layout of the dates of the CSV statements, in the format of the Go time package
+	CSVDateFormat string `mapstructure:"csv_date_format"`
+	CSVSeparator  string `mapstructure:"csv_separator"`
+}
+
+// RegisterFlags defines the flags of the reconciliations on fs, the current settings are the defaults
+func (c *ReconciliationConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.AmountTolerance, "reconciliation-amount-tolerance", c.AmountTolerance, "Largest difference between the amount of a statement entry and the amount of its payment.")
+	fs.IntVar(&c.DateToleranceDays, "reconciliation-date-tolerance", c.DateToleranceDays, "Number of days the booking date of a statement entry can be away from the processing date of its payment.")
+	fs.StringVar(&c.CSVColumns, "reconciliation-csv-columns", c.CSVColumns, "Comma separated field=column pairs naming the columns of the CSV statements, e.g. amount=Betrag.")
+	fs.StringVar(&c.CSVDateFormat, "reconciliation-csv-date-format", c.CSVDateFormat, "Layout of the dates of the CSV statements, in the format of the Go time package.")
+	fs.StringVar(&c.CSVSeparator, "reconciliation-csv-separator", c.CSVSeparator, "Character separating the fields of the CSV statements.")
+}
+
+// AppConfig holds every setting of the application. The settings tagged `reload:"true"` can be changed without a
+// restart, see Reloader
+type AppConfig struct {
+	Server         ServerConfig         `mapstructure:"server"`
+	TLS            TLSConfig            `mapstructure:"tls"`
+	DB             DBConfig             `mapstructure:"db"`
+	Log            LogConfig            `mapstructure:"log"`
+	Auth           AuthConfig           `mapstructure:"auth"`
+	Admin          AdminConfig          `mapstructure:"admin"`
+	Tracing        TracingConfig        `mapstructure:"tracing"`
+	RateLimit      RateLimitConfig      `mapstructure:"rate_limit"`
+	Features       FeatureConfig        `mapstructure:"features"`
+	Imports        ImportConfig         `mapstructure:"imports"`
+	BACS           BACSConfig           `mapstructure:"bacs"`
+	Reconciliation ReconciliationConfig `mapstructure:"reconciliation"`
+}
+
+// DefaultAppConfig returns the settings used when they are not configured
+func DefaultAppConfig() AppConfig {
+	return AppConfig{
+		Server: ServerConfig{
+			Port:              8080,
+			ReadTimeout:       30 * time.Second,
+			ReadHeaderTimeout: 10 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   5 * time.Second,
+		},
+		DB: DBConfig{
+			Driver:          "postgres",
+			Host:            "127.0.0.1",
+			Port:            5432,
+			User:            "postgres",
+			DBName:          "postgres",
+			Sslmode:         "disable",
+			Timeout:         5,
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+		},
+		TLS:       TLSConfig{MinVersion: "1.2", ClientAuth: "none"},
+		Log:       LogConfig{Format: "logfmt", Level: "info"},
+		Auth:      AuthConfig{OrganisationClaim: "org_id"},
+		Admin:     AdminConfig{DrainDelay: 3 * time.Second},
+		RateLimit: RateLimitConfig{Limits: "GET=50:100,POST=5:20,PUT=5:20,DELETE=5:20", By: "organisation"},
+		Features:  FeatureConfig{Approvals: true, RateLimiting: true, Metrics: true},
+		Imports:   ImportConfig{Workers: 4, MaxFileSizeMB: 50},
+		Reconciliation: ReconciliationConfig{
+			AmountTolerance:   "0",
+			DateToleranceDays: 2,
+			CSVDateFormat:     "2006-01-02",
+			CSVSeparator:      ",",
+		},
+	}
+}
+
+// RegisterFlags defines the flags of every setting on fs, the current settings are the defaults
+func (c *AppConfig) RegisterFlags(fs *flag.FlagSet) {
+	c.Server.RegisterFlags(fs)
+	c.TLS.RegisterFlags(fs)
+	c.DB.RegisterFlags(fs)
+	c.Log.RegisterFlags(fs)
+	c.Auth.RegisterFlags(fs)
+	c.Admin.RegisterFlags(fs)
+	c.Tracing.RegisterFlags(fs)
+	c.RateLimit.RegisterFlags(fs)
+	c.Features.RegisterFlags(fs)
+	c.Imports.RegisterFlags(fs)
+	c.BACS.RegisterFlags(fs)
+	c.Reconciliation.RegisterFlags(fs)
+}
+
+// Load reads the settings of the application from, by increasing priority: the defaults, the legacy postgresql TOML
+// file given with -file, the TOML, YAML or JSON file given with -config (DefaultConfigFile if it exists), the
+// PAYMENTSAPI_* environment variables and the command line flags. The flags of every setting, -config and -file are
+// defined on fs, which may already hold other flags, and args are parsed with it. The configuration is not validated
+func Load(fs *flag.FlagSet, args []string) (AppConfig, error) {
+	c := DefaultAppConfig()
+	// the files need to be read before the flags are parsed, as the flags override them
+	configFile, legacyFile := ConfigFile(args), fileArg(args, "file")
+	if legacyFile != "" {
+		db, err := GetDbConfig(legacyFile)
+		if err != nil {
+			return c, errors.New("err: could not read " + legacyFile + ": " + err.Error())
+		}
+		c.DB.Driver, c.DB.Host, c.DB.Port, c.DB.User, c.DB.Password = db.Driver, db.Host, db.Port, db.User, db.Password
+		c.DB.DBName, c.DB.Sslmode, c.DB.Timeout = db.DBName, db.Sslmode, db.Timeout
+	}
+
+	v := viper.New()
+	setDefaults(v, "", reflect.ValueOf(c))
+	if configFile != "" {
+		ext := strings.TrimPrefix(filepath.Ext(configFile), ".")
+		if ext == "yml" {
+			ext = "yaml"
+		}
+		if ext != "toml" && ext != "yaml" && ext != "json" {
+			return c, errors.New("err: unexpected extension of " + configFile + ", the configuration must be a .toml, .yaml or .json file")
+		}
+		f, err := os.Open(configFile)
+		if err != nil {
+			return c, errors.New("err: could not read " + configFile + ": " + err.Error())
+		}
+		defer f.Close()
+		v.SetConfigType(ext)
+		if err := v.ReadConfig(f); err != nil {
+			return c, errors.New("err: could not parse " + configFile + ": " + err.Error())
+		}
+	}
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	for _, key := range v.AllKeys() {
+		secretFile := os.Getenv(envName(key) + "_FILE")
+		if secretFile == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return c, errors.New("err: could not read " + envName(key) + "_FILE: " + err.Error())
+		}
+		v.Set(key, strings.TrimSpace(string(b)))
+	}
+	if err := v.UnmarshalExact(&c); err != nil {
+		return c, errors.New("err: invalid configuration: " + err.Error())
+	}
+
+	c.RegisterFlags(fs)
+	fs.String("config", DefaultConfigFile, "Path of the TOML, YAML or JSON configuration file, overridden by the PAYMENTSAPI_* environment variables and the flags.")
+	fs.String("file", "", "Deprecated: path of a postgresql TOML file holding only the database settings.")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// ConfigFile returns the configuration file Load reads with args, an empty string if there is none
+func ConfigFile(args []string) string {
+	configFile := fileArg(args, "config")
+	if _, err := os.Stat(DefaultConfigFile); configFile == "" && err == nil {
+		configFile = DefaultConfigFile
+	}
+	return configFile
+}
+
+// fileArg returns the value of the -name or --name flag of args
+func fileArg(args []string, name string) string {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		a = strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(a, name+"=") {
+			return strings.TrimPrefix(a, name+"=")
+		}
+	}
+	return ""
+}
+
+// envName returns the environment variable overriding the key
+func envName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// setDefaults makes v aware of every setting of the struct val, so that they can all be overridden by the environment
+func setDefaults(v *viper.Viper, prefix string, val reflect.Value) {
+	t := val.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := prefix + t.Field(i).Tag.Get("mapstructure")
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			setDefaults(v, key+".", val.Field(i))
+			continue
+		}
+		v.SetDefault(key, val.Field(i).Interface())
+	}
+}
+
+// Validate checks every setting and returns an error listing all the invalid ones
+func (c AppConfig) Validate() error {
+	var problems []string
+	check := func(ok bool, key, msg string) {
+		if !ok {
+			problems = append(problems, key+": "+msg)
+		}
+	}
+	validPort := func(p int) bool { return p > 0 && p < 65536 }
+
+	check(validPort(c.Server.Port), "server.port", "must be between 1 and 65535")
+	for key, d := range map[string]time.Duration{
+		"server.read_timeout":        c.Server.ReadTimeout,
+		"server.read_header_timeout": c.Server.ReadHeaderTimeout,
+		"server.write_timeout":       c.Server.WriteTimeout,
+		"server.idle_timeout":        c.Server.IdleTimeout,
+		"server.shutdown_timeout":    c.Server.ShutdownTimeout,
+		"db.conn_max_lifetime":       c.DB.ConnMaxLifetime,
+		"admin.drain_delay":          c.Admin.DrainDelay,
+	} {
+		check(d >= 0, key, "cannot be negative")
+	}
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls", "cert_file and key_file must be set together")
+	check(oneOf(c.TLS.MinVersion, "1.2", "1.3"), "tls.min_version", "must be 1.2 or 1.3")
+	check(oneOf(c.TLS.ClientAuth, "none", "optional", "require"), "tls.client_auth", "must be none, optional or require")
+	if c.TLS.ClientAuth == "optional" || c.TLS.ClientAuth == "require" {
+		check(c.TLS.CertFile != "", "tls.client_auth", "needs tls.cert_file")
+		check(c.TLS.ClientCAFile != "", "tls.client_ca_file", "is required to verify the client certificates")
+		check(c.Auth.ClientCertsFile != "", "auth.client_certs_file", "is required to map the client certificates to organisations")
+	}
+	for key, file := range map[string]string{
+		"tls.cert_file":          c.TLS.CertFile,
+		"tls.key_file":           c.TLS.KeyFile,
+		"tls.client_ca_file":     c.TLS.ClientCAFile,
+		"auth.jwks_file":         c.Auth.JWKSFile,
+		"auth.client_certs_file": c.Auth.ClientCertsFile,
+	} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, key, "cannot be read: "+fmt.Sprint(err))
+		}
+	}
+
+	check(c.DB.Driver != "", "db.driver", "is required")
+	check(c.DB.Host != "", "db.host", "is required")
+	check(validPort(c.DB.Port), "db.port", "must be between 1 and 65535")
+	check(c.DB.DBName != "", "db.dbname", "is required")
+	check(c.DB.User != "", "db.user", "is required")
+	check(c.DB.Timeout >= 0, "db.timeout", "cannot be negative")
+	check(c.DB.MaxOpenConns >= 0, "db.max_open_conns", "cannot be negative")
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns", "cannot be negative")
+	check(c.DB.MaxOpenConns == 0 || c.DB.MaxIdleConns <= c.DB.MaxOpenConns, "db.max_idle_conns", "cannot be more than db.max_open_conns")
+
+	check(oneOf(c.Log.Format, "logfmt", "json"), "log.format", "must be logfmt or json")
+	check(oneOf(c.Log.Level, "debug", "info", "warn", "error"), "log.level", "must be debug, info, warn or error")
+	check(c.Auth.OrganisationClaim != "", "auth.organisation_claim", "is required")
+	check(c.Admin.Port == 0 || validPort(c.Admin.Port), "admin.port", "must be between 1 and 65535, or 0")
+	check(c.Admin.Port != c.Server.Port, "admin.port", "must be different from server.port")
+	check(oneOf(c.RateLimit.By, "organisation", "api_key"), "rate_limit.by", "must be organisation or api_key")
+	check(c.RateLimit.DailyPayments >= 0, "rate_limit.daily_payments", "cannot be negative")
+	check(c.Imports.Workers > 0, "imports.workers", "must be at least 1")
+	check(c.Imports.MaxFileSizeMB > 0, "imports.max_file_size_mb", "must be at least 1")
+	if sun := c.BACS.ServiceUserNumber; sun != "" {
+		check(len(sun) == 6 && strings.Trim(sun, "0123456789") == "", "bacs.service_user_number", "must have 6 digits")
+	}
+	tolerance, err := strconv.ParseFloat(c.Reconciliation.AmountTolerance, 64)
+	check(err == nil && tolerance >= 0, "reconciliation.amount_tolerance", "must be a positive decimal number")
+	check(c.Reconciliation.DateToleranceDays >= 0, "reconciliation.date_tolerance_days", "cannot be negative")
+	check(len([]rune(c.Reconciliation.CSVSeparator)) == 1, "reconciliation.csv_separator", "must be a single character")
+	check(c.Reconciliation.CSVDateFormat != "", "reconciliation.csv_date_format", "is required")
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New("err: invalid configuration:\n  " + strings.Join(problems, "\n  "))
+}
+
+func oneOf(s string, values ...string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the configuration to w in the TOML format, with the secrets masked
+func (c AppConfig) Print(w io.Writer) error {
+	val := reflect.ValueOf(c)
+	t := val.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if _, err := fmt.Fprintf(w, "[%s]\n", t.Field(i).Tag.Get("mapstructure")); err != nil {
+			return err
+		}
+		section := val.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			f := section.Type().Field(j)
+			value := tomlValue(section.Field(j))
+			if f.Tag.Get("secret") == "true" && section.Field(j).String() != "" {
+				value = strconv.Quote(maskedValue)
+			}
+			if _, err := fmt.Fprintf(w, "%s = %s\n", f.Tag.Get("mapstructure"), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tomlValue formats a setting as a TOML value, durations are written as strings like "5s"
+func tomlValue(v reflect.Value) string {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return strconv.Quote(d.String())
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	}
+	return strconv.Quote(fmt.Sprint(v.Interface()))
+}
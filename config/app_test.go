@@ -0,0 +1,131 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	// DefaultConfigFile is not read when it does not exist
+	wd, _ := os.Getwd()
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultAppConfig(), c)
+	assert.Equal(t, ":8080", c.Server.Address())
+}
+
+func TestLoadFormats(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	files := []string{
+		writeFile(t, dir, "app.toml", "[server]\nport = 9000\nread_timeout = \"1m\"\n[db]\nhost = \"db\"\n"),
+		writeFile(t, dir, "app.yaml", "server:\n  port: 9000\n  read_timeout: 1m\ndb:\n  host: db\n"),
+		writeFile(t, dir, "app.json", `{"server": {"port": 9000, "read_timeout": "1m"}, "db": {"host": "db"}}`),
+	}
+	for _, f := range files {
+		c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", f})
+		assert.NoError(t, err, f)
+		assert.Equal(t, 9000, c.Server.Port, f)
+		assert.Equal(t, time.Minute, c.Server.ReadTimeout, f)
+		assert.Equal(t, "db", c.DB.Host, f)
+		assert.Equal(t, 5432, c.DB.Port, f)
+	}
+
+	_, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", writeFile(t, dir, "app.ini", "")})
+	assert.Error(t, err)
+	_, err = Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", writeFile(t, dir, "typo.toml", "[db]\nhots = \"db\"\n")})
+	assert.Error(t, err)
+}
+
+func TestLoadOverrides(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, "app.toml", "[server]\nport = 9000\n[log]\nlevel = \"warn\"\nformat = \"json\"\n")
+	secret := writeFile(t, dir, "password", "s3cret\n")
+	os.Setenv("PAYMENTSAPI_LOG_LEVEL", "error")
+	os.Setenv("PAYMENTSAPI_SERVER_PORT", "9001")
+	os.Setenv("PAYMENTSAPI_DB_PASSWORD_FILE", secret)
+	defer os.Unsetenv("PAYMENTSAPI_LOG_LEVEL")
+	defer os.Unsetenv("PAYMENTSAPI_SERVER_PORT")
+	defer os.Unsetenv("PAYMENTSAPI_DB_PASSWORD_FILE")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	apiKey := RegisterAPIKeyFlags(fs)
+	c, err := Load(fs, []string{"--config=" + file, "-port", "9002", "-issue-api-key", "ci"})
+	assert.NoError(t, err)
+	// the flags override the environment, which overrides the file
+	assert.Equal(t, 9002, c.Server.Port)
+	assert.Equal(t, "error", c.Log.Level)
+	assert.Equal(t, "json", c.Log.Format)
+	assert.Equal(t, "s3cret", c.DB.Password)
+	assert.Equal(t, "ci", apiKey.Name)
+}
+
+func TestLoadDefaultFile(t *testing.T) {
+	// the tests run in /config, where DefaultConfigFile resolves to the sample configuration
+	c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "password", c.DB.Password)
+	assert.NoError(t, c.Validate())
+}
+
+func TestLoadLegacyDBFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, "app.toml", "[db]\nmax_open_conns = 7\n")
+	c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-file", "./postgresql.toml", "-config", file})
+	assert.NoError(t, err)
+	assert.Equal(t, "password", c.DB.Password)
+	assert.Equal(t, 7, c.DB.MaxOpenConns)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, DefaultAppConfig().Validate())
+
+	c := DefaultAppConfig()
+	c.Server.Port = 0
+	c.TLS.CertFile = "server.pem"
+	c.DB.MaxIdleConns = 50
+	c.Log.Level = "verbose"
+	c.RateLimit.By = "ip"
+	c.TLS.MinVersion = "1.1"
+	c.TLS.ClientAuth = "require"
+	c.BACS.ServiceUserNumber = "12345X"
+	c.Reconciliation.AmountTolerance = "-0.01"
+	err := c.Validate()
+	assert.Error(t, err)
+	for _, key := range []string{"server.port", "tls:", "tls.cert_file", "tls.min_version", "tls.client_ca_file", "auth.client_certs_file",
+		"db.max_idle_conns", "log.level", "rate_limit.by", "bacs.service_user_number",
+		"reconciliation.amount_tolerance"} {
+		assert.Contains(t, err.Error(), key)
+	}
+}
+
+func TestPrintMasksSecrets(t *testing.T) {
+	c := DefaultAppConfig()
+	c.DB.Password = "s3cret"
+	var b bytes.Buffer
+	assert.NoError(t, c.Print(&b))
+	assert.NotContains(t, b.String(), "s3cret")
+	assert.Contains(t, b.String(), "password = \"********\"")
+	assert.Contains(t, b.String(), "[rate_limit]\n")
+	assert.Contains(t, b.String(), "shutdown_timeout = \"5s\"")
+}
@@ -4,23 +4,141 @@ import (
 	"errors"
 	"flag"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 // DBConfig needs to be exported as it is the return type of GetDbConfig, which is also exported
 type DBConfig struct {
-	Driver   string
-	Host     string
-	Port     int
-	User     string
-	Password string
-	DBName   string
-	Sslmode  string
-	Timeout  int
+	Driver          string        `mapstructure:"driver"`
+	Host            string        `mapstructure:"host"`
+	Port            int           `mapstructure:"port"`
+	User            string        `mapstructure:"user"`
+	Password        string        `mapstructure:"password" secret:"true"`
+	DBName          string        `mapstructure:"dbname"`
+	Sslmode         string        `mapstructure:"sslmode"`
+	Timeout         int           `mapstructure:"timeout"`
+	MaxOpenConns    int           `mapstructure:"max_open_conns"`
+	MaxIdleConns    int           `mapstructure:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime"`
 }
 
-// ParseArgs needs to be exported as it is called from main.go
+// RegisterFlags defines the database flags on fs, the current settings are the defaults.
+// The password can only be set in the configuration file or the environment, so that it does not show in the process list
+func (c *DBConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Host, "db-host", c.Host, "Host of the postgres database.")
+	fs.IntVar(&c.Port, "db-port", c.Port, "Port of the postgres database.")
+	fs.StringVar(&c.DBName, "db-name", c.DBName, "Name of the postgres database.")
+	fs.StringVar(&c.User, "db-user", c.User, "User the postgres database is accessed with.")
+	fs.IntVar(&c.MaxOpenConns, "db-max-open-conns", c.MaxOpenConns, "Maximum number of open connections to the database, 0 for no limit.")
+	fs.IntVar(&c.MaxIdleConns, "db-max-idle-conns", c.MaxIdleConns, "Maximum number of idle connections kept to the database.")
+	fs.DurationVar(&c.ConnMaxLifetime, "db-conn-max-lifetime", c.ConnMaxLifetime, "Time after which connections to the database are renewed, 0 to keep them.")
+}
+
+// AuthConfig holds the settings used to verify JWT bearer tokens and client certificates, API keys need no configuration
+type AuthConfig struct {
+	JWKSFile          string `mapstructure:"jwks_file"`
+	Issuer            string `mapstructure:"issuer"`
+	Audience          string `mapstructure:"audience"`
+	OrganisationClaim string `mapstructure:"organisation_claim"`
+	ClientCertsFile   string `mapstructure:"client_certs_file"`
+}
+
+// RegisterFlags defines the authentication flags on fs, the current settings are the defaults
+func (c *AuthConfig) RegisterFlags(fs *flag.FlagSet) {
+	// Parse the path of the JWKS file holding the keys that JWT bearer tokens are signed with. JWTs are not accepted if empty
+	fs.StringVar(&c.JWKSFile, "jwks", c.JWKSFile, "Path of the JWKS file used to verify JWT bearer tokens (JWTs are not accepted if empty).")
+	fs.StringVar(&c.Issuer, "jwt-issuer", c.Issuer, "Expected issuer (iss) of JWT bearer tokens, not checked if empty.")
+	fs.StringVar(&c.Audience, "jwt-audience", c.Audience, "Expected audience (aud) of JWT bearer tokens, not checked if empty.")
+	fs.StringVar(&c.OrganisationClaim, "jwt-org-claim", c.OrganisationClaim, "JWT claim holding the organisation ID of the caller.")
+	fs.StringVar(&c.ClientCertsFile, "client-certs", c.ClientCertsFile, "Path of the JSON file mapping the common names of the client certificates to organisations and roles.")
+}
+
+// APIKeyConfig holds the settings of an API key to issue from the command line
+type APIKeyConfig struct {
+	Name           string
+	OrganisationID string
+	Scopes         string
+	Roles          string
+	TTL            time.Duration
+}
+
+// RegisterAPIKeyFlags defines the flags used to issue an API key on fs.
+// The returned APIKeyConfig is filled in when the flags are parsed
+func RegisterAPIKeyFlags(fs *flag.FlagSet) *APIKeyConfig {
+	c := &APIKeyConfig{}
+	// Parse the name of an API key to issue. If defined, the key is issued, printed and the program exits
+	fs.StringVar(&c.Name, "issue-api-key", "", "Name of an API key to issue. The key is printed and the program exits.")
+	fs.StringVar(&c.OrganisationID, "api-key-org", "", "Organisation ID the issued API key belongs to.")
+	fs.StringVar(&c.Scopes, "api-key-scopes", "payments:read payments:write", "Space separated scopes granted to the issued API key.")
+	fs.StringVar(&c.Roles, "api-key-roles", "creator", "Space separated roles given to the issued API key: viewer, creator, approver, operations or admin.")
+	fs.DurationVar(&c.TTL, "api-key-ttl", 0, "Validity of the issued API key, 0 for a key that never expires.")
+	return c
+}
+
+// AdminConfig holds the settings of the admin and health endpoints
+type AdminConfig struct {
+	Port       int           `mapstructure:"port"`
+	DrainDelay time.Duration `mapstructure:"drain_delay"`
+}
+
+// RegisterFlags defines the flags of the admin and health endpoints on fs, the current settings are the defaults
+func (c *AdminConfig) RegisterFlags(fs *flag.FlagSet) {
+	// Parse the port of the admin server exposing /metrics. If none is defined /metrics is served on the application port
+	fs.IntVar(&c.Port, "admin-port", c.Port, "Port of the admin server exposing /metrics and /status, 0 to serve them on the application port.")
+	// Parse the time /readyz fails for before the server is shut down, so that load balancers stop sending requests first
+	fs.DurationVar(&c.DrainDelay, "drain-delay", c.DrainDelay, "Time /readyz reports the service as unavailable for before the HTTP server is shut down.")
+}
+
+// TracingConfig holds the settings of the exporters of trace spans
+type TracingConfig struct {
+	OTLPEndpoint string `mapstructure:"otlp_endpoint"`
+	File         string `mapstructure:"file"`
+}
+
+// RegisterFlags defines the tracing flags on fs, the current settings are the defaults
+func (c *TracingConfig) RegisterFlags(fs *flag.FlagSet) {
+	// Parse the URL of the OTLP/HTTP collector spans are exported to. Spans are not exported over OTLP if empty
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "URL of the OTLP/HTTP collector trace spans are exported to, e.g. http://localhost:4318/v1/traces.")
+	fs.StringVar(&c.File, "trace-file", c.File, "File trace spans are written to as JSON lines, \"stdout\" for the standard output.")
+}
+
+// LogConfig holds the settings of the logger
+type LogConfig struct {
+	Format string `mapstructure:"format"`
+	Level  string `mapstructure:"level" reload:"true"`
+	Redact string `mapstructure:"redact"`
+}
+
+// RegisterFlags defines the logging flags on fs, the current settings are the defaults
+func (c *LogConfig) RegisterFlags(fs *flag.FlagSet) {
+	// Parse the format of the log lines. If none is defined the default is logfmt
+	fs.StringVar(&c.Format, "log-format", c.Format, "Format of the log lines: logfmt or json.")
+	fs.StringVar(&c.Level, "log-level", c.Level, "Minimum level of the logged lines: debug, info, warn or error.")
+	fs.StringVar(&c.Redact, "log-redact", c.Redact, "Comma separated JSON names of payment fields masked in the logs, on top of names, addresses and account numbers.")
+}
+
+// RateLimitConfig holds the settings of the rate limits and of the daily quotas of every organisation
+type RateLimitConfig struct {
+	Limits        string `mapstructure:"limits" reload:"true"`
+	By            string `mapstructure:"by" reload:"true"`
+	DailyPayments int    `mapstructure:"daily_payments" reload:"true"`
+	DailyAmount   string `mapstructure:"daily_amount" reload:"true"`
+}
+
+// RegisterFlags defines the rate limiting and quota flags on fs, the current settings are the defaults
+func (c *RateLimitConfig) RegisterFlags(fs *flag.FlagSet) {
+	// Parse the rate limits of the routes. Payments are written less often than they are read, so writes are limited more
+	fs.StringVar(&c.Limits, "rate-limits", c.Limits, "Comma separated \"[METHOD] [ROUTE]=RATE:BURST\" rate limits in requests per second, the most specific one applies. Empty to disable rate limiting.")
+	fs.StringVar(&c.By, "rate-limit-by", c.By, "Key the requests are rate limited by: organisation or api_key.")
+	fs.IntVar(&c.DailyPayments, "quota-daily-payments", c.DailyPayments, "Number of payments every organisation can create per UTC day, 0 for no limit.")
+	fs.StringVar(&c.DailyAmount, "quota-daily-amount", c.DailyAmount, "Total amount of the payments every organisation can create per UTC day in every currency, or by currency as GBP=5000000,EUR=6000000, no limit if empty.")
+}
+
+// ParseArgs parses the path of a postgresql TOML file and the port of the server from the command line.
+//
+// Deprecated: use Load, which reads every setting of the application
 func ParseArgs() (string, int) {
 	var fileName string
 	// Parse the postrgres configuration file name and path. if not deifned the default is "postgresql.cfg" from /cmd
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is the time the changes of a watched file are gathered for before it is reloaded, editors often
+// write a file in several steps
+const watchDebounce = 200 * time.Millisecond
+
+// Reloader holds the current configuration and reloads it on demand. Only the settings tagged `reload:"true"` are
+// applied by a reload, the changes of the other settings are reported as requiring a restart
+type Reloader struct {
+	// reloading serialises the reloads, mu guards the fields
+	reloading sync.Mutex
+	mu        sync.Mutex
+	current   AppConfig
+	load      func() (AppConfig, error)
+	listeners []func(AppConfig)
+}
+
+// ReloadResult describes the settings changed by a reload
+type ReloadResult struct {
+	// Applied are the keys of the reloadable settings that changed, e.g. "log.level"
+	Applied []string
+	// RestartRequired are the keys of the settings that changed but are only applied when the service restarts
+	RestartRequired []string
+}
+
+// NewReloader returns a Reloader starting from the current configuration and reloading it with load
+func NewReloader(current AppConfig, load func() (AppConfig, error)) *Reloader {
+	return &Reloader{
+		current: current,
+		load:    load,
+	}
+}
+
+// Current returns the configuration in force
+func (r *Reloader) Current() AppConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// OnReload registers a function called with the new configuration after every reload that changed a reloadable
+// setting. The functions are called one reload at a time
+func (r *Reloader) OnReload(fn func(AppConfig)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, fn)
+}
+
+// Reload loads the configuration again and applies its reloadable settings. Nothing is applied when the new
+// configuration cannot be loaded or is not valid
+func (r *Reloader) Reload() (ReloadResult, error) {
+	r.reloading.Lock()
+	defer r.reloading.Unlock()
+	next, err := r.load()
+	if err == nil {
+		err = next.Validate()
+	}
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	res := ReloadResult{}
+	applied := r.Current()
+	mergeReloadable("", reflect.ValueOf(&applied).Elem(), reflect.ValueOf(next), &res)
+	if len(res.Applied) == 0 {
+		return res, nil
+	}
+	r.mu.Lock()
+	r.current = applied
+	listeners := r.listeners
+	r.mu.Unlock()
+	for _, fn := range listeners {
+		fn(applied)
+	}
+	return res, nil
+}
+
+// mergeReloadable copies the reloadable settings of next to current, and records the keys of the changed settings
+func mergeReloadable(prefix string, current, next reflect.Value, res *ReloadResult) {
+	t := current.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("mapstructure")
+		if f.Type.Kind() == reflect.Struct {
+			mergeReloadable(key+".", current.Field(i), next.Field(i), res)
+			continue
+		}
+		if reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+		if f.Tag.Get("reload") != "true" {
+			res.RestartRequired = append(res.RestartRequired, key)
+			continue
+		}
+		current.Field(i).Set(next.Field(i))
+		res.Applied = append(res.Applied, key)
+	}
+}
+
+// WatchFile calls onChange when the file is written, created or replaced. The directory of the file is watched, so
+// that the file is still followed when an editor replaces it. The returned function stops watching the file
+func WatchFile(file string, onChange func()) (func(), error) {
+	if file == "" {
+		return nil, errors.New("err: no file to watch")
+	}
+	file = filepath.Clean(file)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != file || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(watchDebounce, onChange)
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			case <-done:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			watcher.Close()
+		})
+	}, nil
+}
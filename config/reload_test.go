@@ -0,0 +1,79 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	current := DefaultAppConfig()
+	next := current
+	var loadErr error
+	r := NewReloader(current, func() (AppConfig, error) { return next, loadErr })
+	var reloaded []AppConfig
+	r.OnReload(func(c AppConfig) { reloaded = append(reloaded, c) })
+
+	next.Log.Level = "debug"
+	next.Features.Approvals = !current.Features.Approvals
+	next.Server.Port = current.Server.Port + 1
+	res, err := r.Reload()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"log.level", "features.approvals"}, res.Applied)
+	assert.Equal(t, []string{"server.port"}, res.RestartRequired)
+	assert.Equal(t, "debug", r.Current().Log.Level)
+	// the settings needing a restart are left as they were
+	assert.Equal(t, current.Server.Port, r.Current().Server.Port)
+	assert.Len(t, reloaded, 1)
+
+	// nothing is applied from a configuration that is not valid or cannot be loaded
+	next.Log.Level = "verbose"
+	_, err = r.Reload()
+	assert.Error(t, err)
+	next.Log.Level = "warn"
+	loadErr = errors.New("err: unreadable")
+	_, err = r.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "debug", r.Current().Log.Level)
+
+	// the listeners are not called when no reloadable setting changed
+	loadErr = nil
+	next.Log.Level = "debug"
+	res, err = r.Reload()
+	assert.NoError(t, err)
+	assert.Empty(t, res.Applied)
+	assert.Len(t, reloaded, 1)
+}
+
+func TestWatchFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	file := writeFile(t, dir, "paymentsapi.toml", "[log]\nlevel = \"info\"\n")
+	writeFile(t, dir, "other.toml", "")
+
+	changed := make(chan struct{}, 10)
+	stop, err := WatchFile(file, func() { changed <- struct{}{} })
+	assert.NoError(t, err)
+	defer stop()
+
+	writeFile(t, dir, "other.toml", "[log]\n")
+	writeFile(t, dir, "paymentsapi.toml", "[log]\nlevel = \"debug\"\n")
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change of the file was not noticed")
+	}
+	// the writes are gathered, the other files are ignored
+	select {
+	case <-changed:
+		t.Fatal("the change was noticed twice")
+	case <-time.After(2 * watchDebounce):
+	}
+
+	_, err = WatchFile("", func() {})
+	assert.Error(t, err)
+}
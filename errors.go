@@ -0,0 +1,113 @@
+package paymentsapi
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Kinds of errors returned by the API, they are sent along with the error message so that clients can tell them apart
+const (
+	KindInvalidRequest = "invalid_request"
+	KindInvalidPayload = "invalid_payload"
+	KindInvalidID      = "invalid_id"
+	KindNotFound       = "not_found"
+	KindUnauthorised   = "unauthorised"
+	KindForbidden      = "forbidden"
+	KindConflict       = "conflict"
+	KindRateLimited    = "rate_limited"
+	KindQuotaExceeded  = "quota_exceeded"
+	KindInternal       = "internal"
+)
+
+// ErrPayloadNotValid is returned by the Validator when a payment does not pass the model validation
+var ErrPayloadNotValid = errors.New("Payload could not be validated")
+
+// ErrUnauthorised is returned when a request does not carry valid credentials
+var ErrUnauthorised = StatusError{Status: http.StatusUnauthorized, Kind: KindUnauthorised, Message: "err: missing or invalid credentials"}
+
+// ErrForbidden is returned when the authenticated caller is not allowed to perform an operation
+var ErrForbidden = StatusError{Status: http.StatusForbidden, Kind: KindForbidden, Message: "err: operation not allowed"}
+
+// ErrSelfApproval is returned when the caller tries to approve a payment they created or last updated
+var ErrSelfApproval = StatusError{Status: http.StatusForbidden, Kind: KindForbidden, Message: "err: payments cannot be approved by the user who requested them"}
+
+// errPaymentNotFound is returned instead of ErrForbidden when a caller asks for a payment of another organisation,
+// so that the existence of the payment is not disclosed
+var errPaymentNotFound = StatusError{Status: http.StatusNotFound, Kind: KindNotFound, Message: "record not found"}
+
+// checkPaymentUpdatable returns a conflict for a payment whose status is final, its changes would undo what the banks
+// reported and reverse its postings
+func checkPaymentUpdatable(status string) error {
+	switch status {
+	case PaymentStatusSettled, PaymentStatusRejected, PaymentStatusReturned, PaymentStatusCancelled:
+		return StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the payment is " + status + " and can no longer be updated"}
+	}
+	return nil
+}
+
+// StatusError is the error type returned by the endpoints. It implements go-kit's StatusCoder, Headerer and
+// json.Marshaler so that httptransport.DefaultErrorEncoder sends it as a JSON body with the right HTTP status code
+type StatusError struct {
+	Status    int    `json:"status"`
+	Kind      string `json:"kind"`
+	Message   string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+	// RetryAfter is sent in the Retry-After header when it is set
+	RetryAfter time.Duration `json:"-"`
+}
+
+// Error returns the error message
+func (e StatusError) Error() string {
+	return e.Message
+}
+
+// StatusCode returns the HTTP status code the error should be sent with
+func (e StatusError) StatusCode() int {
+	return e.Status
+}
+
+// Headers returns the headers the error should be sent with
+func (e StatusError) Headers() http.Header {
+	h := http.Header{}
+	if e.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	return h
+}
+
+// MarshalJSON encodes the error as the body of an HTTP error response
+func (e StatusError) MarshalJSON() ([]byte, error) {
+	type body StatusError
+	return json.Marshal(body(e))
+}
+
+// IsNotFound reports whether err is a StatusError describing a payment that could not be found
+func IsNotFound(err error) bool {
+	e, ok := err.(StatusError)
+	return ok && e.Kind == KindNotFound
+}
+
+// newStatusError builds a StatusError carrying msg, with the status code and kind derived from the original error
+func newStatusError(msg string, err error) StatusError {
+	switch e := err.(type) {
+	case StatusError:
+		return StatusError{Status: e.Status, Kind: e.Kind, Message: msg, RetryAfter: e.RetryAfter}
+	}
+	switch {
+	case err == ErrPayloadNotValid:
+		return StatusError{Status: http.StatusBadRequest, Kind: KindInvalidPayload, Message: msg}
+	// every error returned when parsing a UUID starts with "uuid:"
+	case strings.HasPrefix(err.Error(), "uuid:"):
+		return StatusError{Status: http.StatusBadRequest, Kind: KindInvalidID, Message: msg}
+	case gorm.IsRecordNotFoundError(err):
+		return StatusError{Status: http.StatusNotFound, Kind: KindNotFound, Message: msg}
+	}
+	return StatusError{Status: http.StatusInternalServerError, Kind: KindInternal, Message: msg}
+}
@@ -0,0 +1,44 @@
+package paymentsapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStatusError(t *testing.T) {
+	_, uuidErr := uuid.FromString("1")
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantKind   string
+	}{
+		{"invalid payload", ErrPayloadNotValid, http.StatusBadRequest, KindInvalidPayload},
+		{"invalid id", uuidErr, http.StatusBadRequest, KindInvalidID},
+		{"not found", gorm.ErrRecordNotFound, http.StatusNotFound, KindNotFound},
+		{"already classified", StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest}, http.StatusBadRequest, KindInvalidRequest},
+		{"anything else", errors.New("connection refused"), http.StatusInternalServerError, KindInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newStatusError("err: test", tt.err)
+			assert.Equal(t, "err: test", e.Error())
+			assert.Equal(t, tt.wantStatus, e.StatusCode())
+			assert.Equal(t, tt.wantKind, e.Kind)
+		})
+	}
+}
+
+func TestStatusErrorMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(StatusError{Status: http.StatusNotFound, Kind: KindNotFound, Message: "record not found"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"status":404,"kind":"not_found","error":"record not found"}`, string(b))
+	assert.True(t, IsNotFound(StatusError{Kind: KindNotFound}))
+	assert.False(t, IsNotFound(errors.New("record not found")))
+}
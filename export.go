@@ -0,0 +1,118 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// PaymentExporter renders payments in the format of a file
+type PaymentExporter struct {
+	ContentType string
+	// Extension is the extension of the exported files
+	Extension string
+	Export    func(payments []Payment) ([]byte, error)
+	// Select picks the payments the format is meant for, when it is set the others are left out of the files
+	Select func(p Payment) bool
+}
+
+// paymentExporters are the formats the payments can be exported in, with the format query parameter of
+// GET /v1/payments and GET /v1/payments/{id}
+var paymentExporters = map[string]PaymentExporter{
+	FormatPain001: {ContentType: "application/xml", Extension: "xml", Export: exportPain001},
+	FormatPacs008: {ContentType: "application/xml", Extension: "xml", Export: exportPacs008},
+	FormatMT103:   {ContentType: "text/plain", Extension: "fin", Export: exportMT103},
+	FormatSEPA:    {ContentType: "application/xml", Extension: "xml", Export: exportSEPA, Select: isSEPAPayment},
+}
+
+// RegisterPaymentExporter adds a format the payments can be exported in, it is meant to be called before the
+// requests are served
+func RegisterPaymentExporter(format string, e PaymentExporter) {
+	paymentExporters[format] = e
+}
+
+// ExportPaymentsRequest is the request type used to export payments
+type ExportPaymentsRequest struct {
+	Format string
+	// PaymentID is the payment exported on its own
+	PaymentID string
+	// PaymentIDs restricts the export of the payments of the caller's organisation to some of them
+	PaymentIDs []string
+	// ProcessingDate restricts the export to the payments processed on that day
+	ProcessingDate string
+}
+
+// ExportResponse is a file of exported payments
+type ExportResponse struct {
+	ContentType string
+	FileName    string
+	Data        []byte
+}
+
+// exportPayments renders the payments of the request with the exporter of its format
+func exportPayments(ctx context.Context, svc PaymentService, req ExportPaymentsRequest) (ExportResponse, error) {
+	exporter, ok := paymentExporters[req.Format]
+	if !ok {
+		return ExportResponse{}, StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: "err: unknown export format " + req.Format}
+	}
+	var payments []Payment
+	name := "payments"
+	if req.PaymentID != "" {
+		p, err := svc.GetPayment(ctx, req.PaymentID)
+		if err != nil {
+			return ExportResponse{}, err
+		}
+		payments, name = []Payment{p}, "payment-"+req.PaymentID
+	} else {
+		all, err := svc.GetListPayments(ctx)
+		if err != nil {
+			return ExportResponse{}, err
+		}
+		payments = selectPayments(all, req.PaymentIDs)
+	}
+	selected := []Payment{}
+	for _, p := range payments {
+		if (req.ProcessingDate == "" || p.Attributes.ProcessingDate.String() == req.ProcessingDate) && (exporter.Select == nil || exporter.Select(p)) {
+			selected = append(selected, p)
+		}
+	}
+	data, err := exporter.Export(selected)
+	if err != nil {
+		return ExportResponse{}, err
+	}
+	return ExportResponse{ContentType: exporter.ContentType, FileName: name + "." + exporter.Extension, Data: data}, nil
+}
+
+// selectPayments returns the payments with the IDs in their order, or all of them when there is no ID
+func selectPayments(payments []Payment, ids []string) []Payment {
+	if len(ids) == 0 {
+		return payments
+	}
+	byID := map[string]Payment{}
+	for _, p := range payments {
+		byID[p.ID.String()] = p
+	}
+	selected := []Payment{}
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			selected = append(selected, p)
+		}
+	}
+	return selected
+}
+
+// MakeExportPaymentsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints exporting payments in a file format
+func MakeExportPaymentsEndpoint(svc PaymentService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ExportPaymentsRequest)
+		v, err := exportPayments(ctx, svc, req)
+		if err != nil {
+			var ErrAcc = errors.New("err: Could not export payments")
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
+			return nil, cErr
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,102 @@
+package paymentsapi
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Switch turns an optional feature on and off while the service runs
+type Switch struct {
+	on int32
+}
+
+// NewSwitch returns a Switch turned on or off
+func NewSwitch(on bool) *Switch {
+	sw := &Switch{}
+	sw.Set(on)
+	return sw
+}
+
+// Enabled reports whether the feature is turned on
+func (sw *Switch) Enabled() bool {
+	return atomic.LoadInt32(&sw.on) == 1
+}
+
+// Set turns the feature on or off
+func (sw *Switch) Set(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&sw.on, v)
+}
+
+// The feature switch middleware sends every call to the service with the feature or to the service without it
+
+// featureSwitch is the type of the wrapper around the core service and any other functionality layers
+type featureSwitch struct {
+	sw  *Switch
+	on  PaymentService
+	off PaymentService
+}
+
+// NewFeatureSwitch returns a new instance of PaymentService that calls on while the switch is turned on and off
+// otherwise. on is usually a functionality layer wrapping off
+func NewFeatureSwitch(sw *Switch, on, off PaymentService) PaymentService {
+	return &featureSwitch{
+		sw:  sw,
+		on:  on,
+		off: off,
+	}
+}
+
+func (mw *featureSwitch) next() PaymentService {
+	if mw.sw.Enabled() {
+		return mw.on
+	}
+	return mw.off
+}
+
+// GetPayment function is implemented for the feature switch layer
+func (mw *featureSwitch) GetPayment(ctx context.Context, id string) (Payment, error) {
+	return mw.next().GetPayment(ctx, id)
+}
+
+// GetListPayments function is implemented for the feature switch layer
+func (mw *featureSwitch) GetListPayments(ctx context.Context) ([]Payment, error) {
+	return mw.next().GetListPayments(ctx)
+}
+
+// CreatePayment function is implemented for the feature switch layer
+func (mw *featureSwitch) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
+	return mw.next().CreatePayment(ctx, p)
+}
+
+// UpdatePayment function is implemented for the feature switch layer
+func (mw *featureSwitch) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	return mw.next().UpdatePayment(ctx, req)
+}
+
+// DeletePayment function is implemented for the feature switch layer
+func (mw *featureSwitch) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	return mw.next().DeletePayment(ctx, id)
+}
+
+// NewHandlerSwitch returns an HTTP handler that serves the requests with on while the switch is turned on and with
+// off otherwise, a nil off answers 404
+func NewHandlerSwitch(sw *Switch, on, off http.Handler) http.Handler {
+	if off == nil {
+		off = http.NotFoundHandler()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sw.Enabled() {
+			on.ServeHTTP(w, r)
+			return
+		}
+		off.ServeHTTP(w, r)
+	})
+}
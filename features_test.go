@@ -0,0 +1,40 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFeatureSwitch(t *testing.T) {
+	on, off := &MockPaymentService{}, &MockPaymentService{}
+	on.On("GetListPayments", mock.Anything).Return([]Payment{}, errors.New("on"))
+	off.On("GetListPayments", mock.Anything).Return([]Payment{}, errors.New("off"))
+	sw := NewSwitch(true)
+	s := NewFeatureSwitch(sw, on, off)
+
+	_, err := s.GetListPayments(context.Background())
+	assert.EqualError(t, err, "on")
+	sw.Set(false)
+	assert.False(t, sw.Enabled())
+	_, err = s.GetListPayments(context.Background())
+	assert.EqualError(t, err, "off")
+}
+
+func TestHandlerSwitch(t *testing.T) {
+	sw := NewSwitch(false)
+	h := NewHandlerSwitch(sw, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	sw.Set(true)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,241 @@
+package paymentsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Statuses reported by the health endpoints
+const (
+	HealthStatusOK          = "ok"
+	HealthStatusUnavailable = "unavailable"
+)
+
+// healthCheckTimeout is the time allowed to every readiness check
+const healthCheckTimeout = 2 * time.Second
+
+// BuildInfo describes the running binary, it is set at build time with -ldflags "-X main.version=..."
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// HealthCheck checks a dependency the service needs to handle requests
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of a HealthCheck
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Health serves the liveness, readiness and status endpoints of the service
+type Health struct {
+	info         BuildInfo
+	started      time.Time
+	checks       []HealthCheck
+	db           *gorm.DB
+	shuttingDown int32
+}
+
+// NewHealth returns the health endpoints of a service built with info. The readiness checks are run in order, the
+// connection pool statistics of db are shown by the status endpoint when db is not nil
+func NewHealth(info BuildInfo, db *gorm.DB, checks ...HealthCheck) *Health {
+	if info.GoVersion == "" {
+		info.GoVersion = runtime.Version()
+	}
+	return &Health{
+		info:    info,
+		started: time.Now(),
+		checks:  checks,
+		db:      db,
+	}
+}
+
+// SetShuttingDown makes the service report that it is not ready anymore, so that load balancers stop sending it
+// requests before the HTTP server is shut down
+func (h *Health) SetShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+// ShuttingDown reports whether the graceful shutdown of the service has started
+func (h *Health) ShuttingDown() bool {
+	return atomic.LoadInt32(&h.shuttingDown) == 1
+}
+
+// Check runs the readiness checks and reports whether they all passed
+func (h *Health) Check(ctx context.Context) ([]CheckResult, bool) {
+	ready := !h.ShuttingDown()
+	results := []CheckResult{{Name: "shutdown", Status: HealthStatusOK}}
+	if !ready {
+		results[0] = CheckResult{Name: "shutdown", Status: HealthStatusUnavailable, Error: "the service is shutting down"}
+	}
+	for _, c := range h.checks {
+		cctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := c.Check(cctx)
+		cancel()
+		r := CheckResult{Name: c.Name, Status: HealthStatusOK}
+		if err != nil {
+			r.Status, r.Error = HealthStatusUnavailable, err.Error()
+			ready = false
+		}
+		results = append(results, r)
+	}
+	return results, ready
+}
+
+// LivenessHandler answers 200 as long as the process can serve HTTP requests, it does not check the dependencies
+// so that an outage of the database does not get the service restarted
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, map[string]string{"status": HealthStatusOK})
+	})
+}
+
+// ReadinessHandler answers 200 when every readiness check passes and 503 otherwise, along with the result of the checks
+func (h *Health) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, ready := h.Check(r.Context())
+		status, code := HealthStatusOK, http.StatusOK
+		if !ready {
+			status, code = HealthStatusUnavailable, http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, map[string]interface{}{"status": status, "checks": results})
+	})
+}
+
+// PoolStats are the statistics of the database connection pool shown by the status endpoint
+type PoolStats struct {
+	OpenConnections int    `json:"open_connections"`
+	InUse           int    `json:"in_use"`
+	Idle            int    `json:"idle"`
+	WaitCount       int64  `json:"wait_count"`
+	WaitDuration    string `json:"wait_duration"`
+}
+
+// Status is the body of the status endpoint
+type Status struct {
+	Status    string        `json:"status"`
+	Build     BuildInfo     `json:"build"`
+	StartedAt time.Time     `json:"started_at"`
+	Uptime    string        `json:"uptime"`
+	Checks    []CheckResult `json:"checks"`
+	DBPool    *PoolStats    `json:"db_pool,omitempty"`
+}
+
+// StatusHandler shows the build, the uptime, the readiness checks and the connection pool statistics of the service.
+// It answers 503 like the readiness endpoint when the service is not ready
+func (h *Health) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, ready := h.Check(r.Context())
+		s := Status{
+			Status:    HealthStatusOK,
+			Build:     h.info,
+			StartedAt: h.started.UTC(),
+			Uptime:    time.Since(h.started).Round(time.Second).String(),
+			Checks:    results,
+		}
+		code := http.StatusOK
+		if !ready {
+			s.Status, code = HealthStatusUnavailable, http.StatusServiceUnavailable
+		}
+		if h.db != nil {
+			stats := h.db.DB().Stats()
+			s.DBPool = &PoolStats{
+				OpenConnections: stats.OpenConnections,
+				InUse:           stats.InUse,
+				Idle:            stats.Idle,
+				WaitCount:       stats.WaitCount,
+				WaitDuration:    stats.WaitDuration.String(),
+			}
+		}
+		writeHealth(w, code, s)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// DBPingCheck checks that the database can be reached
+func DBPingCheck(db *gorm.DB) HealthCheck {
+	return HealthCheck{
+		Name: "database",
+		Check: func(ctx context.Context) error {
+			return db.DB().PingContext(ctx)
+		},
+	}
+}
+
+// schemaCheckQuery lists the tables of the current schema among the tables given as $1
+const schemaCheckQuery = "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ANY($1)"
+
+// errSchemaNotUpToDate is reported by the schema check, the tables that are missing are logged instead since the
+// readiness endpoints are not authenticated
+var errSchemaNotUpToDate = errors.New("err: the database schema is not up to date")
+
+// DBSchemaCheck checks that the tables of every model migrated by MigrateDB exist, with a single query
+func DBSchemaCheck(db *gorm.DB, logger log.Logger) HealthCheck {
+	var tables []string
+	for _, m := range models() {
+		tables = append(tables, db.NewScope(m).TableName())
+	}
+	return HealthCheck{
+		Name: "schema",
+		Check: func(ctx context.Context) error {
+			found, err := existingTables(ctx, db, tables)
+			if err != nil {
+				logger.Log("msg", "could not check the database schema", "err", err)
+				return errSchemaNotUpToDate
+			}
+			var missing []string
+			for _, t := range tables {
+				if !found[t] {
+					missing = append(missing, t)
+				}
+			}
+			if len(missing) > 0 {
+				logger.Log("msg", "tables are missing from the database schema", "tables", strings.Join(missing, " "))
+				return errSchemaNotUpToDate
+			}
+			return nil
+		},
+	}
+}
+
+// existingTables returns which of the tables exist in the current schema
+func existingTables(ctx context.Context, db *gorm.DB, tables []string) (map[string]bool, error) {
+	rows, err := db.DB().QueryContext(ctx, schemaCheckQuery, pq.Array(tables))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		found[name] = true
+	}
+	return found, rows.Err()
+}
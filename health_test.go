@@ -0,0 +1,92 @@
+package paymentsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mocket "github.com/Selvatico/go-mocket"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveness(t *testing.T) {
+	h := NewHealth(BuildInfo{}, nil, HealthCheck{Name: "database", Check: func(context.Context) error { return errors.New("down") }})
+	rec := httptest.NewRecorder()
+	h.LivenessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+}
+
+func TestReadiness(t *testing.T) {
+	var dbErr error
+	h := NewHealth(BuildInfo{}, nil, HealthCheck{Name: "database", Check: func(context.Context) error { return dbErr }})
+	ready := func() (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		h.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		body := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body
+	}
+
+	code, body := ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthStatusOK, body["status"])
+
+	dbErr = errors.New("connection refused")
+	code, body = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HealthStatusUnavailable, body["status"])
+	assert.Contains(t, body["checks"], map[string]interface{}{"name": "database", "status": HealthStatusUnavailable, "error": "connection refused"})
+
+	dbErr = nil
+	h.SetShuttingDown()
+	code, _ = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, h.ShuttingDown())
+}
+
+func TestStatus(t *testing.T) {
+	db := setupTests()
+	h := NewHealth(BuildInfo{Version: "1.2.0", Commit: "abc123"}, db, DBPingCheck(db))
+	rec := httptest.NewRecorder()
+	h.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	s := Status{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &s))
+	assert.Equal(t, "1.2.0", s.Build.Version)
+	assert.Equal(t, "abc123", s.Build.Commit)
+	assert.NotEmpty(t, s.Build.GoVersion)
+	assert.NotEmpty(t, s.Uptime)
+	assert.NotNil(t, s.DBPool)
+	assert.Equal(t, []CheckResult{{Name: "shutdown", Status: HealthStatusOK}, {Name: "database", Status: HealthStatusOK}}, s.Checks)
+}
+
+func TestDBSchemaCheck(t *testing.T) {
+	db := setupTests()
+	var logged []interface{}
+	check := DBSchemaCheck(db, log.LoggerFunc(func(keyvals ...interface{}) error {
+		logged = append(logged, keyvals...)
+		return nil
+	}))
+	var tables []map[string]interface{}
+	for _, m := range models() {
+		if name := db.NewScope(m).TableName(); name != "payment_returns" {
+			tables = append(tables, map[string]interface{}{"table_name": name})
+		}
+	}
+
+	mocket.Catcher.Reset().NewMock().WithQuery("information_schema.tables").WithReply(tables)
+	err := check.Check(context.Background())
+	assert.Equal(t, errSchemaNotUpToDate, err)
+	// the missing tables are logged, not shown by the readiness endpoints
+	assert.Contains(t, logged, "payment_returns")
+	assert.NotContains(t, err.Error(), "payment_returns")
+
+	tables = append(tables, map[string]interface{}{"table_name": "payment_returns"})
+	mocket.Catcher.Reset().NewMock().WithQuery("information_schema.tables").WithReply(tables)
+	assert.NoError(t, check.Check(context.Background()))
+}
@@ -0,0 +1,211 @@
+package paymentsapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Formats of the files that can be imported
+const (
+	// ImportFormatJSONL files hold a payment in the JSON format of the API on every line
+	ImportFormatJSONL = "jsonl"
+	// ImportFormatCSV files have a header naming the JSON field of every column, nested fields are separated by dots
+	// and the charges are numbered, e.g. attributes.amount or attributes.charges_information.sender_charges.0.amount
+	ImportFormatCSV = "csv"
+)
+
+// maxImportLineBytes is the longest line of a JSONL file
+const maxImportLineBytes = 1 << 20
+
+// ImportRow is a payment read from an imported file
+type ImportRow struct {
+	// Line is the line of the file the row starts at
+	Line    int
+	Payment Payment
+	// Err is set when the row could not be read
+	Err error
+}
+
+// ImportParser reads every row of an imported file. It returns an error when the file cannot be read at all, the
+// rows that cannot be read are returned with their error
+type ImportParser func(data []byte) ([]ImportRow, error)
+
+// importParsers are the parsers of every format that can be imported
+var importParsers = map[string]ImportParser{
+	ImportFormatJSONL: parseJSONLImport,
+	ImportFormatCSV:   parseCSVImport,
+	FormatPain001:     parsePain001Import,
+	FormatMT103:       parseMT103Import,
+}
+
+// parseJSONLImport reads a payment from every line that is not blank
+func parseJSONLImport(data []byte) ([]ImportRow, error) {
+	var rows []ImportRow
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineBytes)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		row := ImportRow{Line: line}
+		if err := json.Unmarshal(text, &row.Payment); err != nil {
+			row.Err = errors.New("err: Could not read the payment: " + err.Error())
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("err: Could not read the file: " + err.Error())
+	}
+	return rows, nil
+}
+
+// parseCSVImport reads a payment from every record following the header
+func parseCSVImport(data []byte) ([]ImportRow, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.New("err: Could not read the CSV header: " + err.Error())
+	}
+	columns := make([][]string, len(header))
+	for i, h := range header {
+		columns[i] = strings.Split(strings.TrimSpace(h), ".")
+		if _, err := paymentField(reflect.ValueOf(&Payment{}).Elem(), columns[i]); err != nil {
+			return nil, errors.New("err: Could not read the CSV header: unknown column " + h)
+		}
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		row := ImportRow{}
+		if pe, ok := err.(*csv.ParseError); ok {
+			row.Line, row.Err = pe.StartLine, errors.New("err: Could not read the record: "+pe.Err.Error())
+		} else if err != nil {
+			return nil, errors.New("err: Could not read the file: " + err.Error())
+		} else {
+			row.Line, _ = r.FieldPos(0)
+			row.Err = csvPayment(&row.Payment, columns, record)
+			if len(record) != len(header) {
+				row.Err = errors.New("err: the record has " + strconv.Itoa(len(record)) + " fields instead of " + strconv.Itoa(len(header)))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// csvPayment sets the fields of p named by the columns to the values of the record, empty values are skipped
+func csvPayment(p *Payment, columns [][]string, record []string) error {
+	var errs []string
+	for i, value := range record {
+		if value == "" {
+			continue
+		}
+		f, err := paymentField(reflect.ValueOf(p).Elem(), columns[i])
+		if err == nil {
+			err = setFieldValue(f, value)
+		}
+		if err != nil {
+			errs = append(errs, strings.Join(columns[i], ".")+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("err: Could not read the record: " + strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+var uuidType = reflect.TypeOf(uuid.UUID{})
+
+// paymentField returns the field of v named by the path of JSON names, the slices are grown to the index in the path
+func paymentField(v reflect.Value, path []string) (reflect.Value, error) {
+	if len(path) == 0 {
+		switch v.Kind() {
+		case reflect.String, reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+			return v, nil
+		}
+		if v.Type() == uuidType {
+			return v, nil
+		}
+		return v, errors.New("not a value")
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if f, ok := jsonField(v, path[0]); ok {
+			return paymentField(f, path[1:])
+		}
+	case reflect.Slice:
+		// a payment has a handful of charges at most
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= 100 {
+			return v, errors.New("invalid index " + path[0])
+		}
+		for v.Len() <= i {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		}
+		return paymentField(v.Index(i), path[1:])
+	}
+	return v, errors.New("unknown field " + path[0])
+}
+
+// jsonField returns the field of the struct v encoded with the JSON name, the embedded structs are searched too
+func jsonField(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			if found, ok := jsonField(v.Field(i), name); ok {
+				return found, true
+			}
+			continue
+		}
+		if tag == name && tag != "-" {
+			return v.Field(i), true
+		}
+	}
+	return v, false
+}
+
+// setFieldValue sets a field returned by paymentField
+func setFieldValue(v reflect.Value, s string) error {
+	if v.Type() == uuidType {
+		id, err := uuid.FromString(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(id))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return errors.New("not a positive integer")
+		}
+		v.SetUint(n)
+	}
+	return nil
+}
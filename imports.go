@@ -0,0 +1,403 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// States of an import job
+const (
+	ImportQueued    = "queued"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+	ImportCancelled = "cancelled"
+)
+
+// errImportNotFound is returned when an import job does not exist or belongs to another organisation
+var errImportNotFound = StatusError{Status: http.StatusNotFound, Kind: KindNotFound, Message: "err: import not found"}
+
+// errImportLost is returned by SaveImportProgress when the job was cancelled or taken over by another instance
+var errImportLost = errors.New("err: the import is not run by this instance anymore")
+
+// ImportJob tracks the import of a file of payments. The payments are created on behalf of the principal who uploaded
+// the file, one row after the other, and the progress is saved along with every row so that an interrupted job
+// resumes after the last row it created
+type ImportJob struct {
+	ModelBase
+	ID             uuid.UUID  `json:"id" gorm:"type:uuid; primary_key"`
+	OrganisationID uuid.UUID  `json:"organisation_id" gorm:"type:uuid; index"`
+	Format         string     `json:"format"`
+	FileName       string     `json:"file_name"`
+	State          string     `json:"state" gorm:"index"`
+	TotalRows      int        `json:"total_rows"`
+	ProcessedRows  int        `json:"processed_rows"`
+	CreatedRows    int        `json:"created_rows"`
+	FailedRows     int        `json:"failed_rows"`
+	Progress       float64    `json:"progress" gorm:"-"`
+	Error          string     `json:"error,omitempty"`
+	RequestID      string     `json:"request_id"`
+	CreatedBy      string     `json:"created_by"`
+	Scopes         string     `json:"-"`
+	Roles          string     `json:"-"`
+	AuthMethod     string     `json:"-"`
+	SubmittedAt    time.Time  `json:"submitted_at"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	// Owner is the instance running the job until LeaseUntil, another instance can take the job over afterwards
+	Owner      string     `json:"-"`
+	LeaseUntil *time.Time `json:"-"`
+}
+
+// principal returns the principal the payments of the job are created for
+func (j ImportJob) principal() Principal {
+	return Principal{
+		Subject:        j.CreatedBy,
+		OrganisationID: j.OrganisationID,
+		Scopes:         strings.Fields(j.Scopes),
+		Roles:          strings.Fields(j.Roles),
+		Method:         j.AuthMethod,
+	}
+}
+
+// finished reports whether the job will not process any more row
+func (j ImportJob) finished() bool {
+	return j.State == ImportCompleted || j.State == ImportFailed || j.State == ImportCancelled
+}
+
+// ImportFile holds the uploaded file of an import job, it is kept apart so that the jobs can be read without it
+type ImportFile struct {
+	ModelBase
+	JobID uuid.UUID `gorm:"type:uuid; primary_key"`
+	Data  []byte
+}
+
+// ImportRowError records a row of an imported file that could not be created
+type ImportRowError struct {
+	ModelBase
+	ID     uint      `json:"-" gorm:"primary_key"`
+	JobID  uuid.UUID `json:"-" gorm:"type:uuid; index"`
+	Row    int       `json:"row"`
+	Line   int       `json:"line"`
+	Kind   string    `json:"kind"`
+	Errors string    `json:"errors"`
+}
+
+// ImportStore persists the import jobs
+type ImportStore interface {
+	CreateImport(job *ImportJob, data []byte) error
+	FindImport(id uuid.UUID) (ImportJob, error)
+	FindImportFile(id uuid.UUID) ([]byte, error)
+	// UnfinishedImports lists the jobs that are queued or running
+	UnfinishedImports() ([]ImportJob, error)
+	// ClaimImport makes owner run the job until the lease expires, it fails when another owner holds a lease on the
+	// job or the job is finished
+	ClaimImport(id uuid.UUID, owner string, until time.Time) (ImportJob, bool, error)
+	// SaveImportProgress saves the counters of the job and extends the lease of its owner, it returns
+	// errImportLost when the owner does not run the job anymore
+	SaveImportProgress(ctx context.Context, job *ImportJob) error
+	// FinishImport saves the final state of a job run by its owner
+	FinishImport(job *ImportJob) error
+	// CancelImport cancels a job that is not finished
+	CancelImport(id uuid.UUID) (bool, error)
+	AddImportRowError(ctx context.Context, e *ImportRowError) error
+	ListImportRowErrors(id uuid.UUID) ([]ImportRowError, error)
+	Transactor
+}
+
+type importStore struct {
+	txStore
+}
+
+// NewImportStore returns an ImportStore backed by the database
+func NewImportStore(db *gorm.DB) ImportStore {
+	return &importStore{
+		txStore{db: db},
+	}
+}
+
+// CreateImport stores the job and its file together
+func (s *importStore) CreateImport(job *ImportJob, data []byte) error {
+	tx := s.db.Begin()
+	if err := tx.Create(job).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(&ImportFile{JobID: job.ID, Data: data}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// FindImport retrieves a job based on its ID
+func (s *importStore) FindImport(id uuid.UUID) (ImportJob, error) {
+	j := ImportJob{}
+	err := s.db.Where("id = ?", id).First(&j).Error
+	return j, err
+}
+
+// FindImportFile retrieves the file of a job
+func (s *importStore) FindImportFile(id uuid.UUID) ([]byte, error) {
+	f := ImportFile{}
+	err := s.db.Where("job_id = ?", id).First(&f).Error
+	return f.Data, err
+}
+
+// UnfinishedImports lists the queued and running jobs, oldest first
+func (s *importStore) UnfinishedImports() ([]ImportJob, error) {
+	var jobs []ImportJob
+	err := s.db.Where("state IN (?)", []string{ImportQueued, ImportRunning}).Order("submitted_at").Find(&jobs).Error
+	return jobs, err
+}
+
+// ClaimImport updates the owner of the job only if its lease expired, so that a single instance runs it
+func (s *importStore) ClaimImport(id uuid.UUID, owner string, until time.Time) (ImportJob, bool, error) {
+	now := time.Now().UTC()
+	res := s.db.Model(&ImportJob{}).
+		Where("id = ? AND state IN (?) AND (lease_until IS NULL OR lease_until < ?)", id, []string{ImportQueued, ImportRunning}, now).
+		Updates(map[string]interface{}{"state": ImportRunning, "owner": owner, "lease_until": until, "started_at": gorm.Expr("COALESCE(started_at, ?)", now)})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return ImportJob{}, false, res.Error
+	}
+	j, err := s.FindImport(id)
+	return j, err == nil, err
+}
+
+// SaveImportProgress updates the counters of a job still run by its owner, in the transaction of ctx if there is one
+func (s *importStore) SaveImportProgress(ctx context.Context, job *ImportJob) error {
+	res := withContext(s.db, ctx).Model(&ImportJob{}).Where("id = ? AND owner = ? AND state = ?", job.ID, job.Owner, ImportRunning).
+		Updates(map[string]interface{}{"processed_rows": job.ProcessedRows, "created_rows": job.CreatedRows,
+			"failed_rows": job.FailedRows, "lease_until": job.LeaseUntil})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errImportLost
+	}
+	return nil
+}
+
+// FinishImport saves the state, the error and the end time of a job still run by its owner
+func (s *importStore) FinishImport(job *ImportJob) error {
+	res := s.db.Model(&ImportJob{}).Where("id = ? AND owner = ? AND state = ?", job.ID, job.Owner, ImportRunning).
+		Updates(map[string]interface{}{"state": job.State, "error": job.Error, "finished_at": job.FinishedAt, "lease_until": nil})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errImportLost
+	}
+	return nil
+}
+
+// CancelImport marks the job as cancelled, the instance running it stops before its next row
+func (s *importStore) CancelImport(id uuid.UUID) (bool, error) {
+	res := s.db.Model(&ImportJob{}).Where("id = ? AND state IN (?)", id, []string{ImportQueued, ImportRunning}).
+		Updates(map[string]interface{}{"state": ImportCancelled, "finished_at": time.Now().UTC()})
+	return res.RowsAffected == 1, res.Error
+}
+
+// AddImportRowError stores the error of a row, in the transaction of ctx if there is one
+func (s *importStore) AddImportRowError(ctx context.Context, e *ImportRowError) error {
+	return withContext(s.db, ctx).Create(e).Error
+}
+
+// ListImportRowErrors retrieves the errors of the rows of a job in the order of the file
+func (s *importStore) ListImportRowErrors(id uuid.UUID) ([]ImportRowError, error) {
+	var errs []ImportRowError
+	err := s.db.Where("job_id = ?", id).Order("row").Find(&errs).Error
+	return errs, err
+}
+
+// CreateImportRequest is the request type used to upload a file of payments
+type CreateImportRequest struct {
+	Format   string
+	FileName string
+	Data     []byte
+}
+
+// ImportService runs the imports of files of payments in the background
+type ImportService interface {
+	CreateImport(ctx context.Context, req CreateImportRequest) (ImportJob, error)
+	GetImport(ctx context.Context, id uuid.UUID) (ImportJob, error)
+	CancelImport(ctx context.Context, id uuid.UUID) (ImportJob, error)
+	GetImportErrors(ctx context.Context, id uuid.UUID) ([]ImportRowError, error)
+}
+
+type importService struct {
+	store    ImportStore
+	importer *Importer
+	now      func() time.Time
+}
+
+// NewImportService returns an ImportService queuing the uploaded files on the importer
+func NewImportService(store ImportStore, importer *Importer) ImportService {
+	return &importService{
+		store:    store,
+		importer: importer,
+		now:      time.Now,
+	}
+}
+
+// withProgress sets the share of the rows of the job that were processed
+func withProgress(j ImportJob) ImportJob {
+	j.Progress = 0
+	if j.TotalRows > 0 {
+		j.Progress = float64(j.ProcessedRows) / float64(j.TotalRows)
+	}
+	return j
+}
+
+// CreateImport checks that the file can be read and queues its import
+func (s *importService) CreateImport(ctx context.Context, req CreateImportRequest) (ImportJob, error) {
+	p, err := checkPermission(ctx, PermissionWritePayments)
+	if err != nil {
+		return ImportJob{}, err
+	}
+	parse, ok := importParsers[req.Format]
+	if !ok {
+		return ImportJob{}, StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: "err: unknown import format " + req.Format}
+	}
+	rows, err := parse(req.Data)
+	if err == nil && len(rows) == 0 {
+		err = errors.New("err: the file has no payment")
+	}
+	if err != nil {
+		return ImportJob{}, StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: err.Error()}
+	}
+	id, _ := uuid.NewV4()
+	job := ImportJob{
+		ID:             id,
+		OrganisationID: p.OrganisationID,
+		Format:         req.Format,
+		FileName:       req.FileName,
+		State:          ImportQueued,
+		TotalRows:      len(rows),
+		RequestID:      RequestIDFromContext(ctx),
+		CreatedBy:      p.Subject,
+		Scopes:         strings.Join(p.Scopes, " "),
+		Roles:          strings.Join(p.Roles, " "),
+		AuthMethod:     p.Method,
+		SubmittedAt:    s.now().UTC(),
+	}
+	if err := s.store.CreateImport(&job, req.Data); err != nil {
+		return ImportJob{}, err
+	}
+	s.importer.Enqueue(job.ID)
+	return withProgress(job), nil
+}
+
+// job returns the job if it belongs to the caller's organisation
+func (s *importService) job(ctx context.Context, permission string, id uuid.UUID) (ImportJob, error) {
+	p, err := checkPermission(ctx, permission)
+	if err != nil {
+		return ImportJob{}, err
+	}
+	j, err := s.store.FindImport(id)
+	if gorm.IsRecordNotFoundError(err) || (err == nil && j.OrganisationID != p.OrganisationID) {
+		return ImportJob{}, errImportNotFound
+	}
+	return j, err
+}
+
+// GetImport returns the job along with its progress
+func (s *importService) GetImport(ctx context.Context, id uuid.UUID) (ImportJob, error) {
+	j, err := s.job(ctx, PermissionReadPayments, id)
+	if err != nil {
+		return ImportJob{}, err
+	}
+	return withProgress(j), nil
+}
+
+// CancelImport stops a job that is not finished, the payments already created are kept
+func (s *importService) CancelImport(ctx context.Context, id uuid.UUID) (ImportJob, error) {
+	j, err := s.job(ctx, PermissionWritePayments, id)
+	if err != nil {
+		return ImportJob{}, err
+	}
+	cancelled, err := s.store.CancelImport(id)
+	if err != nil {
+		return ImportJob{}, err
+	}
+	if !cancelled {
+		return ImportJob{}, StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the import is already " + j.State}
+	}
+	return s.GetImport(ctx, id)
+}
+
+// GetImportErrors returns the errors of the rows of the job
+func (s *importService) GetImportErrors(ctx context.Context, id uuid.UUID) ([]ImportRowError, error) {
+	if _, err := s.job(ctx, PermissionReadPayments, id); err != nil {
+		return nil, err
+	}
+	return s.store.ListImportRowErrors(id)
+}
+
+// GetImportRequest is the request type used to retrieve, cancel or get the errors of an import job
+type GetImportRequest struct {
+	ImportID uuid.UUID
+}
+
+// MakeCreateImportEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the CreateImport method
+func MakeCreateImportEndpoint(svc ImportService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreateImportRequest)
+		v, err := svc.CreateImport(ctx, req)
+		if err != nil {
+			var ErrAcc = errors.New("err: Could not create the import")
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
+			return nil, cErr
+		}
+		return v, nil
+	}
+}
+
+// MakeGetImportEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the GetImport method
+func MakeGetImportEndpoint(svc ImportService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetImportRequest)
+		v, err := svc.GetImport(ctx, req.ImportID)
+		if err != nil {
+			var ErrAcc = errors.New("err: Could not GET import")
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
+			return nil, cErr
+		}
+		return v, nil
+	}
+}
+
+// MakeCancelImportEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the CancelImport method
+func MakeCancelImportEndpoint(svc ImportService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetImportRequest)
+		v, err := svc.CancelImport(ctx, req.ImportID)
+		if err != nil {
+			var ErrAcc = errors.New("err: Could not cancel import")
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
+			return nil, cErr
+		}
+		return v, nil
+	}
+}
+
+// MakeGetImportErrorsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the GetImportErrors method
+func MakeGetImportErrorsEndpoint(svc ImportService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetImportRequest)
+		v, err := svc.GetImportErrors(ctx, req.ImportID)
+		if err != nil {
+			var ErrAcc = errors.New("err: Could not GET import errors")
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
+			return nil, cErr
+		}
+		return v, nil
+	}
+}
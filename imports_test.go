@@ -0,0 +1,348 @@
+package paymentsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type memoryImportStore struct {
+	mu     sync.Mutex
+	jobs   map[uuid.UUID]ImportJob
+	files  map[uuid.UUID][]byte
+	errors []ImportRowError
+}
+
+func newMemoryImportStore() *memoryImportStore {
+	return &memoryImportStore{jobs: map[uuid.UUID]ImportJob{}, files: map[uuid.UUID][]byte{}}
+}
+
+func (m *memoryImportStore) CreateImport(job *ImportJob, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.ID], m.files[job.ID] = *job, data
+	return nil
+}
+
+func (m *memoryImportStore) FindImport(id uuid.UUID) (ImportJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return j, gorm.ErrRecordNotFound
+	}
+	return j, nil
+}
+
+func (m *memoryImportStore) FindImportFile(id uuid.UUID) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files[id], nil
+}
+
+func (m *memoryImportStore) UnfinishedImports() ([]ImportJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var jobs []ImportJob
+	for _, j := range m.jobs {
+		if !j.finished() {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
+func (m *memoryImportStore) ClaimImport(id uuid.UUID, owner string, until time.Time) (ImportJob, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.jobs[id]
+	if j.finished() || (j.LeaseUntil != nil && j.LeaseUntil.After(time.Now())) {
+		return ImportJob{}, false, nil
+	}
+	j.State, j.Owner, j.LeaseUntil = ImportRunning, owner, &until
+	m.jobs[id] = j
+	return j, true, nil
+}
+
+func (m *memoryImportStore) SaveImportProgress(ctx context.Context, job *ImportJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.jobs[job.ID]
+	if j.Owner != job.Owner || j.State != ImportRunning {
+		return errImportLost
+	}
+	j.ProcessedRows, j.CreatedRows, j.FailedRows, j.LeaseUntil = job.ProcessedRows, job.CreatedRows, job.FailedRows, job.LeaseUntil
+	m.jobs[job.ID] = j
+	return nil
+}
+
+func (m *memoryImportStore) FinishImport(job *ImportJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.jobs[job.ID]
+	if j.Owner != job.Owner || j.State != ImportRunning {
+		return errImportLost
+	}
+	j.State, j.Error, j.FinishedAt, j.LeaseUntil = job.State, job.Error, job.FinishedAt, nil
+	m.jobs[job.ID] = j
+	return nil
+}
+
+func (m *memoryImportStore) CancelImport(id uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.jobs[id]
+	if j.finished() {
+		return false, nil
+	}
+	j.State = ImportCancelled
+	m.jobs[id] = j
+	return true, nil
+}
+
+func (m *memoryImportStore) AddImportRowError(ctx context.Context, e *ImportRowError) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors = append(m.errors, *e)
+	return nil
+}
+
+func (m *memoryImportStore) ListImportRowErrors(id uuid.UUID) ([]ImportRowError, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []ImportRowError
+	for _, e := range m.errors {
+		if e.JobID == id {
+			errs = append(errs, e)
+		}
+	}
+	return errs, nil
+}
+
+func (m *memoryImportStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// importLines returns a JSONL file of valid payments with the amounts, an empty amount gives a payment that is not valid
+func importLines(org uuid.UUID, amounts ...string) []byte {
+	var lines []string
+	for _, p := range batchPayments(amounts...) {
+		p.OrganisationID = org
+		b, _ := json.Marshal(p)
+		lines = append(lines, string(b))
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func TestParseJSONLImport(t *testing.T) {
+	rows, err := parseJSONLImport([]byte(`{"type": "Payment", "attributes": {"amount": "10"}}` + "\n\n" + `{"type": 1}` + "\n"))
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, 1, rows[0].Line)
+	assert.Equal(t, "10", rows[0].Payment.Attributes.Amount)
+	assert.NoError(t, rows[0].Err)
+	assert.Equal(t, 3, rows[1].Line)
+	assert.Error(t, rows[1].Err)
+}
+
+func TestParseCSVImport(t *testing.T) {
+	org, _ := uuid.NewV4()
+	rows, err := parseCSVImport([]byte("type,organisation_id,attributes.amount,attributes.charges_information.sender_charges.1.amount\n" +
+		"Payment," + org.String() + ",10,2.5\n" +
+		"Payment,not-an-id,11,\n" +
+		"Payment,\"x\n"))
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.NoError(t, rows[0].Err)
+	assert.Equal(t, 2, rows[0].Line)
+	assert.Equal(t, org, rows[0].Payment.OrganisationID)
+	assert.Equal(t, "10", rows[0].Payment.Attributes.Amount)
+	assert.Len(t, rows[0].Payment.Attributes.ChargesInformation.SenderCharges, 2)
+	assert.Equal(t, "2.5", rows[0].Payment.Attributes.ChargesInformation.SenderCharges[1].Amount)
+	assert.Contains(t, rows[1].Err.Error(), "organisation_id")
+	assert.Equal(t, 4, rows[2].Line)
+	assert.Error(t, rows[2].Err)
+
+	_, err = parseCSVImport([]byte("type,attributes.unknown\nPayment,1\n"))
+	assert.Error(t, err)
+}
+
+func TestImportService(t *testing.T) {
+	org, _ := uuid.NewV4()
+	store := newMemoryImportStore()
+	s := NewImportService(store, NewImporter(store, &MockPaymentService{}, 1, log.NewNopLogger()))
+	ctx := roleContext(org, "bob", RoleCreator)
+
+	_, err := s.CreateImport(roleContext(org, "eve", RoleViewer), CreateImportRequest{Format: ImportFormatJSONL, Data: importLines(org, "10")})
+	assert.Equal(t, ErrForbidden, err)
+	for _, req := range []CreateImportRequest{
+		{Format: "xml", Data: importLines(org, "10")},
+		{Format: ImportFormatJSONL},
+		{Format: ImportFormatCSV, Data: []byte("unknown\n1\n")},
+	} {
+		_, err := s.CreateImport(ctx, req)
+		assert.Equal(t, KindInvalidRequest, err.(StatusError).Kind)
+	}
+
+	job, err := s.CreateImport(ctx, CreateImportRequest{Format: ImportFormatJSONL, FileName: "june.jsonl", Data: importLines(org, "10", "11")})
+	assert.NoError(t, err)
+	assert.Equal(t, ImportQueued, job.State)
+	assert.Equal(t, 2, job.TotalRows)
+	assert.Equal(t, "bob", store.jobs[job.ID].CreatedBy)
+
+	got, err := s.GetImport(ctx, job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "june.jsonl", got.FileName)
+	// the jobs of other organisations are not found
+	otherOrg, _ := uuid.NewV4()
+	_, err = s.GetImport(roleContext(otherOrg, "alice", RoleViewer), job.ID)
+	assert.Equal(t, errImportNotFound, err)
+
+	cancelled, err := s.CancelImport(ctx, job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, ImportCancelled, cancelled.State)
+	_, err = s.CancelImport(ctx, job.ID)
+	assert.Equal(t, KindConflict, err.(StatusError).Kind)
+}
+
+// queuedImport stores a job of the file created by bob
+func queuedImport(store *memoryImportStore, org uuid.UUID, data []byte) ImportJob {
+	id, _ := uuid.NewV4()
+	job := ImportJob{ID: id, OrganisationID: org, Format: ImportFormatJSONL, State: ImportQueued, CreatedBy: "bob", Roles: RoleCreator, RequestID: "req-1"}
+	store.CreateImport(&job, data)
+	return job
+}
+
+func TestImporterRun(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService, _ := batchMockService(ErrForbidden)
+	store := newMemoryImportStore()
+	importer := NewImporter(store, mockService, 1, log.NewNopLogger())
+	job := queuedImport(store, org, append(importLines(org, "10", "", "13", "11"), []byte("\n{")...))
+
+	importer.run(job.ID)
+	job = store.jobs[job.ID]
+	assert.Equal(t, ImportCompleted, job.State)
+	assert.Equal(t, 5, job.ProcessedRows)
+	assert.Equal(t, 2, job.CreatedRows)
+	assert.Equal(t, 3, job.FailedRows)
+	assert.NotNil(t, job.FinishedAt)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 3)
+	// the payments are created on behalf of the uploader, with the ID of the upload request
+	ctx := mockService.Calls[0].Arguments.Get(0).(context.Context)
+	p, _ := PrincipalFromContext(ctx)
+	assert.Equal(t, "bob", p.Subject)
+	assert.Equal(t, "req-1", RequestIDFromContext(ctx))
+
+	errs, _ := store.ListImportRowErrors(job.ID)
+	assert.Len(t, errs, 3)
+	assert.Equal(t, ImportRowError{JobID: job.ID, Row: 2, Line: 2, Kind: KindInvalidPayload, Errors: errs[0].Errors}, errs[0])
+	assert.Contains(t, errs[0].Errors, "Payment.Type: required")
+	assert.Equal(t, KindForbidden, errs[1].Kind)
+	assert.Equal(t, 5, errs[2].Line)
+}
+
+func TestImporterResume(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService, _ := batchMockService(ErrForbidden)
+	store := newMemoryImportStore()
+	importer := NewImporter(store, mockService, 1, log.NewNopLogger())
+	job := queuedImport(store, org, importLines(org, "10", "11", "12"))
+
+	// another instance stopped after the first row and its lease expired
+	expired := time.Now().Add(-time.Second)
+	job.State, job.Owner, job.LeaseUntil, job.ProcessedRows, job.CreatedRows = ImportRunning, "gone", &expired, 1, 1
+	store.jobs[job.ID] = job
+	importer.resume()
+	assert.Len(t, importer.queue, 1)
+	importer.run(<-importer.queue)
+	assert.Equal(t, ImportCompleted, store.jobs[job.ID].State)
+	assert.Equal(t, 3, store.jobs[job.ID].CreatedRows)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 2)
+
+	// the jobs leased by a running instance are left to it
+	running := queuedImport(store, org, importLines(org, "10"))
+	lease := time.Now().Add(time.Minute)
+	running.State, running.Owner, running.LeaseUntil = ImportRunning, "other", &lease
+	store.jobs[running.ID] = running
+	importer.resume()
+	assert.Len(t, importer.queue, 0)
+}
+
+func TestImporterCancelAndFailure(t *testing.T) {
+	org, _ := uuid.NewV4()
+	store := newMemoryImportStore()
+	mockService := &MockPaymentService{}
+	importer := NewImporter(store, mockService, 1, log.NewNopLogger())
+	importer.backoff = time.Millisecond
+	job := queuedImport(store, org, importLines(org, "10", "11", "12"))
+
+	// the job is cancelled while the first payment is created
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		store.CancelImport(job.ID)
+	}).Return(CreatePaymentResponse{}, nil).Once()
+	importer.run(job.ID)
+	assert.Equal(t, ImportCancelled, store.jobs[job.ID].State)
+	assert.Equal(t, 0, store.jobs[job.ID].ProcessedRows)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 1)
+
+	// the job fails once a row failed because of the database every time it was tried
+	job = queuedImport(store, org, importLines(org, "10"))
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{}, errors.New("db down"))
+	importer.run(job.ID)
+	assert.Equal(t, ImportFailed, store.jobs[job.ID].State)
+	assert.Equal(t, "db down", store.jobs[job.ID].Error)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 1+1+importRetries)
+}
+
+func TestImportHTTP(t *testing.T) {
+	org, _ := uuid.NewV4()
+	store := newMemoryImportStore()
+	importer := NewImporter(store, &MockPaymentService{}, 1, log.NewNopLogger())
+	router := NewHTTPTransport(&MockPaymentService{})
+	RegisterImportRoutes(router, NewImportService(store, importer), 1024)
+	do := func(method, url, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req = req.WithContext(roleContext(org, "bob", RoleCreator))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("POST", "/v1/imports?filename=june.csv", "text/csv", "type,attributes.amount\nPayment,10\n")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state":"queued"`)
+	assert.Len(t, importer.queue, 1)
+	id := <-importer.queue
+
+	rec = do("GET", "/v1/imports/"+id.String(), "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"file_name":"june.csv"`)
+
+	store.AddImportRowError(context.Background(), &ImportRowError{JobID: id, Row: 1, Line: 2, Kind: KindInvalidPayload, Errors: "Payment.Version: required, Payment.ID: required"})
+	rec = do("GET", "/v1/imports/"+id.String()+"/errors", "", "")
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "row,line,kind,errors\n1,2,invalid_payload,\"Payment.Version: required, Payment.ID: required\"\n", rec.Body.String())
+
+	rec = do("DELETE", "/v1/imports/"+id.String(), "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state":"cancelled"`)
+
+	rec = do("POST", "/v1/imports?format=jsonl", "application/octet-stream", strings.Repeat(" ", 2048))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do("GET", "/v1/imports/nope", "", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
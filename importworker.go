@@ -0,0 +1,259 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Timings of the importer
+const (
+	// importLease is how long a job stays claimed by an instance that stopped saving its progress
+	importLease = time.Minute
+	// importResumeInterval is how often the unfinished jobs are looked for, to resume the jobs of the instances
+	// that stopped
+	importResumeInterval = 15 * time.Second
+	// importRetries is how many times a row failing because of the database is tried again before the job fails
+	importRetries = 3
+)
+
+// Importer runs the import jobs with a pool of workers. The jobs are claimed with a lease in the database, so that
+// several instances can share the jobs and the jobs of an instance that stopped are resumed by the others
+type Importer struct {
+	store    ImportStore
+	payments PaymentService
+	workers  int
+	owner    string
+	logger   log.Logger
+	queue    chan uuid.UUID
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[uuid.UUID]bool
+
+	now     func() time.Time
+	backoff time.Duration
+}
+
+// NewImporter returns an Importer creating the payments with payments, which should be the fully decorated
+// PaymentService so that the imported payments are authorised, held for approval and counted against the quotas
+func NewImporter(store ImportStore, payments PaymentService, workers int, logger log.Logger) *Importer {
+	if workers < 1 {
+		workers = 1
+	}
+	owner, _ := uuid.NewV4()
+	return &Importer{
+		store:    store,
+		payments: payments,
+		workers:  workers,
+		owner:    owner.String(),
+		logger:   logger,
+		queue:    make(chan uuid.UUID, 1024),
+		stop:     make(chan struct{}),
+		running:  map[uuid.UUID]bool{},
+		now:      time.Now,
+		backoff:  time.Second,
+	}
+}
+
+// Start runs the workers and resumes the unfinished jobs
+func (i *Importer) Start() {
+	for n := 0; n < i.workers; n++ {
+		i.wg.Add(1)
+		go func() {
+			defer i.wg.Done()
+			for {
+				select {
+				case <-i.stop:
+					return
+				case id := <-i.queue:
+					i.run(id)
+				}
+			}
+		}()
+	}
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		ticker := time.NewTicker(importResumeInterval)
+		defer ticker.Stop()
+		for {
+			i.resume()
+			select {
+			case <-i.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop waits for the workers to finish the row they are creating, the jobs left are resumed when their lease expires
+func (i *Importer) Stop() {
+	close(i.stop)
+	i.wg.Wait()
+}
+
+// Enqueue queues a job, the job is left to the next look for unfinished jobs when the queue is full
+func (i *Importer) Enqueue(id uuid.UUID) {
+	select {
+	case i.queue <- id:
+	default:
+	}
+}
+
+// resume queues the unfinished jobs that are not leased by a running instance
+func (i *Importer) resume() {
+	jobs, err := i.store.UnfinishedImports()
+	if err != nil {
+		i.logger.Log("msg", "could not list the unfinished imports", "err", err)
+		return
+	}
+	now := i.now().UTC()
+	for _, j := range jobs {
+		if j.LeaseUntil == nil || j.LeaseUntil.Before(now) {
+			i.Enqueue(j.ID)
+		}
+	}
+}
+
+// stopping reports whether Stop was called
+func (i *Importer) stopping() bool {
+	select {
+	case <-i.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run claims the job and creates its payments, a job queued twice is run once
+func (i *Importer) run(id uuid.UUID) {
+	i.mu.Lock()
+	if i.running[id] {
+		i.mu.Unlock()
+		return
+	}
+	i.running[id] = true
+	i.mu.Unlock()
+	defer func() {
+		i.mu.Lock()
+		delete(i.running, id)
+		i.mu.Unlock()
+	}()
+
+	job, claimed, err := i.store.ClaimImport(id, i.owner, i.now().UTC().Add(importLease))
+	if err != nil {
+		i.logger.Log("msg", "could not claim the import", "import_id", id, "err", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	logger := log.With(i.logger, "import_id", id, "request_id", job.RequestID)
+	if job.ProcessedRows > 0 {
+		logger.Log("msg", "resuming the import", "processed_rows", job.ProcessedRows)
+	}
+	if err := i.process(&job); err != nil {
+		if err == errImportLost {
+			logger.Log("msg", "the import was cancelled or taken over", "processed_rows", job.ProcessedRows)
+			return
+		}
+		if i.stopping() {
+			return
+		}
+		job.State, job.Error = ImportFailed, err.Error()
+	} else {
+		job.State = ImportCompleted
+	}
+	finished := i.now().UTC()
+	job.FinishedAt = &finished
+	if err := i.store.FinishImport(&job); err != nil {
+		logger.Log("msg", "could not finish the import", "err", err)
+		return
+	}
+	logger.Log("msg", "import "+job.State, "created_rows", job.CreatedRows, "failed_rows", job.FailedRows)
+}
+
+// process creates the payments of the rows following the last processed one. Every row is created in a transaction
+// along with its error and the progress of the job, so that a row is never created twice
+func (i *Importer) process(job *ImportJob) error {
+	data, err := i.store.FindImportFile(job.ID)
+	if err != nil {
+		return err
+	}
+	parse, ok := importParsers[job.Format]
+	if !ok {
+		return errors.New("err: unknown import format " + job.Format)
+	}
+	rows, err := parse(data)
+	if err != nil {
+		return err
+	}
+	ctx := NewContextWithRequestID(NewContextWithPrincipal(context.Background(), job.principal()), job.RequestID)
+	for job.ProcessedRows < len(rows) {
+		if i.stopping() {
+			return errImportLost
+		}
+		err := i.processRow(ctx, job, rows[job.ProcessedRows])
+		for retry := 0; err != nil && err != errImportLost && retry < importRetries && !i.stopping(); retry++ {
+			time.Sleep(i.backoff << uint(retry))
+			err = i.processRow(ctx, job, rows[job.ProcessedRows])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processRow creates the payment of a row, or records why it could not be created, and saves the progress of the job.
+// It returns an error when the row should be tried again
+func (i *Importer) processRow(ctx context.Context, job *ImportJob, row ImportRow) error {
+	next := *job
+	next.ProcessedRows++
+	lease := i.now().UTC().Add(importLease)
+	next.LeaseUntil = &lease
+	// the files that do not name the organisation, like pain.001 messages, are imported for the uploader's
+	if row.Payment.OrganisationID == uuid.Nil {
+		row.Payment.OrganisationID = job.OrganisationID
+	}
+	err := i.store.InTransaction(ctx, func(ctx context.Context) error {
+		rowErr := &ImportRowError{JobID: job.ID, Row: job.ProcessedRows + 1, Line: row.Line}
+		if row.Err != nil {
+			rowErr.Kind, rowErr.Errors = KindInvalidPayload, row.Err.Error()
+		} else if err := ValidatePayload(row.Payment); err != nil {
+			rowErr.Kind, rowErr.Errors = KindInvalidPayload, strings.Join(validationErrors(err), ", ")
+		} else {
+			p := row.Payment
+			p.Status = ""
+			if _, err := i.payments.CreatePayment(ctx, p); err != nil {
+				if retryable(err) {
+					return err
+				}
+				e := newStatusError(err.Error(), err)
+				rowErr.Kind, rowErr.Errors = e.Kind, e.Message
+			}
+		}
+		if rowErr.Kind != "" {
+			next.FailedRows++
+			if err := i.store.AddImportRowError(ctx, rowErr); err != nil {
+				return err
+			}
+		} else {
+			next.CreatedRows++
+		}
+		return i.store.SaveImportProgress(ctx, &next)
+	})
+	if err != nil {
+		return err
+	}
+	*job = next
+	return nil
+}
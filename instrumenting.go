@@ -0,0 +1,167 @@
+package paymentsapi
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vstoianovici/paymentsapi/metrics"
+)
+
+// The instrumenting middleware records request counts, errors and latencies of every operation of the service
+
+// instrumentingMiddleware is the type of the wrapper around the core service and any other functionality layers
+type instrumentingMiddleware struct {
+	requestCount   metrics.Counter
+	errorCount     metrics.Counter
+	requestLatency metrics.Histogram
+	amountCreated  metrics.Counter
+	next           PaymentService
+}
+
+// NewInstrumenting returns a new instance of PaymentService that counts the requests of each method, counts their
+// errors by kind, observes their latency in seconds and adds up the amounts of the created payments per currency and scheme
+func NewInstrumenting(requestCount, errorCount metrics.Counter, requestLatency metrics.Histogram, amountCreated metrics.Counter, next PaymentService) PaymentService {
+	return &instrumentingMiddleware{
+		requestCount:   requestCount,
+		errorCount:     errorCount,
+		requestLatency: requestLatency,
+		amountCreated:  amountCreated,
+		next:           next,
+	}
+}
+
+// NewServiceMetrics registers the metrics of the instrumenting middleware and returns a constructor wrapping a
+// PaymentService with it
+func NewServiceMetrics(r *metrics.Registry) func(next PaymentService) PaymentService {
+	requestCount := r.NewCounter("payments_requests_total", "Number of requests received by the payment service.")
+	errorCount := r.NewCounter("payments_errors_total", "Number of requests of the payment service that failed, by kind of error.")
+	requestLatency := r.NewHistogram("payments_request_duration_seconds", "Duration of the requests of the payment service.", metrics.DefBuckets)
+	amountCreated := r.NewCounter("payments_created_amount_total", "Total amount of the created payments, by currency and scheme.")
+	return func(next PaymentService) PaymentService {
+		return NewInstrumenting(requestCount, errorCount, requestLatency, amountCreated, next)
+	}
+}
+
+// observe records a request of the method that took since begin and returned err
+func (mw instrumentingMiddleware) observe(method string, begin time.Time, err error) {
+	mw.requestCount.With("method", method).Add(1)
+	mw.requestLatency.With("method", method).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		mw.errorCount.With("method", method, "kind", newStatusError("", err).Kind).Add(1)
+	}
+}
+
+// GetPayment function is implemented for the instrumenting layer
+func (mw instrumentingMiddleware) GetPayment(ctx context.Context, id string) (output Payment, err error) {
+	defer func(begin time.Time) {
+		mw.observe("getPayment", begin, err)
+	}(time.Now())
+	return mw.next.GetPayment(ctx, id)
+}
+
+// GetListPayments function is implemented for the instrumenting layer
+func (mw instrumentingMiddleware) GetListPayments(ctx context.Context) (output []Payment, err error) {
+	defer func(begin time.Time) {
+		mw.observe("getListPayments", begin, err)
+	}(time.Now())
+	return mw.next.GetListPayments(ctx)
+}
+
+// CreatePayment function is implemented for the instrumenting layer, the amount of the created payment is added up
+func (mw instrumentingMiddleware) CreatePayment(ctx context.Context, p Payment) (output CreatePaymentResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("createPayment", begin, err)
+		if err != nil {
+			return
+		}
+		if amount, err := strconv.ParseFloat(p.Attributes.Amount, 64); err == nil {
+			mw.amountCreated.With("currency", p.Attributes.Currency, "scheme", p.Attributes.PaymentScheme).Add(amount)
+		}
+	}(time.Now())
+	return mw.next.CreatePayment(ctx, p)
+}
+
+// UpdatePayment function is implemented for the instrumenting layer
+func (mw instrumentingMiddleware) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (output UpdatePaymentResponse, err error) {
+	defer func(begin time.Time) {
+		mw.observe("updatePayment", begin, err)
+	}(time.Now())
+	return mw.next.UpdatePayment(ctx, req)
+}
+
+// DeletePayment function is implemented for the instrumenting layer
+func (mw instrumentingMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (output *time.Time, err error) {
+	defer func(begin time.Time) {
+		mw.observe("deletePayment", begin, err)
+	}(time.Now())
+	return mw.next.DeletePayment(ctx, id)
+}
+
+// RegisterDBMetrics registers gauges reading the connection pool statistics of the database when the metrics are collected
+func RegisterDBMetrics(r *metrics.Registry, db *gorm.DB) {
+	stats := db.DB().Stats
+	r.NewGaugeFunc("payments_db_max_open_connections", "Maximum number of open connections to the database.", func() float64 { return float64(stats().MaxOpenConnections) })
+	r.NewGaugeFunc("payments_db_open_connections", "Number of open connections to the database.", func() float64 { return float64(stats().OpenConnections) })
+	r.NewGaugeFunc("payments_db_in_use_connections", "Number of connections to the database currently in use.", func() float64 { return float64(stats().InUse) })
+	r.NewGaugeFunc("payments_db_idle_connections", "Number of idle connections to the database.", func() float64 { return float64(stats().Idle) })
+	r.NewGaugeFunc("payments_db_wait_count", "Total number of connections waited for.", func() float64 { return float64(stats().WaitCount) })
+	r.NewGaugeFunc("payments_db_wait_duration_seconds", "Total time blocked waiting for a new connection.", func() float64 { return stats().WaitDuration.Seconds() })
+}
+
+// httpInstrumentation is the HTTP handler recording the requests served by the router
+type httpInstrumentation struct {
+	router         *mux.Router
+	requestCount   metrics.Counter
+	requestLatency metrics.Histogram
+	next           http.Handler
+}
+
+// NewHTTPInstrumentation returns an HTTP handler that counts the requests by HTTP method, route and status code and
+// observes their latency in seconds. Routes are the path templates of the router, so that payment IDs do not end up in labels
+func NewHTTPInstrumentation(next http.Handler, router *mux.Router, requestCount metrics.Counter, requestLatency metrics.Histogram) http.Handler {
+	return &httpInstrumentation{
+		router:         router,
+		requestCount:   requestCount,
+		requestLatency: requestLatency,
+		next:           next,
+	}
+}
+
+// NewHTTPMetrics registers the metrics of the HTTP instrumentation and returns the handler recording them
+func NewHTTPMetrics(r *metrics.Registry, next http.Handler, router *mux.Router) http.Handler {
+	requestCount := r.NewCounter("http_requests_total", "Number of HTTP requests, by method, route and status code.")
+	requestLatency := r.NewHistogram("http_request_duration_seconds", "Duration of the HTTP requests, by method and route.", metrics.DefBuckets)
+	return NewHTTPInstrumentation(next, router, requestCount, requestLatency)
+}
+
+func (mw *httpInstrumentation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	mw.next.ServeHTTP(rec, r)
+
+	route := "unmatched"
+	var match mux.RouteMatch
+	if mw.router.Match(r, &match) && match.Route != nil {
+		if tpl, err := match.Route.GetPathTemplate(); err == nil {
+			route = tpl
+		}
+	}
+	mw.requestCount.With("method", r.Method, "route", route, "code", strconv.Itoa(rec.status)).Add(1)
+	mw.requestLatency.With("method", r.Method, "route", route).Observe(time.Since(begin).Seconds())
+}
+
+// statusRecorder keeps the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,53 @@
+package paymentsapi
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vstoianovici/paymentsapi/metrics"
+)
+
+func TestInstrumenting(t *testing.T) {
+	id, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, "missing").Return(Payment{}, gorm.ErrRecordNotFound)
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{PaymentID: id}, nil)
+	r := metrics.NewRegistry()
+	s := NewServiceMetrics(r)(mockService)
+
+	s.GetPayment(context.Background(), "missing")
+	s.CreatePayment(context.Background(), Payment{Attributes: Attributes{Amount: "100.25", Currency: "GBP", PaymentScheme: "FPS"}})
+	s.CreatePayment(context.Background(), Payment{Attributes: Attributes{Amount: "50", Currency: "GBP", PaymentScheme: "FPS"}})
+
+	var b bytes.Buffer
+	r.WriteTo(&b)
+	assert.Contains(t, b.String(), `payments_requests_total{method="getPayment"} 1`)
+	assert.Contains(t, b.String(), `payments_requests_total{method="createPayment"} 2`)
+	assert.Contains(t, b.String(), `payments_errors_total{kind="not_found",method="getPayment"} 1`)
+	assert.Contains(t, b.String(), `payments_created_amount_total{currency="GBP",scheme="FPS"} 150.25`)
+	assert.Contains(t, b.String(), `payments_request_duration_seconds_count{method="createPayment"} 2`)
+}
+
+func TestHTTPInstrumentation(t *testing.T) {
+	id, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id}, nil)
+	router := NewHTTPTransport(mockService)
+	r := metrics.NewRegistry()
+	h := NewHTTPMetrics(r, router, router)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/payments/"+id.String(), nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/nothing", nil))
+
+	var b bytes.Buffer
+	r.WriteTo(&b)
+	assert.Contains(t, b.String(), `http_requests_total{code="200",method="GET",route="/v1/payments/{id}"} 1`)
+	assert.Contains(t, b.String(), `http_requests_total{code="404",method="GET",route="unmatched"} 1`)
+	assert.NotContains(t, b.String(), id.String())
+}
@@ -0,0 +1,488 @@
+package paymentsapi
+
+import (
+	"bytes"
+	"encoding/xml"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// The building blocks shared by the ISO 20022 messages, named after the XML elements they encode
+
+// isoDateFormat is the layout of the ISODate type
+const isoDateFormat = "2006-01-02"
+
+// isoBankIDCodeBIC is the bank_id_code of the parties identified by a BIC, the others are identified by their
+// membership of the clearing system named by the code, e.g. GBDSC for the UK sort codes
+const isoBankIDCodeBIC = "SWBIC"
+
+// isoAccountNumberCodeIBAN is the account_number_code of the accounts identified by an IBAN
+const isoAccountNumberCodeIBAN = "IBAN"
+
+// isoChargeBearers are the codes of the ChargeBearerType1Code type, the bearer codes of the payments use the same ones
+var isoChargeBearers = []string{"DEBT", "CRED", "SHAR", "SLEV"}
+
+var (
+	isoAmountPattern   = regexp.MustCompile(`^[0-9]{1,13}(\.[0-9]{1,5})?$`)
+	isoRatePattern     = regexp.MustCompile(`^[0-9]{1,11}(\.[0-9]{1,10})?$`)
+	isoCurrencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	isoIBANPattern     = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[a-zA-Z0-9]{1,30}$`)
+	isoBICPattern      = regexp.MustCompile(`^[A-Z0-9]{4}[A-Z]{2}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+	isoUUIDv4Pattern   = regexp.MustCompile(`^[a-f0-9]{8}-[a-f0-9]{4}-4[a-f0-9]{3}-[89ab][a-f0-9]{3}-[a-f0-9]{12}$`)
+)
+
+// isoCurrencyDecimals are the minor units of the ISO 4217 currencies that do not have 2 decimals
+var isoCurrencyDecimals = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0,
+	"VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencyDecimals returns the number of decimals of the amounts in the currency, 2 for most currencies
+func currencyDecimals(currency string) int {
+	if d, ok := isoCurrencyDecimals[currency]; ok {
+		return d
+	}
+	return 2
+}
+
+// isoCurrencyAmount reads a positive amount written as a decimal number with at most the decimals of the currency
+func isoCurrencyAmount(amount, currency string) (*big.Rat, bool) {
+	if !isoAmountPattern.MatchString(amount) {
+		return nil, false
+	}
+	if i := strings.IndexByte(amount, '.'); i >= 0 && len(amount)-i-1 > currencyDecimals(currency) {
+		return nil, false
+	}
+	r, ok := new(big.Rat).SetString(amount)
+	return r, ok && r.Sign() > 0
+}
+
+// isoAmount is an amount with its currency, e.g. InstdAmt
+type isoAmount struct {
+	Ccy   string `xml:"Ccy,attr"`
+	Value string `xml:",chardata"`
+}
+
+// isoCode is a choice between a code of an external list and a proprietary value
+type isoCode struct {
+	Cd    string `xml:"Cd,omitempty"`
+	Prtry string `xml:"Prtry,omitempty"`
+}
+
+// isoParty is a debtor, a creditor or the initiating party
+type isoParty struct {
+	Nm      string            `xml:"Nm,omitempty"`
+	PstlAdr *isoPostalAddress `xml:"PstlAdr,omitempty"`
+	ID      *isoPartyID       `xml:"Id,omitempty"`
+}
+
+type isoPostalAddress struct {
+	AdrLine []string `xml:"AdrLine"`
+}
+
+type isoPartyID struct {
+	OrgID isoOrganisationID `xml:"OrgId"`
+}
+
+type isoOrganisationID struct {
+	Othr []isoGenericID `xml:"Othr"`
+}
+
+// isoGenericID is an identification in a scheme, e.g. the BBAN of an account
+type isoGenericID struct {
+	ID      string   `xml:"Id"`
+	SchmeNm *isoCode `xml:"SchmeNm,omitempty"`
+}
+
+// isoAccount is a CashAccount, identified by its IBAN or by another identification
+type isoAccount struct {
+	ID isoAccountID `xml:"Id"`
+	Nm string       `xml:"Nm,omitempty"`
+}
+
+type isoAccountID struct {
+	IBAN string        `xml:"IBAN,omitempty"`
+	Othr *isoGenericID `xml:"Othr,omitempty"`
+}
+
+// isoAgent is a financial institution, identified by its BIC or by its membership of a clearing system
+type isoAgent struct {
+	FinInstnID isoFinancialInstitutionID `xml:"FinInstnId"`
+}
+
+type isoFinancialInstitutionID struct {
+	BICFI       string             `xml:"BICFI,omitempty"`
+	ClrSysMmbID *isoClearingMember `xml:"ClrSysMmbId,omitempty"`
+	Othr        *isoGenericID      `xml:"Othr,omitempty"`
+}
+
+type isoClearingMember struct {
+	ClrSysID *isoCode `xml:"ClrSysId,omitempty"`
+	MmbID    string   `xml:"MmbId"`
+}
+
+// isoExchangeRate is the exchange rate agreed for a payment
+type isoExchangeRate struct {
+	XchgRate string `xml:"XchgRate,omitempty"`
+	RateTp   string `xml:"RateTp,omitempty"`
+	CtrctID  string `xml:"CtrctId,omitempty"`
+}
+
+// isoPaymentType carries the scheme of a payment
+type isoPaymentType struct {
+	SvcLvl    []isoCode `xml:"SvcLvl,omitempty"`
+	LclInstrm *isoCode  `xml:"LclInstrm,omitempty"`
+	CtgyPurp  *isoCode  `xml:"CtgyPurp,omitempty"`
+}
+
+// isoDate is a choice between a date and a date and time, e.g. ReqdExctnDt
+type isoDate struct {
+	Dt   string `xml:"Dt,omitempty"`
+	DtTm string `xml:"DtTm,omitempty"`
+}
+
+// date returns the day of d
+func (d isoDate) date() string {
+	if d.Dt != "" {
+		return d.Dt
+	}
+	if len(d.DtTm) >= len(isoDateFormat) {
+		return d.DtTm[:len(isoDateFormat)]
+	}
+	return d.DtTm
+}
+
+// isoRemittance carries the references of a payment for the creditor
+type isoRemittance struct {
+	Ustrd []string                  `xml:"Ustrd,omitempty"`
+	Strd  []isoStructuredRemittance `xml:"Strd,omitempty"`
+}
+
+type isoStructuredRemittance struct {
+	CdtrRefInf *isoCreditorReference `xml:"CdtrRefInf,omitempty"`
+}
+
+type isoCreditorReference struct {
+	Ref string `xml:"Ref,omitempty"`
+}
+
+// isoRemittanceOf returns the references of the payment, nil when it has none: the reference is unstructured and the
+// numeric reference is the creditor's reference
+func isoRemittanceOf(a Attributes) *isoRemittance {
+	if a.Reference == "" && a.NumericReference == "" {
+		return nil
+	}
+	r := &isoRemittance{}
+	if a.Reference != "" {
+		r.Ustrd = []string{a.Reference}
+	}
+	if a.NumericReference != "" {
+		r.Strd = []isoStructuredRemittance{{CdtrRefInf: &isoCreditorReference{Ref: a.NumericReference}}}
+	}
+	return r
+}
+
+// isoPartyOf returns the party with its name and address, the address is split in lines of 70 characters
+func isoPartyOf(name, address string) isoParty {
+	party := isoParty{Nm: name}
+	if lines := wrapWords(address, 70); len(lines) > 0 {
+		party.PstlAdr = &isoPostalAddress{AdrLine: lines}
+	}
+	return party
+}
+
+// wrapWords splits a text in lines of at most width characters, between words when it can
+func wrapWords(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		for utf8.RuneCountInString(word) > width {
+			if line != "" {
+				lines, line = append(lines, line), ""
+			}
+			r := []rune(word)
+			lines, word = append(lines, string(r[:width])), string(r[width:])
+		}
+		switch {
+		case line == "":
+			line = word
+		case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) <= width:
+			line += " " + word
+		default:
+			lines, line = append(lines, line), word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// address joins the lines of the address of the party
+func (p isoParty) address() string {
+	if p.PstlAdr == nil {
+		return ""
+	}
+	return strings.Join(p.PstlAdr.AdrLine, " ")
+}
+
+// isoAccountOf returns the account identified by its IBAN, or by its number in the scheme of the code
+func isoAccountOf(number, code, name string) isoAccount {
+	account := isoAccount{Nm: name}
+	if code == isoAccountNumberCodeIBAN {
+		account.ID.IBAN = number
+		return account
+	}
+	account.ID.Othr = &isoGenericID{ID: number}
+	if code != "" {
+		account.ID.Othr.SchmeNm = &isoCode{Cd: code}
+	}
+	return account
+}
+
+// number returns the identification of the account and the code of its scheme
+func (a isoAccount) number() (string, string) {
+	if a.ID.IBAN != "" {
+		return a.ID.IBAN, isoAccountNumberCodeIBAN
+	}
+	if a.ID.Othr == nil {
+		return "", ""
+	}
+	code := ""
+	if a.ID.Othr.SchmeNm != nil {
+		code = a.ID.Othr.SchmeNm.Cd + a.ID.Othr.SchmeNm.Prtry
+	}
+	return a.ID.Othr.ID, code
+}
+
+// isoAgentOf returns the agent identified by its BIC, or by its ID in the clearing system of the code
+func isoAgentOf(bankID, bankIDCode string) isoAgent {
+	if bankIDCode == isoBankIDCodeBIC {
+		return isoAgent{FinInstnID: isoFinancialInstitutionID{BICFI: bankID}}
+	}
+	member := &isoClearingMember{MmbID: bankID}
+	if bankIDCode != "" {
+		member.ClrSysID = &isoCode{Cd: bankIDCode}
+	}
+	return isoAgent{FinInstnID: isoFinancialInstitutionID{ClrSysMmbID: member}}
+}
+
+// bank returns the ID of the agent and the code of the way it is identified
+func (a isoAgent) bank() (string, string) {
+	id := a.FinInstnID
+	if id.BICFI != "" {
+		return id.BICFI, isoBankIDCodeBIC
+	}
+	if id.ClrSysMmbID == nil {
+		return "", ""
+	}
+	code := ""
+	if id.ClrSysMmbID.ClrSysID != nil {
+		code = id.ClrSysMmbID.ClrSysID.Cd + id.ClrSysMmbID.ClrSysID.Prtry
+	}
+	return id.ClrSysMmbID.MmbID, code
+}
+
+// isoSum returns the sum of decimal amounts, as the control sums of the messages
+func isoSum(amounts ...string) string {
+	sum := new(big.Rat)
+	for _, a := range amounts {
+		if r, ok := new(big.Rat).SetString(a); ok {
+			sum.Add(sum, r)
+		}
+	}
+	return decimalString(sum)
+}
+
+// isoSameAmount reports whether two decimal amounts are equal, whatever their number of decimals
+func isoSameAmount(a, b string) bool {
+	x, okA := new(big.Rat).SetString(a)
+	y, okB := new(big.Rat).SetString(b)
+	return okA && okB && x.Cmp(y) == 0
+}
+
+// isoChecker collects the problems found when checking a message against the rules of its XSD schema
+type isoChecker struct {
+	problems []string
+}
+
+func (c *isoChecker) check(ok bool, path, msg string) {
+	if !ok {
+		c.problems = append(c.problems, path+": "+msg)
+	}
+}
+
+// text checks a MaxNText value, required values cannot be empty
+func (c *isoChecker) text(path, value string, max int, required bool) {
+	n := utf8.RuneCountInString(value)
+	if required {
+		c.check(n > 0, path, "is required")
+	}
+	c.check(n <= max, path, "is longer than "+strconv.Itoa(max)+" characters")
+}
+
+func (c *isoChecker) pattern(path, value string, re *regexp.Regexp, msg string) {
+	c.check(re.MatchString(value), path, msg)
+}
+
+func (c *isoChecker) oneOf(path, value string, values ...string) {
+	for _, v := range values {
+		if value == v {
+			return
+		}
+	}
+	c.check(false, path, "must be one of "+strings.Join(values, ", "))
+}
+
+func (c *isoChecker) amount(path string, a *isoAmount) {
+	if a == nil {
+		c.check(false, path, "is required")
+		return
+	}
+	c.pattern(path, a.Value, isoAmountPattern, "must be a positive amount with at most 5 decimals")
+	c.pattern(path+"/@Ccy", a.Ccy, isoCurrencyPattern, "must be an ISO 4217 currency code")
+}
+
+func (c *isoChecker) date(path, value string) {
+	_, err := time.Parse(isoDateFormat, value)
+	c.check(err == nil, path, "must be a date formatted as YYYY-MM-DD")
+}
+
+// dateTime checks an ISODateTime, with or without its time zone
+func (c *isoChecker) dateTime(path, value string) {
+	_, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		_, err = time.Parse("2006-01-02T15:04:05", value)
+	}
+	c.check(err == nil, path, "must be a date and time formatted as YYYY-MM-DDThh:mm:ss")
+}
+
+func (c *isoChecker) party(path string, p *isoParty) {
+	if p == nil {
+		c.check(false, path, "is required")
+		return
+	}
+	c.text(path+"/Nm", p.Nm, 140, false)
+	if p.PstlAdr != nil {
+		c.check(len(p.PstlAdr.AdrLine) <= 7, path+"/PstlAdr/AdrLine", "cannot have more than 7 lines")
+		for _, l := range p.PstlAdr.AdrLine {
+			c.text(path+"/PstlAdr/AdrLine", l, 70, true)
+		}
+	}
+}
+
+func (c *isoChecker) account(path string, a *isoAccount) {
+	if a == nil {
+		c.check(false, path, "is required")
+		return
+	}
+	switch {
+	case a.ID.IBAN != "":
+		c.pattern(path+"/Id/IBAN", a.ID.IBAN, isoIBANPattern, "is not an IBAN")
+	case a.ID.Othr != nil:
+		c.text(path+"/Id/Othr/Id", a.ID.Othr.ID, 34, true)
+	default:
+		c.check(false, path+"/Id", "needs an IBAN or another identification")
+	}
+	c.text(path+"/Nm", a.Nm, 70, false)
+}
+
+func (c *isoChecker) agent(path string, a *isoAgent) {
+	if a == nil {
+		c.check(false, path, "is required")
+		return
+	}
+	id := a.FinInstnID
+	switch {
+	case id.BICFI != "":
+		c.pattern(path+"/FinInstnId/BICFI", id.BICFI, isoBICPattern, "is not a BIC")
+	case id.ClrSysMmbID != nil:
+		c.text(path+"/FinInstnId/ClrSysMmbId/MmbId", id.ClrSysMmbID.MmbID, 35, true)
+	case id.Othr != nil:
+		c.text(path+"/FinInstnId/Othr/Id", id.Othr.ID, 35, true)
+	default:
+		c.check(false, path+"/FinInstnId", "needs a BIC or a clearing system member ID")
+	}
+}
+
+// value returns the code, or the proprietary value
+func (c *isoCode) value() string {
+	if c == nil {
+		return ""
+	}
+	if c.Cd != "" {
+		return c.Cd
+	}
+	return c.Prtry
+}
+
+// isoProprietary returns a proprietary code, nil when the value is empty
+func isoProprietary(value string) *isoCode {
+	if value == "" {
+		return nil
+	}
+	return &isoCode{Prtry: value}
+}
+
+// isoPaymentTypeOf carries the scheme of the payment: the payment scheme is the local instrument, the scheme payment
+// type the service level and the scheme payment sub type the category purpose
+func isoPaymentTypeOf(a Attributes) *isoPaymentType {
+	t := &isoPaymentType{LclInstrm: isoProprietary(a.PaymentScheme), CtgyPurp: isoProprietary(a.SchemePaymentSubType)}
+	if a.SchemePaymentType != "" {
+		t.SvcLvl = []isoCode{{Prtry: a.SchemePaymentType}}
+	}
+	if t.LclInstrm == nil && t.CtgyPurp == nil && t.SvcLvl == nil {
+		return nil
+	}
+	return t
+}
+
+// setScheme sets the scheme of the payment carried by t, see isoPaymentTypeOf
+func (t *isoPaymentType) setScheme(a *Attributes) {
+	if t == nil {
+		return
+	}
+	a.PaymentScheme, a.SchemePaymentSubType = t.LclInstrm.value(), t.CtgyPurp.value()
+	if len(t.SvcLvl) > 0 {
+		a.SchemePaymentType = t.SvcLvl[0].value()
+	}
+}
+
+// isoExchangeRateOf returns the exchange rate agreed for the payment, nil when it has none
+func isoExchangeRateOf(fx Forex) *isoExchangeRate {
+	if fx.ExchangeRate == "" && fx.ContractReference == "" {
+		return nil
+	}
+	return &isoExchangeRate{XchgRate: fx.ExchangeRate, RateTp: "AGRD", CtrctID: fx.ContractReference}
+}
+
+// isoCompactID returns the UUID without its dashes, so that it fits the Max35Text identifications
+func isoCompactID(id uuid.UUID) string {
+	return strings.Replace(id.String(), "-", "", -1)
+}
+
+// xmlElementLines returns the line every element with the local name starts at, in the order of the document
+func xmlElementLines(data []byte, local string) []int {
+	var lines []int
+	d := xml.NewDecoder(bytes.NewReader(data))
+	line, counted := 1, int64(0)
+	for {
+		offset := d.InputOffset()
+		tok, err := d.Token()
+		if err != nil {
+			return lines
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == local {
+			line += bytes.Count(data[counted:offset], []byte("\n"))
+			counted = offset
+			lines = append(lines, line)
+		}
+	}
+}
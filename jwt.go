@@ -0,0 +1,296 @@
+package paymentsapi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// DefaultOrganisationClaim is the JWT claim holding the organisation ID of the caller when none is configured
+const DefaultOrganisationClaim = "org_id"
+
+// jwk is a single JSON Web Key, only RSA and EC (P-256, P-384) public keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWTAuthenticator authenticates requests carrying an "Authorization: Bearer <JWT>" header.
+// Tokens are verified against the public keys of a locally configured JWKS file
+type JWTAuthenticator struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	orgClaim string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+// NewJWTAuthenticator loads the JWKS file and returns an Authenticator for the tokens signed with its keys.
+// issuer and audience are only checked when they are not empty
+func NewJWTAuthenticator(jwksFile, issuer, audience, orgClaim string) (*JWTAuthenticator, error) {
+	b, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return nil, err
+	}
+	if orgClaim == "" {
+		orgClaim = DefaultOrganisationClaim
+	}
+	return &JWTAuthenticator{
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
+		orgClaim: orgClaim,
+		leeway:   30 * time.Second,
+		now:      time.Now,
+	}, nil
+}
+
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, errors.New("err: Could not read JWKS: " + err.Error())
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, errors.New("err: Could not read JWKS key " + k.Kid + ": " + err.Error())
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("err: JWKS does not contain any signing key")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Authenticate implements Authenticator
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	token := bearerToken(r, "Bearer")
+	// API keys may also be sent as bearer tokens, a JWT is made of three parts
+	if token == "" || strings.Count(token, ".") != 2 {
+		return Principal{}, errNoCredentials
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	return a.principal(claims)
+}
+
+// verify checks the signature of the token and returns its claims
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	var ErrToken = errors.New("err: invalid token")
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrToken
+	}
+	key, ok := a.keys[header.Kid]
+	if !ok {
+		return nil, ErrToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrToken
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, ErrToken
+	}
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrToken
+	}
+	return claims, nil
+}
+
+// verifySignature checks the signature with the algorithm announced by the token, which must match the type of key.
+// Unsigned tokens ("none") and symmetric algorithms are rejected
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var ErrAlg = errors.New("err: unsupported signing algorithm " + alg)
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "ES384":
+		h = crypto.SHA384
+	case "RS512":
+		h = crypto.SHA512
+	default:
+		return ErrAlg
+	}
+	hasher := h.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return ErrAlg
+		}
+		return rsa.VerifyPKCS1v15(k, h, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return ErrAlg
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("err: invalid signature")
+		}
+		return nil
+	}
+	return ErrAlg
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// principal checks the registered claims of the token and builds the principal it describes
+func (a *JWTAuthenticator) principal(claims map[string]interface{}) (Principal, error) {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(a.leeway)) {
+		return Principal{}, errors.New("err: token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return Principal{}, errors.New("err: token not valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return Principal{}, errors.New("err: unexpected token issuer")
+	}
+	if a.audience != "" && !hasAudience(claims["aud"], a.audience) {
+		return Principal{}, errors.New("err: unexpected token audience")
+	}
+	org, _ := claims[a.orgClaim].(string)
+	orgID, err := uuid.FromString(org)
+	if err != nil {
+		return Principal{}, errors.New("err: token does not carry a valid " + a.orgClaim + " claim")
+	}
+	sub, _ := claims["sub"].(string)
+	return Principal{
+		Subject:        sub,
+		OrganisationID: orgID,
+		Scopes:         tokenScopes(claims),
+		Roles:          claimStrings(claims["roles"]),
+		Method:         AuthMethodJWT,
+	}, nil
+}
+
+// hasAudience checks the "aud" claim, which is either a string or an array of strings
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenScopes reads the scopes from the "scope" claim or the "scp" claim
+func tokenScopes(claims map[string]interface{}) []string {
+	if _, ok := claims["scope"]; ok {
+		return claimStrings(claims["scope"])
+	}
+	return claimStrings(claims["scp"])
+}
+
+// claimStrings reads a claim holding either a space separated string or an array of strings
+func claimStrings(claim interface{}) []string {
+	if s, ok := claim.(string); ok {
+		return strings.Fields(s)
+	}
+	var values []string
+	if a, ok := claim.([]interface{}); ok {
+		for _, v := range a {
+			if str, ok := v.(string); ok {
+				values = append(values, str)
+			}
+		}
+	}
+	return values
+}
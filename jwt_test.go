@@ -0,0 +1,148 @@
+package paymentsapi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signTestToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest.Sum(nil))
+		assert.NoError(t, err)
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		assert.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+// writeTestJWKS writes the public keys to a temporary JWKS file and returns its path
+func writeTestJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+	}}
+	b, _ := json.Marshal(jwks)
+	f, err := ioutil.TempFile("", "jwks")
+	assert.NoError(t, err)
+	f.Write(b)
+	f.Close()
+	return f.Name()
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	file := writeTestJWKS(t, rsaKey, ecKey)
+	defer os.Remove(file)
+
+	a, err := NewJWTAuthenticator(file, "https://issuer.example.com", "paymentsapi", "")
+	assert.NoError(t, err)
+	org, _ := uuid.NewV4()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":    "user-1",
+			"iss":    "https://issuer.example.com",
+			"aud":    []string{"paymentsapi", "other"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"org_id": org.String(),
+			"scope":  "payments:read payments:write",
+			"roles":  []string{"creator", "approver"},
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"RS256 token", signTestToken(t, "RS256", "rsa1", rsaKey, claims(nil)), false},
+		{"ES256 token", signTestToken(t, "ES256", "ec1", ecKey, claims(nil)), false},
+		{"signed with another key", signTestToken(t, "RS256", "rsa1", otherKey, claims(nil)), true},
+		{"unknown key", signTestToken(t, "RS256", "rsa2", rsaKey, claims(nil)), true},
+		{"algorithm not matching the key", signTestToken(t, "ES256", "rsa1", rsaKey, claims(nil)), true},
+		{"unsigned", b64([]byte(`{"alg":"none","kid":"rsa1"}`)) + "." + b64([]byte(`{}`)) + ".", true},
+		{"expired", signTestToken(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), true},
+		{"no expiry", signTestToken(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"exp": nil})), true},
+		{"not valid yet", signTestToken(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), true},
+		{"wrong issuer", signTestToken(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"iss": "someone"})), true},
+		{"wrong audience", signTestToken(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"aud": "other"})), true},
+		{"no organisation", signTestToken(t, "RS256", "rsa1", rsaKey, claims(map[string]interface{}{"org_id": nil})), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/payments", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			p, err := a.Authenticate(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.NotEqual(t, errNoCredentials, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "user-1", p.Subject)
+			assert.Equal(t, org, p.OrganisationID)
+			assert.Equal(t, AuthMethodJWT, p.Method)
+			assert.True(t, p.HasScope(ScopePaymentsWrite))
+			assert.Equal(t, []string{RoleCreator, RoleApprover}, p.Roles)
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/v1/payments", nil)
+	r.Header.Set("Authorization", "Bearer not-a-jwt")
+	_, err = a.Authenticate(r)
+	assert.Equal(t, errNoCredentials, err)
+}
+
+func TestNewJWTAuthenticatorErrors(t *testing.T) {
+	_, err := NewJWTAuthenticator("./missing-jwks.json", "", "", "")
+	assert.Error(t, err)
+	_, err = parseJWKS([]byte(`{"keys":[]}`))
+	assert.Error(t, err)
+	_, err = parseJWKS([]byte(`{"keys":[{"kty":"oct","kid":"k"}]}`))
+	assert.Error(t, err)
+	_, err = parseJWKS([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestTokenScopes(t *testing.T) {
+	assert.Equal(t, []string{"a", "b"}, tokenScopes(map[string]interface{}{"scope": "a b"}))
+	assert.Equal(t, []string{"a", "b"}, tokenScopes(map[string]interface{}{"scp": []interface{}{"a", "b"}}))
+	assert.Nil(t, tokenScopes(map[string]interface{}{}))
+}
@@ -0,0 +1,580 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Events of the life of a payment that produce ledger postings
+const (
+	LedgerEventCreated   = "created"
+	LedgerEventAmended   = "amended"
+	LedgerEventSettled   = "settled"
+	LedgerEventReturned  = "returned"
+	LedgerEventCancelled = "cancelled"
+)
+
+// Accounts of the ledger. The debtor accounts, the clearing and settlement accounts and the FX positions are suffixed
+// with the account number, the payment scheme and the currency
+const (
+	LedgerAccountDebtor        = "debtor:"
+	LedgerAccountClearing      = "clearing:"
+	LedgerAccountSettlement    = "settlement:"
+	LedgerAccountFXPosition    = "fx_position:"
+	LedgerAccountChargesIncome = "charges_income"
+)
+
+var errLedgerImmutable = errors.New("err: ledger postings cannot be changed, post a reversal instead")
+
+// LedgerPosting is a debit or a credit of an account of the ledger. The postings of an entry balance in every
+// currency, debits are positive amounts and credits negative ones
+type LedgerPosting struct {
+	ID             uint      `json:"id" gorm:"primary_key"`
+	EntryID        uuid.UUID `json:"entry_id" gorm:"type:uuid; index"`
+	OrganisationID uuid.UUID `json:"-" gorm:"type:uuid; index"`
+	PaymentID      uuid.UUID `json:"payment_id" gorm:"type:uuid; index"`
+	Event          string    `json:"event"`
+	Account        string    `json:"account" gorm:"index"`
+	Currency       string    `json:"currency"`
+	Amount         string    `json:"amount"`
+	PostedAt       time.Time `json:"posted_at"`
+	RequestID      string    `json:"request_id,omitempty"`
+}
+
+// BeforeUpdate keeps the postings from being changed, a mistake is corrected by posting its reversal
+func (p *LedgerPosting) BeforeUpdate() error {
+	return errLedgerImmutable
+}
+
+// BeforeDelete keeps the postings from being deleted
+func (p *LedgerPosting) BeforeDelete() error {
+	return errLedgerImmutable
+}
+
+// LedgerBalance is the balance of an account in a currency, the sum of its debits and credits
+type LedgerBalance struct {
+	Account  string `json:"account,omitempty"`
+	Currency string `json:"currency"`
+	Balance  string `json:"balance"`
+}
+
+// LedgerCheck is the outcome of the check of the ledger of an organisation. The ledger is balanced when the postings
+// sum to zero in every currency and every entry balances on its own
+type LedgerCheck struct {
+	Balanced          bool            `json:"balanced"`
+	Postings          int             `json:"postings"`
+	Totals            []LedgerBalance `json:"totals"`
+	UnbalancedEntries []uuid.UUID     `json:"unbalanced_entries"`
+}
+
+// ledgerKey is an account in a currency
+type ledgerKey struct {
+	account, currency string
+}
+
+// ledgerPositions sums amounts by account and currency, keeping the order the positions were first seen in
+type ledgerPositions struct {
+	keys    []ledgerKey
+	amounts map[ledgerKey]*big.Rat
+}
+
+func newLedgerPositions() *ledgerPositions {
+	return &ledgerPositions{amounts: map[ledgerKey]*big.Rat{}}
+}
+
+func (l *ledgerPositions) add(account, currency string, amount *big.Rat) {
+	k := ledgerKey{account, currency}
+	sum, ok := l.amounts[k]
+	if !ok {
+		sum = new(big.Rat)
+		l.amounts[k] = sum
+		l.keys = append(l.keys, k)
+	}
+	sum.Add(sum, amount)
+}
+
+// transfer debits an account and credits another one with the same amount
+func (l *ledgerPositions) transfer(debit, credit, currency string, amount *big.Rat) {
+	l.add(debit, currency, amount)
+	l.add(credit, currency, new(big.Rat).Neg(amount))
+}
+
+// ledgerAmount parses an amount of the payment, the positive amounts only are posted
+func ledgerAmount(field, value string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(value)
+	if !ok || r.Sign() < 0 {
+		return nil, errors.New("err: the " + field + " of the payment cannot be posted: " + value)
+	}
+	return r, nil
+}
+
+// paymentPositions returns the positions the ledger must hold for the payment in its current state:
+//   - accepted: the debtor's account is debited with the amount and the sender charges, and the clearing account of
+//     the scheme and the charges income account are credited. When the payment is converted the debtor is debited in
+//     the original currency, and the FX positions of both currencies take the exchange
+//   - settled: the clearing account is cleared against the settlement account of the scheme
+//   - returned: the debtor gets the amount back and the charges are kept
+//   - pending approval, rejected or deleted: nothing is posted, unless the deleted payment was settled or returned
+func paymentPositions(p Payment) (*ledgerPositions, error) {
+	l := newLedgerPositions()
+	status := p.Status
+	if p.DeletedAt != nil && status != PaymentStatusSettled && status != PaymentStatusReturned {
+		return l, nil
+	}
+	switch status {
+	case PaymentStatusAccepted, PaymentStatusSettled, PaymentStatusReturned:
+	default:
+		return l, nil
+	}
+	a := p.Attributes
+	debtor := LedgerAccountDebtor + a.DebtorParty.AccountNumber
+	clearing := LedgerAccountClearing + a.PaymentScheme
+	for _, c := range a.ChargesInformation.SenderCharges {
+		charge, err := ledgerAmount("sender charge", c.Amount)
+		if err != nil {
+			return nil, err
+		}
+		l.transfer(debtor, LedgerAccountChargesIncome, c.Currency, charge)
+	}
+	if status == PaymentStatusReturned {
+		return l, nil
+	}
+	amount, err := ledgerAmount("amount", a.Amount)
+	if err != nil {
+		return nil, err
+	}
+	fx := a.Forex
+	if fx.OriginalCurrency != "" && fx.OriginalCurrency != a.Currency {
+		original, err := ledgerAmount("original amount", fx.OriginalAmount)
+		if err != nil {
+			return nil, err
+		}
+		l.transfer(debtor, LedgerAccountFXPosition+fx.OriginalCurrency, fx.OriginalCurrency, original)
+		l.transfer(LedgerAccountFXPosition+a.Currency, clearing, a.Currency, amount)
+	} else {
+		l.transfer(debtor, clearing, a.Currency, amount)
+	}
+	if status == PaymentStatusSettled {
+		l.transfer(clearing, LedgerAccountSettlement+a.PaymentScheme, a.Currency, amount)
+	}
+	return l, nil
+}
+
+// ledgerEvent returns the event of a change of the status of a payment
+func ledgerEvent(status string) string {
+	switch status {
+	case PaymentStatusSettled:
+		return LedgerEventSettled
+	case PaymentStatusReturned:
+		return LedgerEventReturned
+	case PaymentStatusAccepted:
+		return LedgerEventCreated
+	}
+	return LedgerEventCancelled
+}
+
+// sumByCurrency sums the postings by currency
+func sumByCurrency(postings []LedgerPosting) (map[string]*big.Rat, error) {
+	sums := map[string]*big.Rat{}
+	for _, p := range postings {
+		amount, ok := new(big.Rat).SetString(p.Amount)
+		if !ok {
+			return nil, errors.New("err: invalid amount in ledger posting " + p.Amount)
+		}
+		if sums[p.Currency] == nil {
+			sums[p.Currency] = new(big.Rat)
+		}
+		sums[p.Currency].Add(sums[p.Currency], amount)
+	}
+	return sums, nil
+}
+
+// LedgerStore persists the postings of the ledger, which are never updated nor deleted
+type LedgerStore interface {
+	// FindPayment retrieves a payment with its attributes, deleted or not, in the transaction of ctx if there is one
+	FindPayment(ctx context.Context, id uuid.UUID) (Payment, error)
+	// ListPostings lists the postings of the organisation in the order they were posted, the postings of a payment
+	// or of an account only when they are given
+	ListPostings(ctx context.Context, organisationID, paymentID uuid.UUID, account string) ([]LedgerPosting, error)
+	// CreatePostings stores the postings of an entry, in the transaction of ctx if there is one
+	CreatePostings(ctx context.Context, postings []LedgerPosting) error
+	// Transactor joins the transaction of ctx if there is one
+	Transactor
+}
+
+type ledgerStore struct {
+	txStore
+}
+
+// NewLedgerStore returns a LedgerStore backed by the database
+func NewLedgerStore(db *gorm.DB) LedgerStore {
+	return &ledgerStore{
+		txStore{db: db},
+	}
+}
+
+// FindPayment retrieves a payment including the soft deleted ones
+func (s *ledgerStore) FindPayment(ctx context.Context, id uuid.UUID) (Payment, error) {
+	p := Payment{}
+	err := withContext(s.db, ctx).Unscoped().Where("id = ?", id).Preload("Attributes.ChargesInformation.SenderCharges").Preload("Attributes.DebtorParty").Preload("Attributes.Forex").Find(&p).Error
+	return p, err
+}
+
+// ListPostings lists the postings by ID, which is the order they were posted in
+func (s *ledgerStore) ListPostings(ctx context.Context, organisationID, paymentID uuid.UUID, account string) ([]LedgerPosting, error) {
+	db := withContext(s.db, ctx).Where("organisation_id = ?", organisationID)
+	if paymentID != uuid.Nil {
+		db = db.Where("payment_id = ?", paymentID)
+	}
+	if account != "" {
+		db = db.Where("account = ?", account)
+	}
+	postings := []LedgerPosting{}
+	err := db.Order("id").Find(&postings).Error
+	return postings, err
+}
+
+// CreatePostings inserts the postings
+func (s *ledgerStore) CreatePostings(ctx context.Context, postings []LedgerPosting) error {
+	db := withContext(s.db, ctx)
+	for i := range postings {
+		if err := db.Create(&postings[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InTransaction joins the transaction of ctx, so that the postings are committed with the change of the payment
+func (s *ledgerStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return s.joinTransaction(ctx, fn)
+}
+
+// postPayment brings the postings of a payment in line with its current state. The positions already posted are
+// subtracted from the ones the payment must hold, the difference is posted as a new entry. Nothing is posted when
+// they are the same
+func postPayment(ctx context.Context, store LedgerStore, id uuid.UUID, event string) error {
+	return store.InTransaction(ctx, func(ctx context.Context) error {
+		payment, err := store.FindPayment(ctx, id)
+		if err != nil {
+			return err
+		}
+		target, err := paymentPositions(payment)
+		if err != nil {
+			return StatusError{Status: http.StatusUnprocessableEntity, Kind: KindInvalidPayload, Message: err.Error()}
+		}
+		posted, err := store.ListPostings(ctx, payment.OrganisationID, payment.ID, "")
+		if err != nil {
+			return err
+		}
+		for _, p := range posted {
+			amount, ok := new(big.Rat).SetString(p.Amount)
+			if !ok {
+				return errors.New("err: invalid amount in ledger posting " + p.Amount)
+			}
+			target.add(p.Account, p.Currency, amount.Neg(amount))
+		}
+		entryID, _ := uuid.NewV4()
+		now := time.Now().UTC()
+		var postings []LedgerPosting
+		for _, k := range target.keys {
+			amount := target.amounts[k]
+			if amount.Sign() == 0 {
+				continue
+			}
+			postings = append(postings, LedgerPosting{
+				EntryID:        entryID,
+				OrganisationID: payment.OrganisationID,
+				PaymentID:      payment.ID,
+				Event:          event,
+				Account:        k.account,
+				Currency:       k.currency,
+				Amount:         decimalString(amount),
+				PostedAt:       now,
+				RequestID:      RequestIDFromContext(ctx),
+			})
+		}
+		if len(postings) == 0 {
+			return nil
+		}
+		sums, err := sumByCurrency(postings)
+		if err != nil {
+			return err
+		}
+		for currency, sum := range sums {
+			if sum.Sign() != 0 {
+				return errors.New("err: the ledger entry of the payment does not balance in " + currency)
+			}
+		}
+		return store.CreatePostings(ctx, postings)
+	})
+}
+
+type ledgerMiddleware struct {
+	store LedgerStore
+	next  PaymentService
+}
+
+// NewLedgerPostings returns a new instance of PaymentService that posts the payments to the ledger when they are
+// created, updated or deleted, in the transaction of the change
+func NewLedgerPostings(store LedgerStore, next PaymentService) PaymentService {
+	return &ledgerMiddleware{
+		store: store,
+		next:  next,
+	}
+}
+
+// GetPayment is passed through
+func (mw ledgerMiddleware) GetPayment(ctx context.Context, id string) (Payment, error) {
+	return mw.next.GetPayment(ctx, id)
+}
+
+// GetListPayments is passed through
+func (mw ledgerMiddleware) GetListPayments(ctx context.Context) ([]Payment, error) {
+	return mw.next.GetListPayments(ctx)
+}
+
+// CreatePayment posts the payment unless it is pending approval
+func (mw ledgerMiddleware) CreatePayment(ctx context.Context, p Payment) (resp CreatePaymentResponse, err error) {
+	err = mw.store.InTransaction(ctx, func(ctx context.Context) error {
+		if resp, err = mw.next.CreatePayment(ctx, p); err != nil {
+			return err
+		}
+		return postPayment(ctx, mw.store, resp.PaymentID, LedgerEventCreated)
+	})
+	return resp, err
+}
+
+// UpdatePayment posts the difference between the new version of the payment and the previous one
+func (mw ledgerMiddleware) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (resp UpdatePaymentResponse, err error) {
+	err = mw.store.InTransaction(ctx, func(ctx context.Context) error {
+		if resp, err = mw.next.UpdatePayment(ctx, req); err != nil {
+			return err
+		}
+		return postPayment(ctx, mw.store, resp.PaymentID, LedgerEventAmended)
+	})
+	return resp, err
+}
+
+// DeletePayment cancels the postings of the payment unless it was settled
+func (mw ledgerMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (deletedAt *time.Time, err error) {
+	err = mw.store.InTransaction(ctx, func(ctx context.Context) error {
+		if deletedAt, err = mw.next.DeletePayment(ctx, id); err != nil {
+			return err
+		}
+		return postPayment(ctx, mw.store, id, LedgerEventCancelled)
+	})
+	return deletedAt, err
+}
+
+// statusReportLedger posts the payments whose status is changed by the status reports of the banks
+type statusReportLedger struct {
+	StatusReportStore
+	ledger LedgerStore
+}
+
+// NewStatusReportLedger returns a StatusReportStore posting the payments to the ledger when their status changes
+func NewStatusReportLedger(store StatusReportStore, ledger LedgerStore) StatusReportStore {
+	return &statusReportLedger{store, ledger}
+}
+
+// SetSchemeStatus changes the status of the payment and posts it in the same transaction
+func (s *statusReportLedger) SetSchemeStatus(ctx context.Context, paymentID uuid.UUID, status, schemeStatus, reason string) error {
+	if err := s.StatusReportStore.SetSchemeStatus(ctx, paymentID, status, schemeStatus, reason); err != nil {
+		return err
+	}
+	return postPayment(ctx, s.ledger, paymentID, ledgerEvent(status))
+}
+
+// reconciliationLedger posts the payments settled by the reconciliations
+type reconciliationLedger struct {
+	ReconciliationStore
+	ledger LedgerStore
+}
+
+// NewReconciliationLedger returns a ReconciliationStore posting the payments to the ledger when they are settled
+func NewReconciliationLedger(store ReconciliationStore, ledger LedgerStore) ReconciliationStore {
+	return &reconciliationLedger{store, ledger}
+}
+
+// SetSchemeStatus changes the status of the payment and posts it in the same transaction
+func (s *reconciliationLedger) SetSchemeStatus(ctx context.Context, paymentID uuid.UUID, status, schemeStatus, reason string) error {
+	if err := s.ReconciliationStore.SetSchemeStatus(ctx, paymentID, status, schemeStatus, reason); err != nil {
+		return err
+	}
+	return postPayment(ctx, s.ledger, paymentID, ledgerEvent(status))
+}
+
+// approvalLedger posts the payments once they are approved
+type approvalLedger struct {
+	ApprovalStore
+	ledger LedgerStore
+}
+
+// NewApprovalLedger returns an ApprovalStore posting the payments to the ledger when they are approved
+func NewApprovalLedger(store ApprovalStore, ledger LedgerStore) ApprovalStore {
+	return &approvalLedger{store, ledger}
+}
+
+// SetPaymentStatus changes the status of the payment and posts it in the same transaction
+func (s *approvalLedger) SetPaymentStatus(ctx context.Context, paymentID uuid.UUID, status string) (bool, error) {
+	changed, err := s.ApprovalStore.SetPaymentStatus(ctx, paymentID, status)
+	if err != nil || !changed {
+		return changed, err
+	}
+	return true, postPayment(ctx, s.ledger, paymentID, ledgerEvent(status))
+}
+
+// LedgerService gives the balances and the postings of the ledger of the caller's organisation
+type LedgerService interface {
+	GetBalances(ctx context.Context, account string) ([]LedgerBalance, error)
+	ListPostings(ctx context.Context, req ListPostingsRequest) ([]LedgerPosting, error)
+	CheckLedger(ctx context.Context) (LedgerCheck, error)
+}
+
+type ledgerService struct {
+	store LedgerStore
+}
+
+// NewLedgerService returns the LedgerService reading the postings of the store
+func NewLedgerService(store LedgerStore) LedgerService {
+	return &ledgerService{
+		store: store,
+	}
+}
+
+// GetBalances returns the balances of the accounts of the caller's organisation by currency, or of the account
+// when one is given
+func (s *ledgerService) GetBalances(ctx context.Context, account string) ([]LedgerBalance, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return nil, err
+	}
+	postings, err := s.store.ListPostings(ctx, p.OrganisationID, uuid.Nil, account)
+	if err != nil {
+		return nil, err
+	}
+	l := newLedgerPositions()
+	for _, posting := range postings {
+		amount, ok := new(big.Rat).SetString(posting.Amount)
+		if !ok {
+			return nil, errors.New("err: invalid amount in ledger posting " + posting.Amount)
+		}
+		l.add(posting.Account, posting.Currency, amount)
+	}
+	sort.Slice(l.keys, func(i, j int) bool {
+		if l.keys[i].account != l.keys[j].account {
+			return l.keys[i].account < l.keys[j].account
+		}
+		return l.keys[i].currency < l.keys[j].currency
+	})
+	balances := []LedgerBalance{}
+	for _, k := range l.keys {
+		balances = append(balances, LedgerBalance{Account: k.account, Currency: k.currency, Balance: decimalString(l.amounts[k])})
+	}
+	return balances, nil
+}
+
+// ListPostings lists the postings of the caller's organisation
+func (s *ledgerService) ListPostings(ctx context.Context, req ListPostingsRequest) ([]LedgerPosting, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.ListPostings(ctx, p.OrganisationID, req.PaymentID, req.Account)
+}
+
+// CheckLedger checks that the postings of the caller's organisation sum to zero in every currency, entry by entry
+func (s *ledgerService) CheckLedger(ctx context.Context) (LedgerCheck, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return LedgerCheck{}, err
+	}
+	postings, err := s.store.ListPostings(ctx, p.OrganisationID, uuid.Nil, "")
+	if err != nil {
+		return LedgerCheck{}, err
+	}
+	check := LedgerCheck{Balanced: true, Postings: len(postings), Totals: []LedgerBalance{}, UnbalancedEntries: []uuid.UUID{}}
+	totals, err := sumByCurrency(postings)
+	if err != nil {
+		return LedgerCheck{}, err
+	}
+	for currency, sum := range totals {
+		check.Totals = append(check.Totals, LedgerBalance{Currency: currency, Balance: decimalString(sum)})
+		check.Balanced = check.Balanced && sum.Sign() == 0
+	}
+	sort.Slice(check.Totals, func(i, j int) bool { return check.Totals[i].Currency < check.Totals[j].Currency })
+	var entries []uuid.UUID
+	byEntry := map[uuid.UUID][]LedgerPosting{}
+	for _, posting := range postings {
+		if byEntry[posting.EntryID] == nil {
+			entries = append(entries, posting.EntryID)
+		}
+		byEntry[posting.EntryID] = append(byEntry[posting.EntryID], posting)
+	}
+	for _, id := range entries {
+		sums, _ := sumByCurrency(byEntry[id])
+		for _, sum := range sums {
+			if sum.Sign() != 0 {
+				check.UnbalancedEntries = append(check.UnbalancedEntries, id)
+				check.Balanced = false
+				break
+			}
+		}
+	}
+	return check, nil
+}
+
+// GetBalancesRequest is the request type used to get the balances of the ledger
+type GetBalancesRequest struct {
+	Account string
+}
+
+// ListPostingsRequest is the request type used to list the postings of the ledger
+type ListPostingsRequest struct {
+	PaymentID uuid.UUID
+	Account   string
+}
+
+// MakeGetBalancesEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the GetBalances method
+func MakeGetBalancesEndpoint(svc LedgerService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetBalancesRequest)
+		v, err := svc.GetBalances(ctx, req.Account)
+		if err != nil {
+			return nil, newStatusError("err: Could not retrieve balances \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeListPostingsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ListPostings method
+func MakeListPostingsEndpoint(svc LedgerService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ListPostingsRequest)
+		v, err := svc.ListPostings(ctx, req)
+		if err != nil {
+			return nil, newStatusError("err: Could not list postings \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeCheckLedgerEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the CheckLedger method
+func MakeCheckLedgerEndpoint(svc LedgerService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		v, err := svc.CheckLedger(ctx)
+		if err != nil {
+			return nil, newStatusError("err: Could not check the ledger \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,293 @@
+package paymentsapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// memoryLedgerStore is a LedgerStore keeping the payments and the postings in memory
+type memoryLedgerStore struct {
+	payments map[uuid.UUID]Payment
+	postings []LedgerPosting
+}
+
+func newMemoryLedgerStore(payments ...Payment) *memoryLedgerStore {
+	s := &memoryLedgerStore{payments: map[uuid.UUID]Payment{}}
+	for _, p := range payments {
+		s.payments[p.ID] = p
+	}
+	return s
+}
+
+func (s *memoryLedgerStore) FindPayment(_ context.Context, id uuid.UUID) (Payment, error) {
+	p, ok := s.payments[id]
+	if !ok {
+		return Payment{}, gorm.ErrRecordNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryLedgerStore) ListPostings(_ context.Context, organisationID, paymentID uuid.UUID, account string) ([]LedgerPosting, error) {
+	postings := []LedgerPosting{}
+	for _, p := range s.postings {
+		if p.OrganisationID == organisationID && (paymentID == uuid.Nil || p.PaymentID == paymentID) && (account == "" || p.Account == account) {
+			postings = append(postings, p)
+		}
+	}
+	return postings, nil
+}
+
+func (s *memoryLedgerStore) CreatePostings(_ context.Context, postings []LedgerPosting) error {
+	for _, p := range postings {
+		p.ID = uint(len(s.postings) + 1)
+		s.postings = append(s.postings, p)
+	}
+	return nil
+}
+
+func (s *memoryLedgerStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// setStatus changes the status of a payment of the store
+func (s *memoryLedgerStore) setStatus(id uuid.UUID, status string) {
+	p := s.payments[id]
+	p.Status = status
+	s.payments[id] = p
+}
+
+// entry returns the postings of the last entry as "event account currency amount"
+func (s *memoryLedgerStore) entry() []string {
+	var lines []string
+	last := s.postings[len(s.postings)-1].EntryID
+	for _, p := range s.postings {
+		if p.EntryID == last {
+			lines = append(lines, p.Event+" "+p.Account+" "+p.Currency+" "+p.Amount)
+		}
+	}
+	return lines
+}
+
+func TestPostPayment(t *testing.T) {
+	p := isoPayment()
+	p.Status = PaymentStatusAccepted
+	store := newMemoryLedgerStore(p)
+	ctx := context.Background()
+
+	// the debtor pays the charges and the original amount of the conversion
+	assert.NoError(t, postPayment(ctx, store, p.ID, LedgerEventCreated))
+	assert.Equal(t, []string{
+		"created debtor:GB29NWBK60161331926819 GBP 5",
+		"created charges_income GBP -5",
+		"created debtor:GB29NWBK60161331926819 USD 210.42",
+		"created charges_income USD -10",
+		"created fx_position:USD USD -200.42",
+		"created fx_position:GBP GBP 100.21",
+		"created clearing:FPS GBP -100.21",
+	}, store.entry())
+	// posting a payment again does not post anything
+	assert.NoError(t, postPayment(ctx, store, p.ID, LedgerEventAmended))
+	assert.Len(t, store.postings, 7)
+
+	store.setStatus(p.ID, PaymentStatusSettled)
+	assert.NoError(t, postPayment(ctx, store, p.ID, LedgerEventSettled))
+	assert.Equal(t, []string{"settled clearing:FPS GBP 100.21", "settled settlement:FPS GBP -100.21"}, store.entry())
+
+	// the charges are kept when the funds come back
+	store.setStatus(p.ID, PaymentStatusReturned)
+	assert.NoError(t, postPayment(ctx, store, p.ID, LedgerEventReturned))
+	assert.Equal(t, []string{
+		"returned debtor:GB29NWBK60161331926819 USD -200.42",
+		"returned fx_position:USD USD 200.42",
+		"returned fx_position:GBP GBP -100.21",
+		"returned settlement:FPS GBP 100.21",
+	}, store.entry())
+
+	svc := NewLedgerService(store)
+	balances, err := svc.GetBalances(roleContext(p.OrganisationID, "ops", RoleViewer), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []LedgerBalance{
+		{Account: "charges_income", Currency: "GBP", Balance: "-5"},
+		{Account: "charges_income", Currency: "USD", Balance: "-10"},
+		{Account: "clearing:FPS", Currency: "GBP", Balance: "0"},
+		{Account: "debtor:GB29NWBK60161331926819", Currency: "GBP", Balance: "5"},
+		{Account: "debtor:GB29NWBK60161331926819", Currency: "USD", Balance: "10"},
+		{Account: "fx_position:GBP", Currency: "GBP", Balance: "0"},
+		{Account: "fx_position:USD", Currency: "USD", Balance: "0"},
+		{Account: "settlement:FPS", Currency: "GBP", Balance: "0"},
+	}, balances)
+	check, err := svc.CheckLedger(roleContext(p.OrganisationID, "ops", RoleViewer))
+	assert.NoError(t, err)
+	assert.True(t, check.Balanced)
+	assert.Equal(t, 13, check.Postings)
+	assert.Equal(t, []LedgerBalance{{Currency: "GBP", Balance: "0"}, {Currency: "USD", Balance: "0"}}, check.Totals)
+}
+
+func TestPostPaymentCancelled(t *testing.T) {
+	p := isoPayment()
+	p.Status = PaymentStatusAccepted
+	p.Attributes.Forex = Forex{}
+	p.Attributes.ChargesInformation.SenderCharges = []Charge{{Amount: "1.50", Currency: "GBP"}}
+	store := newMemoryLedgerStore(p)
+	ctx := context.Background()
+	assert.NoError(t, postPayment(ctx, store, p.ID, LedgerEventCreated))
+	assert.Equal(t, []string{
+		"created debtor:GB29NWBK60161331926819 GBP 101.71",
+		"created charges_income GBP -1.5",
+		"created clearing:FPS GBP -100.21",
+	}, store.entry())
+
+	// a rejected payment gives everything back
+	store.setStatus(p.ID, PaymentStatusRejected)
+	assert.NoError(t, postPayment(ctx, store, p.ID, LedgerEventCancelled))
+	assert.Equal(t, []string{
+		"cancelled debtor:GB29NWBK60161331926819 GBP -101.71",
+		"cancelled charges_income GBP 1.5",
+		"cancelled clearing:FPS GBP 100.21",
+	}, store.entry())
+
+	// a settled payment keeps its postings when it is deleted
+	settled := isoPayment()
+	settled.Status = PaymentStatusSettled
+	now := time.Now()
+	settled.DeletedAt = &now
+	positions, err := paymentPositions(settled)
+	assert.NoError(t, err)
+	assert.Len(t, positions.keys, 8)
+	settled.Status = PaymentStatusAccepted
+	positions, _ = paymentPositions(settled)
+	assert.Empty(t, positions.keys)
+
+	invalid := isoPayment()
+	invalid.Status, invalid.Attributes.Amount = PaymentStatusAccepted, "-3"
+	_, err = paymentPositions(invalid)
+	assert.Contains(t, err.Error(), "the amount of the payment cannot be posted: -3")
+	assert.Equal(t, errLedgerImmutable, (&LedgerPosting{}).BeforeUpdate())
+	assert.Equal(t, errLedgerImmutable, (&LedgerPosting{}).BeforeDelete())
+}
+
+func TestCheckLedgerUnbalanced(t *testing.T) {
+	org, _ := uuid.NewV4()
+	entry, _ := uuid.NewV4()
+	store := newMemoryLedgerStore()
+	store.CreatePostings(context.Background(), []LedgerPosting{
+		{EntryID: entry, OrganisationID: org, Account: "debtor:1", Currency: "EUR", Amount: "10"},
+		{EntryID: entry, OrganisationID: org, Account: "clearing:SEPA", Currency: "EUR", Amount: "-9.99"},
+	})
+	check, err := NewLedgerService(store).CheckLedger(roleContext(org, "ops", RoleViewer))
+	assert.NoError(t, err)
+	assert.False(t, check.Balanced)
+	assert.Equal(t, []LedgerBalance{{Currency: "EUR", Balance: "0.01"}}, check.Totals)
+	assert.Equal(t, []uuid.UUID{entry}, check.UnbalancedEntries)
+}
+
+func TestLedgerPostings(t *testing.T) {
+	p := isoPayment()
+	p.Status = PaymentStatusAccepted
+	p.Attributes.Forex = Forex{}
+	p.Attributes.ChargesInformation.SenderCharges = nil
+	store := newMemoryLedgerStore(p)
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{PaymentID: p.ID}, nil)
+	mockService.On("UpdatePayment", mock.Anything, mock.Anything).Return(UpdatePaymentResponse{PaymentID: p.ID}, nil)
+	now := time.Now()
+	mockService.On("DeletePayment", mock.Anything, p.ID).Return(&now, nil)
+	svc := NewLedgerPostings(store, mockService)
+	ctx := context.Background()
+
+	_, err := svc.CreatePayment(ctx, p)
+	assert.NoError(t, err)
+	assert.Len(t, store.postings, 2)
+	// the new amount is posted as the difference with the previous one
+	p.Attributes.Amount = "120"
+	store.payments[p.ID] = p
+	_, err = svc.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: p.ID.String(), Payment: p})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"amended debtor:GB29NWBK60161331926819 GBP 19.79", "amended clearing:FPS GBP -19.79"}, store.entry())
+	p.DeletedAt = &now
+	store.payments[p.ID] = p
+	_, err = svc.DeletePayment(ctx, p.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cancelled debtor:GB29NWBK60161331926819 GBP -120", "cancelled clearing:FPS GBP 120"}, store.entry())
+
+	// the status reports settle the payments in the ledger too
+	settled := isoPayment()
+	settled.Status = PaymentStatusSettled
+	settled.Attributes.Forex = Forex{}
+	settled.Attributes.ChargesInformation.SenderCharges = nil
+	store.payments[settled.ID] = settled
+	reports := NewStatusReportLedger(newMemoryStatusReportStore(settled), store)
+	assert.NoError(t, reports.SetSchemeStatus(ctx, settled.ID, PaymentStatusSettled, "ACSC", ""))
+	// the clearing account nets to zero when the payment is settled at once
+	assert.Equal(t, []string{"settled debtor:GB29NWBK60161331926819 GBP 100.21", "settled settlement:FPS GBP -100.21"}, store.entry())
+}
+
+// ledgerApprovalStore is a memoryApprovalStore changing the statuses of the payments of a memoryLedgerStore
+type ledgerApprovalStore struct {
+	*memoryApprovalStore
+	ledger *memoryLedgerStore
+}
+
+func (s ledgerApprovalStore) SetPaymentStatus(_ context.Context, id uuid.UUID, status string) (bool, error) {
+	s.ledger.setStatus(id, status)
+	return true, nil
+}
+
+func TestApprovalLedger(t *testing.T) {
+	p := isoPayment()
+	p.Status = PaymentStatusPendingApproval
+	ledger := newMemoryLedgerStore(p)
+	store := NewApprovalLedger(ledgerApprovalStore{newMemoryApprovalStore(), ledger}, ledger)
+	ctx := NewContextWithRequestID(context.Background(), "req-approve")
+
+	accepted, err := store.SetPaymentStatus(ctx, p.ID, PaymentStatusAccepted)
+	assert.NoError(t, err)
+	assert.True(t, accepted)
+	postings, _ := ledger.ListPostings(ctx, p.OrganisationID, p.ID, "")
+	assert.NotEmpty(t, postings)
+	// the postings carry the request of the approval
+	for _, posting := range postings {
+		assert.Equal(t, LedgerEventCreated, posting.Event)
+		assert.Equal(t, "req-approve", posting.RequestID)
+	}
+}
+
+func TestLedgerHTTP(t *testing.T) {
+	p := isoPayment()
+	p.Status = PaymentStatusAccepted
+	store := newMemoryLedgerStore(p)
+	assert.NoError(t, postPayment(context.Background(), store, p.ID, LedgerEventCreated))
+	router := mux.NewRouter()
+	RegisterLedgerRoutes(router, NewLedgerService(store))
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", url, nil).WithContext(roleContext(p.OrganisationID, "ops", RoleViewer)))
+		return rec
+	}
+
+	rec := get("/v1/ledger/balances?account=clearing:FPS")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var balances []LedgerBalance
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &balances))
+	assert.Equal(t, []LedgerBalance{{Account: "clearing:FPS", Currency: "GBP", Balance: "-100.21"}}, balances)
+	rec = get("/v1/ledger/postings?payment_id=" + p.ID.String())
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var postings []LedgerPosting
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &postings))
+	assert.Len(t, postings, 7)
+	rec = get("/v1/ledger/check")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"balanced":true`)
+	rec = get("/v1/ledger/postings?payment_id=x")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,95 @@
+package paymentsapi
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Log levels, set on every log line with the "level" key. Lines without a level are logged at LevelInfo
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// Log formats supported by NewLogger
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+var levelRanks = map[string]int{
+	LevelDebug: 0,
+	LevelInfo:  1,
+	LevelWarn:  2,
+	LevelError: 3,
+}
+
+// levelFilter drops the log lines below its minimum level, the level can be changed while logging with SetLogLevel
+type levelFilter struct {
+	min  int32
+	next log.Logger
+}
+
+// Log implements log.Logger
+func (l *levelFilter) Log(keyvals ...interface{}) error {
+	rank := levelRanks[LevelInfo]
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == "level" {
+			if lvl, ok := keyvals[i+1].(string); ok {
+				if r, ok := levelRanks[lvl]; ok {
+					rank = r
+				}
+			}
+			break
+		}
+	}
+	if int32(rank) < atomic.LoadInt32(&l.min) {
+		return nil
+	}
+	return l.next.Log(keyvals...)
+}
+
+// NewLogger returns a logger writing timestamped lines in the format (logfmt or json) to w,
+// the lines below the level (debug, info, warn or error) are dropped
+func NewLogger(w io.Writer, format, level string) (log.Logger, error) {
+	var logger log.Logger
+	switch format {
+	case LogFormatLogfmt, "":
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	case LogFormatJSON:
+		logger = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		return nil, errors.New("err: unknown log format " + format)
+	}
+	if level == "" {
+		level = LevelInfo
+	}
+	min, ok := levelRanks[level]
+	if !ok {
+		return nil, errors.New("err: unknown log level " + level)
+	}
+	logger = log.With(logger, "time", log.DefaultTimestampUTC())
+	return &levelFilter{min: int32(min), next: logger}, nil
+}
+
+// SetLogLevel changes the minimum level of a logger returned by NewLogger
+func SetLogLevel(logger log.Logger, level string) error {
+	l, ok := logger.(*levelFilter)
+	if !ok {
+		return errors.New("err: the level of the logger cannot be changed")
+	}
+	if level == "" {
+		level = LevelInfo
+	}
+	min, ok := levelRanks[level]
+	if !ok {
+		return errors.New("err: unknown log level " + level)
+	}
+	atomic.StoreInt32(&l.min, int32(min))
+	return nil
+}
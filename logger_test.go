@@ -0,0 +1,51 @@
+package paymentsapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger(t *testing.T) {
+	var b bytes.Buffer
+	logger, err := NewLogger(&b, LogFormatJSON, LevelWarn)
+	assert.NoError(t, err)
+	logger.Log("level", LevelInfo, "msg", "dropped")
+	logger.Log("msg", "dropped too")
+	log.With(logger, "tag", "start").Log("level", LevelError, "msg", "kept")
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &line))
+	assert.Equal(t, "kept", line["msg"])
+	assert.Equal(t, "start", line["tag"])
+	assert.NotEmpty(t, line["time"])
+
+	b.Reset()
+	logger, err = NewLogger(&b, "", "")
+	assert.NoError(t, err)
+	logger.Log("msg", "hello")
+	assert.Contains(t, b.String(), "msg=hello")
+
+	_, err = NewLogger(&b, "xml", LevelInfo)
+	assert.Error(t, err)
+	_, err = NewLogger(&b, LogFormatJSON, "verbose")
+	assert.Error(t, err)
+}
+
+func TestSetLogLevel(t *testing.T) {
+	var b bytes.Buffer
+	logger, err := NewLogger(&b, LogFormatLogfmt, LevelInfo)
+	assert.NoError(t, err)
+	logger.Log("level", LevelDebug, "msg", "dropped")
+	assert.Empty(t, b.String())
+
+	assert.NoError(t, SetLogLevel(logger, LevelDebug))
+	logger.Log("level", LevelDebug, "msg", "kept")
+	assert.Contains(t, b.String(), "msg=kept")
+
+	assert.Error(t, SetLogLevel(logger, "verbose"))
+	assert.Error(t, SetLogLevel(log.NewNopLogger(), LevelDebug))
+}
@@ -1,32 +1,58 @@
 package paymentsapi
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	uuid "github.com/satori/go.uuid"
+	"github.com/vstoianovici/paymentsapi/tracing"
 )
 
 // The logging middleware amends the wallet service with a logger
 
 // loggingMiddleware is the type of the wrapper around the core service and any other functionality layers
 type loggingMiddleware struct {
-	logger log.Logger
-	next   PaymentService
+	logger   log.Logger
+	redactor *Redactor
+	next     PaymentService
 }
 
-// NewLogging is how the logging middleware (loggingMiddleware struct) is constructed (the function is exported so it can be used from outside the package)
+// NewLogging is how the logging middleware (loggingMiddleware struct) is constructed (the function is exported so it can be used from outside the package).
+// The personal data of the logged payments is masked according to the `redact` tags of the model
 func NewLogging(logger log.Logger, next PaymentService) PaymentService {
+	return NewLoggingWithRedactor(logger, NewRedactor(), next)
+}
+
+// NewLoggingWithRedactor returns a logging middleware masking the logged payments with the redactor
+func NewLoggingWithRedactor(logger log.Logger, redactor *Redactor, next PaymentService) PaymentService {
 	return &loggingMiddleware{
-		logger: logger,
-		next:   next,
+		logger:   logger,
+		redactor: redactor,
+		next:     next,
+	}
+}
+
+// levelOf returns the level of the log line of a request that returned err
+func levelOf(err error) string {
+	if err != nil {
+		return LevelError
 	}
+	return LevelInfo
+}
+
+// redacted returns the JSON encoding of the payment with its personal data masked
+func (mw loggingMiddleware) redacted(p Payment) string {
+	b, err := json.Marshal(mw.redactor.Redact(p))
+	if err != nil {
+		return ""
+	}
+	return string(b)
 }
 
 // GetPayment function is implemented for logging layer as the request traverses through the logging layer down to the next layer
-func (mw loggingMiddleware) GetPayment(s string) (output Payment, err error) {
+func (mw loggingMiddleware) GetPayment(ctx context.Context, s string) (output Payment, err error) {
 	// Log everything that the function sees in the provided format
 	defer func(begin time.Time) {
 		status := func(in Payment) string {
@@ -36,7 +62,10 @@ func (mw loggingMiddleware) GetPayment(s string) (output Payment, err error) {
 			return "payment was not found"
 		}(output)
 		_ = mw.logger.Log(
+			"level", levelOf(err),
 			"method", "getPayment",
+			"trace_id", tracing.TraceIDFromContext(ctx),
+			"request_id", RequestIDFromContext(ctx),
 			"input", s,
 			"output", status,
 			"err", err,
@@ -44,61 +73,73 @@ func (mw loggingMiddleware) GetPayment(s string) (output Payment, err error) {
 		)
 	}(time.Now())
 	// The function calls the next layer down
-	output, err = mw.next.GetPayment(s)
+	output, err = mw.next.GetPayment(ctx, s)
 	return
 }
 
 // CreatePayment function is implemented for the logging layer as the request traverses through the logging layer down to the next layer
-func (mw loggingMiddleware) CreatePayment(p Payment) (output CreatePaymentResponse, err error) {
-	// Log everything that the function sees in the provided format
+func (mw loggingMiddleware) CreatePayment(ctx context.Context, p Payment) (output CreatePaymentResponse, err error) {
+	// Log everything that the function sees in the provided format, the payment is only logged at the debug level
 	defer func(begin time.Time) {
-		e, err := json.Marshal(p)
-		if err != nil {
-			return
-		}
-		fmt.Println(string(e))
 		_ = mw.logger.Log(
+			"level", levelOf(err),
 			"method", "createPayment",
-			"input", "Input "+string(e),
-			"output", output,
+			"trace_id", tracing.TraceIDFromContext(ctx),
+			"request_id", RequestIDFromContext(ctx),
+			"output", output.PaymentID,
 			"err", err,
 			"took", time.Since(begin),
 		)
+		_ = mw.logger.Log(
+			"level", LevelDebug,
+			"method", "createPayment",
+			"trace_id", tracing.TraceIDFromContext(ctx),
+			"request_id", RequestIDFromContext(ctx),
+			"input", mw.redacted(p),
+		)
 	}(time.Now())
 	// The function calls the next layer down
-	output, err = mw.next.CreatePayment(p)
+	output, err = mw.next.CreatePayment(ctx, p)
 	return
 }
 
 // UpdatePayment function is implemented for the logging layer as the request traverses through the logging layer down to the next layer
-func (mw loggingMiddleware) UpdatePayment(p UpdatePaymentRequest) (output UpdatePaymentResponse, err error) {
-	// Log everything that the function sees in the provided format
+func (mw loggingMiddleware) UpdatePayment(ctx context.Context, p UpdatePaymentRequest) (output UpdatePaymentResponse, err error) {
+	// Log everything that the function sees in the provided format, the payment is only logged at the debug level
 	defer func(begin time.Time) {
-		e, err := json.Marshal(p.Payment)
-		if err != nil {
-			return
-		}
-		output := "Updated" + p.PaymentID
 		_ = mw.logger.Log(
+			"level", levelOf(err),
 			"method", "updatePayment",
-			"input", "Input "+string(e)+"for id:"+p.PaymentID,
-			"output", output,
+			"trace_id", tracing.TraceIDFromContext(ctx),
+			"request_id", RequestIDFromContext(ctx),
+			"input", "id:"+p.PaymentID,
+			"output", "Updated"+p.PaymentID,
 			"err", err,
 			"took", time.Since(begin),
 		)
+		_ = mw.logger.Log(
+			"level", LevelDebug,
+			"method", "updatePayment",
+			"trace_id", tracing.TraceIDFromContext(ctx),
+			"request_id", RequestIDFromContext(ctx),
+			"input", mw.redacted(p.Payment),
+		)
 	}(time.Now())
 	// The function calls the next layer down
-	output, err = mw.next.UpdatePayment(p)
+	output, err = mw.next.UpdatePayment(ctx, p)
 	return
 }
 
 // DeletePayment function is implemented for the logging layer as the request traverses through the logging layer down to the next layer
-func (mw loggingMiddleware) DeletePayment(id uuid.UUID) (t *time.Time, err error) {
+func (mw loggingMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (t *time.Time, err error) {
 	// Log everything that the function sees in the provided format
 	defer func(begin time.Time) {
 		output := "Deleted" + id.String()
 		_ = mw.logger.Log(
+			"level", levelOf(err),
 			"method", "deletePayment",
+			"trace_id", tracing.TraceIDFromContext(ctx),
+			"request_id", RequestIDFromContext(ctx),
 			"input", "Delete id:"+id.String(),
 			"output", output,
 			"err", err,
@@ -106,12 +147,12 @@ func (mw loggingMiddleware) DeletePayment(id uuid.UUID) (t *time.Time, err error
 		)
 	}(time.Now())
 	// The function calls the next layer down
-	t, err = mw.next.DeletePayment(id)
+	t, err = mw.next.DeletePayment(ctx, id)
 	return
 }
 
 // GetListPaymentsfunction is implemented for the logging layer as the request traverses through the logging layer down to the next layer
-func (mw loggingMiddleware) GetListPayments() (output []Payment, err error) {
+func (mw loggingMiddleware) GetListPayments(ctx context.Context) (output []Payment, err error) {
 
 	defer func(begin time.Time) {
 		status := func(in []Payment) string {
@@ -121,7 +162,10 @@ func (mw loggingMiddleware) GetListPayments() (output []Payment, err error) {
 			return "no payments"
 		}(output)
 		_ = mw.logger.Log(
+			"level", levelOf(err),
 			"method", "getListPayments",
+			"trace_id", tracing.TraceIDFromContext(ctx),
+			"request_id", RequestIDFromContext(ctx),
 			"input", "List Payments",
 			"output", status,
 			"err", err,
@@ -129,6 +173,6 @@ func (mw loggingMiddleware) GetListPayments() (output []Payment, err error) {
 		)
 	}(time.Now())
 	// The function calls the next layer down
-	output, err = mw.next.GetListPayments()
+	output, err = mw.next.GetListPayments(ctx)
 	return
 }
@@ -1,6 +1,8 @@
 package paymentsapi
 
 import (
+	"bytes"
+	"context"
 	"testing"
 	"time"
 
@@ -14,27 +16,27 @@ type mockNextService struct {
 	called bool
 }
 
-func (m *mockNextService) GetPayment(s string) (output Payment, err error) {
+func (m *mockNextService) GetPayment(_ context.Context, s string) (output Payment, err error) {
 	m.called = true
 	return Payment{}, nil
 }
 
-func (m *mockNextService) CreatePayment(p Payment) (output CreatePaymentResponse, err error) {
+func (m *mockNextService) CreatePayment(_ context.Context, p Payment) (output CreatePaymentResponse, err error) {
 	m.called = true
 	return CreatePaymentResponse{}, nil
 }
 
-func (m *mockNextService) UpdatePayment(p UpdatePaymentRequest) (output UpdatePaymentResponse, err error) {
+func (m *mockNextService) UpdatePayment(_ context.Context, p UpdatePaymentRequest) (output UpdatePaymentResponse, err error) {
 	m.called = true
 	return UpdatePaymentResponse{}, nil
 }
 
-func (m *mockNextService) DeletePayment(id uuid.UUID) (t *time.Time, err error) {
+func (m *mockNextService) DeletePayment(_ context.Context, id uuid.UUID) (t *time.Time, err error) {
 	m.called = true
 	return nil, nil
 }
 
-func (m *mockNextService) GetListPayments() (output []Payment, err error) {
+func (m *mockNextService) GetListPayments(_ context.Context) (output []Payment, err error) {
 	m.called = true
 	return nil, nil
 }
@@ -43,16 +45,16 @@ func TestLogGetPayment(t *testing.T) {
 	m := &mockNextService{}
 	s := NewLogging(log.NewNopLogger(), m)
 	assert.False(t, m.called)
-	_, err := s.GetPayment("")
+	_, err := s.GetPayment(context.Background(), "")
 	assert.Nil(t, err)
 	assert.True(t, m.called)
 	p := Payment{}
 	p.Type = "Payment"
 	mockService := &MockPaymentService{}
-	mockService.On("GetPayment", mock.Anything).Return(p, nil)
+	mockService.On("GetPayment", mock.Anything, mock.Anything).Return(p, nil)
 	s1 := NewLogging(log.NewNopLogger(), mockService)
 	//assert.False(t, mockService.called)
-	_, err = s1.GetPayment("abcd")
+	_, err = s1.GetPayment(context.Background(), "abcd")
 	assert.Nil(t, err)
 	//assert.True(t, mockService.called)
 }
@@ -62,7 +64,7 @@ func TestLogCreatePayment(t *testing.T) {
 	s := NewLogging(log.NewNopLogger(), m)
 	assert.False(t, m.called)
 	p := Payment{}
-	_, err := s.CreatePayment(p)
+	_, err := s.CreatePayment(context.Background(), p)
 	assert.Nil(t, err)
 	assert.True(t, m.called)
 }
@@ -72,7 +74,7 @@ func TestLogUpdatePayment(t *testing.T) {
 	s := NewLogging(log.NewNopLogger(), m)
 	assert.False(t, m.called)
 	p := UpdatePaymentRequest{}
-	_, err := s.UpdatePayment(p)
+	_, err := s.UpdatePayment(context.Background(), p)
 	assert.Nil(t, err)
 	assert.True(t, m.called)
 	// up := UpdatePaymentRequest{}
@@ -83,7 +85,7 @@ func TestLogUpdatePayment(t *testing.T) {
 	// mockService.On("UpdateListPayments", up).Return(slice, nil)
 	// s1 := NewLogging(log.NewNopLogger(), mockService)
 	// assert.False(t, m.called)
-	// _, err = s1.GetListPayments()
+	// _, err = s1.GetListPayments(context.Background())
 	// assert.Nil(t, err)
 	// assert.True(t, m.called)
 
@@ -94,7 +96,7 @@ func TestDeleteUpdatePayment(t *testing.T) {
 	s := NewLogging(log.NewNopLogger(), m)
 	assert.False(t, m.called)
 	uuid, _ := uuid.NewV4()
-	_, err := s.DeletePayment(uuid)
+	_, err := s.DeletePayment(context.Background(), uuid)
 	assert.Nil(t, err)
 	assert.True(t, m.called)
 }
@@ -103,7 +105,7 @@ func TestGetListPayment(t *testing.T) {
 	m := &mockNextService{}
 	s := NewLogging(log.NewNopLogger(), m)
 	assert.False(t, m.called)
-	_, err := s.GetListPayments()
+	_, err := s.GetListPayments(context.Background())
 	assert.Nil(t, err)
 	assert.True(t, m.called)
 	p1 := Payment{}
@@ -116,8 +118,28 @@ func TestGetListPayment(t *testing.T) {
 	mockService.On("GetListPayments", mock.Anything).Return(slice, nil)
 	s1 := NewLogging(log.NewNopLogger(), mockService)
 	//assert.False(t, mockService.called)
-	output, err := s1.GetListPayments()
+	output, err := s1.GetListPayments(context.Background())
 	assert.Nil(t, err)
 	assert.NotNil(t, output)
 	//assert.True(t, mockService.called)
 }
+
+func TestLogRedactsPayments(t *testing.T) {
+	var b bytes.Buffer
+	logger, _ := NewLogger(&b, LogFormatJSON, LevelDebug)
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{}, nil)
+	s := NewLogging(logger, mockService)
+	p := Payment{Attributes: Attributes{DebtorParty: DebtorParty{
+		SponsorParty: SponsorParty{AccountNumber: "GB29XABC10161234567801"},
+		Name:         "Emelia Jane Brown",
+	}}}
+	_, err := s.CreatePayment(context.Background(), p)
+	assert.NoError(t, err)
+	assert.NotContains(t, b.String(), "Emelia")
+	assert.NotContains(t, b.String(), "GB29XABC10161234567801")
+	assert.Contains(t, b.String(), "7801")
+	assert.Contains(t, b.String(), `"level":"debug"`)
+	// the payment the next layer receives is not redacted
+	assert.Equal(t, "Emelia Jane Brown", mockService.Calls[0].Arguments.Get(1).(Payment).Attributes.DebtorParty.Name)
+}
@@ -0,0 +1,298 @@
+// Package metrics implements counters, gauges and histograms that can be exposed in the Prometheus text format.
+// The interfaces follow the ones of go-kit's metrics package so that the instrumenting middlewares read the same way
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Counter describes a metric that accumulates values monotonically
+type Counter interface {
+	With(labelValues ...string) Counter
+	Add(delta float64)
+}
+
+// Gauge describes a metric that takes specific values over time
+type Gauge interface {
+	With(labelValues ...string) Gauge
+	Set(value float64)
+	Add(delta float64)
+}
+
+// Histogram describes a metric that takes repeated observations of the same kind of thing and counts them in buckets
+type Histogram interface {
+	With(labelValues ...string) Histogram
+	Observe(value float64)
+}
+
+// DefBuckets are the default buckets of latency histograms, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds the metrics exposed by the /metrics endpoint
+type Registry struct {
+	mtx      sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		families: map[string]*family{},
+	}
+}
+
+// family is a metric and all its labelled series
+type family struct {
+	name    string
+	help    string
+	typ     string
+	buckets []float64
+	fn      func() float64
+
+	mtx    sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.families[f.name]; ok {
+		panic("metrics: " + f.name + " registered twice")
+	}
+	f.series = map[string]*series{}
+	r.families[f.name] = f
+	return f
+}
+
+// NewCounter registers and returns a new counter
+func (r *Registry) NewCounter(name, help string) Counter {
+	return &counter{f: r.register(&family{name: name, help: help, typ: "counter"})}
+}
+
+// NewGauge registers and returns a new gauge
+func (r *Registry) NewGauge(name, help string) Gauge {
+	return &gauge{f: r.register(&family{name: name, help: help, typ: "gauge"})}
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn every time the metrics are collected
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// NewHistogram registers and returns a new histogram counting the observations in the buckets (upper bounds, sorted)
+func (r *Registry) NewHistogram(name, help string, buckets []float64) Histogram {
+	return &histogram{f: r.register(&family{name: name, help: help, typ: "histogram", buckets: buckets})}
+}
+
+// with returns the series of the label values, creating it when needed. The caller must hold f.mtx
+func (f *family) with(labelValues []string) *series {
+	key := formatLabels(labelValues)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+type counter struct {
+	f           *family
+	labelValues []string
+}
+
+// With returns the counter of the label values, given as key/value pairs
+func (c *counter) With(labelValues ...string) Counter {
+	return &counter{f: c.f, labelValues: append(append([]string{}, c.labelValues...), labelValues...)}
+}
+
+// Add increments the counter, negative values are ignored
+func (c *counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.f.mtx.Lock()
+	c.f.with(c.labelValues).value += delta
+	c.f.mtx.Unlock()
+}
+
+type gauge struct {
+	f           *family
+	labelValues []string
+}
+
+// With returns the gauge of the label values, given as key/value pairs
+func (g *gauge) With(labelValues ...string) Gauge {
+	return &gauge{f: g.f, labelValues: append(append([]string{}, g.labelValues...), labelValues...)}
+}
+
+// Set sets the value of the gauge
+func (g *gauge) Set(value float64) {
+	g.f.mtx.Lock()
+	g.f.with(g.labelValues).value = value
+	g.f.mtx.Unlock()
+}
+
+// Add adds delta, which may be negative, to the value of the gauge
+func (g *gauge) Add(delta float64) {
+	g.f.mtx.Lock()
+	g.f.with(g.labelValues).value += delta
+	g.f.mtx.Unlock()
+}
+
+type histogram struct {
+	f           *family
+	labelValues []string
+}
+
+// With returns the histogram of the label values, given as key/value pairs
+func (h *histogram) With(labelValues ...string) Histogram {
+	return &histogram{f: h.f, labelValues: append(append([]string{}, h.labelValues...), labelValues...)}
+}
+
+// Observe records a value
+func (h *histogram) Observe(value float64) {
+	h.f.mtx.Lock()
+	defer h.f.mtx.Unlock()
+	s := h.f.with(h.labelValues)
+	for i, b := range h.f.buckets {
+		if value <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// formatLabels formats key/value pairs as Prometheus labels, sorted by key. A missing last value is reported as "unknown"
+func formatLabels(labelValues []string) string {
+	if len(labelValues) == 0 {
+		return ""
+	}
+	if len(labelValues)%2 == 1 {
+		labelValues = append(labelValues, "unknown")
+	}
+	pairs := make([]string, 0, len(labelValues)/2)
+	for i := 0; i < len(labelValues); i += 2 {
+		pairs = append(pairs, labelValues[i]+`="`+escape(labelValues[i+1])+`"`)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// joinLabels adds a label to an already formatted set of labels and wraps them in braces
+func joinLabels(labels, extra string) string {
+	switch {
+	case labels == "" && extra == "":
+		return ""
+	case labels == "":
+		return "{" + extra + "}"
+	case extra == "":
+		return "{" + labels + "}"
+	}
+	return "{" + labels + "," + extra + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes all the metrics of the registry in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mtx.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mtx.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	if err := cw.w.(*bufio.Writer).Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+func (f *family) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+	if f.fn != nil {
+		fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.fn()))
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, joinLabels(k, ""), formatFloat(s.value))
+			continue
+		}
+		for i, b := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, joinLabels(k, `le="`+formatFloat(b)+`"`), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, joinLabels(k, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, joinLabels(k, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, joinLabels(k, ""), s.count)
+	}
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// Handler returns the HTTP handler of the /metrics endpoint
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
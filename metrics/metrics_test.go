@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Number of requests.")
+	c.With("method", "get").Add(1)
+	c.With("method", "get").Add(2)
+	c.With("method", "create", "code", "x\"y").Add(1)
+	c.With("method", "get").Add(-5)
+	g := r.NewGauge("in_flight", "Requests in flight.")
+	g.Add(3)
+	g.Add(-1)
+	r.NewGaugeFunc("open_connections", "Open connections.", func() float64 { return 4 })
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.With("method", "get").Observe(0.05)
+	h.With("method", "get").Observe(0.5)
+	h.With("method", "get").Observe(5)
+
+	var b bytes.Buffer
+	_, err := r.WriteTo(&b)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="get",le="0.1"} 1
+latency_seconds_bucket{method="get",le="1"} 2
+latency_seconds_bucket{method="get",le="+Inf"} 3
+latency_seconds_sum{method="get"} 5.55
+latency_seconds_count{method="get"} 3
+# HELP open_connections Open connections.
+# TYPE open_connections gauge
+open_connections 4
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{code="x\"y",method="create"} 1
+requests_total{method="get"} 3
+`, b.String())
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "")
+	assert.Panics(t, func() { r.NewGauge("requests_total", "") })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Number of requests.").With("method", "get").Add(1)
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `requests_total{method="get"} 1`)
+}
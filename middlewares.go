@@ -55,11 +55,11 @@ type DeletePaymentResponse struct {
 
 // MakeGetListPaymentsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the GetListPayments method
 func MakeGetListPaymentsEndpoint(svc PaymentService) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
-		v, err := svc.GetListPayments()
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		v, err := svc.GetListPayments(ctx)
 		if err != nil {
 			var ErrAcc = errors.New("err: Could not GET list payments")
-			cErr := errors.New(ErrAcc.Error() + " \n" + err.Error())
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
 			return nil, cErr
 		}
 		return v, nil
@@ -68,12 +68,12 @@ func MakeGetListPaymentsEndpoint(svc PaymentService) endpoint.Endpoint {
 
 // MakeGetPaymentEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the GetPayment method
 func MakeGetPaymentEndpoint(svc PaymentService) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(GetPaymentRequest)
-		v, err := svc.GetPayment(req.PaymentID)
+		v, err := svc.GetPayment(ctx, req.PaymentID)
 		if err != nil {
 			var ErrAcc = errors.New("err: Could not GET payment")
-			cErr := errors.New(ErrAcc.Error() + " \n" + err.Error())
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
 			return nil, cErr
 		}
 		return v, nil
@@ -82,12 +82,12 @@ func MakeGetPaymentEndpoint(svc PaymentService) endpoint.Endpoint {
 
 // MakeCreatePaymentEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the CreatePayment method
 func MakeCreatePaymentEndpoint(svc PaymentService) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(CreatePaymentRequest)
-		v, err := svc.CreatePayment(req.Payment)
+		v, err := svc.CreatePayment(ctx, req.Payment)
 		if err != nil {
 			var ErrAcc = errors.New("err: Could not Create(POST) payment")
-			cErr := errors.New(ErrAcc.Error() + " \n" + err.Error())
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
 			return nil, cErr
 		}
 		return v, nil
@@ -96,12 +96,12 @@ func MakeCreatePaymentEndpoint(svc PaymentService) endpoint.Endpoint {
 
 // MakeUpdatePaymentEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the UpdatePayment method
 func MakeUpdatePaymentEndpoint(svc PaymentService) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(UpdatePaymentRequest)
-		v, err := svc.UpdatePayment(req)
+		v, err := svc.UpdatePayment(ctx, req)
 		if err != nil {
 			var ErrAcc = errors.New("err: Could not Update(PUT) payment ")
-			cErr := errors.New(ErrAcc.Error() + " \n" + err.Error())
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
 			return UpdatePaymentRequest{}, cErr
 		}
 		return v, nil
@@ -110,12 +110,12 @@ func MakeUpdatePaymentEndpoint(svc PaymentService) endpoint.Endpoint {
 
 // MakeDeletePaymentEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the DeletePayment method
 func MakeDeletePaymentEndpoint(svc PaymentService) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(DeletePaymentRequest)
-		t, err := svc.DeletePayment(req.PaymentID)
+		t, err := svc.DeletePayment(ctx, req.PaymentID)
 		if err != nil {
 			var ErrAcc = errors.New("err: Could not DELETE payment")
-			cErr := errors.New(ErrAcc.Error() + " \n" + err.Error())
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
 			return DeletePaymentRequest{}, cErr
 		}
 		return DeletePaymentResponse{DeletedAt: t}, nil
@@ -82,7 +82,7 @@ func TestMakeGetPaymentEndpoint(t *testing.T) {
 			name: "MakeGetPaymentEndpoint successfully GETs a payment",
 			Service: func() PaymentService {
 				mockSvc := &MockPaymentService{}
-				mockSvc.On("GetPayment", mock.Anything).Return(response, nil)
+				mockSvc.On("GetPayment", mock.Anything, mock.Anything).Return(response, nil)
 				return mockSvc
 			},
 			isError:     false,
@@ -93,7 +93,7 @@ func TestMakeGetPaymentEndpoint(t *testing.T) {
 			name: "MakeGetPaymentEndpoint failed to GET a payment",
 			Service: func() PaymentService {
 				mockSvc := &MockPaymentService{}
-				mockSvc.On("GetPayment", mock.Anything).Return(response, tError)
+				mockSvc.On("GetPayment", mock.Anything, mock.Anything).Return(response, tError)
 				return mockSvc
 			},
 			isError:     true,
@@ -136,7 +136,7 @@ func TestMakeCreatePaymentEndpoint(t *testing.T) {
 			name: "MakeCreatePaymentEndpoint successfully POSTs a payment",
 			Service: func() PaymentService {
 				mockSvc := &MockPaymentService{}
-				mockSvc.On("CreatePayment", mock.Anything).Return(response, nil)
+				mockSvc.On("CreatePayment", mock.Anything, mock.Anything).Return(response, nil)
 				return mockSvc
 			},
 			isError:     false,
@@ -147,7 +147,7 @@ func TestMakeCreatePaymentEndpoint(t *testing.T) {
 			name: "MakeCreatePaymentEndpoint failed to POST a payment",
 			Service: func() PaymentService {
 				mockSvc := &MockPaymentService{}
-				mockSvc.On("CreatePayment", mock.Anything).Return(response, tError)
+				mockSvc.On("CreatePayment", mock.Anything, mock.Anything).Return(response, tError)
 				return mockSvc
 			},
 			isError:     true,
@@ -190,7 +190,7 @@ func TestMakeDeletePaymentEndpoint(t *testing.T) {
 			name: "MakeDeletePaymentEndpoint successfully DELETEs a payment",
 			Service: func() PaymentService {
 				mockSvc := &MockPaymentService{}
-				mockSvc.On("DeletePayment", mock.Anything).Return(response, nil)
+				mockSvc.On("DeletePayment", mock.Anything, mock.Anything).Return(response, nil)
 				return mockSvc
 			},
 			isError:     false,
@@ -201,7 +201,7 @@ func TestMakeDeletePaymentEndpoint(t *testing.T) {
 			name: "MakeDeletePaymentEndpoint failed to DELETE a payment",
 			Service: func() PaymentService {
 				mockSvc := &MockPaymentService{}
-				mockSvc.On("DeletePayment", mock.Anything).Return(response, tError)
+				mockSvc.On("DeletePayment", mock.Anything, mock.Anything).Return(response, tError)
 				return mockSvc
 			},
 			isError:     true,
@@ -245,7 +245,7 @@ func TestMakeUpdatePaymentEndpoint(t *testing.T) {
 			name: "MakeUpdatePaymentEndpoint successfully PUTs a payment",
 			Service: func() PaymentService {
 				mockSvc := &MockPaymentService{}
-				mockSvc.On("UpdatePayment", mock.Anything).Return(response, nil)
+				mockSvc.On("UpdatePayment", mock.Anything, mock.Anything).Return(response, nil)
 				return mockSvc
 			},
 			isError:     false,
@@ -256,7 +256,7 @@ func TestMakeUpdatePaymentEndpoint(t *testing.T) {
 			name: "MakeUpdatePaymentEndpoint failed to PUT a payment",
 			Service: func() PaymentService {
 				mockSvc := &MockPaymentService{}
-				mockSvc.On("UpdatePayment", mock.Anything).Return(response, tError)
+				mockSvc.On("UpdatePayment", mock.Anything, mock.Anything).Return(response, tError)
 				return mockSvc
 			},
 			isError:     true,
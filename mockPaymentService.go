@@ -2,6 +2,7 @@
 
 package paymentsapi
 
+import context "context"
 import mock "github.com/stretchr/testify/mock"
 import time "time"
 import uuid "github.com/satori/go.uuid"
@@ -11,20 +12,20 @@ type MockPaymentService struct {
 	mock.Mock
 }
 
-// CreatePayment provides a mock function with given fields: p
-func (_m *MockPaymentService) CreatePayment(p Payment) (CreatePaymentResponse, error) {
-	ret := _m.Called(p)
+// CreatePayment provides a mock function with given fields: ctx, p
+func (_m *MockPaymentService) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
+	ret := _m.Called(ctx, p)
 
 	var r0 CreatePaymentResponse
-	if rf, ok := ret.Get(0).(func(Payment) CreatePaymentResponse); ok {
-		r0 = rf(p)
+	if rf, ok := ret.Get(0).(func(context.Context, Payment) CreatePaymentResponse); ok {
+		r0 = rf(ctx, p)
 	} else {
 		r0 = ret.Get(0).(CreatePaymentResponse)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(Payment) error); ok {
-		r1 = rf(p)
+	if rf, ok := ret.Get(1).(func(context.Context, Payment) error); ok {
+		r1 = rf(ctx, p)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -32,13 +33,13 @@ func (_m *MockPaymentService) CreatePayment(p Payment) (CreatePaymentResponse, e
 	return r0, r1
 }
 
-// DeletePayment provides a mock function with given fields: id
-func (_m *MockPaymentService) DeletePayment(id uuid.UUID) (*time.Time, error) {
-	ret := _m.Called(id)
+// DeletePayment provides a mock function with given fields: ctx, id
+func (_m *MockPaymentService) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	ret := _m.Called(ctx, id)
 
 	var r0 *time.Time
-	if rf, ok := ret.Get(0).(func(uuid.UUID) *time.Time); ok {
-		r0 = rf(id)
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) *time.Time); ok {
+		r0 = rf(ctx, id)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*time.Time)
@@ -46,8 +47,8 @@ func (_m *MockPaymentService) DeletePayment(id uuid.UUID) (*time.Time, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(uuid.UUID) error); ok {
-		r1 = rf(id)
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, id)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -55,13 +56,13 @@ func (_m *MockPaymentService) DeletePayment(id uuid.UUID) (*time.Time, error) {
 	return r0, r1
 }
 
-// GetListPayments provides a mock function with given fields:
-func (_m *MockPaymentService) GetListPayments() ([]Payment, error) {
-	ret := _m.Called()
+// GetListPayments provides a mock function with given fields: ctx
+func (_m *MockPaymentService) GetListPayments(ctx context.Context) ([]Payment, error) {
+	ret := _m.Called(ctx)
 
 	var r0 []Payment
-	if rf, ok := ret.Get(0).(func() []Payment); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context) []Payment); ok {
+		r0 = rf(ctx)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]Payment)
@@ -69,8 +70,8 @@ func (_m *MockPaymentService) GetListPayments() ([]Payment, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func() error); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -78,20 +79,20 @@ func (_m *MockPaymentService) GetListPayments() ([]Payment, error) {
 	return r0, r1
 }
 
-// GetPayment provides a mock function with given fields: id
-func (_m *MockPaymentService) GetPayment(id string) (Payment, error) {
-	ret := _m.Called(id)
+// GetPayment provides a mock function with given fields: ctx, id
+func (_m *MockPaymentService) GetPayment(ctx context.Context, id string) (Payment, error) {
+	ret := _m.Called(ctx, id)
 
 	var r0 Payment
-	if rf, ok := ret.Get(0).(func(string) Payment); ok {
-		r0 = rf(id)
+	if rf, ok := ret.Get(0).(func(context.Context, string) Payment); ok {
+		r0 = rf(ctx, id)
 	} else {
 		r0 = ret.Get(0).(Payment)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(id)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, id)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -99,20 +100,20 @@ func (_m *MockPaymentService) GetPayment(id string) (Payment, error) {
 	return r0, r1
 }
 
-// UpdatePayment provides a mock function with given fields: p
-func (_m *MockPaymentService) UpdatePayment(p UpdatePaymentRequest) (UpdatePaymentResponse, error) {
-	ret := _m.Called(p)
+// UpdatePayment provides a mock function with given fields: ctx, p
+func (_m *MockPaymentService) UpdatePayment(ctx context.Context, p UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	ret := _m.Called(ctx, p)
 
 	var r0 UpdatePaymentResponse
-	if rf, ok := ret.Get(0).(func(UpdatePaymentRequest) UpdatePaymentResponse); ok {
-		r0 = rf(p)
+	if rf, ok := ret.Get(0).(func(context.Context, UpdatePaymentRequest) UpdatePaymentResponse); ok {
+		r0 = rf(ctx, p)
 	} else {
 		r0 = ret.Get(0).(UpdatePaymentResponse)
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(UpdatePaymentRequest) error); ok {
-		r1 = rf(p)
+	if rf, ok := ret.Get(1).(func(context.Context, UpdatePaymentRequest) error); ok {
+		r1 = rf(ctx, p)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -2,6 +2,9 @@ package paymentsapi
 
 import (
 	//"github.com/jinzhu/gorm"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -20,15 +23,128 @@ type Model struct {
 	ModelBase
 }
 
+// Date is a day without a time of day, e.g. the processing date of a payment. It is formatted as YYYY-MM-DD in JSON
+// and stored as such, the zero Date is empty
+type Date struct {
+	time.Time
+}
+
+// ParseDate parses a day formatted as YYYY-MM-DD
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse(isoDateFormat, s)
+	if err != nil {
+		return Date{}, fmt.Errorf("err: %q is not a date formatted as YYYY-MM-DD", s)
+	}
+	return Date{t}, nil
+}
+
+// DateOf returns the day of t in UTC
+func DateOf(t time.Time) Date {
+	y, m, d := t.UTC().Date()
+	return Date{time.Date(y, m, d, 0, 0, 0, 0, time.UTC)}
+}
+
+// String formats d as YYYY-MM-DD, the zero Date as an empty string
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format(isoDateFormat)
+}
+
+// MarshalText formats d as YYYY-MM-DD
+func (d Date) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText parses a day formatted as YYYY-MM-DD, an empty text is the zero Date
+func (d *Date) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = Date{}
+		return nil
+	}
+	date, err := ParseDate(string(text))
+	if err != nil {
+		return err
+	}
+	*d = date
+	return nil
+}
+
+// MarshalJSON formats d as YYYY-MM-DD, replacing the timestamp format of time.Time
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON parses a day formatted as YYYY-MM-DD, null and an empty string are the zero Date
+func (d *Date) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// Value stores d as YYYY-MM-DD, which a date column as well as a text one takes
+func (d Date) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	return d.String(), nil
+}
+
+// Scan reads a date column, or a text one holding YYYY-MM-DD
+func (d *Date) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*d = Date{}
+		return nil
+	case time.Time:
+		*d = DateOf(v)
+		return nil
+	case string:
+		return d.UnmarshalText([]byte(v))
+	case []byte:
+		return d.UnmarshalText(v)
+	}
+	return fmt.Errorf("err: cannot read a date from a %T", value)
+}
+
+// Statuses of a payment. The status is managed by the API, the one sent by clients is ignored
+const (
+	PaymentStatusAccepted        = "accepted"
+	PaymentStatusPendingApproval = "pending_approval"
+	// PaymentStatusScheduled holds a payment until its processing date, when the scheduler accepts it. A scheduled
+	// payment can be cancelled, and PaymentStatusCancelled is final
+	PaymentStatusScheduled = "scheduled"
+	PaymentStatusCancelled = "cancelled"
+	// PaymentStatusSettled and PaymentStatusRejected are final, they are set from the status reports of the banks
+	PaymentStatusSettled  = "settled"
+	PaymentStatusRejected = "rejected"
+	// PaymentStatusReturned is final, the funds of a settled payment came back from the beneficiary's bank
+	PaymentStatusReturned = "returned"
+)
+
 // Payment reprensents a payment resource
 type Payment struct {
 	ModelBase
-	ID             uuid.UUID  `json:"id" gorm:"type:uuid; primary_key"`
-	Type           string     `json:"type" validate:"required"`
-	Version        uint       `json:"version" binding:"exists"`
+	ID      uuid.UUID `json:"id" gorm:"type:uuid; primary_key"`
+	Type    string    `json:"type" validate:"required"`
+	Version uint      `json:"version" binding:"exists"`
+	Status  string    `json:"status"`
+	// SchemeStatus is the last transaction status reported by the banks, e.g. ACSP, and StatusReason the reason codes
+	// they gave for it
+	SchemeStatus   string     `json:"scheme_status,omitempty"`
+	StatusReason   string     `json:"status_reason,omitempty"`
 	OrganisationID uuid.UUID  `json:"organisation_id" validate:"required"`
 	Attributes     Attributes `json:"attributes" gorm:"auto_preload" validate:"required"`
 	AttributesID   uint       `json:"-" sql:"index"`
+	// Refunds sums the refunds of a refunded payment, and RefundOf is the payment a refund refunds
+	Refunds  *RefundSummary `json:"refunds,omitempty" gorm:"-"`
+	RefundOf *uuid.UUID     `json:"refund_of,omitempty" gorm:"-"`
 }
 
 // Attributes ...
@@ -50,7 +166,7 @@ type Attributes struct {
 	PaymentPurpose       string             `json:"payment_purpose" validate:"required"`
 	PaymentScheme        string             `json:"payment_scheme" validate:"required"`
 	PaymentType          string             `json:"payment_type" validate:"required"`
-	ProcessingDate       string             `json:"processing_date" validate:"required"`
+	ProcessingDate       Date               `json:"processing_date" gorm:"type:date" validate:"required"`
 	Reference            string             `json:"reference" validate:"required"`
 	SchemePaymentSubType string             `json:"scheme_payment_sub_type" validate:"required"`
 	SchemePaymentType    string             `json:"scheme_payment_type" validate:"required"`
@@ -67,17 +183,17 @@ type BeneficiaryParty struct {
 // DebtorParty ...
 type DebtorParty struct {
 	SponsorParty
-	AccountName       string `json:"account_name" validate:"required"`
+	AccountName       string `json:"account_name" validate:"required" redact:"mask"`
 	AccountNumberCode string `json:"account_number_code" validate:"required"`
-	Address           string `json:"address" validate:"required"`
-	Name              string `json:"name" validate:"required"`
+	Address           string `json:"address" validate:"required" redact:"mask"`
+	Name              string `json:"name" validate:"required" redact:"mask"`
 }
 
 // SponsorParty ...
 type SponsorParty struct {
 	Model
 	//gorm.Model
-	AccountNumber string `json:"account_number" validate:"required"`
+	AccountNumber string `json:"account_number" validate:"required" redact:"last4"`
 	BankID        string `json:"bank_id" validate:"required"`
 	BankIDCode    string `json:"bank_id_code" validate:"required"`
 }
@@ -0,0 +1,44 @@
+package paymentsapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mustDate parses a day formatted as YYYY-MM-DD, the tests only use valid ones
+func mustDate(s string) Date {
+	d, err := ParseDate(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestDate(t *testing.T) {
+	var a Attributes
+	assert.NoError(t, json.Unmarshal([]byte(`{"processing_date":"2017-01-18"}`), &a))
+	assert.Equal(t, mustDate("2017-01-18"), a.ProcessingDate)
+	b, _ := json.Marshal(a.ProcessingDate)
+	assert.Equal(t, `"2017-01-18"`, string(b))
+	assert.EqualError(t, json.Unmarshal([]byte(`{"processing_date":"18/01/2017"}`), &a), `err: "18/01/2017" is not a date formatted as YYYY-MM-DD`)
+	assert.NoError(t, json.Unmarshal([]byte(`{"processing_date":""}`), &a))
+	assert.True(t, a.ProcessingDate.IsZero())
+
+	// the day is taken in UTC
+	assert.Equal(t, mustDate("2019-04-04"), DateOf(time.Date(2019, 4, 3, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60))))
+
+	var d Date
+	assert.NoError(t, d.Scan(time.Date(2017, 1, 18, 0, 0, 0, 0, time.Local)))
+	assert.Equal(t, "2017-01-18", d.String())
+	assert.NoError(t, d.Scan([]byte("2017-01-19")))
+	assert.Equal(t, mustDate("2017-01-19"), d)
+	assert.NoError(t, d.Scan(nil))
+	assert.True(t, d.IsZero())
+	v, _ := d.Value()
+	assert.Nil(t, v)
+	v, _ = mustDate("2017-01-18").Value()
+	assert.Equal(t, "2017-01-18", v)
+}
@@ -0,0 +1,551 @@
+package paymentsapi
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/text/unicode/norm"
+)
+
+// FormatMT103 is the SWIFT MT103 single customer credit transfer, the messages of a file are separated by a line
+// holding a $ as in the RJE files
+const FormatMT103 = "mt103"
+
+// mt103DateFormat is the layout of the value date of :32A:
+const mt103DateFormat = "060102"
+
+// mt103BearerCodes map the bearer codes of the payments to the details of charges of :71A:
+var mt103BearerCodes = map[string]string{
+	"DEBT": "OUR",
+	"CRED": "BEN",
+	"SHAR": "SHA",
+	"SLEV": "SHA",
+}
+
+// mt103ClearingCodes map the bank_id_code of the clearing systems to the codes of the party identifiers of :57C:,
+// e.g. //SC403000 for a UK sort code
+var mt103ClearingCodes = map[string]string{
+	"GBDSC": "SC",
+	"DEBLZ": "BL",
+	"ATBLZ": "AT",
+	"CHBCC": "SW",
+	"USABA": "FW",
+	"CACPA": "CC",
+	"AUBSB": "AU",
+	"IENCC": "IE",
+	"ITNCC": "IT",
+	"ESNCC": "ES",
+	"PTNCC": "PT",
+}
+
+var (
+	mt103ReferencePattern = regexp.MustCompile(`^[a-zA-Z0-9/\-?:().,'+ ]{1,16}$`)
+	mt103AmountPattern    = regexp.MustCompile(`^[0-9]{1,14},[0-9]*$`)
+	mt103ChargePattern    = regexp.MustCompile(`^[A-Z]{3}[0-9]{1,14},[0-9]*$`)
+	mt103TagPattern       = regexp.MustCompile(`^:([0-9]{2}[A-Z]?):`)
+)
+
+// swiftTransliterations replace the letters the accents cannot be stripped from
+var swiftTransliterations = map[rune]string{
+	'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Ø': "O", 'ø': "o", 'Œ': "OE", 'œ': "oe", 'Ł': "L", 'ł': "l", 'Đ': "D", 'đ': "d",
+	'&': "+", '_': "-", '"': "'", '\t': " ",
+}
+
+// swiftCharset transliterates the text to the SWIFT X character set: the accents are stripped and the characters
+// left outside of the set are replaced by dots
+func swiftCharset(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case swiftTransliterations[r] != "":
+			b.WriteString(swiftTransliterations[r])
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("/-?:().,'+ ", r):
+			b.WriteRune(r)
+		case r == '\n' || r == '\r':
+			b.WriteRune(' ')
+		default:
+			b.WriteRune('.')
+		}
+	}
+	return b.String()
+}
+
+// mt103Lines transliterates the text and wraps it in lines of at most 35 characters. A line cannot start with : or -
+// which would start a field or end the message
+func mt103Lines(text string) []string {
+	lines := wrapWords(swiftCharset(text), 35)
+	for i, l := range lines {
+		if strings.HasPrefix(l, ":") || strings.HasPrefix(l, "-") {
+			lines[i] = "." + l[1:]
+		}
+	}
+	return lines
+}
+
+// mt103Field is a field of the text block, the lines of its value are separated by \n
+type mt103Field struct {
+	Tag   string
+	Value string
+}
+
+// mt103Message is an MT103 with its basic header, application header, user header and text block
+type mt103Message struct {
+	// Sender and Receiver are the BICs of the banks exchanging the message
+	Sender   string
+	Receiver string
+	UETR     string
+	Fields   []mt103Field
+	// Line is the line of the file the message starts at
+	Line int
+}
+
+// field returns the value of the first field with the tag
+func (m mt103Message) field(tags ...string) (string, string) {
+	for _, f := range m.Fields {
+		for _, tag := range tags {
+			if f.Tag == tag {
+				return f.Tag, f.Value
+			}
+		}
+	}
+	return "", ""
+}
+
+// mt103Address returns the logical terminal address of the BIC, a BIC without a branch is the head office XXX
+func mt103Address(bic string, terminal byte) string {
+	branch := "XXX"
+	if len(bic) == 11 {
+		branch = bic[8:]
+	}
+	if len(bic) < 8 {
+		return bic
+	}
+	return bic[:8] + string(terminal) + branch
+}
+
+// mt103BIC returns the BIC of the logical terminal address
+func mt103BIC(address string) string {
+	if len(address) != 12 {
+		return address
+	}
+	if address[9:] == "XXX" {
+		return address[:8]
+	}
+	return address[:8] + address[9:]
+}
+
+// String renders the message with the CRLF line endings of the network
+func (m mt103Message) String() string {
+	var b strings.Builder
+	b.WriteString("{1:F01" + mt103Address(m.Sender, 'A') + "0000000000}")
+	b.WriteString("{2:I103" + mt103Address(m.Receiver, 'X') + "N}")
+	if m.UETR != "" {
+		b.WriteString("{3:{121:" + m.UETR + "}}")
+	}
+	b.WriteString("{4:\r\n")
+	for _, f := range m.Fields {
+		b.WriteString(":" + f.Tag + ":" + strings.Replace(f.Value, "\n", "\r\n", -1) + "\r\n")
+	}
+	b.WriteString("-}")
+	return b.String()
+}
+
+// mt103Amount formats a decimal amount with the decimal comma, e.g. 100,21 or 100,
+func mt103Amount(amount string) string {
+	if !strings.Contains(amount, ".") {
+		return amount + ","
+	}
+	return strings.Replace(amount, ".", ",", 1)
+}
+
+// mt103Decimal reads an amount with a decimal comma
+func mt103Decimal(amount string) string {
+	return strings.TrimSuffix(strings.Replace(amount, ",", ".", 1), ".")
+}
+
+// mt103Party renders the account, the name and the address of a party, the name and the address take at most four
+// lines and are cut beyond
+func mt103Party(account, name, address string) string {
+	var lines []string
+	if account != "" {
+		lines = append(lines, "/"+swiftCharset(account))
+	}
+	details := append(mt103Lines(name), mt103Lines(address)...)
+	if len(details) > 4 {
+		details = details[:4]
+	}
+	return strings.Join(append(lines, details...), "\n")
+}
+
+// mt103Bank renders the field of a bank with its option: A with a BIC, C with a clearing code and D otherwise
+func mt103Bank(tag, bankID, bankIDCode string) mt103Field {
+	if bankIDCode == isoBankIDCodeBIC {
+		return mt103Field{Tag: tag + "A", Value: bankID}
+	}
+	if code, ok := mt103ClearingCodes[bankIDCode]; ok {
+		return mt103Field{Tag: tag + "C", Value: "//" + code + bankID}
+	}
+	return mt103Field{Tag: tag + "D", Value: "//" + swiftCharset(bankIDCode+bankID)}
+}
+
+// mt103MessageOf renders the payment as an MT103 sent by the debtor's bank. The message goes to the sponsor when it
+// has a BIC, it is then the correspondent holding the account of :53B:, and straight to the beneficiary's bank
+// otherwise. The problems returned keep the message from being sent
+func mt103MessageOf(p Payment) (mt103Message, []string) {
+	a := p.Attributes
+	c := &isoChecker{}
+	m := mt103Message{Sender: a.DebtorParty.BankID}
+	if p.ID != uuid.Nil {
+		m.UETR = p.ID.String()
+	}
+	c.check(a.DebtorParty.BankIDCode == isoBankIDCodeBIC, "debtor_party.bank_id", "the sender needs a BIC")
+	switch {
+	case a.SponsorParty.BankIDCode == isoBankIDCodeBIC && a.SponsorParty.BankID != "":
+		m.Receiver = a.SponsorParty.BankID
+	case a.BeneficiaryParty.BankIDCode == isoBankIDCodeBIC:
+		m.Receiver = a.BeneficiaryParty.BankID
+	default:
+		c.check(false, "beneficiary_party.bank_id", "the receiver needs a BIC, of the sponsor or of the beneficiary's bank")
+	}
+	for _, bic := range []string{m.Sender, m.Receiver} {
+		if bic != "" {
+			c.pattern("bank_id "+bic, bic, isoBICPattern, "is not a BIC")
+		}
+	}
+
+	c.pattern("field 20", a.PayID, mt103ReferencePattern, "payment_id must have between 1 and 16 characters of the SWIFT X set")
+	c.check(!strings.HasPrefix(a.PayID, "/") && !strings.HasSuffix(a.PayID, "/") && !strings.Contains(a.PayID, "//"), "field 20", "payment_id cannot start or end with / or hold //")
+	m.Fields = append(m.Fields, mt103Field{Tag: "20", Value: a.PayID}, mt103Field{Tag: "23B", Value: "CRED"})
+	c.check(!a.ProcessingDate.IsZero(), "field 32A", "processing_date is required")
+	m.Fields = append(m.Fields, mt103Field{Tag: "32A", Value: a.ProcessingDate.Format(mt103DateFormat) + a.Currency + mt103Amount(a.Amount)})
+	c.pattern("field 32A", a.Currency, isoCurrencyPattern, "currency must be an ISO 4217 currency code")
+	c.pattern("field 32A", mt103Amount(a.Amount), mt103AmountPattern, "amount must be a positive amount of at most 14 digits")
+
+	// the network rules only let the sender's charges through with BEN and SHA, and the receiver's with OUR
+	bearer, ok := mt103BearerCodes[a.ChargesInformation.BearerCode]
+	c.check(ok, "field 71A", "bearer_code must be one of DEBT, CRED, SHAR, SLEV")
+	var charges []mt103Field
+	switch bearer {
+	case "BEN", "SHA":
+		for _, ch := range a.ChargesInformation.SenderCharges {
+			charges = append(charges, mt103Field{Tag: "71F", Value: ch.Currency + mt103Amount(ch.Amount)})
+		}
+		if bearer == "BEN" && len(charges) == 0 {
+			charges = append(charges, mt103Field{Tag: "71F", Value: a.Currency + "0,"})
+		}
+	case "OUR":
+		if rc := a.ChargesInformation.ReceiverChargesAmount; rc != "" && !isoSameAmount(rc, "0") {
+			charges = append(charges, mt103Field{Tag: "71G", Value: a.ChargesInformation.ReceiverChargesCurrency + mt103Amount(rc)})
+		}
+	}
+	// the instructed amount is required along with the charges and the exchange rate when it is in another currency
+	instructed := mt103Field{Tag: "33B", Value: a.Currency + mt103Amount(a.Amount)}
+	if a.Forex.OriginalAmount != "" {
+		instructed.Value = a.Forex.OriginalCurrency + mt103Amount(a.Forex.OriginalAmount)
+	}
+	if a.Forex.OriginalAmount != "" || len(charges) > 0 {
+		m.Fields = append(m.Fields, instructed)
+	}
+	if a.Forex.OriginalAmount != "" && a.Forex.OriginalCurrency != a.Currency {
+		c.check(a.Forex.ExchangeRate != "", "field 36", "fx.exchange_rate is required when the original currency differs")
+		m.Fields = append(m.Fields, mt103Field{Tag: "36", Value: mt103Amount(a.Forex.ExchangeRate)})
+	}
+
+	m.Fields = append(m.Fields, mt103Field{Tag: "50K", Value: mt103Party(a.DebtorParty.AccountNumber, a.DebtorParty.Name, a.DebtorParty.Address)})
+	if m.Receiver != "" && m.Receiver == a.SponsorParty.BankID && a.SponsorParty.AccountNumber != "" {
+		m.Fields = append(m.Fields, mt103Field{Tag: "53B", Value: "/" + swiftCharset(a.SponsorParty.AccountNumber)})
+	}
+	if m.Receiver != a.BeneficiaryParty.BankID {
+		m.Fields = append(m.Fields, mt103Bank("57", a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode))
+	}
+	m.Fields = append(m.Fields, mt103Field{Tag: "59", Value: mt103Party(a.BeneficiaryParty.AccountNumber, a.BeneficiaryParty.Name, a.BeneficiaryParty.Address)})
+
+	// the references go to the remittance information, the code words name the ones that are not free text
+	var remittance []string
+	if a.EndToEndReference != "" {
+		remittance = append(remittance, "/ROC/"+swiftCharset(a.EndToEndReference))
+	}
+	if a.NumericReference != "" {
+		remittance = append(remittance, "/RFB/"+swiftCharset(a.NumericReference))
+	}
+	remittance = append(remittance, mt103Lines(a.Reference)...)
+	for _, l := range remittance {
+		c.check(len(l) <= 35, "field 70", "the line "+l+" is longer than 35 characters")
+	}
+	c.check(len(remittance) <= 4, "field 70", "the references take more than 4 lines")
+	if len(remittance) > 0 {
+		m.Fields = append(m.Fields, mt103Field{Tag: "70", Value: strings.Join(remittance, "\n")})
+	}
+	m.Fields = append(m.Fields, mt103Field{Tag: "71A", Value: bearer})
+	m.Fields = append(m.Fields, charges...)
+	for _, ch := range charges {
+		c.pattern("field "+ch.Tag, ch.Value, mt103ChargePattern, "must be a currency and an amount")
+	}
+	return m, c.problems
+}
+
+// exportMT103 renders every payment as an MT103, the problems of all the payments are reported together
+func exportMT103(payments []Payment) ([]byte, error) {
+	if len(payments) == 0 {
+		return nil, errNothingToExport
+	}
+	var messages []string
+	var problems []string
+	for i, p := range payments {
+		m, ps := mt103MessageOf(p)
+		for _, problem := range ps {
+			problems = append(problems, "payment["+strconv.Itoa(i)+"] "+problem)
+		}
+		if p.Status == PaymentStatusPendingApproval {
+			problems = append(problems, "payment["+strconv.Itoa(i)+"] status: the payment is pending approval")
+		}
+		messages = append(messages, m.String())
+	}
+	if len(problems) > 0 {
+		return nil, exportError(FormatMT103, problems)
+	}
+	return []byte(strings.Join(messages, "\r\n$\r\n") + "\r\n"), nil
+}
+
+// parseMT103Messages reads the blocks and the fields of the messages of an RJE file
+func parseMT103Messages(data []byte) ([]mt103Message, error) {
+	var messages []mt103Message
+	var chunk []string
+	start := 0
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		m, err := parseMT103Message(strings.Join(chunk, "\n"))
+		if err != nil {
+			return errors.New("err: Could not read the MT103 at line " + strconv.Itoa(start) + ": " + err.Error())
+		}
+		m.Line = start
+		messages = append(messages, m)
+		chunk = nil
+		return nil
+	}
+	for i, l := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		switch {
+		case strings.TrimSpace(l) == "$":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case len(chunk) == 0 && strings.TrimSpace(l) == "":
+		default:
+			if len(chunk) == 0 {
+				start = i + 1
+			}
+			chunk = append(chunk, l)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("err: the file has no MT103")
+	}
+	return messages, nil
+}
+
+// parseMT103Message reads the headers and the text block of a message
+func parseMT103Message(text string) (mt103Message, error) {
+	m := mt103Message{}
+	text = strings.TrimSpace(text)
+	body := strings.Index(text, "{4:")
+	if body < 0 || !strings.HasSuffix(text, "-}") {
+		return m, errors.New("the text block {4: ... -} is missing")
+	}
+	headers := text[:body]
+	if i := strings.Index(headers, "{1:F01"); i >= 0 && len(headers) >= i+18 {
+		m.Sender = mt103BIC(headers[i+6 : i+18])
+	} else {
+		return m, errors.New("the basic header block is missing")
+	}
+	if i := strings.Index(headers, "{2:I103"); i >= 0 && len(headers) >= i+19 {
+		m.Receiver = mt103BIC(headers[i+7 : i+19])
+	} else if strings.Index(headers, "{2:O103") >= 0 {
+		// output messages carry the sender's address after the input time
+		i := strings.Index(headers, "{2:O103")
+		if len(headers) >= i+29 {
+			m.Receiver = mt103BIC(headers[i+17 : i+29])
+		}
+	} else {
+		return m, errors.New("the application header is not the one of an MT103")
+	}
+	if i := strings.Index(headers, "{121:"); i >= 0 {
+		if j := strings.Index(headers[i:], "}"); j > 0 {
+			m.UETR = headers[i+5 : i+j]
+		}
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(text[body+3:], "-}"), "\n") {
+		if l == "" {
+			continue
+		}
+		if tag := mt103TagPattern.FindStringSubmatch(l); tag != nil {
+			m.Fields = append(m.Fields, mt103Field{Tag: tag[1], Value: l[len(tag[0]):]})
+			continue
+		}
+		if len(m.Fields) == 0 {
+			return m, errors.New("the text block does not start with a field")
+		}
+		m.Fields[len(m.Fields)-1].Value += "\n" + l
+	}
+	return m, nil
+}
+
+// mt103Account splits the account line of a party from its name and address
+func mt103Account(value string) (string, string, string) {
+	lines := strings.Split(value, "\n")
+	account := ""
+	if strings.HasPrefix(lines[0], "/") {
+		account, lines = strings.TrimPrefix(lines[0], "/"), lines[1:]
+	}
+	if len(lines) == 0 {
+		return account, "", ""
+	}
+	return account, lines[0], strings.Join(lines[1:], " ")
+}
+
+// mt103AccountCode returns the account_number_code of an account read from a message
+func mt103AccountCode(account string) string {
+	if isoIBANPattern.MatchString(account) {
+		return isoAccountNumberCodeIBAN
+	}
+	return "BBAN"
+}
+
+// mt103Charge reads a currency and an amount
+func mt103Charge(value string) Charge {
+	if len(value) < 3 {
+		return Charge{}
+	}
+	return Charge{Currency: value[:3], Amount: mt103Decimal(value[3:])}
+}
+
+// payment maps the message back to a payment, the opposite of mt103MessageOf
+func (m mt103Message) payment() (Payment, error) {
+	p := Payment{Type: "Payment"}
+	a := &p.Attributes
+	a.PaymentType = "Credit"
+	_, a.PayID = m.field("20")
+	_, v := m.field("32A")
+	if len(v) < 10 {
+		return p, errors.New("err: :32A: must hold a date, a currency and an amount")
+	}
+	date, err := time.Parse(mt103DateFormat, v[:6])
+	if err != nil {
+		return p, errors.New("err: :32A: the value date is not formatted as YYMMDD")
+	}
+	a.ProcessingDate, a.Currency, a.Amount = DateOf(date), v[6:9], mt103Decimal(v[9:])
+
+	tag, v := m.field("50K", "50A", "50F")
+	if tag != "50K" {
+		return p, errors.New("err: the ordering customer must be given with :50K:")
+	}
+	a.DebtorParty.AccountNumber, a.DebtorParty.Name, a.DebtorParty.Address = mt103Account(v)
+	a.DebtorParty.AccountNumberCode = mt103AccountCode(a.DebtorParty.AccountNumber)
+	a.DebtorParty.BankID, a.DebtorParty.BankIDCode = m.Sender, isoBankIDCodeBIC
+	if _, v := m.field("52A"); v != "" {
+		a.DebtorParty.BankID = v
+	}
+
+	tag, v = m.field("57A", "57C", "57D")
+	switch tag {
+	case "":
+		a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode = m.Receiver, isoBankIDCodeBIC
+	case "57A":
+		a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode = v, isoBankIDCodeBIC
+		a.SponsorParty.BankID, a.SponsorParty.BankIDCode = m.Receiver, isoBankIDCodeBIC
+	default:
+		id := strings.TrimPrefix(strings.Split(v, "\n")[0], "//")
+		for code, prefix := range mt103ClearingCodes {
+			if tag == "57C" && strings.HasPrefix(id, prefix) {
+				a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode = strings.TrimPrefix(id, prefix), code
+			}
+		}
+		if a.BeneficiaryParty.BankID == "" {
+			a.BeneficiaryParty.BankID = id
+		}
+		a.SponsorParty.BankID, a.SponsorParty.BankIDCode = m.Receiver, isoBankIDCodeBIC
+	}
+	if _, v := m.field("53B"); v != "" {
+		a.SponsorParty.AccountNumber = strings.TrimPrefix(v, "/")
+	}
+	_, v = m.field("59")
+	if v == "" {
+		return p, errors.New("err: the beneficiary customer must be given with :59:")
+	}
+	a.BeneficiaryParty.AccountNumber, a.BeneficiaryParty.Name, a.BeneficiaryParty.Address = mt103Account(v)
+	a.BeneficiaryParty.AccountNumberCode = mt103AccountCode(a.BeneficiaryParty.AccountNumber)
+
+	_, v = m.field("70")
+	var reference []string
+	for _, l := range strings.Split(v, "\n") {
+		switch {
+		case strings.HasPrefix(l, "/ROC/"):
+			a.EndToEndReference = strings.TrimPrefix(l, "/ROC/")
+		case strings.HasPrefix(l, "/RFB/"):
+			a.NumericReference = strings.TrimPrefix(l, "/RFB/")
+		case l != "":
+			reference = append(reference, l)
+		}
+	}
+	a.Reference = strings.Join(reference, " ")
+
+	_, v = m.field("71A")
+	for code, bearer := range mt103BearerCodes {
+		// SHA is shared by SHAR and SLEV, it is read back as SHAR
+		if bearer == v && code != "SLEV" {
+			a.ChargesInformation.BearerCode = code
+		}
+	}
+	if a.ChargesInformation.BearerCode == "" {
+		return p, errors.New("err: :71A: must be one of OUR, BEN, SHA")
+	}
+	a.ChargesInformation.SenderCharges = []Charge{}
+	a.ChargesInformation.ReceiverChargesAmount, a.ChargesInformation.ReceiverChargesCurrency = "0", a.Currency
+	for _, f := range m.Fields {
+		switch f.Tag {
+		case "71F":
+			// the charge of zero only tells that the beneficiary bears the charges
+			if ch := mt103Charge(f.Value); !isoSameAmount(ch.Amount, "0") {
+				a.ChargesInformation.SenderCharges = append(a.ChargesInformation.SenderCharges, ch)
+			}
+		case "71G":
+			ch := mt103Charge(f.Value)
+			a.ChargesInformation.ReceiverChargesAmount, a.ChargesInformation.ReceiverChargesCurrency = ch.Amount, ch.Currency
+		}
+	}
+	if _, v := m.field("36"); v != "" {
+		_, instructed := m.field("33B")
+		ch := mt103Charge(instructed)
+		a.Forex.OriginalAmount, a.Forex.OriginalCurrency, a.Forex.ExchangeRate = ch.Amount, ch.Currency, mt103Decimal(v)
+	}
+	return p, nil
+}
+
+// parseMT103Import reads a payment from every message of an RJE file of MT103s
+func parseMT103Import(data []byte) ([]ImportRow, error) {
+	if !bytes.Contains(data, []byte("{4:")) {
+		return nil, errors.New("err: the file is not an MT103 file")
+	}
+	messages, err := parseMT103Messages(data)
+	if err != nil {
+		return nil, err
+	}
+	var rows []ImportRow
+	for _, m := range messages {
+		row := ImportRow{Line: m.Line}
+		row.Payment, row.Err = m.payment()
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
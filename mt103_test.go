@@ -0,0 +1,130 @@
+package paymentsapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// mt103Payment returns a payment sent through a correspondent, the sponsor
+func mt103Payment() Payment {
+	p := isoPayment()
+	p.Attributes.SponsorParty.BankID, p.Attributes.SponsorParty.BankIDCode = "CHASUS33", "SWBIC"
+	p.Attributes.DebtorParty.Name = "Zoë Ærøskøbing & Søn"
+	p.Attributes.BeneficiaryParty.Address = "-1 The Street, a town with a name that is too long to fit on a line"
+	return p
+}
+
+func TestMT103RoundTrip(t *testing.T) {
+	p := mt103Payment()
+	data, err := exportMT103([]Payment{p})
+	assert.NoError(t, err)
+	msg := string(data)
+	assert.True(t, strings.HasPrefix(msg, "{1:F01NWBKGB2LAXXX0000000000}{2:I103CHASUS33XXXXN}{3:{121:"+p.ID.String()+"}}{4:\r\n"))
+	assert.Contains(t, msg, "\r\n:20:123344556790\r\n:23B:CRED\r\n:32A:170118GBP100,21\r\n:33B:USD200,42\r\n:36:2,0000\r\n")
+	assert.Contains(t, msg, "\r\n:50K:/GB29NWBK60161331926819\r\nZoe AEroskobing + Son\r\n")
+	assert.Contains(t, msg, "\r\n:53B:/5678923\r\n:57C://SC403000\r\n")
+	// the address is wrapped at 35 characters and a line cannot start with a dash
+	assert.Contains(t, msg, "\r\n.1 The Street, a town with a name\r\nthat is too long to fit on a line\r\n")
+	assert.Contains(t, msg, "\r\n:70:/ROC/Wil def ee\r\n/RFB/10223453\r\nPAYmen\r\n")
+	assert.Contains(t, msg, "\r\n:71A:SHA\r\n:71F:GBP5,00\r\n:71F:USD10,00\r\n-}")
+	// the receiver's charges cannot be sent when the charges are shared
+	assert.NotContains(t, msg, ":71G:")
+
+	rows, err := parseMT103Import(data)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.NoError(t, rows[0].Err)
+	assert.Equal(t, 1, rows[0].Line)
+	a := rows[0].Payment.Attributes
+	assert.Equal(t, "123344556790", a.PayID)
+	assert.Equal(t, "2017-01-18", a.ProcessingDate.String())
+	assert.Equal(t, "100.21", a.Amount)
+	assert.Equal(t, "GBP", a.Currency)
+	assert.Equal(t, Forex{ExchangeRate: "2.0000", OriginalAmount: "200.42", OriginalCurrency: "USD"}, a.Forex)
+	assert.Equal(t, "Zoe AEroskobing + Son", a.DebtorParty.Name)
+	assert.Equal(t, "GB29NWBK60161331926819", a.DebtorParty.AccountNumber)
+	assert.Equal(t, "IBAN", a.DebtorParty.AccountNumberCode)
+	assert.Equal(t, "NWBKGB2L", a.DebtorParty.BankID)
+	assert.Equal(t, "403000", a.BeneficiaryParty.BankID)
+	assert.Equal(t, "GBDSC", a.BeneficiaryParty.BankIDCode)
+	assert.Equal(t, "CHASUS33", a.SponsorParty.BankID)
+	assert.Equal(t, "5678923", a.SponsorParty.AccountNumber)
+	assert.Equal(t, "Wil def ee", a.EndToEndReference)
+	assert.Equal(t, "10223453", a.NumericReference)
+	assert.Equal(t, "PAYmen", a.Reference)
+	assert.Equal(t, "SHAR", a.ChargesInformation.BearerCode)
+	assert.Equal(t, p.Attributes.ChargesInformation.SenderCharges[1].Amount, a.ChargesInformation.SenderCharges[1].Amount)
+}
+
+func TestMT103Charges(t *testing.T) {
+	ours := mt103Payment()
+	ours.Attributes.ChargesInformation.BearerCode = "DEBT"
+	ours.Attributes.Forex = Forex{}
+	m, problems := mt103MessageOf(ours)
+	assert.Empty(t, problems)
+	msg := m.String()
+	assert.Contains(t, msg, ":71A:OUR\r\n:71G:USD1,00\r\n")
+	assert.Contains(t, msg, ":33B:GBP100,21\r\n")
+	assert.NotContains(t, msg, ":71F:")
+	assert.NotContains(t, msg, ":36:")
+
+	// the beneficiary bears the charges, a zero charge of the sender says so
+	bens := mt103Payment()
+	bens.Attributes.ChargesInformation.BearerCode = "CRED"
+	bens.Attributes.ChargesInformation.SenderCharges = nil
+	m, _ = mt103MessageOf(bens)
+	assert.Contains(t, m.String(), ":71A:BEN\r\n:71F:GBP0,\r\n")
+	rows, err := parseMT103Import([]byte(m.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, "CRED", rows[0].Payment.Attributes.ChargesInformation.BearerCode)
+	assert.Empty(t, rows[0].Payment.Attributes.ChargesInformation.SenderCharges)
+}
+
+func TestMT103Checks(t *testing.T) {
+	p := mt103Payment()
+	p.Attributes.PayID = "a-reference-that-is-too-long"
+	p.Attributes.DebtorParty.BankIDCode = "GBDSC"
+	p.Attributes.SponsorParty.BankIDCode = "GBDSC"
+	p.Attributes.ChargesInformation.BearerCode = "NONE"
+	_, err := exportMT103([]Payment{p})
+	assert.Equal(t, KindInvalidPayload, err.(StatusError).Kind)
+	assert.Contains(t, err.Error(), "payment[0] debtor_party.bank_id: the sender needs a BIC")
+	assert.Contains(t, err.Error(), "payment[0] beneficiary_party.bank_id: the receiver needs a BIC")
+	assert.Contains(t, err.Error(), "payment[0] field 20: payment_id must have between 1 and 16 characters")
+	assert.Contains(t, err.Error(), "payment[0] field 71A: bearer_code must be one of DEBT, CRED, SHAR, SLEV")
+}
+
+func TestParseMT103Import(t *testing.T) {
+	first, _ := exportMT103([]Payment{mt103Payment()})
+	broken := "{1:F01NWBKGB2LAXXX0000000000}{2:I103CHASUS33XXXXN}{4:\r\n:20:REF\r\n:32A:170118GBP1,\r\n:50A:NWBKGB2L\r\n-}"
+	file := string(first) + "$\r\n" + broken + "\r\n"
+	rows, err := parseMT103Import([]byte(file))
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.NoError(t, rows[0].Err)
+	assert.Equal(t, strings.Count(string(first), "\n")+2, rows[1].Line)
+	assert.EqualError(t, rows[1].Err, "err: the ordering customer must be given with :50K:")
+
+	for _, bad := range []string{"not a message", "{1:F01NWBKGB2LAXXX0000000000}{2:I202CHASUS33XXXXN}{4:\r\n:20:REF\r\n-}", "{1:F01NWBKGB2LAXXX0000000000}{2:I103CHASUS33XXXXN}{4:\r\n:20:REF"} {
+		_, err := parseMT103Import([]byte(bad))
+		assert.Error(t, err)
+	}
+}
+
+func TestExportMT103HTTP(t *testing.T) {
+	p := mt103Payment()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, p.ID.String()).Return(p, nil)
+	router := NewHTTPTransport(mockService)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/payments/"+p.ID.String()+"?format=mt103", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=payment-`+p.ID.String()+`.fin`, rec.Header().Get("Content-Disposition"))
+	assert.Contains(t, rec.Body.String(), ":20:123344556790\r\n")
+}
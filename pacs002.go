@@ -0,0 +1,282 @@
+package paymentsapi
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Results of applying the status of a transaction of a status report to a payment
+const (
+	StatusReportApplied   = "applied"
+	StatusReportIgnored   = "ignored"
+	StatusReportNotFound  = "not_found"
+	StatusReportAmbiguous = "ambiguous"
+)
+
+// pacs002PaymentStatuses are the transaction statuses that change the status of the payments, the other ones only
+// record how far the banks got with the payment
+var pacs002PaymentStatuses = map[string]string{
+	"ACSC": PaymentStatusSettled,
+	"ACCC": PaymentStatusSettled,
+	"RJCT": PaymentStatusRejected,
+}
+
+type pacs002Document struct {
+	XMLName xml.Name      `xml:"urn:iso:std:iso:20022:tech:xsd:pacs.002.001.10 Document"`
+	Report  pacs002Report `xml:"FIToFIPmtStsRpt"`
+}
+
+type pacs002Report struct {
+	GrpHdr            pacs002GroupHeader         `xml:"GrpHdr"`
+	OrgnlGrpInfAndSts []pacs002OriginalGroup     `xml:"OrgnlGrpInfAndSts"`
+	TxInfAndSts       []pacs002TransactionStatus `xml:"TxInfAndSts"`
+}
+
+type pacs002GroupHeader struct {
+	MsgID   string `xml:"MsgId"`
+	CreDtTm string `xml:"CreDtTm"`
+}
+
+type pacs002OriginalGroup struct {
+	OrgnlMsgID   string `xml:"OrgnlMsgId"`
+	OrgnlMsgNmID string `xml:"OrgnlMsgNmId"`
+	GrpSts       string `xml:"GrpSts"`
+}
+
+// pacs002TransactionStatus is the status of a transaction of the original message
+type pacs002TransactionStatus struct {
+	OrgnlEndToEndID string                `xml:"OrgnlEndToEndId"`
+	OrgnlTxID       string                `xml:"OrgnlTxId"`
+	OrgnlUETR       string                `xml:"OrgnlUETR"`
+	TxSts           string                `xml:"TxSts"`
+	StsRsnInf       []pacs002StatusReason `xml:"StsRsnInf"`
+}
+
+type pacs002StatusReason struct {
+	Rsn      *isoCode `xml:"Rsn"`
+	AddtlInf []string `xml:"AddtlInf"`
+}
+
+// reasons returns the reason codes of the status and their additional information
+func (s pacs002TransactionStatus) reasons() (string, string) {
+	var codes, info []string
+	for _, r := range s.StsRsnInf {
+		if code := r.Rsn.value(); code != "" {
+			codes = append(codes, code)
+		}
+		info = append(info, r.AddtlInf...)
+	}
+	return strings.Join(codes, " "), strings.Join(info, " ")
+}
+
+// parsePacs002 reads a pacs.002 message, a message that does not report the status of any transaction is rejected
+func parsePacs002(data []byte) (pacs002Report, error) {
+	doc := pacs002Document{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return pacs002Report{}, errors.New("err: Could not read the pacs.002 message: " + err.Error())
+	}
+	c := &isoChecker{}
+	c.text("GrpHdr/MsgId", doc.Report.GrpHdr.MsgID, 35, true)
+	c.dateTime("GrpHdr/CreDtTm", doc.Report.GrpHdr.CreDtTm)
+	c.check(len(doc.Report.TxInfAndSts) > 0, "TxInfAndSts", "is required, the statuses of whole messages cannot be matched to payments")
+	for i, s := range doc.Report.TxInfAndSts {
+		path := "TxInfAndSts[" + strconv.Itoa(i) + "]"
+		c.text(path+"/OrgnlEndToEndId", s.OrgnlEndToEndID, 35, true)
+		c.text(path+"/TxSts", s.TxSts, 4, true)
+	}
+	if len(c.problems) > 0 {
+		return pacs002Report{}, errors.New("err: the file is not a valid pacs.002.001.10 message: " + strings.Join(c.problems, "; "))
+	}
+	return doc.Report, nil
+}
+
+// PaymentStatusReport records the status a bank reported for a payment and what it changed
+type PaymentStatusReport struct {
+	ModelBase
+	ID                uint      `json:"-" gorm:"primary_key"`
+	OrganisationID    uuid.UUID `json:"-" gorm:"type:uuid; index"`
+	MessageID         string    `json:"message_id"`
+	EndToEndReference string    `json:"end_to_end_reference" gorm:"index"`
+	PaymentID         uuid.UUID `json:"payment_id,omitempty" gorm:"type:uuid; index"`
+	TransactionStatus string    `json:"transaction_status"`
+	ReasonCodes       string    `json:"reason_codes,omitempty"`
+	AdditionalInfo    string    `json:"additional_info,omitempty"`
+	// Status is the status of the payment once the report was applied
+	Status     string    `json:"status,omitempty"`
+	Result     string    `json:"result"`
+	ReceivedAt time.Time `json:"received_at"`
+	RequestID  string    `json:"request_id"`
+}
+
+// StatusReportResult is the outcome of a status report, transaction by transaction
+type StatusReportResult struct {
+	MessageID    string                `json:"message_id"`
+	Transactions []PaymentStatusReport `json:"transactions"`
+}
+
+// StatusReportStore persists the statuses reported for the payments
+type StatusReportStore interface {
+	// FindPaymentsByEndToEndReference lists the payments of the organisation with the end-to-end reference, in the
+	// transaction of ctx if there is one. The payments stay locked until the transaction ends
+	FindPaymentsByEndToEndReference(ctx context.Context, organisationID uuid.UUID, reference string) ([]Payment, error)
+	// SetSchemeStatus changes the status of the payment along with the status and the reasons reported by the banks,
+	// in the transaction of ctx if there is one
+	SetSchemeStatus(ctx context.Context, paymentID uuid.UUID, status, schemeStatus, reason string) error
+	CreateStatusReport(ctx context.Context, r *PaymentStatusReport) error
+	Transactor
+}
+
+type statusReportStore struct {
+	txStore
+}
+
+// NewStatusReportStore returns a StatusReportStore backed by the database
+func NewStatusReportStore(db *gorm.DB) StatusReportStore {
+	return &statusReportStore{
+		txStore{db: db},
+	}
+}
+
+// FindPaymentsByEndToEndReference lists the payments, without their attributes
+func (s *statusReportStore) FindPaymentsByEndToEndReference(ctx context.Context, organisationID uuid.UUID, reference string) ([]Payment, error) {
+	var payments []Payment
+	err := withContext(s.db, ctx).Set("gorm:query_option", "FOR UPDATE").Joins("JOIN attributes ON attributes.id = payments.attributes_id").
+		Where("payments.organisation_id = ? AND attributes.end_to_end_reference = ?", organisationID, reference).
+		Find(&payments).Error
+	return payments, err
+}
+
+// SetSchemeStatus changes the statuses of a payment
+func (s *statusReportStore) SetSchemeStatus(ctx context.Context, paymentID uuid.UUID, status, schemeStatus, reason string) error {
+	return withContext(s.db, ctx).Model(&Payment{}).Where("id = ?", paymentID).
+		Updates(map[string]interface{}{"status": status, "scheme_status": schemeStatus, "status_reason": reason}).Error
+}
+
+// CreateStatusReport stores the status reported for a transaction
+func (s *statusReportStore) CreateStatusReport(ctx context.Context, r *PaymentStatusReport) error {
+	return withContext(s.db, ctx).Create(r).Error
+}
+
+// StatusReportService applies the status reports sent by the banks to the payments
+type StatusReportService interface {
+	ApplyStatusReport(ctx context.Context, data []byte) (StatusReportResult, error)
+}
+
+type statusReportService struct {
+	store StatusReportStore
+	now   func() time.Time
+}
+
+// NewStatusReportService returns the StatusReportService updating the payments of the store
+func NewStatusReportService(store StatusReportStore) StatusReportService {
+	return &statusReportService{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// ApplyStatusReport applies the statuses of a pacs.002 message to the payments of the caller's organisation with the
+// same end-to-end references. The UETR tells apart the payments sharing a reference, settled and rejected payments
+// keep their status. The report is applied in a single transaction, none of it is applied when a transaction status
+// cannot be stored
+func (s *statusReportService) ApplyStatusReport(ctx context.Context, data []byte) (StatusReportResult, error) {
+	p, err := checkPermission(ctx, PermissionApplyStatusReports)
+	if err != nil {
+		return StatusReportResult{}, err
+	}
+	report, err := parsePacs002(data)
+	if err != nil {
+		return StatusReportResult{}, StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: err.Error()}
+	}
+	result := StatusReportResult{MessageID: report.GrpHdr.MsgID, Transactions: []PaymentStatusReport{}}
+	err = s.store.InTransaction(ctx, func(ctx context.Context) error {
+		for _, tx := range report.TxInfAndSts {
+			r := PaymentStatusReport{
+				OrganisationID:    p.OrganisationID,
+				MessageID:         report.GrpHdr.MsgID,
+				EndToEndReference: tx.OrgnlEndToEndID,
+				TransactionStatus: tx.TxSts,
+				ReceivedAt:        s.now().UTC(),
+				RequestID:         RequestIDFromContext(ctx),
+			}
+			r.ReasonCodes, r.AdditionalInfo = tx.reasons()
+			if err := s.apply(ctx, tx, &r); err != nil {
+				return err
+			}
+			result.Transactions = append(result.Transactions, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return StatusReportResult{}, err
+	}
+	return result, nil
+}
+
+// apply applies the status of the transaction to its payment and records the report, in the transaction of ctx
+func (s *statusReportService) apply(ctx context.Context, tx pacs002TransactionStatus, r *PaymentStatusReport) error {
+	payments, err := s.store.FindPaymentsByEndToEndReference(ctx, r.OrganisationID, tx.OrgnlEndToEndID)
+	if err != nil {
+		return err
+	}
+	if len(payments) > 1 && tx.OrgnlUETR != "" {
+		for _, p := range payments {
+			if p.ID.String() == tx.OrgnlUETR {
+				payments = []Payment{p}
+				break
+			}
+		}
+	}
+	switch len(payments) {
+	case 0:
+		r.Result = StatusReportNotFound
+		return s.store.CreateStatusReport(ctx, r)
+	case 1:
+	default:
+		r.Result = StatusReportAmbiguous
+		return s.store.CreateStatusReport(ctx, r)
+	}
+	payment := payments[0]
+	r.PaymentID, r.Status = payment.ID, payment.Status
+	switch payment.Status {
+	case PaymentStatusSettled, PaymentStatusRejected, PaymentStatusReturned, PaymentStatusPendingApproval, PaymentStatusScheduled, PaymentStatusCancelled:
+		r.Result = StatusReportIgnored
+		return s.store.CreateStatusReport(ctx, r)
+	}
+	if status, ok := pacs002PaymentStatuses[tx.TxSts]; ok {
+		r.Status = status
+	}
+	r.Result = StatusReportApplied
+	if err := s.store.SetSchemeStatus(ctx, payment.ID, r.Status, r.TransactionStatus, r.ReasonCodes); err != nil {
+		return err
+	}
+	return s.store.CreateStatusReport(ctx, r)
+}
+
+// ApplyStatusReportRequest is the request type used to upload a status report
+type ApplyStatusReportRequest struct {
+	Data []byte
+}
+
+// MakeApplyStatusReportEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ApplyStatusReport method
+func MakeApplyStatusReportEndpoint(svc StatusReportService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ApplyStatusReportRequest)
+		v, err := svc.ApplyStatusReport(ctx, req.Data)
+		if err != nil {
+			var ErrAcc = errors.New("err: Could not apply the status report")
+			cErr := newStatusError(ErrAcc.Error()+" \n"+err.Error(), err)
+			return nil, cErr
+		}
+		return v, nil
+	}
+}
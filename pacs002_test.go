@@ -0,0 +1,198 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryStatusReportStore is a StatusReportStore keeping the payments and the reports in memory, a transaction that
+// fails leaves them as they were
+type memoryStatusReportStore struct {
+	payments map[uuid.UUID]*Payment
+	reports  []PaymentStatusReport
+	// failReference fails the reports of the transaction statuses with this end-to-end reference
+	failReference string
+}
+
+func newMemoryStatusReportStore(payments ...Payment) *memoryStatusReportStore {
+	s := &memoryStatusReportStore{payments: map[uuid.UUID]*Payment{}}
+	for i := range payments {
+		s.payments[payments[i].ID] = &payments[i]
+	}
+	return s
+}
+
+func (s *memoryStatusReportStore) FindPaymentsByEndToEndReference(_ context.Context, organisationID uuid.UUID, reference string) ([]Payment, error) {
+	var payments []Payment
+	for _, p := range s.payments {
+		if p.OrganisationID == organisationID && p.Attributes.EndToEndReference == reference {
+			payments = append(payments, *p)
+		}
+	}
+	return payments, nil
+}
+
+func (s *memoryStatusReportStore) SetSchemeStatus(_ context.Context, paymentID uuid.UUID, status, schemeStatus, reason string) error {
+	p := s.payments[paymentID]
+	p.Status, p.SchemeStatus, p.StatusReason = status, schemeStatus, reason
+	return nil
+}
+
+func (s *memoryStatusReportStore) CreateStatusReport(_ context.Context, r *PaymentStatusReport) error {
+	if r.EndToEndReference == s.failReference {
+		return errors.New("err: could not store the report")
+	}
+	s.reports = append(s.reports, *r)
+	return nil
+}
+
+func (s *memoryStatusReportStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	payments := map[uuid.UUID]Payment{}
+	for id, p := range s.payments {
+		payments[id] = *p
+	}
+	reports := s.reports
+	err := fn(ctx)
+	if err != nil {
+		for id, p := range payments {
+			*s.payments[id] = p
+		}
+		s.reports = reports
+	}
+	return err
+}
+
+// pacs002Message reports the statuses of the transactions, given as end-to-end reference, UETR, status and reason
+func pacs002Message(statuses ...[4]string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pacs.002.001.10">
+  <FIToFIPmtStsRpt>
+    <GrpHdr><MsgId>STS-1</MsgId><CreDtTm>2019-04-02T09:00:00</CreDtTm></GrpHdr>
+    <OrgnlGrpInfAndSts><OrgnlMsgId>MSG-1</OrgnlMsgId><OrgnlMsgNmId>pacs.008.001.08</OrgnlMsgNmId></OrgnlGrpInfAndSts>`)
+	for _, s := range statuses {
+		b.WriteString("<TxInfAndSts><OrgnlEndToEndId>" + s[0] + "</OrgnlEndToEndId>")
+		if s[1] != "" {
+			b.WriteString("<OrgnlUETR>" + s[1] + "</OrgnlUETR>")
+		}
+		b.WriteString("<TxSts>" + s[2] + "</TxSts>")
+		if s[3] != "" {
+			b.WriteString("<StsRsnInf><Rsn><Cd>" + s[3] + "</Cd></Rsn><AddtlInf>Closed account</AddtlInf></StsRsnInf>")
+		}
+		b.WriteString("</TxInfAndSts>")
+	}
+	b.WriteString("</FIToFIPmtStsRpt></Document>")
+	return b.String()
+}
+
+func TestApplyStatusReport(t *testing.T) {
+	org, _ := uuid.NewV4()
+	other, _ := uuid.NewV4()
+	payment := func(ref, status string, orgID uuid.UUID) Payment {
+		p := isoPayment()
+		p.OrganisationID, p.Status, p.Attributes.EndToEndReference = orgID, status, ref
+		return p
+	}
+	settled := payment("E2E-1", PaymentStatusAccepted, org)
+	rejected := payment("E2E-2", PaymentStatusAccepted, org)
+	twin1, twin2 := payment("E2E-3", PaymentStatusAccepted, org), payment("E2E-3", PaymentStatusAccepted, org)
+	pending := payment("E2E-4", PaymentStatusPendingApproval, org)
+	foreign := payment("E2E-5", PaymentStatusAccepted, other)
+	final := payment("E2E-6", PaymentStatusSettled, org)
+	store := newMemoryStatusReportStore(settled, rejected, twin1, twin2, pending, foreign, final)
+	svc := NewStatusReportService(store)
+	ctx := roleContext(org, "ops", RoleOperations)
+
+	res, err := svc.ApplyStatusReport(ctx, []byte(pacs002Message(
+		[4]string{"E2E-1", "", "ACSC", ""},
+		[4]string{"E2E-2", "", "RJCT", "AC04"},
+		[4]string{"E2E-3", twin2.ID.String(), "ACSP", ""},
+		[4]string{"E2E-3", "", "ACSP", ""},
+		[4]string{"E2E-4", "", "ACSC", ""},
+		[4]string{"E2E-5", "", "ACSC", ""},
+		[4]string{"E2E-6", "", "RJCT", ""},
+	)))
+	assert.NoError(t, err)
+	assert.Equal(t, "STS-1", res.MessageID)
+	var results []string
+	for _, r := range res.Transactions {
+		results = append(results, r.Result)
+	}
+	assert.Equal(t, []string{StatusReportApplied, StatusReportApplied, StatusReportApplied, StatusReportAmbiguous,
+		StatusReportIgnored, StatusReportNotFound, StatusReportIgnored}, results)
+	assert.Len(t, store.reports, 7)
+
+	assert.Equal(t, PaymentStatusSettled, store.payments[settled.ID].Status)
+	assert.Equal(t, "ACSC", store.payments[settled.ID].SchemeStatus)
+	r := store.payments[rejected.ID]
+	assert.Equal(t, PaymentStatusRejected, r.Status)
+	assert.Equal(t, "AC04", r.StatusReason)
+	assert.Equal(t, "Closed account", res.Transactions[1].AdditionalInfo)
+	// statuses that do not settle or reject the payment are only recorded
+	assert.Equal(t, PaymentStatusAccepted, store.payments[twin2.ID].Status)
+	assert.Equal(t, "ACSP", store.payments[twin2.ID].SchemeStatus)
+	assert.Equal(t, "", store.payments[twin1.ID].SchemeStatus)
+	assert.Equal(t, PaymentStatusPendingApproval, store.payments[pending.ID].Status)
+	assert.Equal(t, PaymentStatusAccepted, store.payments[foreign.ID].Status)
+	assert.Equal(t, PaymentStatusSettled, store.payments[final.ID].Status)
+
+	// reports without transaction statuses cannot be matched
+	_, err = svc.ApplyStatusReport(ctx, []byte(pacs002Message()))
+	assert.Equal(t, http.StatusBadRequest, err.(StatusError).Status)
+	_, err = svc.ApplyStatusReport(ctx, []byte("not xml"))
+	assert.Error(t, err)
+	// changing the statuses to what the banks reported is left to operations
+	for _, role := range []string{RoleViewer, RoleCreator, RoleApprover} {
+		_, err = svc.ApplyStatusReport(roleContext(org, role, role), []byte(pacs002Message([4]string{"E2E-1", "", "ACSC", ""})))
+		assert.Equal(t, ErrForbidden, err)
+	}
+}
+
+func TestApplyStatusReportAtomic(t *testing.T) {
+	org, _ := uuid.NewV4()
+	first, second := isoPayment(), isoPayment()
+	first.OrganisationID, first.Status, first.Attributes.EndToEndReference = org, PaymentStatusAccepted, "E2E-1"
+	second.OrganisationID, second.Status, second.Attributes.EndToEndReference = org, PaymentStatusAccepted, "E2E-2"
+	store := newMemoryStatusReportStore(first, second)
+	store.failReference = "E2E-2"
+	svc := NewStatusReportService(store)
+
+	// the statuses applied before the failure are rolled back with it
+	_, err := svc.ApplyStatusReport(roleContext(org, "ops", RoleOperations), []byte(pacs002Message(
+		[4]string{"E2E-1", "", "ACSC", ""},
+		[4]string{"E2E-2", "", "ACSC", ""},
+	)))
+	assert.EqualError(t, err, "err: could not store the report")
+	assert.Equal(t, PaymentStatusAccepted, store.payments[first.ID].Status)
+	assert.Empty(t, store.payments[first.ID].SchemeStatus)
+	assert.Empty(t, store.reports)
+}
+
+func TestStatusReportHTTP(t *testing.T) {
+	org, _ := uuid.NewV4()
+	p := isoPayment()
+	p.OrganisationID, p.Status = org, PaymentStatusAccepted
+	router := mux.NewRouter()
+	RegisterStatusReportRoutes(router, NewStatusReportService(newMemoryStatusReportStore(p)), 1<<20)
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/status-reports", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req.WithContext(roleContext(org, "ops", RoleOperations)))
+		return rec
+	}
+
+	rec := post(pacs002Message([4]string{"Wil def ee", "", "ACCC", ""}))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"result":"applied"`)
+	assert.Contains(t, rec.Body.String(), `"status":"settled"`)
+	rec = post("<Document/>")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
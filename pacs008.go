@@ -0,0 +1,247 @@
+package paymentsapi
+
+import (
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// FormatPacs008 is the ISO 20022 FIToFICustomerCreditTransfer message, version pacs.008.001.08
+const FormatPacs008 = "pacs.008"
+
+type pacs008Document struct {
+	XMLName  xml.Name        `xml:"urn:iso:std:iso:20022:tech:xsd:pacs.008.001.08 Document"`
+	Transfer pacs008Transfer `xml:"FIToFICstmrCdtTrf"`
+}
+
+type pacs008Transfer struct {
+	GrpHdr      pacs008GroupHeader   `xml:"GrpHdr"`
+	CdtTrfTxInf []pacs008Transaction `xml:"CdtTrfTxInf"`
+}
+
+type pacs008GroupHeader struct {
+	MsgID             string            `xml:"MsgId"`
+	CreDtTm           string            `xml:"CreDtTm"`
+	NbOfTxs           string            `xml:"NbOfTxs"`
+	CtrlSum           string            `xml:"CtrlSum,omitempty"`
+	TtlIntrBkSttlmAmt *isoAmount        `xml:"TtlIntrBkSttlmAmt,omitempty"`
+	SttlmInf          pacs008Settlement `xml:"SttlmInf"`
+}
+
+type pacs008Settlement struct {
+	SttlmMtd string `xml:"SttlmMtd"`
+}
+
+// pacs008Transaction is the credit transfer of a payment between the debtor's and the creditor's banks
+type pacs008Transaction struct {
+	PmtID          pacs008PaymentID `xml:"PmtId"`
+	PmtTpInf       *isoPaymentType  `xml:"PmtTpInf,omitempty"`
+	IntrBkSttlmAmt *isoAmount       `xml:"IntrBkSttlmAmt"`
+	IntrBkSttlmDt  string           `xml:"IntrBkSttlmDt,omitempty"`
+	InstdAmt       *isoAmount       `xml:"InstdAmt,omitempty"`
+	XchgRate       string           `xml:"XchgRate,omitempty"`
+	ChrgBr         string           `xml:"ChrgBr"`
+	ChrgsInf       []pacs008Charge  `xml:"ChrgsInf,omitempty"`
+	InstgAgt       *isoAgent        `xml:"InstgAgt,omitempty"`
+	InstdAgt       *isoAgent        `xml:"InstdAgt,omitempty"`
+	IntrmyAgt1     *isoAgent        `xml:"IntrmyAgt1,omitempty"`
+	IntrmyAgt1Acct *isoAccount      `xml:"IntrmyAgt1Acct,omitempty"`
+	Dbtr           *isoParty        `xml:"Dbtr"`
+	DbtrAcct       *isoAccount      `xml:"DbtrAcct,omitempty"`
+	DbtrAgt        *isoAgent        `xml:"DbtrAgt"`
+	CdtrAgt        *isoAgent        `xml:"CdtrAgt"`
+	Cdtr           *isoParty        `xml:"Cdtr"`
+	CdtrAcct       *isoAccount      `xml:"CdtrAcct,omitempty"`
+	Purp           *isoCode         `xml:"Purp,omitempty"`
+	RmtInf         *isoRemittance   `xml:"RmtInf,omitempty"`
+}
+
+type pacs008PaymentID struct {
+	InstrID    string `xml:"InstrId,omitempty"`
+	EndToEndID string `xml:"EndToEndId"`
+	TxID       string `xml:"TxId,omitempty"`
+	UETR       string `xml:"UETR,omitempty"`
+}
+
+// pacs008Charge is a charge taken by an agent of the transfer
+type pacs008Charge struct {
+	Amt isoAmount `xml:"Amt"`
+	Agt isoAgent  `xml:"Agt"`
+}
+
+// exportPacs008 renders the payments as a pacs.008 message settled through the clearing system. The payments
+// pending approval cannot be sent to the banks and are reported as problems
+func exportPacs008(payments []Payment) ([]byte, error) {
+	if len(payments) == 0 {
+		return nil, errNothingToExport
+	}
+	msgID, _ := uuid.NewV4()
+	doc := pacs008Document{}
+	var amounts []string
+	currencies := map[string]bool{}
+	for _, p := range payments {
+		doc.Transfer.CdtTrfTxInf = append(doc.Transfer.CdtTrfTxInf, pacs008TransactionOf(p))
+		amounts = append(amounts, p.Attributes.Amount)
+		currencies[p.Attributes.Currency] = true
+	}
+	doc.Transfer.GrpHdr = pacs008GroupHeader{
+		MsgID:    isoCompactID(msgID),
+		CreDtTm:  time.Now().UTC().Format(time.RFC3339),
+		NbOfTxs:  strconv.Itoa(len(payments)),
+		CtrlSum:  isoSum(amounts...),
+		SttlmInf: pacs008Settlement{SttlmMtd: "CLRG"},
+	}
+	// the total settled can only be given when all the transactions are settled in the same currency
+	if len(currencies) == 1 {
+		doc.Transfer.GrpHdr.TtlIntrBkSttlmAmt = &isoAmount{Ccy: payments[0].Attributes.Currency, Value: isoSum(amounts...)}
+	}
+	c := &isoChecker{}
+	doc.check(c)
+	for i, p := range payments {
+		c.check(p.Status != PaymentStatusPendingApproval, "CdtTrfTxInf["+strconv.Itoa(i)+"]", "the payment is pending approval")
+	}
+	if len(c.problems) > 0 {
+		return nil, exportError(FormatPacs008, c.problems)
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// pacs008TransactionOf maps the payment to a credit transfer. The amount of the payment is the amount settled between
+// the banks, when the payment was converted the original amount is the amount instructed by the debtor. The sender
+// charges are taken by the debtor's bank and the receiver charges by the creditor's bank
+func pacs008TransactionOf(p Payment) pacs008Transaction {
+	a := p.Attributes
+	debtor := isoPartyOf(a.DebtorParty.Name, a.DebtorParty.Address)
+	debtorAccount := isoAccountOf(a.DebtorParty.AccountNumber, a.DebtorParty.AccountNumberCode, a.DebtorParty.AccountName)
+	debtorAgent := isoAgentOf(a.DebtorParty.BankID, a.DebtorParty.BankIDCode)
+	creditor := isoPartyOf(a.BeneficiaryParty.Name, a.BeneficiaryParty.Address)
+	creditorAccount := isoAccountOf(a.BeneficiaryParty.AccountNumber, a.BeneficiaryParty.AccountNumberCode, a.BeneficiaryParty.AccountName)
+	creditorAgent := isoAgentOf(a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode)
+
+	tx := pacs008Transaction{
+		PmtID:          pacs008PaymentID{InstrID: a.PayID, EndToEndID: a.EndToEndReference, TxID: isoCompactID(p.ID)},
+		PmtTpInf:       isoPaymentTypeOf(a),
+		IntrBkSttlmAmt: &isoAmount{Ccy: a.Currency, Value: a.Amount},
+		IntrBkSttlmDt:  a.ProcessingDate.String(),
+		XchgRate:       a.Forex.ExchangeRate,
+		ChrgBr:         a.ChargesInformation.BearerCode,
+		InstgAgt:       &debtorAgent,
+		InstdAgt:       &creditorAgent,
+		Dbtr:           &debtor,
+		DbtrAcct:       &debtorAccount,
+		DbtrAgt:        &debtorAgent,
+		CdtrAgt:        &creditorAgent,
+		Cdtr:           &creditor,
+		CdtrAcct:       &creditorAccount,
+		Purp:           isoProprietary(a.PaymentPurpose),
+		RmtInf:         isoRemittanceOf(a),
+	}
+	if p.ID != uuid.Nil {
+		tx.PmtID.UETR = p.ID.String()
+	}
+	if a.Forex.OriginalAmount != "" {
+		tx.InstdAmt = &isoAmount{Ccy: a.Forex.OriginalCurrency, Value: a.Forex.OriginalAmount}
+	}
+	for _, c := range a.ChargesInformation.SenderCharges {
+		tx.ChrgsInf = append(tx.ChrgsInf, pacs008Charge{Amt: isoAmount{Ccy: c.Currency, Value: c.Amount}, Agt: debtorAgent})
+	}
+	if a.ChargesInformation.ReceiverChargesAmount != "" && !isoSameAmount(a.ChargesInformation.ReceiverChargesAmount, "0") {
+		tx.ChrgsInf = append(tx.ChrgsInf, pacs008Charge{
+			Amt: isoAmount{Ccy: a.ChargesInformation.ReceiverChargesCurrency, Value: a.ChargesInformation.ReceiverChargesAmount},
+			Agt: creditorAgent,
+		})
+	}
+	// the sponsor is the bank holding the account the debtor's bank settles through
+	if a.SponsorParty.BankID != "" {
+		sponsor := isoAgentOf(a.SponsorParty.BankID, a.SponsorParty.BankIDCode)
+		tx.IntrmyAgt1 = &sponsor
+	}
+	if a.SponsorParty.AccountNumber != "" {
+		account := isoAccountOf(a.SponsorParty.AccountNumber, "", "")
+		tx.IntrmyAgt1Acct = &account
+	}
+	return tx
+}
+
+// check collects the problems of the message against the XSD schema
+func (d pacs008Document) check(c *isoChecker) {
+	h := d.Transfer.GrpHdr
+	c.text("GrpHdr/MsgId", h.MsgID, 35, true)
+	c.dateTime("GrpHdr/CreDtTm", h.CreDtTm)
+	if h.TtlIntrBkSttlmAmt != nil {
+		c.amount("GrpHdr/TtlIntrBkSttlmAmt", h.TtlIntrBkSttlmAmt)
+	}
+	for i, tx := range d.Transfer.CdtTrfTxInf {
+		tx.check(c, "CdtTrfTxInf["+strconv.Itoa(i)+"]")
+	}
+}
+
+// check checks the transaction
+func (tx pacs008Transaction) check(c *isoChecker, path string) {
+	c.text(path+"/PmtId/InstrId", tx.PmtID.InstrID, 35, false)
+	c.text(path+"/PmtId/EndToEndId", tx.PmtID.EndToEndID, 35, true)
+	c.text(path+"/PmtId/TxId", tx.PmtID.TxID, 35, false)
+	if tx.PmtID.UETR != "" {
+		c.pattern(path+"/PmtId/UETR", tx.PmtID.UETR, isoUUIDv4Pattern, "is not a UUID v4")
+	}
+	if t := tx.PmtTpInf; t != nil {
+		for _, s := range t.SvcLvl {
+			c.text(path+"/PmtTpInf/SvcLvl/Prtry", s.value(), 35, true)
+		}
+		c.text(path+"/PmtTpInf/LclInstrm/Prtry", t.LclInstrm.value(), 35, false)
+		c.text(path+"/PmtTpInf/CtgyPurp/Prtry", t.CtgyPurp.value(), 35, false)
+	}
+	c.amount(path+"/IntrBkSttlmAmt", tx.IntrBkSttlmAmt)
+	c.date(path+"/IntrBkSttlmDt", tx.IntrBkSttlmDt)
+	if tx.InstdAmt != nil {
+		c.amount(path+"/InstdAmt", tx.InstdAmt)
+		// an amount instructed in another currency needs the rate it was converted at
+		if tx.IntrBkSttlmAmt != nil && tx.InstdAmt.Ccy != tx.IntrBkSttlmAmt.Ccy {
+			c.check(tx.XchgRate != "", path+"/XchgRate", "is required when InstdAmt is in another currency")
+		}
+	}
+	if tx.XchgRate != "" {
+		c.pattern(path+"/XchgRate", tx.XchgRate, isoRatePattern, "must be a rate with at most 10 decimals")
+	}
+	c.oneOf(path+"/ChrgBr", tx.ChrgBr, isoChargeBearers...)
+	for j, ch := range tx.ChrgsInf {
+		ch := ch
+		c.amount(path+"/ChrgsInf["+strconv.Itoa(j)+"]/Amt", &ch.Amt)
+		c.agent(path+"/ChrgsInf["+strconv.Itoa(j)+"]/Agt", &ch.Agt)
+	}
+	if tx.IntrmyAgt1 != nil {
+		c.agent(path+"/IntrmyAgt1", tx.IntrmyAgt1)
+	}
+	if tx.IntrmyAgt1Acct != nil {
+		c.account(path+"/IntrmyAgt1Acct", tx.IntrmyAgt1Acct)
+	}
+	c.party(path+"/Dbtr", tx.Dbtr)
+	if tx.DbtrAcct != nil {
+		c.account(path+"/DbtrAcct", tx.DbtrAcct)
+	}
+	c.agent(path+"/DbtrAgt", tx.DbtrAgt)
+	c.agent(path+"/CdtrAgt", tx.CdtrAgt)
+	c.party(path+"/Cdtr", tx.Cdtr)
+	if tx.CdtrAcct != nil {
+		c.account(path+"/CdtrAcct", tx.CdtrAcct)
+	}
+	if tx.Purp != nil {
+		c.text(path+"/Purp/Prtry", tx.Purp.value(), 35, true)
+	}
+	if tx.RmtInf != nil {
+		for _, u := range tx.RmtInf.Ustrd {
+			c.text(path+"/RmtInf/Ustrd", u, 140, true)
+		}
+		for _, s := range tx.RmtInf.Strd {
+			if s.CdtrRefInf != nil {
+				c.text(path+"/RmtInf/Strd/CdtrRefInf/Ref", s.CdtrRefInf.Ref, 35, false)
+			}
+		}
+	}
+}
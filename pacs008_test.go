@@ -0,0 +1,52 @@
+package paymentsapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportPacs008(t *testing.T) {
+	p := isoPayment()
+	data, err := exportPacs008([]Payment{p})
+	assert.NoError(t, err)
+	xml := string(data)
+	assert.Contains(t, xml, `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pacs.008.001.08">`)
+	assert.Contains(t, xml, "<EndToEndId>Wil def ee</EndToEndId>")
+	assert.Contains(t, xml, "<TxId>"+isoCompactID(p.ID)+"</TxId>")
+	assert.Contains(t, xml, `<TtlIntrBkSttlmAmt Ccy="GBP">100.21</TtlIntrBkSttlmAmt>`)
+	assert.Contains(t, xml, "<SttlmMtd>CLRG</SttlmMtd>")
+	assert.Contains(t, xml, `<IntrBkSttlmAmt Ccy="GBP">100.21</IntrBkSttlmAmt>`)
+	assert.Contains(t, xml, "<IntrBkSttlmDt>2017-01-18</IntrBkSttlmDt>")
+	// the scheme payment type is the service level
+	assert.Contains(t, xml, "<SvcLvl>\n          <Prtry>Immediate Pay</Prtry>")
+	// the payment was converted from the amount instructed by the debtor
+	assert.Contains(t, xml, `<InstdAmt Ccy="USD">200.42</InstdAmt>`)
+	assert.Contains(t, xml, "<XchgRate>2.0000</XchgRate>")
+	assert.Contains(t, xml, "<ChrgBr>SHAR</ChrgBr>")
+	// the sender charges are taken by the debtor's bank, the receiver charges by the creditor's
+	assert.Contains(t, xml, "<ChrgsInf>\n        <Amt Ccy=\"GBP\">5.00</Amt>\n        <Agt>\n          <FinInstnId>\n            <BICFI>NWBKGB2L</BICFI>")
+	assert.Contains(t, xml, "<ChrgsInf>\n        <Amt Ccy=\"USD\">1.00</Amt>\n        <Agt>\n          <FinInstnId>\n            <ClrSysMmbId>")
+}
+
+func TestExportPacs008Checks(t *testing.T) {
+	pending := isoPayment()
+	pending.Status = PaymentStatusPendingApproval
+	converted := isoPayment()
+	converted.Attributes.Forex.ExchangeRate = ""
+	noBearer := isoPayment()
+	noBearer.Attributes.ChargesInformation.BearerCode = ""
+	_, err := exportPacs008([]Payment{pending, converted, noBearer})
+	assert.Equal(t, KindInvalidPayload, err.(StatusError).Kind)
+	assert.Contains(t, err.Error(), "CdtTrfTxInf[0]: the payment is pending approval")
+	assert.Contains(t, err.Error(), "CdtTrfTxInf[1]/XchgRate: is required when InstdAmt is in another currency")
+	assert.Contains(t, err.Error(), "CdtTrfTxInf[2]/ChrgBr: must be one of DEBT, CRED, SHAR, SLEV")
+
+	// the total settled is left out when the payments are in several currencies
+	euros := isoPayment()
+	euros.Attributes.Currency = "EUR"
+	data, err := exportPacs008([]Payment{isoPayment(), euros})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "TtlIntrBkSttlmAmt")
+	assert.Contains(t, string(data), "<NbOfTxs>2</NbOfTxs>")
+}
@@ -0,0 +1,407 @@
+package paymentsapi
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// FormatPain001 is the ISO 20022 CustomerCreditTransferInitiation message, version pain.001.001.09
+const FormatPain001 = "pain.001"
+
+// paymentSupplementPlace names the supplementary data carrying the fields of a payment that pain.001 has no element for
+const paymentSupplementPlace = "paymentsapi"
+
+type pain001Document struct {
+	XMLName    xml.Name          `xml:"urn:iso:std:iso:20022:tech:xsd:pain.001.001.09 Document"`
+	Initiation pain001Initiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001Initiation struct {
+	GrpHdr pain001GroupHeader          `xml:"GrpHdr"`
+	PmtInf []pain001PaymentInformation `xml:"PmtInf"`
+}
+
+type pain001GroupHeader struct {
+	MsgID    string   `xml:"MsgId"`
+	CreDtTm  string   `xml:"CreDtTm"`
+	NbOfTxs  string   `xml:"NbOfTxs"`
+	CtrlSum  string   `xml:"CtrlSum,omitempty"`
+	InitgPty isoParty `xml:"InitgPty"`
+}
+
+// pain001PaymentInformation holds the transactions of a debtor account executed on the same day
+type pain001PaymentInformation struct {
+	PmtInfID    string               `xml:"PmtInfId"`
+	PmtMtd      string               `xml:"PmtMtd"`
+	NbOfTxs     string               `xml:"NbOfTxs,omitempty"`
+	CtrlSum     string               `xml:"CtrlSum,omitempty"`
+	PmtTpInf    *isoPaymentType      `xml:"PmtTpInf,omitempty"`
+	ReqdExctnDt isoDate              `xml:"ReqdExctnDt"`
+	Dbtr        *isoParty            `xml:"Dbtr"`
+	DbtrAcct    *isoAccount          `xml:"DbtrAcct"`
+	DbtrAgt     *isoAgent            `xml:"DbtrAgt"`
+	ChrgBr      string               `xml:"ChrgBr,omitempty"`
+	CdtTrfTxInf []pain001Transaction `xml:"CdtTrfTxInf"`
+}
+
+// pain001Transaction is a credit transfer, the payment it is read from or written to
+type pain001Transaction struct {
+	PmtID          pain001PaymentID    `xml:"PmtId"`
+	PmtTpInf       *isoPaymentType     `xml:"PmtTpInf,omitempty"`
+	Amt            pain001Amount       `xml:"Amt"`
+	XchgRateInf    *isoExchangeRate    `xml:"XchgRateInf,omitempty"`
+	ChrgBr         string              `xml:"ChrgBr,omitempty"`
+	IntrmyAgt1     *isoAgent           `xml:"IntrmyAgt1,omitempty"`
+	IntrmyAgt1Acct *isoAccount         `xml:"IntrmyAgt1Acct,omitempty"`
+	CdtrAgt        *isoAgent           `xml:"CdtrAgt,omitempty"`
+	Cdtr           *isoParty           `xml:"Cdtr,omitempty"`
+	CdtrAcct       *isoAccount         `xml:"CdtrAcct,omitempty"`
+	Purp           *isoCode            `xml:"Purp,omitempty"`
+	RmtInf         *isoRemittance      `xml:"RmtInf,omitempty"`
+	SplmtryData    []supplementaryData `xml:"SplmtryData,omitempty"`
+}
+
+type pain001PaymentID struct {
+	InstrID    string `xml:"InstrId,omitempty"`
+	EndToEndID string `xml:"EndToEndId"`
+	UETR       string `xml:"UETR,omitempty"`
+}
+
+type pain001Amount struct {
+	InstdAmt *isoAmount `xml:"InstdAmt,omitempty"`
+}
+
+type supplementaryData struct {
+	PlcAndNm string             `xml:"PlcAndNm,omitempty"`
+	Envlp    supplementEnvelope `xml:"Envlp"`
+}
+
+type supplementEnvelope struct {
+	Pmt *paymentSupplement `xml:"Pmt"`
+}
+
+// paymentSupplement carries the fields of a payment the ISO 20022 messages have no element for, so that the payments
+// exported by the API are imported back as they were
+type paymentSupplement struct {
+	PaymentType     string      `xml:"PmtTp,omitempty"`
+	AccountType     int         `xml:"CdtrAcctTp"`
+	SenderCharges   []isoAmount `xml:"SndrChrgs"`
+	ReceiverCharges *isoAmount  `xml:"RcvrChrgs,omitempty"`
+	OriginalAmount  *isoAmount  `xml:"OrgnlAmt,omitempty"`
+}
+
+// errNothingToExport is returned when a message would not hold any payment
+var errNothingToExport = StatusError{Status: http.StatusUnprocessableEntity, Kind: KindInvalidRequest, Message: "err: there is no payment to export"}
+
+// exportError reports the problems that keep payments from being exported in a format
+func exportError(format string, problems []string) error {
+	return StatusError{Status: http.StatusUnprocessableEntity, Kind: KindInvalidPayload, Message: "err: the payments cannot be exported as " + format + ": " + strings.Join(problems, "; ")}
+}
+
+// exportPain001 renders the payments as a pain.001 message, every payment gets its own payment information block so
+// that its debtor, execution date and scheme are kept
+func exportPain001(payments []Payment) ([]byte, error) {
+	if len(payments) == 0 {
+		return nil, errNothingToExport
+	}
+	msgID, _ := uuid.NewV4()
+	doc := pain001Document{}
+	var amounts []string
+	for _, p := range payments {
+		doc.Initiation.PmtInf = append(doc.Initiation.PmtInf, pain001PaymentInformationOf(p))
+		amounts = append(amounts, p.Attributes.Amount)
+	}
+	doc.Initiation.GrpHdr = pain001GroupHeader{
+		MsgID:   isoCompactID(msgID),
+		CreDtTm: time.Now().UTC().Format(time.RFC3339),
+		NbOfTxs: strconv.Itoa(len(payments)),
+		CtrlSum: isoSum(amounts...),
+		InitgPty: isoParty{ID: &isoPartyID{OrgID: isoOrganisationID{Othr: []isoGenericID{
+			{ID: isoCompactID(payments[0].OrganisationID)},
+		}}}},
+	}
+	if problems := doc.check(); len(problems) > 0 {
+		return nil, exportError(FormatPain001, problems)
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// pain001PaymentInformationOf maps the payment to a payment information block holding a single transaction
+func pain001PaymentInformationOf(p Payment) pain001PaymentInformation {
+	a := p.Attributes
+	debtor := isoPartyOf(a.DebtorParty.Name, a.DebtorParty.Address)
+	debtorAccount := isoAccountOf(a.DebtorParty.AccountNumber, a.DebtorParty.AccountNumberCode, a.DebtorParty.AccountName)
+	debtorAgent := isoAgentOf(a.DebtorParty.BankID, a.DebtorParty.BankIDCode)
+	creditor := isoPartyOf(a.BeneficiaryParty.Name, a.BeneficiaryParty.Address)
+	creditorAccount := isoAccountOf(a.BeneficiaryParty.AccountNumber, a.BeneficiaryParty.AccountNumberCode, a.BeneficiaryParty.AccountName)
+	creditorAgent := isoAgentOf(a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode)
+
+	tx := pain001Transaction{
+		PmtID:       pain001PaymentID{InstrID: a.PayID, EndToEndID: a.EndToEndReference},
+		Amt:         pain001Amount{InstdAmt: &isoAmount{Ccy: a.Currency, Value: a.Amount}},
+		XchgRateInf: isoExchangeRateOf(a.Forex),
+		ChrgBr:      a.ChargesInformation.BearerCode,
+		CdtrAgt:     &creditorAgent,
+		Cdtr:        &creditor,
+		CdtrAcct:    &creditorAccount,
+		Purp:        isoProprietary(a.PaymentPurpose),
+		RmtInf:      isoRemittanceOf(a),
+		SplmtryData: []supplementaryData{{PlcAndNm: paymentSupplementPlace, Envlp: supplementEnvelope{Pmt: paymentSupplementOf(a)}}},
+	}
+	if p.ID != uuid.Nil {
+		tx.PmtID.UETR = p.ID.String()
+	}
+	// the sponsor is the bank holding the account the debtor's bank settles through
+	if a.SponsorParty.BankID != "" {
+		sponsor := isoAgentOf(a.SponsorParty.BankID, a.SponsorParty.BankIDCode)
+		tx.IntrmyAgt1 = &sponsor
+	}
+	if a.SponsorParty.AccountNumber != "" {
+		account := isoAccountOf(a.SponsorParty.AccountNumber, "", "")
+		tx.IntrmyAgt1Acct = &account
+	}
+	return pain001PaymentInformation{
+		PmtInfID:    isoCompactID(p.ID),
+		PmtMtd:      "TRF",
+		NbOfTxs:     "1",
+		CtrlSum:     isoSum(a.Amount),
+		PmtTpInf:    isoPaymentTypeOf(a),
+		ReqdExctnDt: isoDate{Dt: a.ProcessingDate.String()},
+		Dbtr:        &debtor,
+		DbtrAcct:    &debtorAccount,
+		DbtrAgt:     &debtorAgent,
+		CdtTrfTxInf: []pain001Transaction{tx},
+	}
+}
+
+// paymentSupplementOf returns the fields of the payment carried as supplementary data
+func paymentSupplementOf(a Attributes) *paymentSupplement {
+	s := &paymentSupplement{PaymentType: a.PaymentType, AccountType: a.BeneficiaryParty.AccountType}
+	for _, c := range a.ChargesInformation.SenderCharges {
+		s.SenderCharges = append(s.SenderCharges, isoAmount{Ccy: c.Currency, Value: c.Amount})
+	}
+	if a.ChargesInformation.ReceiverChargesAmount != "" {
+		s.ReceiverCharges = &isoAmount{Ccy: a.ChargesInformation.ReceiverChargesCurrency, Value: a.ChargesInformation.ReceiverChargesAmount}
+	}
+	if a.Forex.OriginalAmount != "" {
+		s.OriginalAmount = &isoAmount{Ccy: a.Forex.OriginalCurrency, Value: a.Forex.OriginalAmount}
+	}
+	return s
+}
+
+// parsePain001Import reads a payment from every transaction of a pain.001 message. The file is rejected when its
+// group header or its payment information blocks do not follow the XSD schema, the transactions that do not are
+// returned with their problems
+func parsePain001Import(data []byte) ([]ImportRow, error) {
+	doc := pain001Document{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.New("err: Could not read the pain.001 message: " + err.Error())
+	}
+	c := &isoChecker{}
+	doc.checkHeader(c)
+	if len(c.problems) > 0 {
+		return nil, errors.New("err: the file is not a valid pain.001.001.09 message: " + strings.Join(c.problems, "; "))
+	}
+	lines := xmlElementLines(data, "CdtTrfTxInf")
+	var rows []ImportRow
+	for i, pi := range doc.Initiation.PmtInf {
+		for j, tx := range pi.CdtTrfTxInf {
+			row := ImportRow{}
+			if len(rows) < len(lines) {
+				row.Line = lines[len(rows)]
+			}
+			c := &isoChecker{}
+			tx.check(c, "PmtInf["+strconv.Itoa(i)+"]/CdtTrfTxInf["+strconv.Itoa(j)+"]")
+			if len(c.problems) > 0 {
+				row.Err = errors.New("err: " + strings.Join(c.problems, "; "))
+			} else {
+				row.Payment = tx.payment(pi)
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// payment maps the transaction of the payment information block to a payment. pain.001 only says who bears the
+// charges, a transaction without supplementary data has no charges
+func (tx pain001Transaction) payment(pi pain001PaymentInformation) Payment {
+	p := Payment{Type: "Payment"}
+	a := &p.Attributes
+	a.Amount, a.Currency = tx.Amt.InstdAmt.Value, tx.Amt.InstdAmt.Ccy
+	a.EndToEndReference, a.PayID = tx.PmtID.EndToEndID, tx.PmtID.InstrID
+	// checkHeader rejected the messages with a malformed execution date
+	a.ProcessingDate, _ = ParseDate(pi.ReqdExctnDt.date())
+	a.PaymentType = "Credit"
+
+	a.DebtorParty.Name, a.DebtorParty.Address = pi.Dbtr.Nm, pi.Dbtr.address()
+	a.DebtorParty.AccountNumber, a.DebtorParty.AccountNumberCode = pi.DbtrAcct.number()
+	a.DebtorParty.AccountName = pi.DbtrAcct.Nm
+	a.DebtorParty.BankID, a.DebtorParty.BankIDCode = pi.DbtrAgt.bank()
+	a.BeneficiaryParty.Name, a.BeneficiaryParty.Address = tx.Cdtr.Nm, tx.Cdtr.address()
+	a.BeneficiaryParty.AccountNumber, a.BeneficiaryParty.AccountNumberCode = tx.CdtrAcct.number()
+	a.BeneficiaryParty.AccountName = tx.CdtrAcct.Nm
+	if tx.CdtrAgt != nil {
+		a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode = tx.CdtrAgt.bank()
+	}
+	if tx.IntrmyAgt1 != nil {
+		a.SponsorParty.BankID, a.SponsorParty.BankIDCode = tx.IntrmyAgt1.bank()
+	}
+	if tx.IntrmyAgt1Acct != nil {
+		a.SponsorParty.AccountNumber, _ = tx.IntrmyAgt1Acct.number()
+	}
+
+	pi.PmtTpInf.setScheme(a)
+	tx.PmtTpInf.setScheme(a)
+	a.ChargesInformation.BearerCode = pi.ChrgBr
+	if tx.ChrgBr != "" {
+		a.ChargesInformation.BearerCode = tx.ChrgBr
+	}
+	a.ChargesInformation.SenderCharges = []Charge{}
+	a.ChargesInformation.ReceiverChargesAmount, a.ChargesInformation.ReceiverChargesCurrency = "0", a.Currency
+	if fx := tx.XchgRateInf; fx != nil {
+		a.Forex.ExchangeRate, a.Forex.ContractReference = fx.XchgRate, fx.CtrctID
+	}
+	a.PaymentPurpose = tx.Purp.value()
+	if tx.RmtInf != nil {
+		a.Reference = strings.Join(tx.RmtInf.Ustrd, " ")
+		for _, s := range tx.RmtInf.Strd {
+			if s.CdtrRefInf != nil && a.NumericReference == "" {
+				a.NumericReference = s.CdtrRefInf.Ref
+			}
+		}
+	}
+	for _, d := range tx.SplmtryData {
+		if d.PlcAndNm == paymentSupplementPlace && d.Envlp.Pmt != nil {
+			d.Envlp.Pmt.apply(a)
+		}
+	}
+	return p
+}
+
+// apply sets the fields of the payment carried by the supplement
+func (s *paymentSupplement) apply(a *Attributes) {
+	if s.PaymentType != "" {
+		a.PaymentType = s.PaymentType
+	}
+	a.BeneficiaryParty.AccountType = s.AccountType
+	for _, c := range s.SenderCharges {
+		a.ChargesInformation.SenderCharges = append(a.ChargesInformation.SenderCharges, Charge{Amount: c.Value, Currency: c.Ccy})
+	}
+	if s.ReceiverCharges != nil {
+		a.ChargesInformation.ReceiverChargesAmount, a.ChargesInformation.ReceiverChargesCurrency = s.ReceiverCharges.Value, s.ReceiverCharges.Ccy
+	}
+	if s.OriginalAmount != nil {
+		a.Forex.OriginalAmount, a.Forex.OriginalCurrency = s.OriginalAmount.Value, s.OriginalAmount.Ccy
+	}
+}
+
+// check returns the problems of the message against the XSD schema
+func (d pain001Document) check() []string {
+	c := &isoChecker{}
+	d.checkHeader(c)
+	for i, pi := range d.Initiation.PmtInf {
+		for j, tx := range pi.CdtTrfTxInf {
+			tx.check(c, "PmtInf["+strconv.Itoa(i)+"]/CdtTrfTxInf["+strconv.Itoa(j)+"]")
+		}
+	}
+	return c.problems
+}
+
+// checkHeader checks the group header and the payment information blocks, along with the number of transactions and
+// the control sums they announce
+func (d pain001Document) checkHeader(c *isoChecker) {
+	h := d.Initiation.GrpHdr
+	c.text("GrpHdr/MsgId", h.MsgID, 35, true)
+	c.dateTime("GrpHdr/CreDtTm", h.CreDtTm)
+	c.check(len(d.Initiation.PmtInf) > 0, "PmtInf", "is required")
+	var amounts []string
+	n := 0
+	for i, pi := range d.Initiation.PmtInf {
+		path := "PmtInf[" + strconv.Itoa(i) + "]"
+		c.text(path+"/PmtInfId", pi.PmtInfID, 35, true)
+		c.oneOf(path+"/PmtMtd", pi.PmtMtd, "TRF", "CHK", "TRA")
+		c.date(path+"/ReqdExctnDt", pi.ReqdExctnDt.date())
+		c.party(path+"/Dbtr", pi.Dbtr)
+		c.account(path+"/DbtrAcct", pi.DbtrAcct)
+		c.agent(path+"/DbtrAgt", pi.DbtrAgt)
+		if pi.ChrgBr != "" {
+			c.oneOf(path+"/ChrgBr", pi.ChrgBr, isoChargeBearers...)
+		}
+		c.check(len(pi.CdtTrfTxInf) > 0, path+"/CdtTrfTxInf", "is required")
+		var piAmounts []string
+		for _, tx := range pi.CdtTrfTxInf {
+			if tx.Amt.InstdAmt != nil {
+				piAmounts = append(piAmounts, tx.Amt.InstdAmt.Value)
+			}
+		}
+		if pi.NbOfTxs != "" {
+			c.check(pi.NbOfTxs == strconv.Itoa(len(pi.CdtTrfTxInf)), path+"/NbOfTxs", "does not match the number of transactions")
+		}
+		if pi.CtrlSum != "" {
+			c.check(isoSameAmount(pi.CtrlSum, isoSum(piAmounts...)), path+"/CtrlSum", "does not match the sum of the amounts")
+		}
+		n += len(pi.CdtTrfTxInf)
+		amounts = append(amounts, piAmounts...)
+	}
+	c.check(h.NbOfTxs == strconv.Itoa(n), "GrpHdr/NbOfTxs", "does not match the number of transactions")
+	if h.CtrlSum != "" {
+		c.check(isoSameAmount(h.CtrlSum, isoSum(amounts...)), "GrpHdr/CtrlSum", "does not match the sum of the amounts")
+	}
+}
+
+// check checks the transaction
+func (tx pain001Transaction) check(c *isoChecker, path string) {
+	c.text(path+"/PmtId/InstrId", tx.PmtID.InstrID, 35, false)
+	c.text(path+"/PmtId/EndToEndId", tx.PmtID.EndToEndID, 35, true)
+	if tx.PmtID.UETR != "" {
+		c.pattern(path+"/PmtId/UETR", tx.PmtID.UETR, isoUUIDv4Pattern, "is not a UUID v4")
+	}
+	c.amount(path+"/Amt/InstdAmt", tx.Amt.InstdAmt)
+	if fx := tx.XchgRateInf; fx != nil {
+		if fx.XchgRate != "" {
+			c.pattern(path+"/XchgRateInf/XchgRate", fx.XchgRate, isoRatePattern, "must be a rate with at most 10 decimals")
+		}
+		if fx.RateTp != "" {
+			c.oneOf(path+"/XchgRateInf/RateTp", fx.RateTp, "SPOT", "SALE", "AGRD")
+		}
+		c.text(path+"/XchgRateInf/CtrctId", fx.CtrctID, 35, false)
+	}
+	if tx.ChrgBr != "" {
+		c.oneOf(path+"/ChrgBr", tx.ChrgBr, isoChargeBearers...)
+	}
+	if tx.IntrmyAgt1 != nil {
+		c.agent(path+"/IntrmyAgt1", tx.IntrmyAgt1)
+	}
+	if tx.IntrmyAgt1Acct != nil {
+		c.account(path+"/IntrmyAgt1Acct", tx.IntrmyAgt1Acct)
+	}
+	if tx.CdtrAgt != nil {
+		c.agent(path+"/CdtrAgt", tx.CdtrAgt)
+	}
+	c.party(path+"/Cdtr", tx.Cdtr)
+	c.account(path+"/CdtrAcct", tx.CdtrAcct)
+	if tx.Purp != nil {
+		c.text(path+"/Purp/Prtry", tx.Purp.value(), 35, true)
+	}
+	if tx.RmtInf != nil {
+		for _, u := range tx.RmtInf.Ustrd {
+			c.text(path+"/RmtInf/Ustrd", u, 140, true)
+		}
+		for _, s := range tx.RmtInf.Strd {
+			if s.CdtrRefInf != nil {
+				c.text(path+"/RmtInf/Strd/CdtrRefInf/Ref", s.CdtrRefInf.Ref, 35, false)
+			}
+		}
+	}
+}
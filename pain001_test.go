@@ -0,0 +1,181 @@
+package paymentsapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// isoPayment returns a valid payment with accounts and banks that follow the ISO 20022 rules
+func isoPayment() Payment {
+	id, _ := uuid.NewV4()
+	p := mockPayment(id.String())
+	p.Attributes.DebtorParty.AccountNumber = "GB29NWBK60161331926819"
+	p.Attributes.DebtorParty.BankID, p.Attributes.DebtorParty.BankIDCode = "NWBKGB2L", "SWBIC"
+	p.Attributes.BeneficiaryParty.AccountNumber, p.Attributes.BeneficiaryParty.AccountNumberCode = "31926819", "BBAN"
+	p.Attributes.BeneficiaryParty.BankID, p.Attributes.BeneficiaryParty.BankIDCode = "403000", "GBDSC"
+	p.Attributes.BeneficiaryParty.AccountType = 1
+	return p
+}
+
+func TestPain001RoundTrip(t *testing.T) {
+	p := isoPayment()
+	data, err := exportPain001([]Payment{p})
+	assert.NoError(t, err)
+	xml := string(data)
+	assert.Contains(t, xml, `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.001.001.09">`)
+	assert.Contains(t, xml, "<EndToEndId>Wil def ee</EndToEndId>")
+	assert.Contains(t, xml, "<UETR>"+p.ID.String()+"</UETR>")
+	assert.Contains(t, xml, "<ChrgBr>SHAR</ChrgBr>")
+	assert.Contains(t, xml, `<InstdAmt Ccy="GBP">100.21</InstdAmt>`)
+	assert.Contains(t, xml, "<BICFI>NWBKGB2L</BICFI>")
+	assert.Contains(t, xml, "<Cd>GBDSC</Cd>")
+	assert.Contains(t, xml, "<Dt>2017-01-18</Dt>")
+
+	rows, err := parsePain001Import(data)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.NoError(t, rows[0].Err)
+	assert.True(t, rows[0].Line > 1)
+	assert.Equal(t, p.Type, rows[0].Payment.Type)
+	assert.Equal(t, p.Attributes, rows[0].Payment.Attributes)
+}
+
+func TestPain001ExportChecks(t *testing.T) {
+	_, err := exportPain001(nil)
+	assert.Equal(t, errNothingToExport, err)
+
+	p := isoPayment()
+	p.Attributes.Amount = "-3"
+	p.Attributes.EndToEndReference = strings.Repeat("x", 36)
+	_, err = exportPain001([]Payment{isoPayment(), p})
+	assert.Equal(t, KindInvalidPayload, err.(StatusError).Kind)
+	assert.Contains(t, err.Error(), "PmtInf[1]/CdtTrfTxInf[0]/PmtId/EndToEndId: is longer than 35 characters")
+	assert.Contains(t, err.Error(), "PmtInf[1]/CdtTrfTxInf[0]/Amt/InstdAmt: must be a positive amount")
+}
+
+const pain001Message = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.001.001.09">
+  <CstmrCdtTrfInitn>
+    <GrpHdr>
+      <MsgId>MSG-1</MsgId>
+      <CreDtTm>2019-04-01T10:00:00</CreDtTm>
+      <NbOfTxs>2</NbOfTxs>
+      <CtrlSum>30.5</CtrlSum>
+      <InitgPty><Nm>Acme</Nm></InitgPty>
+    </GrpHdr>
+    <PmtInf>
+      <PmtInfId>PI-1</PmtInfId>
+      <PmtMtd>TRF</PmtMtd>
+      <PmtTpInf><LclInstrm><Prtry>FPS</Prtry></LclInstrm></PmtTpInf>
+      <ReqdExctnDt><Dt>2019-04-02</Dt></ReqdExctnDt>
+      <Dbtr><Nm>Acme Ltd</Nm><PstlAdr><AdrLine>1 Main Street</AdrLine><AdrLine>London</AdrLine></PstlAdr></Dbtr>
+      <DbtrAcct><Id><IBAN>GB29NWBK60161331926819</IBAN></Id></DbtrAcct>
+      <DbtrAgt><FinInstnId><BICFI>NWBKGB2L</BICFI></FinInstnId></DbtrAgt>
+      <ChrgBr>DEBT</ChrgBr>
+      <CdtTrfTxInf>
+        <PmtId><EndToEndId>INV-1</EndToEndId></PmtId>
+        <Amt><InstdAmt Ccy="GBP">10.50</InstdAmt></Amt>
+        <Cdtr><Nm>Jane</Nm></Cdtr>
+        <CdtrAcct><Id><Othr><Id>31926819</Id><SchmeNm><Cd>BBAN</Cd></SchmeNm></Othr></Id></CdtrAcct>
+        <RmtInf><Ustrd>Invoice 1</Ustrd></RmtInf>
+      </CdtTrfTxInf>
+      <CdtTrfTxInf>
+        <PmtId><EndToEndId>INV-2</EndToEndId></PmtId>
+        <Amt><InstdAmt Ccy="GBP">20</InstdAmt></Amt>
+        <Cdtr><Nm>John</Nm></Cdtr>
+      </CdtTrfTxInf>
+    </PmtInf>
+  </CstmrCdtTrfInitn>
+</Document>`
+
+func TestParsePain001Import(t *testing.T) {
+	rows, err := parsePain001Import([]byte(pain001Message))
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.NoError(t, rows[0].Err)
+	assert.Equal(t, 20, rows[0].Line)
+	a := rows[0].Payment.Attributes
+	assert.Equal(t, "10.50", a.Amount)
+	assert.Equal(t, "INV-1", a.EndToEndReference)
+	assert.Equal(t, "2019-04-02", a.ProcessingDate.String())
+	assert.Equal(t, "FPS", a.PaymentScheme)
+	assert.Equal(t, "DEBT", a.ChargesInformation.BearerCode)
+	assert.Equal(t, "1 Main Street London", a.DebtorParty.Address)
+	assert.Equal(t, "NWBKGB2L", a.DebtorParty.BankID)
+	assert.Equal(t, "31926819", a.BeneficiaryParty.AccountNumber)
+	assert.Equal(t, "BBAN", a.BeneficiaryParty.AccountNumberCode)
+	assert.Equal(t, "Invoice 1", a.Reference)
+	// the second transaction has no creditor account
+	assert.Equal(t, 27, rows[1].Line)
+	assert.Contains(t, rows[1].Err.Error(), "PmtInf[0]/CdtTrfTxInf[1]/CdtrAcct: is required")
+
+	for _, bad := range []string{
+		strings.Replace(pain001Message, "pain.001.001.09", "pain.001.001.03", 1),
+		strings.Replace(pain001Message, "<NbOfTxs>2</NbOfTxs>", "<NbOfTxs>3</NbOfTxs>", 1),
+		strings.Replace(pain001Message, "<CtrlSum>30.5</CtrlSum>", "<CtrlSum>30</CtrlSum>", 1),
+		strings.Replace(pain001Message, "<Dt>2019-04-02</Dt>", "<Dt>tomorrow</Dt>", 1),
+		"not xml",
+	} {
+		_, err := parsePain001Import([]byte(bad))
+		assert.Error(t, err)
+	}
+}
+
+func TestExportPaymentsHTTP(t *testing.T) {
+	p := isoPayment()
+	other := isoPayment()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, p.ID.String()).Return(p, nil)
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{p, other}, nil)
+	router := NewHTTPTransport(mockService)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+
+	rec := get("/v1/payments/" + p.ID.String() + "?format=pain.001")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/xml", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=payment-`+p.ID.String()+`.xml`, rec.Header().Get("Content-Disposition"))
+	assert.Contains(t, rec.Body.String(), "<NbOfTxs>1</NbOfTxs>")
+
+	rec = get("/v1/payments?format=pain.001")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<NbOfTxs>2</NbOfTxs>")
+	rec = get("/v1/payments?format=pain.001&ids=" + other.ID.String())
+	assert.Contains(t, rec.Body.String(), "<NbOfTxs>1</NbOfTxs>")
+	assert.Contains(t, rec.Body.String(), other.ID.String())
+
+	rec = get("/v1/payments/" + p.ID.String() + "?format=xls")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = get("/v1/payments?format=pain.001&ids=unknown")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	// without a format the payment is sent as JSON
+	rec = get("/v1/payments/" + p.ID.String())
+	assert.Contains(t, rec.Body.String(), `"end_to_end_reference":"Wil def ee"`)
+}
+
+func TestImportPain001(t *testing.T) {
+	org, _ := uuid.NewV4()
+	data, _ := exportPain001([]Payment{isoPayment()})
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{}, nil)
+	store := newMemoryImportStore()
+	job := queuedImport(store, org, data)
+	job.Format = FormatPain001
+	store.jobs[job.ID] = job
+
+	NewImporter(store, mockService, 1, log.NewNopLogger()).run(job.ID)
+	assert.Equal(t, 1, store.jobs[job.ID].CreatedRows)
+	// the payments of the message are created for the uploader's organisation
+	created := mockService.Calls[0].Arguments.Get(1).(Payment)
+	assert.Equal(t, org, created.OrganisationID)
+}
@@ -0,0 +1,341 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Quotas are the daily limits of the payments created by every organisation. A zero Payments means no limit on the
+// number of payments. The amounts are counted currency by currency: Amounts gives the limit of a currency and Amount
+// the limit of the other currencies, nil means no limit
+type Quotas struct {
+	Payments int
+	Amount   *big.Rat
+	Amounts  map[string]*big.Rat
+}
+
+// amountQuota returns the daily limit on the amount of the payments in the currency, nil when there is none
+func (q Quotas) amountQuota(currency string) *big.Rat {
+	if a, ok := q.Amounts[currency]; ok {
+		return a
+	}
+	return q.Amount
+}
+
+// unlimited reports whether nothing is limited
+func (q Quotas) unlimited() bool {
+	return q.Payments == 0 && q.Amount == nil && len(q.Amounts) == 0
+}
+
+// ParseQuotas reads the daily quotas on the number of payments and on their total amount. The amount is a limit for
+// every currency, e.g. 5000000, or limits by currency with an optional limit for the others, e.g.
+// GBP=5000000,EUR=6000000 or JPY=500000000,5000000. An empty amount means no limit
+func ParseQuotas(payments int, amount string) (Quotas, error) {
+	q := Quotas{Payments: payments}
+	if payments < 0 {
+		return q, errors.New("err: the daily payment quota cannot be negative")
+	}
+	if amount == "" {
+		return q, nil
+	}
+	for _, limit := range strings.Split(amount, ",") {
+		currency, value := "", strings.TrimSpace(limit)
+		if i := strings.IndexByte(value, '='); i >= 0 {
+			currency, value = strings.ToUpper(strings.TrimSpace(value[:i])), strings.TrimSpace(value[i+1:])
+			if !isoCurrencyPattern.MatchString(currency) {
+				return q, errors.New("err: the daily amount quota of " + strconv.Quote(currency) + " is not for a currency code")
+			}
+		}
+		a, ok := new(big.Rat).SetString(value)
+		if !ok || a.Sign() < 0 {
+			return q, errors.New("err: the daily amount quota must be a positive decimal number")
+		}
+		switch {
+		case currency == "":
+			q.Amount = a
+		case q.Amounts == nil:
+			q.Amounts = map[string]*big.Rat{currency: a}
+		default:
+			q.Amounts[currency] = a
+		}
+	}
+	return q, nil
+}
+
+// QuotaUsage records the number of payments created by an organisation on a UTC day
+type QuotaUsage struct {
+	ModelBase
+	OrganisationID uuid.UUID `json:"organisation_id" gorm:"type:uuid; primary_key"`
+	Day            string    `json:"day" gorm:"primary_key"`
+	Payments       int       `json:"payments"`
+}
+
+// QuotaAmountUsage records the amount of the payments in a currency created by an organisation on a UTC day
+type QuotaAmountUsage struct {
+	ModelBase
+	OrganisationID uuid.UUID `json:"organisation_id" gorm:"type:uuid; primary_key"`
+	Day            string    `json:"day" gorm:"primary_key"`
+	Currency       string    `json:"currency" gorm:"primary_key"`
+	Amount         string    `json:"amount"`
+}
+
+// QuotaStore persists the usage of the quotas
+type QuotaStore interface {
+	// UpdateQuotaUsage applies update to the usage of the organisation on the day and to its amount in the currency,
+	// both are saved unless update returns an error, in the transaction of ctx if there is one. Concurrent updates of
+	// the same usage are applied one after the other
+	UpdateQuotaUsage(ctx context.Context, organisationID uuid.UUID, day, currency string, update func(u *QuotaUsage, a *QuotaAmountUsage) error) error
+}
+
+type quotaStore struct {
+	txStore
+}
+
+// NewQuotaStore returns a QuotaStore backed by the database
+func NewQuotaStore(db *gorm.DB) QuotaStore {
+	return &quotaStore{
+		txStore{db: db},
+	}
+}
+
+// UpdateQuotaUsage locks the usage rows of the organisation and day, creating them if needed, until the end of the
+// transaction. The payments row is locked first, so the updates of the different currencies do not deadlock
+func (s *quotaStore) UpdateQuotaUsage(ctx context.Context, organisationID uuid.UUID, day, currency string, update func(u *QuotaUsage, a *QuotaAmountUsage) error) error {
+	return s.joinTransaction(ctx, func(ctx context.Context) error {
+		tx := withContext(s.db, ctx)
+		now := time.Now().UTC()
+		err := tx.Exec("INSERT INTO quota_usages (organisation_id, day, payments, created_at, updated_at) VALUES (?, ?, 0, ?, ?) ON CONFLICT DO NOTHING",
+			organisationID, day, now, now).Error
+		if err != nil {
+			return err
+		}
+		u := QuotaUsage{}
+		err = tx.Set("gorm:query_option", "FOR UPDATE").Where("organisation_id = ? AND day = ?", organisationID, day).First(&u).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec("INSERT INTO quota_amount_usages (organisation_id, day, currency, amount, created_at, updated_at) VALUES (?, ?, ?, '0', ?, ?) ON CONFLICT DO NOTHING",
+			organisationID, day, currency, now, now).Error
+		if err != nil {
+			return err
+		}
+		a := QuotaAmountUsage{}
+		err = tx.Set("gorm:query_option", "FOR UPDATE").Where("organisation_id = ? AND day = ? AND currency = ?", organisationID, day, currency).First(&a).Error
+		if err != nil {
+			return err
+		}
+		if err := update(&u, &a); err != nil {
+			return err
+		}
+		if err := tx.Save(&u).Error; err != nil {
+			return err
+		}
+		return tx.Save(&a).Error
+	})
+}
+
+// The quota middleware rejects the payments that would take an organisation over its daily quotas
+
+// QuotaLimiting is the PaymentService enforcing the daily quotas of the organisations
+type QuotaLimiting struct {
+	store QuotaStore
+	// mu guards quotas. The store serialises the updates of the usages, it is not held during them since the usages
+	// updated in the transaction of an all-or-nothing batch stay locked until the batch ends
+	mu     sync.Mutex
+	quotas Quotas
+	now    func() time.Time
+	next   PaymentService
+}
+
+// NewQuotas returns a new instance of PaymentService that counts the payments created by every organisation and
+// their amounts, and rejects the payments over the daily quotas with a 429 status code until the next UTC day.
+// Nothing is counted while there is no quota, the quotas can be changed with Update
+func NewQuotas(store QuotaStore, quotas Quotas, next PaymentService) *QuotaLimiting {
+	return &QuotaLimiting{
+		store:  store,
+		quotas: quotas,
+		now:    time.Now,
+		next:   next,
+	}
+}
+
+// Update replaces the quotas, the usages counted so far are kept
+func (mw *QuotaLimiting) Update(quotas Quotas) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.quotas = quotas
+}
+
+// quotaExceeded returns the error of a payment over a quota, it can be retried at the start of the next UTC day
+func quotaExceeded(msg string, now time.Time) StatusError {
+	tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	return StatusError{Status: http.StatusTooManyRequests, Kind: KindQuotaExceeded, Message: msg, RetryAfter: tomorrow.Sub(now)}
+}
+
+// usageAmount reads the amount of a usage, a new usage has none
+func usageAmount(a *QuotaAmountUsage) *big.Rat {
+	used, ok := new(big.Rat).SetString(a.Amount)
+	if !ok {
+		used = new(big.Rat)
+	}
+	return used
+}
+
+// reserve adds the payments, none for an update, and the amount in the currency to the usage of the organisation if
+// it stays within the quotas
+func (mw *QuotaLimiting) reserve(ctx context.Context, quotas Quotas, org uuid.UUID, day string, payments int, currency string, amount *big.Rat) error {
+	now := mw.now()
+	return mw.store.UpdateQuotaUsage(ctx, org, day, currency, func(u *QuotaUsage, a *QuotaAmountUsage) error {
+		if payments > 0 && quotas.Payments > 0 && u.Payments+payments > quotas.Payments {
+			return quotaExceeded("err: the daily quota of payments of the organisation is used up", now)
+		}
+		total := new(big.Rat).Add(usageAmount(a), amount)
+		if limit := quotas.amountQuota(currency); limit != nil && total.Cmp(limit) > 0 {
+			return quotaExceeded("err: the payment would exceed the daily "+currency+" amount quota of the organisation", now)
+		}
+		u.Payments += payments
+		a.Amount = decimalString(total)
+		return nil
+	})
+}
+
+// release removes what reserve added for a payment that could not be created or updated
+func (mw *QuotaLimiting) release(ctx context.Context, org uuid.UUID, day string, payments int, currency string, amount *big.Rat) error {
+	return mw.store.UpdateQuotaUsage(ctx, org, day, currency, func(u *QuotaUsage, a *QuotaAmountUsage) error {
+		u.Payments -= payments
+		if u.Payments < 0 {
+			u.Payments = 0
+		}
+		total := new(big.Rat).Sub(usageAmount(a), amount)
+		if total.Sign() < 0 {
+			total = new(big.Rat)
+		}
+		a.Amount = decimalString(total)
+		return nil
+	})
+}
+
+// decimalString formats r as a decimal number with as few decimals as needed, sums of decimal amounts always are
+func decimalString(r *big.Rat) string {
+	ten := big.NewInt(10)
+	scaled := new(big.Rat).Set(r)
+	for prec := 0; prec <= 18; prec++ {
+		if scaled.IsInt() {
+			return r.FloatString(prec)
+		}
+		scaled.Mul(scaled, new(big.Rat).SetInt(ten))
+	}
+	return r.RatString()
+}
+
+// GetPayment function is implemented for the quota layer, reads are not counted
+func (mw *QuotaLimiting) GetPayment(ctx context.Context, id string) (Payment, error) {
+	return mw.next.GetPayment(ctx, id)
+}
+
+// GetListPayments function is implemented for the quota layer, reads are not counted
+func (mw *QuotaLimiting) GetListPayments(ctx context.Context) ([]Payment, error) {
+	return mw.next.GetListPayments(ctx)
+}
+
+// counted reserves the payments and the amount in the currency for the caller's organisation, then calls fn and
+// releases them if it fails
+func (mw *QuotaLimiting) counted(ctx context.Context, payments int, currency string, amount *big.Rat, fn func() error) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return ErrUnauthorised
+	}
+	day := mw.now().UTC().Format(isoDateFormat)
+
+	mw.mu.Lock()
+	quotas := mw.quotas
+	mw.mu.Unlock()
+	if err := mw.reserve(ctx, quotas, principal.OrganisationID, day, payments, currency, amount); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		// the usage is left over-counted if it cannot be released, which errs on the side of the quota
+		_ = mw.release(ctx, principal.OrganisationID, day, payments, currency, amount)
+		return err
+	}
+	return nil
+}
+
+// quotaAmount reads the amount of a payment counted against the quotas
+func quotaAmount(p Payment) (*big.Rat, error) {
+	amount, ok := new(big.Rat).SetString(p.Attributes.Amount)
+	if !ok || amount.Sign() < 0 {
+		return nil, ErrPayloadNotValid
+	}
+	return amount, nil
+}
+
+// CreatePayment counts the payment against the quotas of the caller's organisation before creating it
+func (mw *QuotaLimiting) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
+	mw.mu.Lock()
+	unlimited := mw.quotas.unlimited()
+	mw.mu.Unlock()
+	if unlimited {
+		return mw.next.CreatePayment(ctx, p)
+	}
+	amount, err := quotaAmount(p)
+	if err != nil {
+		return CreatePaymentResponse{}, err
+	}
+	var res CreatePaymentResponse
+	err = mw.counted(ctx, 1, p.Attributes.Currency, amount, func() error {
+		var err error
+		res, err = mw.next.CreatePayment(ctx, p)
+		return err
+	})
+	return res, err
+}
+
+// UpdatePayment counts the amount added by the update against the quotas of the caller's organisation on the day of
+// the update, the whole amount when the currency changes. A lowered amount is not given back
+func (mw *QuotaLimiting) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	mw.mu.Lock()
+	unlimited := mw.quotas.unlimited()
+	mw.mu.Unlock()
+	if unlimited {
+		return mw.next.UpdatePayment(ctx, req)
+	}
+	amount, err := quotaAmount(req.Payment)
+	if err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	current, err := mw.next.GetPayment(ctx, req.PaymentID)
+	if err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	currency := req.Payment.Attributes.Currency
+	if currency == current.Attributes.Currency {
+		if before, ok := new(big.Rat).SetString(current.Attributes.Amount); ok {
+			amount.Sub(amount, before)
+		}
+	}
+	if amount.Sign() <= 0 {
+		return mw.next.UpdatePayment(ctx, req)
+	}
+	var res UpdatePaymentResponse
+	err = mw.counted(ctx, 0, currency, amount, func() error {
+		var err error
+		res, err = mw.next.UpdatePayment(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// DeletePayment function is implemented for the quota layer, deleted payments still count against the quotas
+func (mw *QuotaLimiting) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	return mw.next.DeletePayment(ctx, id)
+}
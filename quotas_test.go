@@ -0,0 +1,184 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type memoryQuotaStore struct {
+	usages  map[string]QuotaUsage
+	amounts map[string]QuotaAmountUsage
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{usages: map[string]QuotaUsage{}, amounts: map[string]QuotaAmountUsage{}}
+}
+
+func (m *memoryQuotaStore) UpdateQuotaUsage(_ context.Context, org uuid.UUID, day, currency string, update func(u *QuotaUsage, a *QuotaAmountUsage) error) error {
+	u, ok := m.usages[org.String()+day]
+	if !ok {
+		u = QuotaUsage{OrganisationID: org, Day: day}
+	}
+	a, ok := m.amounts[org.String()+day+currency]
+	if !ok {
+		a = QuotaAmountUsage{OrganisationID: org, Day: day, Currency: currency, Amount: "0"}
+	}
+	if err := update(&u, &a); err != nil {
+		return err
+	}
+	m.usages[org.String()+day], m.amounts[org.String()+day+currency] = u, a
+	return nil
+}
+
+func TestParseQuotas(t *testing.T) {
+	q, err := ParseQuotas(10, "1000.50")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, q.Payments)
+	assert.Equal(t, "1000.50", q.Amount.FloatString(2))
+
+	q, err = ParseQuotas(0, "")
+	assert.NoError(t, err)
+	assert.Nil(t, q.Amount)
+
+	_, err = ParseQuotas(-1, "")
+	assert.Error(t, err)
+	_, err = ParseQuotas(0, "lots")
+	assert.Error(t, err)
+
+	q, err = ParseQuotas(0, "gbp=1000, JPY=150000,2000")
+	assert.NoError(t, err)
+	assert.Equal(t, "1000", decimalString(q.amountQuota("GBP")))
+	assert.Equal(t, "150000", decimalString(q.amountQuota("JPY")))
+	assert.Equal(t, "2000", decimalString(q.amountQuota("EUR")))
+	q, _ = ParseQuotas(0, "GBP=1000")
+	assert.Nil(t, q.amountQuota("EUR"))
+	_, err = ParseQuotas(0, "pounds=1000")
+	assert.Error(t, err)
+	_, err = ParseQuotas(0, "GBP=-1")
+	assert.Error(t, err)
+}
+
+func TestQuotas(t *testing.T) {
+	org, _ := uuid.NewV4()
+	store := newMemoryQuotaStore()
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{}, nil)
+	s := NewQuotas(store, Quotas{Payments: 4, Amount: big.NewRat(150, 1)}, mockService)
+	now := time.Date(2020, 1, 1, 18, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	ctx := roleContext(org, "bob", RoleCreator)
+	payment := func(amount string) Payment {
+		return Payment{Attributes: Attributes{Amount: amount, Currency: "GBP"}}
+	}
+
+	_, err := s.CreatePayment(ctx, payment("100.25"))
+	assert.NoError(t, err)
+	_, err = s.CreatePayment(ctx, payment("50"))
+	assert.Equal(t, KindQuotaExceeded, err.(StatusError).Kind)
+	assert.Equal(t, http.StatusTooManyRequests, err.(StatusError).Status)
+	assert.Equal(t, 6*time.Hour, err.(StatusError).RetryAfter)
+	_, err = s.CreatePayment(ctx, payment("49.75"))
+	assert.NoError(t, err)
+	_, err = s.CreatePayment(ctx, payment("0"))
+	assert.NoError(t, err)
+	// the amounts of every currency are counted apart
+	_, err = s.CreatePayment(ctx, Payment{Attributes: Attributes{Amount: "150", Currency: "EUR"}})
+	assert.NoError(t, err)
+	_, err = s.CreatePayment(ctx, payment("0"))
+	assert.Equal(t, KindQuotaExceeded, err.(StatusError).Kind)
+	assert.Equal(t, QuotaUsage{OrganisationID: org, Day: "2020-01-01", Payments: 4}, store.usages[org.String()+"2020-01-01"])
+	assert.Equal(t, "150", store.amounts[org.String()+"2020-01-01GBP"].Amount)
+	assert.Equal(t, "150", store.amounts[org.String()+"2020-01-01EUR"].Amount)
+
+	// the quotas start again the next day
+	now = now.Add(6 * time.Hour)
+	_, err = s.CreatePayment(ctx, payment("1"))
+	assert.NoError(t, err)
+
+	_, err = s.CreatePayment(ctx, payment("one"))
+	assert.Equal(t, ErrPayloadNotValid, err)
+}
+
+func TestQuotasReleaseFailedPayments(t *testing.T) {
+	org, _ := uuid.NewV4()
+	store := newMemoryQuotaStore()
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{}, errors.New("db down"))
+	s := NewQuotas(store, Quotas{Payments: 1}, mockService)
+	ctx := roleContext(org, "bob", RoleCreator)
+
+	for i := 0; i < 2; i++ {
+		_, err := s.CreatePayment(ctx, Payment{Attributes: Attributes{Amount: "10.5"}})
+		assert.EqualError(t, err, "db down")
+	}
+	for _, u := range store.usages {
+		assert.Equal(t, 0, u.Payments)
+	}
+	for _, a := range store.amounts {
+		assert.Equal(t, "0", a.Amount)
+	}
+}
+
+func TestQuotasUpdate(t *testing.T) {
+	org, _ := uuid.NewV4()
+	store := newMemoryQuotaStore()
+	mockService := &MockPaymentService{}
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{}, nil)
+	s := NewQuotas(store, Quotas{}, mockService)
+	ctx := roleContext(org, "bob", RoleCreator)
+
+	// nothing is counted without quotas
+	_, err := s.CreatePayment(ctx, Payment{Attributes: Attributes{Amount: "10"}})
+	assert.NoError(t, err)
+	assert.Empty(t, store.usages)
+
+	s.Update(Quotas{Payments: 1})
+	_, err = s.CreatePayment(ctx, Payment{Attributes: Attributes{Amount: "10"}})
+	assert.NoError(t, err)
+	_, err = s.CreatePayment(ctx, Payment{Attributes: Attributes{Amount: "10"}})
+	assert.Equal(t, KindQuotaExceeded, err.(StatusError).Kind)
+}
+
+func TestQuotasUpdatePayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	store := newMemoryQuotaStore()
+	payments := newMemoryPaymentService()
+	s := NewQuotas(store, Quotas{Amount: big.NewRat(150, 1)}, payments)
+	s.now = func() time.Time { return time.Date(2020, 1, 1, 18, 0, 0, 0, time.UTC) }
+	ctx := roleContext(org, "bob", RoleCreator)
+	payment := func(amount, currency string) Payment {
+		p := isoPayment()
+		p.OrganisationID, p.Attributes.Amount, p.Attributes.Currency = org, amount, currency
+		return p
+	}
+	used := func(currency string) string {
+		return store.amounts[org.String()+"2020-01-01"+currency].Amount
+	}
+
+	res, err := s.CreatePayment(ctx, payment("100", "GBP"))
+	assert.NoError(t, err)
+	id := res.PaymentID.String()
+	// raising the amount counts the difference, lowering it gives nothing back
+	_, err = s.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: id, Payment: payment("140", "GBP")})
+	assert.NoError(t, err)
+	assert.Equal(t, "140", used("GBP"))
+	_, err = s.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: id, Payment: payment("1000", "GBP")})
+	assert.Equal(t, KindQuotaExceeded, err.(StatusError).Kind)
+	assert.Equal(t, "140", payments.payments[res.PaymentID].Attributes.Amount)
+	_, err = s.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: id, Payment: payment("10", "GBP")})
+	assert.NoError(t, err)
+	assert.Equal(t, "140", used("GBP"))
+	// a payment moved to another currency counts there in full
+	_, err = s.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: id, Payment: payment("120", "EUR")})
+	assert.NoError(t, err)
+	assert.Equal(t, "120", used("EUR"))
+	assert.Equal(t, 1, store.usages[org.String()+"2020-01-01"].Payments)
+}
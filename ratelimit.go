@@ -0,0 +1,252 @@
+package paymentsapi
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Keys the requests can be rate limited by
+const (
+	RateLimitByOrganisation = "organisation"
+	RateLimitByAPIKey       = "api_key"
+)
+
+// The buckets not used for pruneAfter are forgotten every pruneEvery requests, so that idle callers do not hold memory
+const (
+	pruneEvery = 10000
+	pruneAfter = time.Hour
+)
+
+// RateLimitRule limits the requests matching a method and a route template. An empty method or route matches
+// every request. Tokens are added to the bucket of every caller at Rate per second, up to Burst
+type RateLimitRule struct {
+	Method string
+	Route  string
+	Rate   float64
+	Burst  int
+}
+
+// specificity ranks the rules, a rule naming a method and a route is preferred to a rule naming only one of them
+func (r RateLimitRule) specificity() int {
+	s := 0
+	if r.Route != "" {
+		s += 2
+	}
+	if r.Method != "" {
+		s++
+	}
+	return s
+}
+
+// ParseRateLimitRules reads rate limit rules written as comma separated "[METHOD] [ROUTE]=RATE:BURST" items, e.g.
+// "GET=50:100,POST /v1/payments=5:10". RATE is the number of requests allowed per second, BURST defaults to RATE
+func ParseRateLimitRules(spec string) ([]RateLimitRule, error) {
+	var rules []RateLimitRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, errors.New("err: rate limit " + item + " must be written [METHOD] [ROUTE]=RATE:BURST")
+		}
+		rule := RateLimitRule{}
+		for _, f := range strings.Fields(item[:i]) {
+			if strings.HasPrefix(f, "/") {
+				rule.Route = f
+			} else {
+				rule.Method = strings.ToUpper(f)
+			}
+		}
+		limit := strings.SplitN(item[i+1:], ":", 2)
+		rate, err := strconv.ParseFloat(limit[0], 64)
+		if err != nil || rate <= 0 {
+			return nil, errors.New("err: rate of rate limit " + item + " must be a positive number")
+		}
+		rule.Rate = rate
+		rule.Burst = int(math.Ceil(rate))
+		if len(limit) == 2 {
+			if rule.Burst, err = strconv.Atoi(limit[1]); err != nil || rule.Burst <= 0 {
+				return nil, errors.New("err: burst of rate limit " + item + " must be a positive integer")
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// tokenBucket holds the tokens left to a caller at the time it was last used
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket rate limiter keeping a bucket per caller and rule
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+	now     func() time.Time
+}
+
+// NewRateLimiter returns an empty RateLimiter
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key for the rule. It reports whether a token was left, the number of
+// tokens left, the time until a token is available and the time until the bucket is full again
+func (l *RateLimiter) Allow(key string, rule RateLimitRule) (ok bool, remaining int, retryAfter, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.calls++
+	if l.calls%pruneEvery == 0 {
+		l.prune(now)
+	}
+
+	burst := float64(rule.Burst)
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rule.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retryAfter = seconds((1 - b.tokens) / rule.Rate)
+	}
+	reset = seconds((burst - b.tokens) / rule.Rate)
+	return ok, int(b.tokens), retryAfter, reset
+}
+
+// prune forgets the idle buckets, they are created full again when their caller comes back
+func (l *RateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > pruneAfter {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// RateLimiting is the HTTP handler throttling the requests of every caller
+type RateLimiting struct {
+	limiter *RateLimiter
+	// mu guards the rules and by, which can be changed with Update
+	mu     sync.RWMutex
+	rules  []RateLimitRule
+	by     string
+	router *mux.Router
+	next   http.Handler
+}
+
+// NewRateLimiting returns an HTTP handler that rate limits the requests of every organisation or API key (by) with
+// the most specific matching rule. Requests over the limit are rejected with a 429 status code and a Retry-After
+// header, the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers are sent with every response.
+// It needs to be wrapped by the authentication middleware, unauthenticated requests are limited by IP address
+func NewRateLimiting(next http.Handler, router *mux.Router, limiter *RateLimiter, by string, rules []RateLimitRule) (*RateLimiting, error) {
+	mw := &RateLimiting{
+		limiter: limiter,
+		router:  router,
+		next:    next,
+	}
+	if err := mw.Update(by, rules); err != nil {
+		return nil, err
+	}
+	return mw, nil
+}
+
+// Update replaces the rules and the key the requests are limited by, no request is limited without rules. The
+// buckets of the callers are kept for the rules matching the same method and route as before
+func (mw *RateLimiting) Update(by string, rules []RateLimitRule) error {
+	if by != RateLimitByOrganisation && by != RateLimitByAPIKey {
+		return errors.New("err: requests can only be rate limited by " + RateLimitByOrganisation + " or " + RateLimitByAPIKey)
+	}
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.by, mw.rules = by, rules
+	return nil
+}
+
+// rule returns the most specific rule matching the request and the key the request is counted against, false if
+// no rule matches
+func (mw *RateLimiting) rule(r *http.Request) (RateLimitRule, string, bool) {
+	route := ""
+	var match mux.RouteMatch
+	if mw.router.Match(r, &match) && match.Route != nil {
+		route, _ = match.Route.GetPathTemplate()
+	}
+	mw.mu.RLock()
+	defer mw.mu.RUnlock()
+	best := -1
+	for i, rule := range mw.rules {
+		if (rule.Method != "" && rule.Method != r.Method) || (rule.Route != "" && rule.Route != route) {
+			continue
+		}
+		if best < 0 || rule.specificity() > mw.rules[best].specificity() {
+			best = i
+		}
+	}
+	if best < 0 {
+		return RateLimitRule{}, "", false
+	}
+	rule := mw.rules[best]
+	return rule, rule.Method + " " + rule.Route + "|" + mw.caller(r), true
+}
+
+// caller returns the key of the caller the request is counted against
+func (mw *RateLimiting) caller(r *http.Request) string {
+	p, ok := PrincipalFromContext(r.Context())
+	switch {
+	case !ok:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		return "ip:" + host
+	case mw.by == RateLimitByAPIKey:
+		return "subject:" + p.Subject
+	}
+	return "org:" + p.OrganisationID.String()
+}
+
+func (mw *RateLimiting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rule, key, found := mw.rule(r)
+	if !found {
+		mw.next.ServeHTTP(w, r)
+		return
+	}
+	ok, remaining, retryAfter, reset := mw.limiter.Allow(key, rule)
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(rule.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	if !ok {
+		EncodeError(r.Context(), StatusError{
+			Status:     http.StatusTooManyRequests,
+			Kind:       KindRateLimited,
+			Message:    "err: too many requests, retry later",
+			RetryAfter: retryAfter,
+		}, w)
+		return
+	}
+	mw.next.ServeHTTP(w, r)
+}
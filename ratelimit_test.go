@@ -0,0 +1,103 @@
+package paymentsapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseRateLimitRules(t *testing.T) {
+	rules, err := ParseRateLimitRules("GET=50:100, post /v1/payments=0.5:2,/v1/approval-policy=3")
+	assert.NoError(t, err)
+	assert.Equal(t, []RateLimitRule{
+		{Method: "GET", Rate: 50, Burst: 100},
+		{Method: "POST", Route: "/v1/payments", Rate: 0.5, Burst: 2},
+		{Route: "/v1/approval-policy", Rate: 3, Burst: 3},
+	}, rules)
+
+	rules, err = ParseRateLimitRules("")
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, spec := range []string{"GET", "GET=fast", "GET=-1:5", "GET=1:0"} {
+		_, err = ParseRateLimitRules(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter()
+	l.now = func() time.Time { return now }
+	rule := RateLimitRule{Rate: 1, Burst: 2}
+
+	ok, remaining, _, _ := l.Allow("a", rule)
+	assert.True(t, ok)
+	assert.Equal(t, 1, remaining)
+	ok, remaining, _, reset := l.Allow("a", rule)
+	assert.True(t, ok)
+	assert.Equal(t, 0, remaining)
+	assert.Equal(t, 2*time.Second, reset)
+	ok, _, retryAfter, _ := l.Allow("a", rule)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// other callers have their own bucket
+	ok, _, _, _ = l.Allow("b", rule)
+	assert.True(t, ok)
+
+	now = now.Add(time.Second)
+	ok, _, _, _ = l.Allow("a", rule)
+	assert.True(t, ok)
+}
+
+func TestRateLimiting(t *testing.T) {
+	org, _ := uuid.NewV4()
+	otherOrg, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{}, nil)
+	router := NewHTTPTransport(mockService)
+	rules := []RateLimitRule{{Method: "GET", Rate: 100, Burst: 100}, {Method: "GET", Route: "/v1/payments", Rate: 0.1, Burst: 1}}
+	h, err := NewRateLimiting(router, router, NewRateLimiter(), RateLimitByOrganisation, rules)
+	assert.NoError(t, err)
+
+	get := func(org uuid.UUID, subject string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/payments", nil)
+		req = req.WithContext(roleContext(org, subject, RoleViewer))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := get(org, "apikey:a")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "10", rec.Header().Get("RateLimit-Reset"))
+
+	// the limit is shared by the API keys of the organisation
+	rec = get(org, "apikey:b")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), KindRateLimited)
+
+	rec = get(otherOrg, "apikey:c")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// the buckets are kept when the rules are updated, and nothing is limited without rules
+	assert.NoError(t, h.Update(RateLimitByOrganisation, rules[1:]))
+	rec = get(org, "apikey:a")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NoError(t, h.Update(RateLimitByOrganisation, nil))
+	rec = get(org, "apikey:a")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+	assert.Error(t, h.Update("ip", rules))
+
+	_, err = NewRateLimiting(router, router, NewRateLimiter(), "ip", rules)
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package paymentsapi
+
+import (
+	"context"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Roles that can be given to API keys and JWT bearer tokens
+const (
+	RoleViewer     = "viewer"
+	RoleCreator    = "creator"
+	RoleApprover   = "approver"
+	RoleOperations = "operations"
+	RoleAdmin      = "admin"
+)
+
+// Permissions checked in front of the operations of the API
+const (
+	PermissionReadPayments       = "read_payments"
+	PermissionWritePayments      = "write_payments"
+	PermissionApprovePayments    = "approve_payments"
+	PermissionManagePolicies     = "manage_policies"
+	PermissionApplyStatusReports = "apply_status_reports"
+)
+
+// rolePermissions lists the permissions granted by each role
+var rolePermissions = map[string][]string{
+	RoleViewer:     {PermissionReadPayments},
+	RoleCreator:    {PermissionReadPayments, PermissionWritePayments},
+	RoleApprover:   {PermissionReadPayments, PermissionApprovePayments},
+	RoleOperations: {PermissionReadPayments, PermissionApplyStatusReports},
+	RoleAdmin:      {PermissionReadPayments, PermissionWritePayments, PermissionApprovePayments, PermissionManagePolicies, PermissionApplyStatusReports},
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether one of the principal's roles grants the permission
+func (p Principal) HasPermission(permission string) bool {
+	for _, r := range p.Roles {
+		for _, perm := range rolePermissions[r] {
+			if perm == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkPermission returns the principal carried by ctx if one of its roles grants the permission
+func checkPermission(ctx context.Context, permission string) (Principal, error) {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return Principal{}, ErrUnauthorised
+	}
+	if !p.HasPermission(permission) {
+		return Principal{}, ErrForbidden
+	}
+	return p, nil
+}
+
+// The access control middleware checks the roles of the caller in front of every operation
+
+// accessControlMiddleware is the type of the wrapper around the core service and any other functionality layers
+type accessControlMiddleware struct {
+	next PaymentService
+}
+
+// NewAccessControl returns a new instance of PaymentService that checks that the roles of the principal carried by the
+// context grant the permission needed by each operation
+func NewAccessControl(next PaymentService) PaymentService {
+	return &accessControlMiddleware{
+		next: next,
+	}
+}
+
+// GetPayment requires the read_payments permission
+func (mw accessControlMiddleware) GetPayment(ctx context.Context, id string) (Payment, error) {
+	if _, err := checkPermission(ctx, PermissionReadPayments); err != nil {
+		return Payment{}, err
+	}
+	return mw.next.GetPayment(ctx, id)
+}
+
+// GetListPayments requires the read_payments permission
+func (mw accessControlMiddleware) GetListPayments(ctx context.Context) ([]Payment, error) {
+	if _, err := checkPermission(ctx, PermissionReadPayments); err != nil {
+		return nil, err
+	}
+	return mw.next.GetListPayments(ctx)
+}
+
+// CreatePayment requires the write_payments permission
+func (mw accessControlMiddleware) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
+	if _, err := checkPermission(ctx, PermissionWritePayments); err != nil {
+		return CreatePaymentResponse{}, err
+	}
+	return mw.next.CreatePayment(ctx, p)
+}
+
+// UpdatePayment requires the write_payments permission
+func (mw accessControlMiddleware) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	if _, err := checkPermission(ctx, PermissionWritePayments); err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	return mw.next.UpdatePayment(ctx, req)
+}
+
+// DeletePayment requires the write_payments permission
+func (mw accessControlMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	if _, err := checkPermission(ctx, PermissionWritePayments); err != nil {
+		return nil, err
+	}
+	return mw.next.DeletePayment(ctx, id)
+}
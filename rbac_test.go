@@ -0,0 +1,80 @@
+package paymentsapi
+
+import (
+	"context"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func roleContext(org uuid.UUID, subject string, roles ...string) context.Context {
+	return NewContextWithPrincipal(context.Background(), Principal{Subject: subject, OrganisationID: org, Roles: roles})
+}
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		role       string
+		permission string
+		want       bool
+	}{
+		{RoleViewer, PermissionReadPayments, true},
+		{RoleViewer, PermissionWritePayments, false},
+		{RoleCreator, PermissionWritePayments, true},
+		{RoleCreator, PermissionApprovePayments, false},
+		{RoleApprover, PermissionApprovePayments, true},
+		{RoleApprover, PermissionWritePayments, false},
+		{RoleAdmin, PermissionManagePolicies, true},
+		{RoleOperations, PermissionApplyStatusReports, true},
+		{RoleOperations, PermissionWritePayments, false},
+		{RoleAdmin, PermissionApplyStatusReports, true},
+		{RoleCreator, PermissionApplyStatusReports, false},
+		{RoleApprover, PermissionApplyStatusReports, false},
+		{"unknown", PermissionReadPayments, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.permission, func(t *testing.T) {
+			assert.Equal(t, tt.want, Principal{Roles: []string{tt.role}}.HasPermission(tt.permission))
+		})
+	}
+	assert.True(t, ValidRole(RoleAdmin))
+	assert.False(t, ValidRole("root"))
+}
+
+func TestAccessControl(t *testing.T) {
+	org, _ := uuid.NewV4()
+	id, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id}, nil)
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{}, nil)
+	mockService.On("CreatePayment", mock.Anything, mock.Anything).Return(CreatePaymentResponse{}, nil)
+	mockService.On("UpdatePayment", mock.Anything, mock.Anything).Return(UpdatePaymentResponse{}, nil)
+	mockService.On("DeletePayment", mock.Anything, id).Return(nil, nil)
+	s := NewAccessControl(mockService)
+
+	viewer := roleContext(org, "viewer", RoleViewer)
+	creator := roleContext(org, "creator", RoleCreator)
+
+	_, err := s.GetPayment(viewer, id.String())
+	assert.NoError(t, err)
+	_, err = s.GetListPayments(viewer)
+	assert.NoError(t, err)
+	_, err = s.CreatePayment(viewer, Payment{})
+	assert.Equal(t, ErrForbidden, err)
+	_, err = s.UpdatePayment(viewer, UpdatePaymentRequest{})
+	assert.Equal(t, ErrForbidden, err)
+	_, err = s.DeletePayment(viewer, id)
+	assert.Equal(t, ErrForbidden, err)
+
+	_, err = s.CreatePayment(creator, Payment{})
+	assert.NoError(t, err)
+	_, err = s.UpdatePayment(creator, UpdatePaymentRequest{})
+	assert.NoError(t, err)
+	_, err = s.DeletePayment(creator, id)
+	assert.NoError(t, err)
+
+	_, err = s.GetPayment(context.Background(), id.String())
+	assert.Equal(t, ErrUnauthorised, err)
+	mockService.AssertNumberOfCalls(t, "CreatePayment", 1)
+}
@@ -0,0 +1,810 @@
+package paymentsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	config "github.com/vstoianovici/paymentsapi/config"
+)
+
+// FormatStatementCSV is a bank statement in the CSV layout configured with ReconciliationOptions
+const FormatStatementCSV = "csv"
+
+// Kinds of the items of a reconciliation
+const (
+	ReconciliationMatched          = "matched"
+	ReconciliationUnmatchedEntry   = "unmatched_entry"
+	ReconciliationUnmatchedPayment = "unmatched_payment"
+)
+
+// How the entries of the statements were matched to the payments
+const (
+	MatchedByEndToEndReference = "end_to_end_reference"
+	MatchedByNumericReference  = "numeric_reference"
+	MatchedByAmountAndDate     = "amount_and_date"
+	MatchedManually            = "manual"
+)
+
+// States of the unmatched items in the review queue
+const (
+	ReviewOpen     = "open"
+	ReviewResolved = "resolved"
+)
+
+// statementNotProvided is the reference the banks give to the transactions that had none
+const statementNotProvided = "NOTPROVIDED"
+
+// statementCSVFields are the fields of the entries of the CSV statements, the first three are required
+var statementCSVFields = []string{"booking_date", "amount", "currency", "credit_debit", "end_to_end_reference", "numeric_reference", "reference", "description"}
+
+var (
+	errReconciliationNotFound = StatusError{Status: http.StatusNotFound, Kind: KindNotFound, Message: "err: reconciliation not found"}
+	errReviewItemNotFound     = StatusError{Status: http.StatusNotFound, Kind: KindNotFound, Message: "err: review item not found"}
+)
+
+// Statement is a bank statement, the entries are the transactions booked on the account
+type Statement struct {
+	ID      string
+	Account string
+	// FromDate and ToDate are the period of the statement, the days of its first and last entries if it does not
+	// give one
+	FromDate string
+	ToDate   string
+	Entries  []StatementEntry
+	// Ignored counts the entries that are not booked yet
+	Ignored int
+}
+
+// StatementEntry is a transaction booked on the account of a statement
+type StatementEntry struct {
+	// Reference is the reference the bank gave to the entry
+	Reference         string
+	EndToEndReference string
+	NumericReference  string
+	Amount            string
+	Currency          string
+	// Debit tells the payments sent from the account from the money received
+	Debit       bool
+	BookingDate string
+	Description string
+}
+
+// references reports whether the entry carries references of the payment
+func (e StatementEntry) references() bool {
+	return reference(e.EndToEndReference) != "" || reference(e.NumericReference) != ""
+}
+
+// reference returns the reference, or an empty string when the bank reported it was not provided
+func reference(ref string) string {
+	if ref == statementNotProvided {
+		return ""
+	}
+	return ref
+}
+
+// StatementCSVLayout describes the CSV statements of a bank
+type StatementCSVLayout struct {
+	// Columns maps the fields of the entries to the columns holding them
+	Columns    map[string]string
+	DateFormat string
+	Separator  rune
+}
+
+// ReconciliationOptions sets how the entries of the statements are matched to the payments
+type ReconciliationOptions struct {
+	// AmountTolerance is the largest difference between the amount of an entry and the amount of its payment
+	AmountTolerance *big.Rat
+	// DateTolerance is the number of days the booking date of an entry can be away from the processing date
+	DateTolerance int
+	CSV           StatementCSVLayout
+}
+
+// ParseReconciliationOptions reads the options of the reconciliations from the configuration
+func ParseReconciliationOptions(c config.ReconciliationConfig) (ReconciliationOptions, error) {
+	o := ReconciliationOptions{
+		DateTolerance: c.DateToleranceDays,
+		CSV:           StatementCSVLayout{Columns: map[string]string{}, DateFormat: c.CSVDateFormat, Separator: ','},
+	}
+	tolerance, ok := new(big.Rat).SetString(c.AmountTolerance)
+	if !ok || tolerance.Sign() < 0 {
+		return o, errors.New("err: the amount tolerance must be a positive decimal number")
+	}
+	o.AmountTolerance = tolerance
+	if o.DateTolerance < 0 {
+		return o, errors.New("err: the date tolerance cannot be negative")
+	}
+	if r := []rune(c.CSVSeparator); len(r) == 1 {
+		o.CSV.Separator = r[0]
+	}
+	for _, f := range statementCSVFields {
+		o.CSV.Columns[f] = f
+	}
+	for _, pair := range strings.Split(c.CSVColumns, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		field := strings.TrimSpace(kv[0])
+		if _, ok := o.CSV.Columns[field]; !ok || len(kv) != 2 || strings.TrimSpace(kv[1]) == "" {
+			return o, errors.New("err: invalid CSV column " + pair + ", expected field=column with a field among " + strings.Join(statementCSVFields, ", "))
+		}
+		o.CSV.Columns[field] = strings.TrimSpace(kv[1])
+	}
+	return o, nil
+}
+
+// parseCSVStatement reads the entries of a CSV statement. The amounts of the debits are negative, unless the
+// credit_debit column tells them apart with values starting with C or D
+func parseCSVStatement(data []byte, layout StatementCSVLayout) (Statement, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	r.Comma = layout.Separator
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return Statement{}, errors.New("err: Could not read the CSV header: " + err.Error())
+	}
+	index := map[string]int{}
+	for i, h := range header {
+		for field, column := range layout.Columns {
+			if strings.EqualFold(strings.TrimSpace(h), column) {
+				index[field] = i
+			}
+		}
+	}
+	for _, field := range statementCSVFields[:3] {
+		if _, ok := index[field]; !ok {
+			return Statement{}, errors.New("err: Could not read the CSV header: the column " + layout.Columns[field] + " is missing")
+		}
+	}
+
+	s := Statement{}
+	var problems []string
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Statement{}, errors.New("err: Could not read the CSV statement: " + err.Error())
+		}
+		line, _ := r.FieldPos(0)
+		value := func(field string) string {
+			if i, ok := index[field]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		e := StatementEntry{
+			Reference:         value("reference"),
+			EndToEndReference: value("end_to_end_reference"),
+			NumericReference:  value("numeric_reference"),
+			Currency:          strings.ToUpper(value("currency")),
+			Description:       value("description"),
+		}
+		amount := value("amount")
+		e.Debit = strings.HasPrefix(amount, "-")
+		e.Amount = strings.TrimLeft(amount, "+-")
+		if cd := strings.ToUpper(value("credit_debit")); cd != "" {
+			e.Debit = strings.HasPrefix(cd, "D")
+		}
+		date, err := time.Parse(layout.DateFormat, value("booking_date"))
+		e.BookingDate = date.Format(isoDateFormat)
+		switch {
+		case err != nil:
+			problems = append(problems, "line "+strconv.Itoa(line)+": the booking date is not formatted as "+layout.DateFormat)
+		case !isoAmountPattern.MatchString(e.Amount):
+			problems = append(problems, "line "+strconv.Itoa(line)+": the amount is not a decimal number")
+		case !isoCurrencyPattern.MatchString(e.Currency):
+			problems = append(problems, "line "+strconv.Itoa(line)+": the currency is not an ISO 4217 code")
+		}
+		s.Entries = append(s.Entries, e)
+	}
+	if len(problems) > 0 {
+		return Statement{}, errors.New("err: the CSV statement is not valid: " + strings.Join(problems, "; "))
+	}
+	return s, nil
+}
+
+// earliestDate returns the earliest of two days, the empty one is ignored
+func earliestDate(a, b string) string {
+	if a == "" || (b != "" && b < a) {
+		return b
+	}
+	return a
+}
+
+// latestDate returns the latest of two days, the empty one is ignored
+func latestDate(a, b string) string {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// Reconciliation is the outcome of matching a bank statement with the payments of an organisation, the counters
+// summarise the items
+type Reconciliation struct {
+	ModelBase
+	ID                uuid.UUID            `json:"id" gorm:"type:uuid; primary_key"`
+	OrganisationID    uuid.UUID            `json:"organisation_id" gorm:"type:uuid; index"`
+	Format            string               `json:"format"`
+	StatementID       string               `json:"statement_id,omitempty"`
+	Account           string               `json:"account,omitempty"`
+	FromDate          string               `json:"from_date"`
+	ToDate            string               `json:"to_date"`
+	Entries           int                  `json:"entries"`
+	IgnoredEntries    int                  `json:"ignored_entries"`
+	Matched           int                  `json:"matched"`
+	UnmatchedEntries  int                  `json:"unmatched_entries"`
+	UnmatchedPayments int                  `json:"unmatched_payments"`
+	CreatedBy         string               `json:"created_by"`
+	RequestID         string               `json:"request_id"`
+	ReconciledAt      time.Time            `json:"reconciled_at"`
+	Items             []ReconciliationItem `json:"items,omitempty" gorm:"-"`
+}
+
+// ReconciliationItem is an entry of a statement matched to its payment, or an entry or a payment left unmatched.
+// The unmatched items wait in the review queue until they are resolved
+type ReconciliationItem struct {
+	ModelBase
+	ID                uint      `json:"id" gorm:"primary_key"`
+	ReconciliationID  uuid.UUID `json:"reconciliation_id" gorm:"type:uuid; index"`
+	OrganisationID    uuid.UUID `json:"-" gorm:"type:uuid; index"`
+	Kind              string    `json:"kind"`
+	MatchedBy         string    `json:"matched_by,omitempty"`
+	PaymentID         uuid.UUID `json:"payment_id,omitempty" gorm:"type:uuid; index"`
+	EntryReference    string    `json:"entry_reference,omitempty"`
+	EndToEndReference string    `json:"end_to_end_reference,omitempty"`
+	NumericReference  string    `json:"numeric_reference,omitempty"`
+	Amount            string    `json:"amount"`
+	Currency          string    `json:"currency"`
+	Debit             bool      `json:"debit"`
+	Date              string    `json:"date"`
+	Description       string    `json:"description,omitempty"`
+	// Reason tells why the item was not matched
+	Reason      string     `json:"reason,omitempty"`
+	ReviewState string     `json:"review_state,omitempty" gorm:"index"`
+	ResolvedBy  string     `json:"resolved_by,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+	Note        string     `json:"note,omitempty"`
+}
+
+// entryItem returns the unmatched item of an entry
+func entryItem(e StatementEntry) ReconciliationItem {
+	return ReconciliationItem{
+		Kind:              ReconciliationUnmatchedEntry,
+		EntryReference:    e.Reference,
+		EndToEndReference: e.EndToEndReference,
+		NumericReference:  e.NumericReference,
+		Amount:            e.Amount,
+		Currency:          e.Currency,
+		Debit:             e.Debit,
+		Date:              e.BookingDate,
+		Description:       e.Description,
+		ReviewState:       ReviewOpen,
+	}
+}
+
+// ReconciliationStore persists the reconciliations and settles the payments they matched
+type ReconciliationStore interface {
+	// CreateReconciliation stores the reconciliation and its items, in the transaction of ctx if there is one
+	CreateReconciliation(ctx context.Context, r *Reconciliation) error
+	// FindReconciliation retrieves a reconciliation along with its items
+	FindReconciliation(id uuid.UUID) (Reconciliation, error)
+	// ListReconciliations lists the reconciliations of the organisation without their items, newest first
+	ListReconciliations(organisationID uuid.UUID) ([]Reconciliation, error)
+	// ListReviewItems lists the items of the organisation waiting for a review, oldest first
+	ListReviewItems(organisationID uuid.UUID) ([]ReconciliationItem, error)
+	FindReconciliationItem(id uint) (ReconciliationItem, error)
+	SaveReconciliationItem(ctx context.Context, item *ReconciliationItem) error
+	// ReconciledPaymentIDs returns the payments of the organisation already matched to an entry
+	ReconciledPaymentIDs(organisationID uuid.UUID) (map[uuid.UUID]bool, error)
+	// SetSchemeStatus changes the status of the payment along with the status and the reasons reported by the banks,
+	// in the transaction of ctx if there is one
+	SetSchemeStatus(ctx context.Context, paymentID uuid.UUID, status, schemeStatus, reason string) error
+	Transactor
+}
+
+type reconciliationStore struct {
+	statusReportStore
+}
+
+// NewReconciliationStore returns a ReconciliationStore backed by the database
+func NewReconciliationStore(db *gorm.DB) ReconciliationStore {
+	return &reconciliationStore{
+		statusReportStore{txStore{db: db}},
+	}
+}
+
+// CreateReconciliation stores the reconciliation, then its items
+func (s *reconciliationStore) CreateReconciliation(ctx context.Context, r *Reconciliation) error {
+	db := withContext(s.db, ctx)
+	if err := db.Create(r).Error; err != nil {
+		return err
+	}
+	for i := range r.Items {
+		if err := db.Create(&r.Items[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindReconciliation retrieves a reconciliation and its items in the order of the statement
+func (s *reconciliationStore) FindReconciliation(id uuid.UUID) (Reconciliation, error) {
+	r := Reconciliation{}
+	if err := s.db.Where("id = ?", id).First(&r).Error; err != nil {
+		return r, err
+	}
+	err := s.db.Where("reconciliation_id = ?", id).Order("id").Find(&r.Items).Error
+	return r, err
+}
+
+// ListReconciliations lists the reconciliations of an organisation
+func (s *reconciliationStore) ListReconciliations(organisationID uuid.UUID) ([]Reconciliation, error) {
+	reconciliations := []Reconciliation{}
+	err := s.db.Where("organisation_id = ?", organisationID).Order("reconciled_at desc").Find(&reconciliations).Error
+	return reconciliations, err
+}
+
+// ListReviewItems lists the open items of an organisation
+func (s *reconciliationStore) ListReviewItems(organisationID uuid.UUID) ([]ReconciliationItem, error) {
+	items := []ReconciliationItem{}
+	err := s.db.Where("organisation_id = ? AND review_state = ?", organisationID, ReviewOpen).Order("id").Find(&items).Error
+	return items, err
+}
+
+// FindReconciliationItem retrieves an item of a reconciliation
+func (s *reconciliationStore) FindReconciliationItem(id uint) (ReconciliationItem, error) {
+	item := ReconciliationItem{}
+	err := s.db.Where("id = ?", id).First(&item).Error
+	return item, err
+}
+
+// SaveReconciliationItem saves the review of an item
+func (s *reconciliationStore) SaveReconciliationItem(ctx context.Context, item *ReconciliationItem) error {
+	return withContext(s.db, ctx).Save(item).Error
+}
+
+// ReconciledPaymentIDs returns the payments matched automatically or by hand
+func (s *reconciliationStore) ReconciledPaymentIDs(organisationID uuid.UUID) (map[uuid.UUID]bool, error) {
+	var ids []uuid.UUID
+	err := s.db.Model(&ReconciliationItem{}).Where("organisation_id = ? AND matched_by <> ''", organisationID).Pluck("payment_id", &ids).Error
+	reconciled := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		reconciled[id] = true
+	}
+	return reconciled, err
+}
+
+// statementMatcher pairs the entries of a statement with the payments, a payment is matched to a single entry
+type statementMatcher struct {
+	options  ReconciliationOptions
+	payments []Payment
+	used     map[uuid.UUID]bool
+}
+
+// candidates returns the payments that are not matched yet with the amount, the currency and the date of the entry,
+// within the tolerances
+func (m *statementMatcher) candidates(e StatementEntry) []Payment {
+	amount, ok := new(big.Rat).SetString(e.Amount)
+	day, err := time.Parse(isoDateFormat, e.BookingDate)
+	if !ok || err != nil {
+		return nil
+	}
+	var payments []Payment
+	for _, p := range m.payments {
+		a := p.Attributes
+		if m.used[p.ID] || a.Currency != e.Currency {
+			continue
+		}
+		pAmount, ok := new(big.Rat).SetString(a.Amount)
+		if !ok || a.ProcessingDate.IsZero() {
+			continue
+		}
+		diff := new(big.Rat).Sub(amount, pAmount)
+		days := int(day.Sub(a.ProcessingDate.Time).Hours() / 24)
+		if diff.Abs(diff).Cmp(m.options.AmountTolerance) <= 0 && days <= m.options.DateTolerance && -days <= m.options.DateTolerance {
+			payments = append(payments, p)
+		}
+	}
+	return payments
+}
+
+// withReference keeps the payments whose reference is ref
+func withReference(payments []Payment, ref string, field func(a Attributes) string) []Payment {
+	var found []Payment
+	for _, p := range payments {
+		if field(p.Attributes) == ref {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// reconcileStatement matches the debits of the statement to the payments, by end-to-end reference first, then by
+// numeric reference. The entries without any reference are matched by amount and date when a single payment fits.
+// The entries left and the open payments of the statement's account and period are returned as unmatched
+func reconcileStatement(s Statement, payments []Payment, options ReconciliationOptions) []ReconciliationItem {
+	m := &statementMatcher{options: options, payments: payments, used: map[uuid.UUID]bool{}}
+	items := make([]ReconciliationItem, len(s.Entries))
+	for i, e := range s.Entries {
+		items[i] = entryItem(e)
+	}
+	match := func(i int, p Payment, by string) {
+		m.used[p.ID] = true
+		items[i].Kind, items[i].MatchedBy, items[i].PaymentID, items[i].ReviewState = ReconciliationMatched, by, p.ID, ""
+	}
+	passes := []struct {
+		by    string
+		entry func(e StatementEntry) string
+		field func(a Attributes) string
+	}{
+		{MatchedByEndToEndReference, func(e StatementEntry) string { return reference(e.EndToEndReference) }, func(a Attributes) string { return a.EndToEndReference }},
+		{MatchedByNumericReference, func(e StatementEntry) string { return reference(e.NumericReference) }, func(a Attributes) string { return a.NumericReference }},
+	}
+	for _, pass := range passes {
+		for i, e := range s.Entries {
+			if ref := pass.entry(e); e.Debit && ref != "" && items[i].Kind == ReconciliationUnmatchedEntry {
+				if found := withReference(m.candidates(e), ref, pass.field); len(found) == 1 {
+					match(i, found[0], pass.by)
+				}
+			}
+		}
+	}
+	for i, e := range s.Entries {
+		if !e.Debit || e.references() || items[i].Kind != ReconciliationUnmatchedEntry {
+			continue
+		}
+		if found := m.candidates(e); len(found) == 1 {
+			match(i, found[0], MatchedByAmountAndDate)
+		}
+	}
+
+	for i, e := range s.Entries {
+		if items[i].Kind != ReconciliationUnmatchedEntry {
+			continue
+		}
+		found := m.candidates(e)
+		switch {
+		case !e.Debit:
+			items[i].Reason = "the entry is a credit, it is not a payment of the organisation"
+		case len(found) == 0:
+			items[i].Reason = "no payment has the amount, the currency and the date of the entry"
+		case e.references():
+			items[i].Reason = "no single payment with the amount, the currency and the date has the references of the entry"
+		default:
+			items[i].Reason = "several payments have the amount, the currency and the date of the entry"
+		}
+	}
+
+	for _, p := range payments {
+		a := p.Attributes
+		account := s.Account == "" || a.DebtorParty.AccountNumber == s.Account || a.SponsorParty.AccountNumber == s.Account
+		if m.used[p.ID] || p.Status != PaymentStatusAccepted || !account || a.ProcessingDate.String() < s.FromDate || a.ProcessingDate.String() > s.ToDate {
+			continue
+		}
+		items = append(items, ReconciliationItem{
+			Kind:              ReconciliationUnmatchedPayment,
+			PaymentID:         p.ID,
+			EndToEndReference: a.EndToEndReference,
+			NumericReference:  a.NumericReference,
+			Amount:            a.Amount,
+			Currency:          a.Currency,
+			Debit:             true,
+			Date:              a.ProcessingDate.String(),
+			Reason:            "the payment is not on the statement",
+			ReviewState:       ReviewOpen,
+		})
+	}
+	return items
+}
+
+// ReconciliationService reconciles the bank statements with the payments
+type ReconciliationService interface {
+	Reconcile(ctx context.Context, format string, data []byte) (Reconciliation, error)
+	GetReconciliation(ctx context.Context, id uuid.UUID) (Reconciliation, error)
+	ListReconciliations(ctx context.Context) ([]Reconciliation, error)
+	ListReviewItems(ctx context.Context) ([]ReconciliationItem, error)
+	ResolveReviewItem(ctx context.Context, req ResolveReviewItemRequest) (ReconciliationItem, error)
+}
+
+type reconciliationService struct {
+	store    ReconciliationStore
+	payments PaymentService
+	options  ReconciliationOptions
+	now      func() time.Time
+}
+
+// NewReconciliationService returns the ReconciliationService matching the statements to the payments retrieved
+// through the PaymentService
+func NewReconciliationService(store ReconciliationStore, payments PaymentService, options ReconciliationOptions) ReconciliationService {
+	return &reconciliationService{
+		store:    store,
+		payments: payments,
+		options:  options,
+		now:      time.Now,
+	}
+}
+
+// parse reads a statement of the format
+func (s *reconciliationService) parse(format string, data []byte) (Statement, error) {
+	switch format {
+	case FormatCamt053:
+		return parseCamt053(data)
+	case FormatStatementCSV:
+		return parseCSVStatement(data, s.options.CSV)
+	}
+	return Statement{}, errors.New("err: unknown statement format " + strconv.Quote(format) + ", expected " + FormatCamt053 + " or " + FormatStatementCSV)
+}
+
+// reconcilableStatus reports whether a payment of the status can be matched to a statement entry: the accepted
+// payments, which have been sent, and the settled ones so that matching them again changes nothing
+func reconcilableStatus(status string) bool {
+	return status == PaymentStatusAccepted || status == PaymentStatusSettled
+}
+
+// reconcilable returns the payments that can be matched to the entries of a statement, the payments that have not been
+// sent, that are final or that are already matched to an entry are left out
+func (s *reconciliationService) reconcilable(ctx context.Context, organisationID uuid.UUID) ([]Payment, error) {
+	payments, err := s.payments.GetListPayments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reconciled, err := s.store.ReconciledPaymentIDs(organisationID)
+	if err != nil {
+		return nil, err
+	}
+	var open []Payment
+	for _, p := range payments {
+		if reconcilableStatus(p.Status) && !reconciled[p.ID] {
+			open = append(open, p)
+		}
+	}
+	return open, nil
+}
+
+// settle marks a matched payment as settled, as its entry was booked
+func (s *reconciliationService) settle(ctx context.Context, id uuid.UUID, status string) error {
+	if status == PaymentStatusSettled {
+		return nil
+	}
+	return s.store.SetSchemeStatus(ctx, id, PaymentStatusSettled, "BOOK", "")
+}
+
+// Reconcile matches the entries of a statement to the payments of the caller's organisation. The matched payments are
+// settled, the entries and the payments left unmatched are queued for review
+func (s *reconciliationService) Reconcile(ctx context.Context, format string, data []byte) (Reconciliation, error) {
+	p, err := checkPermission(ctx, PermissionWritePayments)
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	statement, err := s.parse(format, data)
+	if err != nil {
+		return Reconciliation{}, StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: err.Error()}
+	}
+	if statement.FromDate == "" || statement.ToDate == "" {
+		for _, e := range statement.Entries {
+			statement.FromDate, statement.ToDate = earliestDate(statement.FromDate, e.BookingDate), latestDate(statement.ToDate, e.BookingDate)
+		}
+	}
+	payments, err := s.reconcilable(ctx, p.OrganisationID)
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	id, _ := uuid.NewV4()
+	r := Reconciliation{
+		ID:             id,
+		OrganisationID: p.OrganisationID,
+		Format:         format,
+		StatementID:    statement.ID,
+		Account:        statement.Account,
+		FromDate:       statement.FromDate,
+		ToDate:         statement.ToDate,
+		Entries:        len(statement.Entries),
+		IgnoredEntries: statement.Ignored,
+		CreatedBy:      p.Subject,
+		RequestID:      RequestIDFromContext(ctx),
+		ReconciledAt:   s.now().UTC(),
+		Items:          reconcileStatement(statement, payments, s.options),
+	}
+	statuses := map[uuid.UUID]string{}
+	for _, payment := range payments {
+		statuses[payment.ID] = payment.Status
+	}
+	err = s.store.InTransaction(ctx, func(ctx context.Context) error {
+		for i := range r.Items {
+			item := &r.Items[i]
+			item.ReconciliationID, item.OrganisationID = r.ID, r.OrganisationID
+			switch item.Kind {
+			case ReconciliationMatched:
+				r.Matched++
+				if err := s.settle(ctx, item.PaymentID, statuses[item.PaymentID]); err != nil {
+					return err
+				}
+			case ReconciliationUnmatchedEntry:
+				r.UnmatchedEntries++
+			case ReconciliationUnmatchedPayment:
+				r.UnmatchedPayments++
+			}
+		}
+		return s.store.CreateReconciliation(ctx, &r)
+	})
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	return r, nil
+}
+
+// GetReconciliation returns a reconciliation of the caller's organisation with its items
+func (s *reconciliationService) GetReconciliation(ctx context.Context, id uuid.UUID) (Reconciliation, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	r, err := s.store.FindReconciliation(id)
+	if gorm.IsRecordNotFoundError(err) || (err == nil && r.OrganisationID != p.OrganisationID) {
+		return Reconciliation{}, errReconciliationNotFound
+	}
+	return r, err
+}
+
+// ListReconciliations lists the reconciliations of the caller's organisation
+func (s *reconciliationService) ListReconciliations(ctx context.Context) ([]Reconciliation, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.ListReconciliations(p.OrganisationID)
+}
+
+// ListReviewItems lists the unmatched entries and payments of the caller's organisation that are not resolved yet
+func (s *reconciliationService) ListReviewItems(ctx context.Context) ([]ReconciliationItem, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.ListReviewItems(p.OrganisationID)
+}
+
+// ResolveReviewItem takes an item out of the review queue. An unmatched entry can be matched to a payment by hand,
+// which settles the payment
+func (s *reconciliationService) ResolveReviewItem(ctx context.Context, req ResolveReviewItemRequest) (ReconciliationItem, error) {
+	p, err := checkPermission(ctx, PermissionWritePayments)
+	if err != nil {
+		return ReconciliationItem{}, err
+	}
+	item, err := s.store.FindReconciliationItem(req.ItemID)
+	if gorm.IsRecordNotFoundError(err) || (err == nil && item.OrganisationID != p.OrganisationID) {
+		return ReconciliationItem{}, errReviewItemNotFound
+	}
+	if err != nil {
+		return ReconciliationItem{}, err
+	}
+	if item.ReviewState != ReviewOpen {
+		return ReconciliationItem{}, StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the item is not waiting for a review"}
+	}
+	payment := Payment{}
+	if req.PaymentID != "" {
+		if item.Kind != ReconciliationUnmatchedEntry {
+			return ReconciliationItem{}, StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: "err: only the unmatched entries can be matched to a payment"}
+		}
+		payment, err = s.payments.GetPayment(ctx, req.PaymentID)
+		if err != nil {
+			return ReconciliationItem{}, err
+		}
+		reconciled, err := s.store.ReconciledPaymentIDs(p.OrganisationID)
+		if err != nil {
+			return ReconciliationItem{}, err
+		}
+		if reconciled[payment.ID] {
+			return ReconciliationItem{}, StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the payment cannot be matched, it is already reconciled"}
+		}
+		if !reconcilableStatus(payment.Status) {
+			return ReconciliationItem{}, StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the payment cannot be matched, it is " + payment.Status + ", only accepted and settled payments are"}
+		}
+		item.PaymentID, item.MatchedBy = payment.ID, MatchedManually
+	}
+	now := s.now().UTC()
+	item.ReviewState, item.ResolvedBy, item.ResolvedAt, item.Note = ReviewResolved, p.Subject, &now, req.Note
+	err = s.store.InTransaction(ctx, func(ctx context.Context) error {
+		if item.MatchedBy == MatchedManually {
+			if err := s.settle(ctx, payment.ID, payment.Status); err != nil {
+				return err
+			}
+		}
+		return s.store.SaveReconciliationItem(ctx, &item)
+	})
+	if err != nil {
+		return ReconciliationItem{}, err
+	}
+	return item, nil
+}
+
+// ReconcileRequest is the request type used to upload a bank statement
+type ReconcileRequest struct {
+	Format string
+	Data   []byte
+}
+
+// GetReconciliationRequest is the request type used to retrieve a reconciliation
+type GetReconciliationRequest struct {
+	ReconciliationID uuid.UUID
+}
+
+// ResolveReviewItemRequest is the request type used to resolve an item of the review queue, PaymentID is the payment
+// an unmatched entry is matched to by hand
+type ResolveReviewItemRequest struct {
+	ItemID    uint   `json:"-"`
+	PaymentID string `json:"payment_id"`
+	Note      string `json:"note"`
+}
+
+// MakeReconcileEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the Reconcile method
+func MakeReconcileEndpoint(svc ReconciliationService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ReconcileRequest)
+		v, err := svc.Reconcile(ctx, req.Format, req.Data)
+		if err != nil {
+			return nil, newStatusError("err: Could not reconcile the statement \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeGetReconciliationEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the GetReconciliation method
+func MakeGetReconciliationEndpoint(svc ReconciliationService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetReconciliationRequest)
+		v, err := svc.GetReconciliation(ctx, req.ReconciliationID)
+		if err != nil {
+			return nil, newStatusError("err: Could not retrieve reconciliation \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeListReconciliationsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ListReconciliations method
+func MakeListReconciliationsEndpoint(svc ReconciliationService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		v, err := svc.ListReconciliations(ctx)
+		if err != nil {
+			return nil, newStatusError("err: Could not list reconciliations \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeListReviewItemsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ListReviewItems method
+func MakeListReviewItemsEndpoint(svc ReconciliationService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		v, err := svc.ListReviewItems(ctx)
+		if err != nil {
+			return nil, newStatusError("err: Could not list review items \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeResolveReviewItemEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ResolveReviewItem method
+func MakeResolveReviewItemEndpoint(svc ReconciliationService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ResolveReviewItemRequest)
+		v, err := svc.ResolveReviewItem(ctx, req)
+		if err != nil {
+			return nil, newStatusError("err: Could not resolve review item \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,353 @@
+package paymentsapi
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	config "github.com/vstoianovici/paymentsapi/config"
+)
+
+// memoryReconciliationStore is a ReconciliationStore keeping the reconciliations in memory, along with the statuses
+// given to the payments
+type memoryReconciliationStore struct {
+	reconciliations []Reconciliation
+	items           []ReconciliationItem
+	statuses        map[uuid.UUID]string
+}
+
+func newMemoryReconciliationStore() *memoryReconciliationStore {
+	return &memoryReconciliationStore{statuses: map[uuid.UUID]string{}}
+}
+
+func (s *memoryReconciliationStore) CreateReconciliation(_ context.Context, r *Reconciliation) error {
+	for i := range r.Items {
+		r.Items[i].ID = uint(len(s.items) + 1)
+		s.items = append(s.items, r.Items[i])
+	}
+	s.reconciliations = append(s.reconciliations, *r)
+	return nil
+}
+
+func (s *memoryReconciliationStore) FindReconciliation(id uuid.UUID) (Reconciliation, error) {
+	for _, r := range s.reconciliations {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return Reconciliation{}, gorm.ErrRecordNotFound
+}
+
+func (s *memoryReconciliationStore) ListReconciliations(organisationID uuid.UUID) ([]Reconciliation, error) {
+	reconciliations := []Reconciliation{}
+	for _, r := range s.reconciliations {
+		if r.OrganisationID == organisationID {
+			r.Items = nil
+			reconciliations = append(reconciliations, r)
+		}
+	}
+	return reconciliations, nil
+}
+
+func (s *memoryReconciliationStore) ListReviewItems(organisationID uuid.UUID) ([]ReconciliationItem, error) {
+	items := []ReconciliationItem{}
+	for _, item := range s.items {
+		if item.OrganisationID == organisationID && item.ReviewState == ReviewOpen {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (s *memoryReconciliationStore) FindReconciliationItem(id uint) (ReconciliationItem, error) {
+	if id == 0 || int(id) > len(s.items) {
+		return ReconciliationItem{}, gorm.ErrRecordNotFound
+	}
+	return s.items[id-1], nil
+}
+
+func (s *memoryReconciliationStore) SaveReconciliationItem(_ context.Context, item *ReconciliationItem) error {
+	s.items[item.ID-1] = *item
+	return nil
+}
+
+func (s *memoryReconciliationStore) ReconciledPaymentIDs(organisationID uuid.UUID) (map[uuid.UUID]bool, error) {
+	reconciled := map[uuid.UUID]bool{}
+	for _, item := range s.items {
+		if item.OrganisationID == organisationID && item.MatchedBy != "" {
+			reconciled[item.PaymentID] = true
+		}
+	}
+	return reconciled, nil
+}
+
+func (s *memoryReconciliationStore) SetSchemeStatus(_ context.Context, paymentID uuid.UUID, status, schemeStatus, reason string) error {
+	s.statuses[paymentID] = status
+	return nil
+}
+
+func (s *memoryReconciliationStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// reconciliationPayment returns an accepted payment of the organisation
+func reconciliationPayment(org uuid.UUID, amount, e2e, numeric, date string) Payment {
+	p := isoPayment()
+	p.OrganisationID, p.Status = org, PaymentStatusAccepted
+	a := &p.Attributes
+	a.Amount, a.EndToEndReference, a.NumericReference, a.ProcessingDate = amount, e2e, numeric, mustDate(date)
+	return p
+}
+
+// camt053Message is the statement of the debtor account of isoPayment over two days. It books a debit matched by
+// end-to-end reference, a batch of a debit matched by numeric reference and of a debit without references, a credit
+// and a debit of an unknown payment, and it holds a pending entry
+const camt053Message = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.08">
+  <BkToCstmrStmt>
+    <GrpHdr><MsgId>STMT-2017-01-19</MsgId><CreDtTm>2017-01-20T06:00:00</CreDtTm></GrpHdr>
+    <Stmt>
+      <Id>STMT-1</Id>
+      <FrToDt><FrDtTm>2017-01-18T00:00:00</FrDtTm><ToDtTm>2017-01-19T23:59:59</ToDtTm></FrToDt>
+      <Acct><Id><IBAN>GB29NWBK60161331926819</IBAN></Id></Acct>
+      <Ntry>
+        <Amt Ccy="GBP">100.21</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts><Cd>BOOK</Cd></Sts>
+        <BookgDt><Dt>2017-01-18</Dt></BookgDt><AcctSvcrRef>BNK-1</AcctSvcrRef>
+        <NtryDtls><TxDtls><Refs><EndToEndId>Wil def ee</EndToEndId></Refs></TxDtls></NtryDtls>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="GBP">70.00</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts><Cd>BOOK</Cd></Sts>
+        <BookgDt><Dt>2017-01-19</Dt></BookgDt><AcctSvcrRef>BNK-2</AcctSvcrRef>
+        <NtryDtls>
+          <TxDtls>
+            <Refs><EndToEndId>NOTPROVIDED</EndToEndId></Refs><Amt Ccy="GBP">50.00</Amt>
+            <RmtInf><Strd><CdtrRefInf><Ref>555</Ref></CdtrRefInf></Strd></RmtInf>
+          </TxDtls>
+          <TxDtls><Amt Ccy="GBP">20.00</Amt><RmtInf><Ustrd>Invoice 12</Ustrd></RmtInf></TxDtls>
+        </NtryDtls>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="GBP">10.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Sts><Cd>BOOK</Cd></Sts>
+        <BookgDt><Dt>2017-01-19</Dt></BookgDt><AcctSvcrRef>BNK-3</AcctSvcrRef>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="GBP">999.00</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts><Cd>BOOK</Cd></Sts>
+        <BookgDt><Dt>2017-01-19</Dt></BookgDt><AcctSvcrRef>BNK-4</AcctSvcrRef>
+        <NtryDtls><TxDtls><Refs><EndToEndId>UNKNOWN</EndToEndId></Refs></TxDtls></NtryDtls>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="GBP">5.00</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts><Cd>PDNG</Cd></Sts>
+        <BookgDt><Dt>2017-01-19</Dt></BookgDt>
+      </Ntry>
+    </Stmt>
+  </BkToCstmrStmt>
+</Document>`
+
+func testReconciliationOptions() ReconciliationOptions {
+	o, _ := ParseReconciliationOptions(config.DefaultAppConfig().Reconciliation)
+	return o
+}
+
+func TestParseCamt053(t *testing.T) {
+	s, err := parseCamt053([]byte(camt053Message))
+	assert.NoError(t, err)
+	assert.Equal(t, "STMT-2017-01-19", s.ID)
+	assert.Equal(t, "GB29NWBK60161331926819", s.Account)
+	assert.Equal(t, "2017-01-18", s.FromDate)
+	assert.Equal(t, "2017-01-19", s.ToDate)
+	assert.Equal(t, 1, s.Ignored)
+	if assert.Len(t, s.Entries, 5) {
+		assert.Equal(t, StatementEntry{Reference: "BNK-1", EndToEndReference: "Wil def ee", Amount: "100.21", Currency: "GBP", Debit: true, BookingDate: "2017-01-18"}, s.Entries[0])
+		// the transactions of a batch have their own amounts
+		assert.Equal(t, "50.00", s.Entries[1].Amount)
+		assert.Equal(t, "555", s.Entries[1].NumericReference)
+		assert.Equal(t, "20.00", s.Entries[2].Amount)
+		assert.Equal(t, "Invoice 12", s.Entries[2].Description)
+		assert.False(t, s.Entries[3].Debit)
+	}
+
+	_, err = parseCamt053([]byte(pain001Message))
+	assert.Contains(t, err.Error(), "not a camt.053 message")
+	_, err = parseCamt053([]byte(strings.Replace(camt053Message, "<CdtDbtInd>CRDT", "<CdtDbtInd>X", 1)))
+	assert.Contains(t, err.Error(), "Stmt[0]/Ntry[2]/CdtDbtInd: must be one of CRDT, DBIT")
+}
+
+func TestParseCSVStatement(t *testing.T) {
+	o, err := ParseReconciliationOptions(config.ReconciliationConfig{
+		AmountTolerance: "0.05",
+		CSVColumns:      "booking_date=Buchungstag, amount=Betrag,currency=Waehrung,end_to_end_reference=E2E",
+		CSVDateFormat:   "02.01.2006",
+		CSVSeparator:    ";",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewRat(5, 100), o.AmountTolerance)
+	data := "\xef\xbb\xbfBuchungstag;Betrag;Waehrung;E2E;Description\n18.01.2017;-100.21;gbp;Wil def ee;Rent\n19.01.2017;+10;GBP;;\n"
+	s, err := parseCSVStatement([]byte(data), o.CSV)
+	assert.NoError(t, err)
+	assert.Equal(t, []StatementEntry{
+		{EndToEndReference: "Wil def ee", Amount: "100.21", Currency: "GBP", Debit: true, BookingDate: "2017-01-18", Description: "Rent"},
+		{Amount: "10", Currency: "GBP", BookingDate: "2017-01-19"},
+	}, s.Entries)
+
+	_, err = parseCSVStatement([]byte("Buchungstag;Betrag;Waehrung\n2017-01-18;1,5;GBP\n"), o.CSV)
+	assert.Contains(t, err.Error(), "line 2: the booking date is not formatted as 02.01.2006")
+	_, err = parseCSVStatement([]byte("Buchungstag;Waehrung\n"), o.CSV)
+	assert.Contains(t, err.Error(), "the column Betrag is missing")
+	_, err = ParseReconciliationOptions(config.ReconciliationConfig{AmountTolerance: "0", CSVColumns: "iban=Konto"})
+	assert.Contains(t, err.Error(), "invalid CSV column iban=Konto")
+}
+
+func TestReconcile(t *testing.T) {
+	org, _ := uuid.NewV4()
+	byE2E := reconciliationPayment(org, "100.21", "Wil def ee", "1", "2017-01-18")
+	byNumeric := reconciliationPayment(org, "50", "E2E-2", "555", "2017-01-18")
+	byAmount := reconciliationPayment(org, "20", "E2E-3", "2", "2017-01-17")
+	missing := reconciliationPayment(org, "75", "E2E-4", "3", "2017-01-19")
+	pending := reconciliationPayment(org, "999", "UNKNOWN", "4", "2017-01-19")
+	pending.Status = PaymentStatusPendingApproval
+	elsewhere := reconciliationPayment(org, "75", "E2E-5", "5", "2017-01-19")
+	elsewhere.Attributes.DebtorParty.AccountNumber = "GB94BARC10201530093459"
+	mockService := &MockPaymentService{}
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{byE2E, byNumeric, byAmount, missing, pending, elsewhere}, nil)
+	mockService.On("GetPayment", mock.Anything, missing.ID.String()).Return(missing, nil)
+	store := newMemoryReconciliationStore()
+	svc := NewReconciliationService(store, mockService, testReconciliationOptions())
+	ctx := roleContext(org, "ops", RoleCreator)
+
+	r, err := svc.Reconcile(ctx, FormatCamt053, []byte(camt053Message))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, r.Entries)
+	assert.Equal(t, 1, r.IgnoredEntries)
+	assert.Equal(t, 3, r.Matched)
+	assert.Equal(t, 2, r.UnmatchedEntries)
+	assert.Equal(t, 1, r.UnmatchedPayments)
+	var kinds []string
+	for _, item := range r.Items {
+		kinds = append(kinds, item.Kind+" "+item.MatchedBy)
+	}
+	assert.Equal(t, []string{"matched end_to_end_reference", "matched numeric_reference", "matched amount_and_date",
+		"unmatched_entry ", "unmatched_entry ", "unmatched_payment "}, kinds)
+	assert.Equal(t, byAmount.ID, r.Items[2].PaymentID)
+	assert.Contains(t, r.Items[3].Reason, "credit")
+	assert.Equal(t, missing.ID, r.Items[5].PaymentID)
+	assert.Equal(t, map[uuid.UUID]string{byE2E.ID: PaymentStatusSettled, byNumeric.ID: PaymentStatusSettled, byAmount.ID: PaymentStatusSettled}, store.statuses)
+
+	// the unmatched items wait for a review, an entry can be matched by hand
+	review, err := svc.ListReviewItems(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, review, 3)
+	item, err := svc.ResolveReviewItem(ctx, ResolveReviewItemRequest{ItemID: review[1].ID, PaymentID: missing.ID.String(), Note: "booked under another amount"})
+	assert.NoError(t, err)
+	assert.Equal(t, ReviewResolved, item.ReviewState)
+	assert.Equal(t, MatchedManually, item.MatchedBy)
+	assert.Equal(t, "ops", item.ResolvedBy)
+	assert.Equal(t, PaymentStatusSettled, store.statuses[missing.ID])
+	_, err = svc.ResolveReviewItem(ctx, ResolveReviewItemRequest{ItemID: review[1].ID})
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+	_, err = svc.ResolveReviewItem(ctx, ResolveReviewItemRequest{ItemID: review[2].ID, PaymentID: missing.ID.String()})
+	assert.Equal(t, http.StatusBadRequest, err.(StatusError).Status)
+	review, _ = svc.ListReviewItems(ctx)
+	assert.Len(t, review, 2)
+
+	// the payments matched once are not matched again
+	again, err := svc.Reconcile(ctx, FormatCamt053, []byte(camt053Message))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, again.Matched)
+
+	other, _ := uuid.NewV4()
+	_, err = svc.GetReconciliation(roleContext(other, "ops", RoleViewer), r.ID)
+	assert.Equal(t, errReconciliationNotFound, err)
+	_, err = svc.ResolveReviewItem(roleContext(other, "ops", RoleCreator), ResolveReviewItemRequest{ItemID: review[0].ID})
+	assert.Equal(t, errReviewItemNotFound, err)
+	_, err = svc.Reconcile(roleContext(org, "viewer", RoleViewer), FormatCamt053, []byte(camt053Message))
+	assert.Equal(t, ErrForbidden, err)
+	_, err = svc.Reconcile(ctx, "mt940", []byte(camt053Message))
+	assert.Equal(t, http.StatusBadRequest, err.(StatusError).Status)
+}
+
+func TestReconcileClosedPayment(t *testing.T) {
+	org, _ := uuid.NewV4()
+	for _, status := range []string{PaymentStatusReturned, PaymentStatusScheduled, PaymentStatusCancelled, PaymentStatusRejected, PaymentStatusPendingApproval} {
+		p := reconciliationPayment(org, "100.21", "Wil def ee", "1", "2017-01-18")
+		p.Status = status
+		mockService := &MockPaymentService{}
+		mockService.On("GetListPayments", mock.Anything).Return([]Payment{p}, nil)
+		mockService.On("GetPayment", mock.Anything, p.ID.String()).Return(p, nil)
+		store := newMemoryReconciliationStore()
+		svc := NewReconciliationService(store, mockService, testReconciliationOptions())
+		ctx := roleContext(org, "ops", RoleCreator)
+
+		r, err := svc.Reconcile(ctx, FormatCamt053, []byte(camt053Message))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, r.Matched, status)
+		review, _ := svc.ListReviewItems(ctx)
+		_, err = svc.ResolveReviewItem(ctx, ResolveReviewItemRequest{ItemID: review[0].ID, PaymentID: p.ID.String()})
+		assert.Equal(t, "err: the payment cannot be matched, it is "+status+", only accepted and settled payments are", err.Error())
+		assert.Empty(t, store.statuses)
+	}
+}
+
+func TestReconcileTolerance(t *testing.T) {
+	org, _ := uuid.NewV4()
+	p := reconciliationPayment(org, "20.02", "E2E-1", "1", "2017-01-15")
+	statement := Statement{Entries: []StatementEntry{{Amount: "20.00", Currency: "GBP", Debit: true, BookingDate: "2017-01-18"}}}
+	o := testReconciliationOptions()
+
+	items := reconcileStatement(statement, []Payment{p}, o)
+	assert.Equal(t, ReconciliationUnmatchedEntry, items[0].Kind)
+	o.AmountTolerance, o.DateTolerance = big.NewRat(2, 100), 3
+	items = reconcileStatement(statement, []Payment{p}, o)
+	assert.Equal(t, ReconciliationMatched, items[0].Kind)
+	// the entries without references are not matched when several payments fit
+	items = reconcileStatement(statement, []Payment{p, reconciliationPayment(org, "20", "E2E-2", "2", "2017-01-18")}, o)
+	assert.Equal(t, ReconciliationUnmatchedEntry, items[0].Kind)
+	assert.Contains(t, items[0].Reason, "several payments")
+}
+
+func TestReconciliationHTTP(t *testing.T) {
+	org, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{reconciliationPayment(org, "100.21", "Wil def ee", "1", "2017-01-18")}, nil)
+	router := mux.NewRouter()
+	RegisterReconciliationRoutes(router, NewReconciliationService(newMemoryReconciliationStore(), mockService, testReconciliationOptions()), 1<<20)
+	do := func(method, url, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req.WithContext(roleContext(org, "ops", RoleCreator)))
+		return rec
+	}
+
+	rec := do("POST", "/v1/reconciliations", "text/csv", "booking_date,amount,currency,end_to_end_reference\n2017-01-18,-100.21,GBP,Wil def ee\n2017-01-18,-3,GBP,\n")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	r := Reconciliation{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &r))
+	assert.Equal(t, FormatStatementCSV, r.Format)
+	assert.Equal(t, 1, r.Matched)
+	assert.Equal(t, 1, r.UnmatchedEntries)
+
+	rec = do("GET", "/v1/reconciliations/review", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var review []ReconciliationItem
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &review))
+	assert.Len(t, review, 1)
+	rec = do("POST", "/v1/reconciliations/review/2", "application/json", `{"note":"bank fee"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"review_state":"resolved"`)
+	rec = do("GET", "/v1/reconciliations/"+r.ID.String(), "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"matched_by":"end_to_end_reference"`)
+	rec = do("GET", "/v1/reconciliations", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do("POST", "/v1/reconciliations", "application/pdf", "%PDF")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
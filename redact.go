@@ -0,0 +1,97 @@
+package paymentsapi
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Redaction modes of the `redact` struct tag
+const (
+	// RedactLast4 masks everything but the last 4 characters, used for account numbers
+	RedactLast4 = "last4"
+	// RedactMask masks the whole value, used for names and addresses
+	RedactMask = "mask"
+)
+
+// redactedValue replaces the values masked with RedactMask
+const redactedValue = "[REDACTED]"
+
+// Redactor masks the personal data of the model before it is logged. The fields to mask are tagged with
+// `redact:"last4"` or `redact:"mask"` on the model, more fields can be masked by their JSON name
+type Redactor struct {
+	fields map[string]string
+}
+
+// NewRedactor returns a Redactor masking the tagged fields of the model and the fields with the given JSON names
+func NewRedactor(fields ...string) *Redactor {
+	r := &Redactor{fields: map[string]string{}}
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f != "" {
+			r.fields[f] = RedactMask
+		}
+	}
+	return r
+}
+
+// Redact returns a copy of v with its sensitive string fields masked. v is left untouched
+func (r *Redactor) Redact(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	cp := reflect.New(reflect.TypeOf(v)).Elem()
+	cp.Set(reflect.ValueOf(v))
+	r.redact(cp)
+	return cp.Interface()
+}
+
+// redact masks the sensitive fields of the settable value v in place, slices are copied before their elements are changed
+func (r *Redactor) redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			fv := v.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			mode := f.Tag.Get("redact")
+			if name := strings.Split(f.Tag.Get("json"), ",")[0]; mode == "" && name != "" {
+				mode = r.fields[name]
+			}
+			if mode != "" && fv.Kind() == reflect.String {
+				fv.SetString(redactString(fv.String(), mode))
+				continue
+			}
+			r.redact(fv)
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(cp, v)
+		for i := 0; i < cp.Len(); i++ {
+			r.redact(cp.Index(i))
+		}
+		v.Set(cp)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		cp := reflect.New(v.Elem().Type())
+		cp.Elem().Set(v.Elem())
+		r.redact(cp.Elem())
+		v.Set(cp)
+	}
+}
+
+func redactString(s, mode string) string {
+	if s == "" {
+		return s
+	}
+	if mode == RedactLast4 && len(s) > 4 {
+		return strings.Repeat("*", len(s)-4) + s[len(s)-4:]
+	}
+	return redactedValue
+}
@@ -0,0 +1,42 @@
+package paymentsapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	p := Payment{Type: "Payment", Attributes: Attributes{
+		Amount: "100.21",
+		BeneficiaryParty: BeneficiaryParty{DebtorParty: DebtorParty{
+			SponsorParty: SponsorParty{AccountNumber: "31926819", BankID: "403000"},
+			AccountName:  "W Owens",
+			Address:      "1 The Beneficiary Localtown SE2",
+			Name:         "Wilfred Jeremiah Owens",
+		}},
+		ChargesInformation: ChargesInformation{SenderCharges: []Charge{{Amount: "5.00", Currency: "GBP"}}},
+		Reference:          "Payment for Em's piano lessons",
+		SponsorParty:       SponsorParty{AccountNumber: "123"},
+	}}
+
+	r := NewRedactor("reference", " ")
+	got := r.Redact(p).(Payment)
+	b := got.Attributes.BeneficiaryParty
+	assert.Equal(t, "****6819", b.AccountNumber)
+	assert.Equal(t, "[REDACTED]", b.AccountName)
+	assert.Equal(t, "[REDACTED]", b.Address)
+	assert.Equal(t, "[REDACTED]", b.Name)
+	assert.Equal(t, "403000", b.BankID)
+	// values too short to keep their last 4 characters are masked completely
+	assert.Equal(t, "[REDACTED]", got.Attributes.SponsorParty.AccountNumber)
+	assert.Equal(t, "[REDACTED]", got.Attributes.Reference)
+	assert.Equal(t, "100.21", got.Attributes.Amount)
+	assert.Equal(t, "5.00", got.Attributes.ChargesInformation.SenderCharges[0].Amount)
+
+	// the original payment is left untouched
+	assert.Equal(t, "31926819", p.Attributes.BeneficiaryParty.AccountNumber)
+	assert.Equal(t, "Payment for Em's piano lessons", p.Attributes.Reference)
+
+	assert.Nil(t, r.Redact(nil))
+}
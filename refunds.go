@@ -0,0 +1,419 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Refund statuses of a payment
+const (
+	RefundStatusPartial  = "partially_refunded"
+	RefundStatusRefunded = "refunded"
+)
+
+// refundBearerCodes gives the bearer of the charges of a refund. The parties are swapped, so the party that bore the
+// charges of the payment bears the charges of its refund
+var refundBearerCodes = map[string]string{
+	"DEBT": "CRED",
+	"CRED": "DEBT",
+}
+
+// Refund links a refund to the payment it refunds
+type Refund struct {
+	ModelBase
+	ID              uint      `json:"-" gorm:"primary_key"`
+	OrganisationID  uuid.UUID `json:"-" gorm:"type:uuid; index"`
+	PaymentID       uuid.UUID `json:"-" gorm:"type:uuid; index"`
+	RefundPaymentID uuid.UUID `json:"-" gorm:"type:uuid; unique_index"`
+	Amount          string    `json:"-"`
+	Currency        string    `json:"-"`
+	CreatedBy       string    `json:"-"`
+	RequestID       string    `json:"-"`
+}
+
+// RefundSummary is what has been refunded of a payment. The refunds rejected, returned or deleted do not count
+type RefundSummary struct {
+	Status           string       `json:"status"`
+	Currency         string       `json:"currency"`
+	RefundedAmount   string       `json:"refunded_amount"`
+	RefundableAmount string       `json:"refundable_amount"`
+	Refunds          []RefundLink `json:"refunds"`
+}
+
+// RefundLink is a refund of a payment
+type RefundLink struct {
+	PaymentID uuid.UUID `json:"payment_id"`
+	Amount    string    `json:"amount"`
+	Status    string    `json:"status"`
+}
+
+// refundableAmount returns the most that can be refunded of the payment. The beneficiary did not receive the receiver
+// charges when it bore them, alone or shared, so they are not refunded
+func refundableAmount(p Payment) (*big.Rat, error) {
+	a := p.Attributes
+	amount, ok := new(big.Rat).SetString(a.Amount)
+	if !ok {
+		return nil, errors.New("err: the amount of the payment is not a decimal number: " + a.Amount)
+	}
+	c := a.ChargesInformation
+	if (c.BearerCode == "CRED" || c.BearerCode == "SHAR") && c.ReceiverChargesCurrency == a.Currency {
+		if charges, ok := new(big.Rat).SetString(c.ReceiverChargesAmount); ok && charges.Sign() > 0 {
+			amount.Sub(amount, charges)
+		}
+	}
+	if amount.Sign() < 0 {
+		amount.SetInt64(0)
+	}
+	return amount, nil
+}
+
+// countsAsRefunded reports whether a refund in the status takes from the refundable amount
+func countsAsRefunded(status string) bool {
+	return status != PaymentStatusRejected && status != PaymentStatusReturned
+}
+
+// refundSummary sums the refunds of a payment, status gives the status of a refund payment and false when it was
+// deleted
+func refundSummary(p Payment, refunds []Refund, status func(id uuid.UUID) (string, bool)) (*RefundSummary, error) {
+	remaining, err := refundableAmount(p)
+	if err != nil {
+		return nil, err
+	}
+	refunded := new(big.Rat)
+	s := &RefundSummary{Currency: p.Attributes.Currency, Refunds: []RefundLink{}}
+	for _, r := range refunds {
+		st, ok := status(r.RefundPaymentID)
+		if !ok {
+			continue
+		}
+		s.Refunds = append(s.Refunds, RefundLink{PaymentID: r.RefundPaymentID, Amount: r.Amount, Status: st})
+		if amount, ok := new(big.Rat).SetString(r.Amount); ok && countsAsRefunded(st) {
+			refunded.Add(refunded, amount)
+		}
+	}
+	remaining.Sub(remaining, refunded)
+	if remaining.Sign() < 0 {
+		remaining.SetInt64(0)
+	}
+	s.RefundedAmount, s.RefundableAmount = decimalString(refunded), decimalString(remaining)
+	s.Status = RefundStatusPartial
+	if remaining.Sign() == 0 {
+		s.Status = RefundStatusRefunded
+	}
+	return s, nil
+}
+
+// refundEndToEndReference returns a new end-to-end reference for a refund, so that a refund is not found in the
+// place of its payment by the status reports, the returns or the reconciliations
+func refundEndToEndReference() string {
+	return "RFND" + strings.ToUpper(strings.Replace(uuid.Must(uuid.NewV4()).String(), "-", "", -1)[:16])
+}
+
+// refundPayment returns the payment refunding amount of p, with the debtor and the beneficiary swapped. The refund
+// is made in the currency of the payment, without conversion nor charges known yet
+func refundPayment(p Payment, amount string, req RefundPaymentRequest) Payment {
+	a := p.Attributes
+	refund := Payment{
+		Type:           p.Type,
+		OrganisationID: p.OrganisationID,
+		Attributes: Attributes{
+			Amount:   amount,
+			Currency: a.Currency,
+			DebtorParty: DebtorParty{
+				SponsorParty:      SponsorParty{AccountNumber: a.BeneficiaryParty.AccountNumber, BankID: a.BeneficiaryParty.BankID, BankIDCode: a.BeneficiaryParty.BankIDCode},
+				AccountName:       a.BeneficiaryParty.AccountName,
+				AccountNumberCode: a.BeneficiaryParty.AccountNumberCode,
+				Address:           a.BeneficiaryParty.Address,
+				Name:              a.BeneficiaryParty.Name,
+			},
+			BeneficiaryParty: BeneficiaryParty{
+				DebtorParty: DebtorParty{
+					SponsorParty:      SponsorParty{AccountNumber: a.DebtorParty.AccountNumber, BankID: a.DebtorParty.BankID, BankIDCode: a.DebtorParty.BankIDCode},
+					AccountName:       a.DebtorParty.AccountName,
+					AccountNumberCode: a.DebtorParty.AccountNumberCode,
+					Address:           a.DebtorParty.Address,
+					Name:              a.DebtorParty.Name,
+				},
+			},
+			ChargesInformation: ChargesInformation{
+				BearerCode:              a.ChargesInformation.BearerCode,
+				SenderCharges:           []Charge{},
+				ReceiverChargesAmount:   "0.00",
+				ReceiverChargesCurrency: a.Currency,
+			},
+			EndToEndReference: refundEndToEndReference(),
+			Forex: Forex{
+				ContractReference: a.Forex.ContractReference,
+				ExchangeRate:      "1",
+				OriginalAmount:    amount,
+				OriginalCurrency:  a.Currency,
+			},
+			NumericReference:     a.NumericReference,
+			PayID:                a.PayID,
+			PaymentPurpose:       a.PaymentPurpose,
+			PaymentScheme:        a.PaymentScheme,
+			PaymentType:          a.PaymentType,
+			ProcessingDate:       DateOf(time.Now()),
+			Reference:            a.Reference,
+			SchemePaymentSubType: a.SchemePaymentSubType,
+			SchemePaymentType:    a.SchemePaymentType,
+			SponsorParty:         SponsorParty{AccountNumber: a.SponsorParty.AccountNumber, BankID: a.SponsorParty.BankID, BankIDCode: a.SponsorParty.BankIDCode},
+		},
+	}
+	if bearer, ok := refundBearerCodes[a.ChargesInformation.BearerCode]; ok {
+		refund.Attributes.ChargesInformation.BearerCode = bearer
+	}
+	if req.PayID != "" {
+		refund.Attributes.PayID = req.PayID
+	}
+	if req.EndToEndReference != "" {
+		refund.Attributes.EndToEndReference = req.EndToEndReference
+	}
+	if req.Reference != "" {
+		refund.Attributes.Reference = req.Reference
+	}
+	if !req.ProcessingDate.IsZero() {
+		refund.Attributes.ProcessingDate = req.ProcessingDate
+	}
+	return refund
+}
+
+// RefundStore persists the links between the payments and their refunds
+type RefundStore interface {
+	// LockPayment locks the payment of the organisation until the end of the transaction of ctx, so that its refunds
+	// are made one at a time
+	LockPayment(ctx context.Context, organisationID, id uuid.UUID) error
+	// ListRefunds lists the refunds of the payment, and the link to the payment it refunds if it is a refund, in the
+	// transaction of ctx if there is one
+	ListRefunds(ctx context.Context, paymentID uuid.UUID) ([]Refund, error)
+	CreateRefund(ctx context.Context, r *Refund) error
+	Transactor
+}
+
+type refundStore struct {
+	txStore
+}
+
+// NewRefundStore returns a RefundStore backed by the database
+func NewRefundStore(db *gorm.DB) RefundStore {
+	return &refundStore{
+		txStore{db: db},
+	}
+}
+
+// LockPayment selects the payment for update, a payment of another organisation is not found
+func (s *refundStore) LockPayment(ctx context.Context, organisationID, id uuid.UUID) error {
+	return lockPayment(withContext(s.db, ctx), organisationID, id)
+}
+
+// ListRefunds lists the refunds by creation
+func (s *refundStore) ListRefunds(ctx context.Context, paymentID uuid.UUID) ([]Refund, error) {
+	var refunds []Refund
+	err := withContext(s.db, ctx).Where("payment_id = ? OR refund_payment_id = ?", paymentID, paymentID).Order("id").Find(&refunds).Error
+	return refunds, err
+}
+
+// CreateRefund stores the link of a refund
+func (s *refundStore) CreateRefund(ctx context.Context, r *Refund) error {
+	return withContext(s.db, ctx).Create(r).Error
+}
+
+type refundMiddleware struct {
+	store RefundStore
+	next  PaymentService
+}
+
+// NewRefundSummaries returns a new instance of PaymentService that adds their refund summary to the refunded
+// payments, and the payment they refund to the refunds
+func NewRefundSummaries(store RefundStore, next PaymentService) PaymentService {
+	return &refundMiddleware{
+		store: store,
+		next:  next,
+	}
+}
+
+// withRefunds adds the refunds to the payment, the statuses of the refunds are looked up in payments first
+func (mw refundMiddleware) withRefunds(ctx context.Context, p *Payment, payments map[uuid.UUID]Payment) error {
+	refunds, err := mw.store.ListRefunds(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+	var paid []Refund
+	for _, r := range refunds {
+		if r.RefundPaymentID == p.ID {
+			id := r.PaymentID
+			p.RefundOf = &id
+			continue
+		}
+		paid = append(paid, r)
+	}
+	if len(paid) == 0 {
+		return nil
+	}
+	p.Refunds, err = refundSummary(*p, paid, func(id uuid.UUID) (string, bool) {
+		if refund, ok := payments[id]; ok {
+			return refund.Status, true
+		}
+		refund, err := mw.next.GetPayment(ctx, id.String())
+		return refund.Status, err == nil
+	})
+	return err
+}
+
+// GetPayment adds the refunds to the payment
+func (mw refundMiddleware) GetPayment(ctx context.Context, id string) (Payment, error) {
+	p, err := mw.next.GetPayment(ctx, id)
+	if err != nil {
+		return p, err
+	}
+	return p, mw.withRefunds(ctx, &p, nil)
+}
+
+// GetListPayments adds their refunds to the payments
+func (mw refundMiddleware) GetListPayments(ctx context.Context) ([]Payment, error) {
+	payments, err := mw.next.GetListPayments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[uuid.UUID]Payment{}
+	for _, p := range payments {
+		byID[p.ID] = p
+	}
+	for i := range payments {
+		if err := mw.withRefunds(ctx, &payments[i], byID); err != nil {
+			return nil, err
+		}
+	}
+	return payments, nil
+}
+
+// CreatePayment is passed through
+func (mw refundMiddleware) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
+	return mw.next.CreatePayment(ctx, p)
+}
+
+// UpdatePayment is passed through
+func (mw refundMiddleware) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	return mw.next.UpdatePayment(ctx, req)
+}
+
+// DeletePayment is passed through
+func (mw refundMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	return mw.next.DeletePayment(ctx, id)
+}
+
+// RefundService refunds the payments
+type RefundService interface {
+	RefundPayment(ctx context.Context, req RefundPaymentRequest) (Payment, error)
+}
+
+type refundService struct {
+	store    RefundStore
+	payments PaymentService
+}
+
+// NewRefundService returns the RefundService creating the refunds through the PaymentService, with the same checks
+// as any other payment
+func NewRefundService(store RefundStore, payments PaymentService) RefundService {
+	return &refundService{
+		store:    store,
+		payments: payments,
+	}
+}
+
+// RefundPayment creates a refund of a settled payment of the caller's organisation. The whole refundable amount is
+// refunded unless an amount is given, the refunds of a payment cannot add up to more than its refundable amount
+func (s *refundService) RefundPayment(ctx context.Context, req RefundPaymentRequest) (Payment, error) {
+	principal, err := checkPermission(ctx, PermissionWritePayments)
+	if err != nil {
+		return Payment{}, err
+	}
+	var refund Payment
+	err = s.store.InTransaction(ctx, func(ctx context.Context) error {
+		if err := s.store.LockPayment(ctx, principal.OrganisationID, req.PaymentID); err != nil {
+			return err
+		}
+		original, err := s.payments.GetPayment(ctx, req.PaymentID.String())
+		if err != nil {
+			return err
+		}
+		if original.RefundOf != nil {
+			return StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: a refund cannot be refunded"}
+		}
+		if original.Status != PaymentStatusSettled {
+			return StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: only settled payments can be refunded, the payment is " + original.Status}
+		}
+		remaining, err := refundableAmount(original)
+		if err != nil {
+			return err
+		}
+		if original.Refunds != nil {
+			remaining.SetString(original.Refunds.RefundableAmount)
+		}
+		currency := original.Attributes.Currency
+		amount := new(big.Rat).Set(remaining)
+		if req.Amount != "" {
+			var ok bool
+			if amount, ok = isoCurrencyAmount(req.Amount, currency); !ok {
+				return StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: "err: the amount of the refund must be a positive decimal number with at most " + strconv.Itoa(currencyDecimals(currency)) + " decimals"}
+			}
+		}
+		if remaining.Sign() == 0 {
+			return StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the payment is already refunded"}
+		}
+		if amount.Cmp(remaining) > 0 {
+			return StatusError{Status: http.StatusUnprocessableEntity, Kind: KindInvalidPayload, Message: "err: the refund is more than the refundable amount of " + decimalString(remaining) + " " + currency}
+		}
+		refundAmount := decimalString(amount)
+		resp, err := s.payments.CreatePayment(ctx, refundPayment(original, refundAmount, req))
+		if err != nil {
+			return err
+		}
+		if err := s.store.CreateRefund(ctx, &Refund{
+			OrganisationID:  principal.OrganisationID,
+			PaymentID:       original.ID,
+			RefundPaymentID: resp.PaymentID,
+			Amount:          refundAmount,
+			Currency:        currency,
+			CreatedBy:       principal.Subject,
+			RequestID:       RequestIDFromContext(ctx),
+		}); err != nil {
+			return err
+		}
+		refund, err = s.payments.GetPayment(ctx, resp.PaymentID.String())
+		return err
+	})
+	return refund, err
+}
+
+// RefundPaymentRequest is the request type used to refund a payment, the refund takes the references of the payment
+// unless others are given, but for the end-to-end reference which is new
+type RefundPaymentRequest struct {
+	PaymentID         uuid.UUID `json:"-"`
+	Amount            string    `json:"amount"`
+	PayID             string    `json:"payment_id"`
+	EndToEndReference string    `json:"end_to_end_reference"`
+	Reference         string    `json:"reference"`
+	ProcessingDate    Date      `json:"processing_date"`
+}
+
+// MakeRefundPaymentEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the RefundPayment method
+func MakeRefundPaymentEndpoint(svc RefundService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RefundPaymentRequest)
+		v, err := svc.RefundPayment(ctx, req)
+		if err != nil {
+			return nil, newStatusError("err: Could not refund payment \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
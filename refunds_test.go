@@ -0,0 +1,238 @@
+package paymentsapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryRefundStore struct {
+	refunds  []Refund
+	payments *memoryPaymentService
+}
+
+func (s *memoryRefundStore) LockPayment(_ context.Context, organisationID, id uuid.UUID) error {
+	if s.payments == nil {
+		return nil
+	}
+	if p, ok := s.payments.payments[id]; !ok || p.OrganisationID != organisationID {
+		return errPaymentNotFound
+	}
+	return nil
+}
+
+func (s *memoryRefundStore) ListRefunds(_ context.Context, id uuid.UUID) ([]Refund, error) {
+	var refunds []Refund
+	for _, r := range s.refunds {
+		if r.PaymentID == id || r.RefundPaymentID == id {
+			refunds = append(refunds, r)
+		}
+	}
+	return refunds, nil
+}
+
+func (s *memoryRefundStore) CreateRefund(_ context.Context, r *Refund) error {
+	s.refunds = append(s.refunds, *r)
+	return nil
+}
+
+func (s *memoryRefundStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// memoryPaymentService is a PaymentService keeping the payments in memory, of every organisation
+type memoryPaymentService struct {
+	payments map[uuid.UUID]Payment
+}
+
+func newMemoryPaymentService(payments ...Payment) *memoryPaymentService {
+	s := &memoryPaymentService{payments: map[uuid.UUID]Payment{}}
+	for _, p := range payments {
+		s.payments[p.ID] = p
+	}
+	return s
+}
+
+func (s *memoryPaymentService) GetPayment(_ context.Context, id string) (Payment, error) {
+	p, ok := s.payments[uuid.FromStringOrNil(id)]
+	if !ok {
+		return Payment{}, gorm.ErrRecordNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryPaymentService) GetListPayments(_ context.Context) ([]Payment, error) {
+	var payments []Payment
+	for _, p := range s.payments {
+		payments = append(payments, p)
+	}
+	return payments, nil
+}
+
+func (s *memoryPaymentService) CreatePayment(_ context.Context, p Payment) (CreatePaymentResponse, error) {
+	p.ID, _ = uuid.NewV4()
+	if p.Status == "" {
+		p.Status = PaymentStatusAccepted
+	}
+	s.payments[p.ID] = p
+	return CreatePaymentResponse{PaymentID: p.ID}, nil
+}
+
+func (s *memoryPaymentService) UpdatePayment(_ context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	id := uuid.FromStringOrNil(req.PaymentID)
+	s.payments[id] = req.Payment
+	return UpdatePaymentResponse{PaymentID: id}, nil
+}
+
+func (s *memoryPaymentService) DeletePayment(_ context.Context, id uuid.UUID) (*time.Time, error) {
+	delete(s.payments, id)
+	now := time.Now()
+	return &now, nil
+}
+
+func settledPayment() Payment {
+	p := isoPayment()
+	p.Status = PaymentStatusSettled
+	return p
+}
+
+func TestRefundableAmount(t *testing.T) {
+	p := settledPayment()
+	c := &p.Attributes.ChargesInformation
+	c.BearerCode, c.ReceiverChargesAmount, c.ReceiverChargesCurrency = "DEBT", "1.00", "GBP"
+	amount, err := refundableAmount(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "100.21", decimalString(amount))
+	// the beneficiary did not receive the charges it bore
+	for _, bearer := range []string{"SHAR", "CRED"} {
+		c.BearerCode = bearer
+		amount, _ = refundableAmount(p)
+		assert.Equal(t, "99.21", decimalString(amount))
+	}
+	c.ReceiverChargesCurrency = "USD"
+	amount, _ = refundableAmount(p)
+	assert.Equal(t, "100.21", decimalString(amount))
+}
+
+func TestRefundPaymentParties(t *testing.T) {
+	p := settledPayment()
+	p.Attributes.ChargesInformation.BearerCode = "DEBT"
+	refund := refundPayment(p, "40", RefundPaymentRequest{Reference: "REFUND-1"})
+	a := refund.Attributes
+	assert.Equal(t, p.Attributes.BeneficiaryParty.AccountNumber, a.DebtorParty.AccountNumber)
+	assert.Equal(t, p.Attributes.BeneficiaryParty.Name, a.DebtorParty.Name)
+	assert.Equal(t, p.Attributes.DebtorParty.AccountNumber, a.BeneficiaryParty.AccountNumber)
+	assert.Equal(t, p.Attributes.DebtorParty.BankID, a.BeneficiaryParty.BankID)
+	assert.Equal(t, "40", a.Amount)
+	assert.Equal(t, "CRED", a.ChargesInformation.BearerCode)
+	assert.Empty(t, a.ChargesInformation.SenderCharges)
+	assert.Equal(t, Forex{ContractReference: p.Attributes.Forex.ContractReference, ExchangeRate: "1", OriginalAmount: "40", OriginalCurrency: "GBP"}, a.Forex)
+	assert.Equal(t, "REFUND-1", a.Reference)
+	// the refund has its own end-to-end reference unless one is given
+	assert.Regexp(t, "^RFND[0-9A-F]{16}$", a.EndToEndReference)
+	assert.NotEqual(t, a.EndToEndReference, refundPayment(p, "40", RefundPaymentRequest{}).Attributes.EndToEndReference)
+	assert.Equal(t, "E2E-1", refundPayment(p, "40", RefundPaymentRequest{EndToEndReference: "E2E-1"}).Attributes.EndToEndReference)
+	assert.Equal(t, p.OrganisationID, refund.OrganisationID)
+	assert.NoError(t, ValidatePayload(refund))
+}
+
+func TestRefundPayment(t *testing.T) {
+	p := settledPayment()
+	payments := newMemoryPaymentService(p)
+	store := &memoryRefundStore{payments: payments}
+	svc := NewRefundSummaries(store, payments)
+	refunds := NewRefundService(store, svc)
+	ctx := roleContext(p.OrganisationID, "ops", RoleCreator)
+
+	// the payments of another organisation are not found, and not locked
+	otherOrg, _ := uuid.NewV4()
+	_, err := refunds.RefundPayment(roleContext(otherOrg, "ops", RoleCreator), RefundPaymentRequest{PaymentID: p.ID})
+	assert.Equal(t, errPaymentNotFound, err)
+
+	first, err := refunds.RefundPayment(ctx, RefundPaymentRequest{PaymentID: p.ID, Amount: "40.00"})
+	assert.NoError(t, err)
+	assert.Equal(t, "40", first.Attributes.Amount)
+	assert.Equal(t, &p.ID, first.RefundOf)
+	original, _ := svc.GetPayment(ctx, p.ID.String())
+	assert.Equal(t, &RefundSummary{
+		Status: RefundStatusPartial, Currency: "GBP", RefundedAmount: "40", RefundableAmount: "60.21",
+		Refunds: []RefundLink{{PaymentID: first.ID, Amount: "40", Status: PaymentStatusAccepted}},
+	}, original.Refunds)
+
+	_, err = refunds.RefundPayment(ctx, RefundPaymentRequest{PaymentID: p.ID, Amount: "60.22"})
+	assert.Equal(t, http.StatusUnprocessableEntity, err.(StatusError).Status)
+	assert.Contains(t, err.Error(), "more than the refundable amount of 60.21 GBP")
+	for _, amount := range []string{"-1", "0", "1/3", "1e2", "0.001"} {
+		_, err = refunds.RefundPayment(ctx, RefundPaymentRequest{PaymentID: p.ID, Amount: amount})
+		assert.Equal(t, http.StatusBadRequest, err.(StatusError).Status, amount)
+	}
+
+	// the rest is refunded when no amount is given
+	second, err := refunds.RefundPayment(ctx, RefundPaymentRequest{PaymentID: p.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, "60.21", second.Attributes.Amount)
+	original, _ = svc.GetPayment(ctx, p.ID.String())
+	assert.Equal(t, RefundStatusRefunded, original.Refunds.Status)
+	_, err = refunds.RefundPayment(ctx, RefundPaymentRequest{PaymentID: p.ID, Amount: "1"})
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+
+	// a rejected refund gives its amount back
+	rejected := payments.payments[second.ID]
+	rejected.Status = PaymentStatusRejected
+	payments.payments[second.ID] = rejected
+	list, err := svc.GetListPayments(ctx)
+	assert.NoError(t, err)
+	for _, payment := range list {
+		if payment.ID == p.ID {
+			assert.Equal(t, "60.21", payment.Refunds.RefundableAmount)
+			assert.Len(t, payment.Refunds.Refunds, 2)
+		}
+	}
+
+	first.Status = PaymentStatusSettled
+	payments.payments[first.ID] = first
+	_, err = refunds.RefundPayment(ctx, RefundPaymentRequest{PaymentID: first.ID})
+	assert.Contains(t, err.Error(), "a refund cannot be refunded")
+	accepted := isoPayment()
+	accepted.Status, accepted.OrganisationID = PaymentStatusAccepted, p.OrganisationID
+	payments.payments[accepted.ID] = accepted
+	_, err = refunds.RefundPayment(ctx, RefundPaymentRequest{PaymentID: accepted.ID})
+	assert.Contains(t, err.Error(), "only settled payments can be refunded")
+	_, err = refunds.RefundPayment(roleContext(p.OrganisationID, "viewer", RoleViewer), RefundPaymentRequest{PaymentID: p.ID})
+	assert.Equal(t, ErrForbidden, err)
+}
+
+func TestRefundPaymentHTTP(t *testing.T) {
+	p := settledPayment()
+	store := &memoryRefundStore{}
+	svc := NewRefundSummaries(store, newMemoryPaymentService(p))
+	router := mux.NewRouter()
+	RegisterRefundRoutes(router, NewRefundService(store, svc))
+	post := func(url, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", url, strings.NewReader(body)).WithContext(roleContext(p.OrganisationID, "ops", RoleCreator)))
+		return rec
+	}
+
+	rec := post("/v1/payments/"+p.ID.String()+"/refunds", `{"amount":"10","reference":"Refund"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	refund := Payment{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &refund))
+	assert.Equal(t, "10", refund.Attributes.Amount)
+	assert.Contains(t, rec.Body.String(), `"refund_of":"`+p.ID.String()+`"`)
+	// the body is optional
+	rec = post("/v1/payments/"+p.ID.String()+"/refunds", "")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"amount":"90.21"`)
+	rec = post("/v1/payments/x/refunds", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,80 @@
+package paymentsapi
+
+import (
+	"context"
+	"net/http"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vstoianovici/paymentsapi/tracing"
+)
+
+// RequestIDHeader is the header carrying the ID of a request, sent back in every response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length above which an incoming request ID is replaced by a generated one
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// NewContextWithRequestID returns a copy of ctx carrying the request ID
+func NewContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, or an empty string
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether an incoming request ID can be kept. Only printable ASCII without spaces is accepted
+// so that request IDs can be logged and sent back as they are
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware is the HTTP handler giving an ID to every request
+type requestIDMiddleware struct {
+	next http.Handler
+}
+
+// NewRequestID returns an HTTP handler that keeps the X-Request-ID header of the request, or generates one, puts it
+// in the request's context and sends it back in the response headers
+func NewRequestID(next http.Handler) http.Handler {
+	return &requestIDMiddleware{
+		next: next,
+	}
+}
+
+func (mw *requestIDMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		u, _ := uuid.NewV4()
+		id = u.String()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	tracing.SpanFromContext(r.Context()).SetAttribute("request.id", id)
+	mw.next.ServeHTTP(w, r.WithContext(NewContextWithRequestID(r.Context(), id)))
+}
+
+// EncodeError sends the error as a JSON body with the right HTTP status code, along with the ID of the request
+func EncodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	e, ok := err.(StatusError)
+	if !ok {
+		e = newStatusError(err.Error(), err)
+	}
+	e.RequestID = RequestIDFromContext(ctx)
+	httptransport.DefaultErrorEncoder(ctx, e, w)
+}
@@ -0,0 +1,67 @@
+package paymentsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := NewRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/v1/payments", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, "req-1", seen)
+	assert.Equal(t, "req-1", rec.Header().Get(RequestIDHeader))
+
+	for _, id := range []string{"", "with space", strings.Repeat("a", maxRequestIDLength+1)} {
+		req = httptest.NewRequest("GET", "/v1/payments", nil)
+		req.Header.Set(RequestIDHeader, id)
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		_, err := uuid.FromString(seen)
+		assert.NoError(t, err, id)
+		assert.Equal(t, seen, rec.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestRequestIDInErrors(t *testing.T) {
+	id, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{}, errPaymentNotFound)
+	h := NewRequestID(NewHTTPTransport(mockService))
+
+	req := httptest.NewRequest("GET", "/v1/payments/"+id.String(), nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	var body StatusError
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, KindNotFound, body.Kind)
+	assert.Equal(t, "req-1", body.RequestID)
+}
+
+func TestRequestIDInLogs(t *testing.T) {
+	var b bytes.Buffer
+	logger, _ := NewLogger(&b, LogFormatLogfmt, LevelInfo)
+	mockService := &MockPaymentService{}
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{}, nil)
+	s := NewLogging(logger, mockService)
+	_, err := s.GetListPayments(NewContextWithRequestID(context.Background(), "req-1"))
+	assert.NoError(t, err)
+	assert.Contains(t, b.String(), "request_id=req-1")
+}
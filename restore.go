@@ -0,0 +1,128 @@
+package paymentsapi
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// RestoreStore brings back the soft deleted payments
+type RestoreStore interface {
+	// FindDeletedPayment retrieves a payment, deleted or not, in the transaction of ctx if there is one
+	FindDeletedPayment(ctx context.Context, id uuid.UUID) (Payment, error)
+	// RestorePayment undeletes a payment, in the transaction of ctx if there is one. It reports false when the
+	// payment is not deleted
+	RestorePayment(ctx context.Context, id uuid.UUID) (bool, error)
+	Transactor
+}
+
+type restoreStore struct {
+	txStore
+}
+
+// NewRestoreStore returns a RestoreStore backed by the database
+func NewRestoreStore(db *gorm.DB) RestoreStore {
+	return &restoreStore{txStore{db: db}}
+}
+
+// FindDeletedPayment retrieves the payment without its attributes, including the soft deleted ones
+func (s *restoreStore) FindDeletedPayment(ctx context.Context, id uuid.UUID) (Payment, error) {
+	p := Payment{}
+	err := withContext(s.db, ctx).Unscoped().Where("id = ?", id).First(&p).Error
+	return p, err
+}
+
+// RestorePayment clears the deletion time of the payment if it is still deleted, only the payment row is soft
+// deleted so its attributes come back with it
+func (s *restoreStore) RestorePayment(ctx context.Context, id uuid.UUID) (bool, error) {
+	res := withContext(s.db, ctx).Unscoped().Model(&Payment{}).Where("id = ? AND deleted_at IS NOT NULL", id).
+		Update("deleted_at", gorm.Expr("NULL"))
+	return res.RowsAffected == 1, res.Error
+}
+
+// restoreLedger posts the restored payments
+type restoreLedger struct {
+	RestoreStore
+	ledger LedgerStore
+}
+
+// NewRestoreLedger returns a RestoreStore posting the payments to the ledger again when they are restored
+func NewRestoreLedger(store RestoreStore, ledger LedgerStore) RestoreStore {
+	return &restoreLedger{store, ledger}
+}
+
+// RestorePayment restores the payment and posts it in the same transaction
+func (s *restoreLedger) RestorePayment(ctx context.Context, id uuid.UUID) (bool, error) {
+	restored, err := s.RestoreStore.RestorePayment(ctx, id)
+	if err != nil || !restored {
+		return restored, err
+	}
+	p, err := s.ledger.FindPayment(ctx, id)
+	if err != nil {
+		return true, err
+	}
+	return true, postPayment(ctx, s.ledger, id, ledgerEvent(p.Status))
+}
+
+// RestoreService restores the soft deleted payments
+type RestoreService interface {
+	RestorePayment(ctx context.Context, id uuid.UUID) (Payment, error)
+}
+
+type restoreService struct {
+	store    RestoreStore
+	payments PaymentService
+}
+
+// NewRestoreService returns the RestoreService returning the restored payments through the PaymentService
+func NewRestoreService(store RestoreStore, payments PaymentService) RestoreService {
+	return &restoreService{store: store, payments: payments}
+}
+
+// RestorePayment undeletes a payment of the caller's organisation, it comes back with the status it had
+func (s *restoreService) RestorePayment(ctx context.Context, id uuid.UUID) (Payment, error) {
+	principal, err := checkPermission(ctx, PermissionWritePayments)
+	if err != nil {
+		return Payment{}, err
+	}
+	var payment Payment
+	err = s.store.InTransaction(ctx, func(ctx context.Context) error {
+		p, err := s.store.FindDeletedPayment(ctx, id)
+		if gorm.IsRecordNotFoundError(err) || (err == nil && p.OrganisationID != principal.OrganisationID) {
+			return errPaymentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		restored, err := s.store.RestorePayment(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !restored {
+			return StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the payment is not deleted"}
+		}
+		payment, err = s.payments.GetPayment(ctx, id.String())
+		return err
+	})
+	return payment, err
+}
+
+// RestorePaymentRequest is the request type used to restore a deleted payment
+type RestorePaymentRequest struct {
+	PaymentID uuid.UUID
+}
+
+// MakeRestorePaymentEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the RestorePayment method
+func MakeRestorePaymentEndpoint(svc RestoreService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RestorePaymentRequest)
+		v, err := svc.RestorePayment(ctx, req.PaymentID)
+		if err != nil {
+			return nil, newStatusError("err: Could not restore payment \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
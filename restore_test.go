@@ -0,0 +1,100 @@
+package paymentsapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryRestoreStore is a RestoreStore undeleting the payments of a map shared with the other memory stores
+type memoryRestoreStore struct {
+	payments map[uuid.UUID]Payment
+}
+
+func (s *memoryRestoreStore) FindDeletedPayment(_ context.Context, id uuid.UUID) (Payment, error) {
+	p, ok := s.payments[id]
+	if !ok {
+		return Payment{}, gorm.ErrRecordNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryRestoreStore) RestorePayment(_ context.Context, id uuid.UUID) (bool, error) {
+	p := s.payments[id]
+	if p.DeletedAt == nil {
+		return false, nil
+	}
+	p.DeletedAt = nil
+	s.payments[id] = p
+	return true, nil
+}
+
+func (s *memoryRestoreStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// deletedPayment returns an accepted payment deleted at now
+func deletedPayment() Payment {
+	p := isoPayment()
+	now := time.Now()
+	p.Status, p.DeletedAt = PaymentStatusAccepted, &now
+	return p
+}
+
+func TestRestorePayment(t *testing.T) {
+	p := deletedPayment()
+	ledger := newMemoryLedgerStore(p)
+	svc := NewRestoreService(NewRestoreLedger(&memoryRestoreStore{payments: ledger.payments}, ledger), &memoryPaymentService{payments: ledger.payments})
+	ctx := NewContextWithRequestID(roleContext(p.OrganisationID, "ops", RoleCreator), "req-restore")
+
+	_, err := svc.RestorePayment(roleContext(p.OrganisationID, "viewer", RoleViewer), p.ID)
+	assert.Equal(t, ErrForbidden, err)
+	// the payments of the other organisations are not found
+	_, err = svc.RestorePayment(roleContext(uuid.Must(uuid.NewV4()), "ops", RoleCreator), p.ID)
+	assert.Equal(t, http.StatusNotFound, err.(StatusError).Status)
+	_, err = svc.RestorePayment(ctx, uuid.Must(uuid.NewV4()))
+	assert.Equal(t, http.StatusNotFound, err.(StatusError).Status)
+
+	restored, err := svc.RestorePayment(ctx, p.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, restored.DeletedAt)
+	assert.Equal(t, PaymentStatusAccepted, restored.Status)
+	// the restored payment is posted again
+	postings, _ := ledger.ListPostings(ctx, p.OrganisationID, p.ID, "")
+	assert.NotEmpty(t, postings)
+	for _, posting := range postings {
+		assert.Equal(t, LedgerEventCreated, posting.Event)
+		assert.Equal(t, "req-restore", posting.RequestID)
+	}
+
+	_, err = svc.RestorePayment(ctx, p.ID)
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+	assert.Contains(t, err.Error(), "the payment is not deleted")
+}
+
+func TestRestorePaymentHTTP(t *testing.T) {
+	p := deletedPayment()
+	payments := newMemoryPaymentService(p)
+	router := mux.NewRouter()
+	RegisterRestoreRoutes(router, NewRestoreService(&memoryRestoreStore{payments: payments.payments}, payments))
+	post := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", url, nil).WithContext(roleContext(p.OrganisationID, "ops", RoleCreator)))
+		return rec
+	}
+
+	rec := post("/v1/payments/" + p.ID.String() + "/restore")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"id":"`+p.ID.String()+`"`)
+	rec = post("/v1/payments/" + p.ID.String() + "/restore")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = post("/v1/payments/x/restore")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,70 @@
+package paymentsapi
+
+// ReturnReasonCode is a reason a payment is returned. The ISO 20022 codes of the ExternalReturnReason1Code list are
+// the reasons recorded, the codes of a scheme are translated to the ISO code of the same meaning
+type ReturnReasonCode struct {
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Scheme is the payment scheme of a scheme code and ISOCode the ISO code it is recorded as
+	Scheme  string `json:"scheme,omitempty"`
+	ISOCode string `json:"iso_code,omitempty"`
+}
+
+// returnReasonCodes are the ISO 20022 return reasons, followed by the codes of the schemes that do not report them.
+// The Faster Payments scheme has no codes of its own here, its returns are recorded with the ISO code of the reason
+// and a Faster Payments code is rejected as unknown
+var returnReasonCodes = []ReturnReasonCode{
+	{Code: "AC01", Name: "IncorrectAccountNumber", Description: "Format of the account number specified is not correct"},
+	{Code: "AC02", Name: "InvalidDebtorAccountNumber", Description: "Debtor account number invalid or missing"},
+	{Code: "AC03", Name: "InvalidCreditorAccountNumber", Description: "Wrong IBAN in SCT"},
+	{Code: "AC04", Name: "ClosedAccountNumber", Description: "Account number specified has been closed on the bank of account's books"},
+	{Code: "AC06", Name: "BlockedAccount", Description: "Account specified is blocked, prohibiting posting of transactions against it"},
+	{Code: "AC13", Name: "InvalidDebtorAccountType", Description: "Debtor account type is missing or invalid"},
+	{Code: "AG01", Name: "TransactionForbidden", Description: "Transaction forbidden on this type of account"},
+	{Code: "AG02", Name: "InvalidBankOperationCode", Description: "Bank operation code specified in the message is not valid for receiver"},
+	{Code: "AM01", Name: "ZeroAmount", Description: "Specified message amount is equal to zero"},
+	{Code: "AM02", Name: "NotAllowedAmount", Description: "Specific transaction/message amount is greater than allowed maximum"},
+	{Code: "AM03", Name: "NotAllowedCurrency", Description: "Specified message amount is in a non processable currency outside of existing agreement"},
+	{Code: "AM04", Name: "InsufficientFunds", Description: "Amount of funds available to cover specified message amount is insufficient"},
+	{Code: "AM05", Name: "Duplication", Description: "Duplication"},
+	{Code: "AM09", Name: "WrongAmount", Description: "Amount received is not the amount agreed or expected"},
+	{Code: "BE01", Name: "InconsistentWithEndCustomer", Description: "Identification of end customer is not consistent with associated account number"},
+	{Code: "BE04", Name: "MissingCreditorAddress", Description: "Specification of creditor's address, which is required for payment, is missing/not correct"},
+	{Code: "CNOR", Name: "CreditorBankIsNotRegistered", Description: "Creditor bank is not registered under this BIC in the CSM"},
+	{Code: "CUST", Name: "RequestedByCustomer", Description: "Cancellation requested by the debtor"},
+	{Code: "DNOR", Name: "DebtorBankIsNotRegistered", Description: "Debtor bank is not registered under this BIC in the CSM"},
+	{Code: "FOCR", Name: "FollowingCancellationRequest", Description: "Return following a cancellation request"},
+	{Code: "FR01", Name: "Fraud", Description: "Returned as a result of fraud"},
+	{Code: "MD07", Name: "EndCustomerDeceased", Description: "End customer is deceased"},
+	{Code: "MS02", Name: "NotSpecifiedReasonCustomerGenerated", Description: "Reason has not been specified by end customer"},
+	{Code: "MS03", Name: "NotSpecifiedReasonAgentGenerated", Description: "Reason has not been specified by agent"},
+	{Code: "NARR", Name: "Narrative", Description: "Reason is provided as narrative information in the additional reason information"},
+	{Code: "RC01", Name: "BankIdentifierIncorrect", Description: "Bank identifier code specified in the message has an incorrect format"},
+	{Code: "RR01", Name: "MissingDebtorAccountOrIdentification", Description: "Specification of the debtor's account or unique identification needed for regulatory requirements is insufficient or missing"},
+	{Code: "RR02", Name: "MissingDebtorNameOrAddress", Description: "Specification of the debtor's name and/or address needed for regulatory requirements is insufficient or missing"},
+	{Code: "RR03", Name: "MissingCreditorNameOrAddress", Description: "Specification of the creditor's name and/or address needed for regulatory requirements is insufficient or missing"},
+	{Code: "RR04", Name: "RegulatoryReason", Description: "Regulatory reason"},
+
+	// the BACS returns of unapplied credits (ARUCS) carry a single character
+	{Code: "0", Name: "ReferToPayer", Description: "Refer to payer", Scheme: "BACS", ISOCode: "MS03"},
+	{Code: "2", Name: "PayeeDeceased", Description: "Payee deceased", Scheme: "BACS", ISOCode: "MD07"},
+	{Code: "3", Name: "AccountTransferred", Description: "Account transferred to another bank", Scheme: "BACS", ISOCode: "AC04"},
+	{Code: "5", Name: "NoAccount", Description: "No account or wrong account type", Scheme: "BACS", ISOCode: "AC01"},
+	{Code: "B", Name: "AccountClosed", Description: "Account closed", Scheme: "BACS", ISOCode: "AC04"},
+}
+
+// returnReason returns the ISO reason of a code, either an ISO code or a code of the scheme
+func returnReason(scheme, code string) (ReturnReasonCode, bool) {
+	for _, r := range returnReasonCodes {
+		if r.Scheme == "" && r.Code == code {
+			return r, true
+		}
+	}
+	for _, r := range returnReasonCodes {
+		if r.Scheme != "" && r.Scheme == scheme && r.Code == code {
+			return returnReason("", r.ISOCode)
+		}
+	}
+	return ReturnReasonCode{}, false
+}
@@ -0,0 +1,669 @@
+package paymentsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Formats of the files of returns
+const (
+	FormatPacs004    = "pacs.004"
+	FormatReturnsCSV = "csv"
+)
+
+// pacs004Namespace is the start of the namespaces of the pacs.004 versions
+const pacs004Namespace = "urn:iso:std:iso:20022:tech:xsd:pacs.004."
+
+// Results of recording a return against a payment
+const (
+	ReturnRecorded  = "recorded"
+	ReturnIgnored   = "ignored"
+	ReturnNotFound  = "not_found"
+	ReturnAmbiguous = "ambiguous"
+	ReturnDuplicate = "duplicate"
+	ReturnInvalid   = "invalid"
+)
+
+// errReturnRecorded is returned by the ReturnStore for a return whose ID was already recorded
+var errReturnRecorded = errors.New("return already recorded")
+
+// returnSchemeStatus is the scheme status of the returned payments
+const returnSchemeStatus = "RTRN"
+
+// returnsCSVColumns are the columns of the CSV files of returns, a payment is given by its ID or its end-to-end
+// reference and a reason by its ISO code or the code of the scheme
+var returnsCSVColumns = []string{"payment_id", "end_to_end_reference", "return_id", "reason_code", "scheme_reason_code", "additional_info", "amount", "currency", "returned_on"}
+
+// PaymentReturn is the return of a payment by the scheme, with the ISO code of the reason. An organisation records
+// the ID of a return given by the scheme once, it is NULL when there is none so that such returns do not collide
+type PaymentReturn struct {
+	ModelBase
+	ID                uint      `json:"id" gorm:"primary_key"`
+	OrganisationID    uuid.UUID `json:"-" gorm:"type:uuid; unique_index:idx_payment_return_id"`
+	PaymentID         uuid.UUID `json:"payment_id" gorm:"type:uuid; index"`
+	ReturnID          *string   `json:"return_id,omitempty" gorm:"unique_index:idx_payment_return_id"`
+	EndToEndReference string    `json:"end_to_end_reference"`
+	Scheme            string    `json:"scheme"`
+	ReasonCode        string    `json:"reason_code" gorm:"index"`
+	SchemeReasonCode  string    `json:"scheme_reason_code,omitempty"`
+	AdditionalInfo    string    `json:"additional_info,omitempty"`
+	Amount            string    `json:"amount"`
+	Currency          string    `json:"currency"`
+	ReturnedOn        string    `json:"returned_on"`
+	Source            string    `json:"source"`
+	RecordedAt        time.Time `json:"recorded_at"`
+	RecordedBy        string    `json:"recorded_by"`
+	RequestID         string    `json:"request_id"`
+}
+
+// ReturnResult is the outcome of a return of a file
+type ReturnResult struct {
+	Line    int            `json:"line"`
+	Result  string         `json:"result"`
+	Problem string         `json:"problem,omitempty"`
+	Return  *PaymentReturn `json:"return,omitempty"`
+}
+
+// ReturnImportResult is the outcome of a file of returns, return by return
+type ReturnImportResult struct {
+	Format   string         `json:"format"`
+	Recorded int            `json:"recorded"`
+	Returns  []ReturnResult `json:"returns"`
+}
+
+// ReturnReportLine sums the returns of a reason
+type ReturnReportLine struct {
+	ReasonCode string          `json:"reason_code"`
+	Name       string          `json:"name"`
+	Count      int             `json:"count"`
+	Amounts    []LedgerBalance `json:"amounts"`
+}
+
+// returnProblem is a return that cannot be recorded, with its result
+type returnProblem struct {
+	result, message string
+}
+
+func (p returnProblem) Error() string {
+	return "err: " + p.message
+}
+
+// statusError returns the error of the API for the problem
+func (p returnProblem) statusError() StatusError {
+	switch p.result {
+	case ReturnNotFound:
+		return StatusError{Status: http.StatusNotFound, Kind: KindNotFound, Message: p.Error()}
+	case ReturnInvalid:
+		return StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: p.Error()}
+	}
+	return StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: p.Error()}
+}
+
+type pacs004Document struct {
+	XMLName xml.Name      `xml:"Document"`
+	Return  pacs004Return `xml:"PmtRtr"`
+}
+
+type pacs004Return struct {
+	GrpHdr pacs002GroupHeader   `xml:"GrpHdr"`
+	TxInf  []pacs004Transaction `xml:"TxInf"`
+}
+
+type pacs004Transaction struct {
+	RtrID              string                `xml:"RtrId"`
+	OrgnlEndToEndID    string                `xml:"OrgnlEndToEndId"`
+	OrgnlUETR          string                `xml:"OrgnlUETR"`
+	RtrdIntrBkSttlmAmt isoAmount             `xml:"RtrdIntrBkSttlmAmt"`
+	IntrBkSttlmDt      string                `xml:"IntrBkSttlmDt"`
+	RtrRsnInf          []pacs002StatusReason `xml:"RtrRsnInf"`
+}
+
+// parsePacs004 reads the returned transactions of a pacs.004 message, any version. The UETR of a transaction is the
+// ID of the payment
+func parsePacs004(data []byte) ([]ReturnRequest, error) {
+	doc := pacs004Document{}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.New("err: Could not read the pacs.004 message: " + err.Error())
+	}
+	if !strings.HasPrefix(doc.XMLName.Space, pacs004Namespace) {
+		return nil, errors.New("err: the file is not a pacs.004 message but " + doc.XMLName.Space)
+	}
+	c := &isoChecker{}
+	c.text("GrpHdr/MsgId", doc.Return.GrpHdr.MsgID, 35, true)
+	c.check(len(doc.Return.TxInf) > 0, "TxInf", "is required")
+	var requests []ReturnRequest
+	for i, tx := range doc.Return.TxInf {
+		path := "TxInf[" + strconv.Itoa(i) + "]"
+		c.amount(path+"/RtrdIntrBkSttlmAmt", &tx.RtrdIntrBkSttlmAmt)
+		c.check(len(tx.RtrRsnInf) > 0, path+"/RtrRsnInf", "is required")
+		r := ReturnRequest{
+			PaymentID:         tx.OrgnlUETR,
+			EndToEndReference: tx.OrgnlEndToEndID,
+			ReturnID:          tx.RtrID,
+			Amount:            tx.RtrdIntrBkSttlmAmt.Value,
+			Currency:          tx.RtrdIntrBkSttlmAmt.Ccy,
+			ReturnedOn:        tx.IntrBkSttlmDt,
+		}
+		if len(tx.RtrRsnInf) > 0 {
+			reason := tx.RtrRsnInf[0]
+			if reason.Rsn != nil {
+				r.ReasonCode, r.SchemeReasonCode = reason.Rsn.Cd, reason.Rsn.Prtry
+			}
+			r.AdditionalInfo = strings.Join(reason.AddtlInf, " ")
+		}
+		requests = append(requests, r)
+	}
+	if len(c.problems) > 0 {
+		return nil, errors.New("err: the file is not a valid pacs.004 message: " + strings.Join(c.problems, "; "))
+	}
+	return requests, nil
+}
+
+// parseReturnsCSV reads the returns of a CSV file, with a header naming its columns
+func parseReturnsCSV(data []byte) ([]ReturnRequest, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.New("err: Could not read the CSV header: " + err.Error())
+	}
+	index := map[string]int{}
+	for i, h := range header {
+		for _, column := range returnsCSVColumns {
+			if strings.EqualFold(strings.TrimSpace(h), column) {
+				index[column] = i
+			}
+		}
+	}
+	_, byID := index["payment_id"]
+	_, byReference := index["end_to_end_reference"]
+	if !byID && !byReference {
+		return nil, errors.New("err: Could not read the CSV header: a payment_id or end_to_end_reference column is required")
+	}
+	var requests []ReturnRequest
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("err: Could not read the CSV returns: " + err.Error())
+		}
+		line, _ := r.FieldPos(0)
+		value := func(column string) string {
+			if i, ok := index[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		requests = append(requests, ReturnRequest{
+			Line:              line,
+			PaymentID:         value("payment_id"),
+			EndToEndReference: value("end_to_end_reference"),
+			ReturnID:          value("return_id"),
+			ReasonCode:        strings.ToUpper(value("reason_code")),
+			SchemeReasonCode:  value("scheme_reason_code"),
+			AdditionalInfo:    value("additional_info"),
+			Amount:            value("amount"),
+			Currency:          strings.ToUpper(value("currency")),
+			ReturnedOn:        value("returned_on"),
+		})
+	}
+	return requests, nil
+}
+
+// ReturnStore persists the returns of the payments and returns the payments
+type ReturnStore interface {
+	// FindPaymentsByEndToEndReference lists the payments of the organisation with the end-to-end reference, in the
+	// transaction of ctx if there is one
+	FindPaymentsByEndToEndReference(ctx context.Context, organisationID uuid.UUID, reference string) ([]Payment, error)
+	// ReturnRecorded reports whether the organisation recorded a return with the ID of the scheme, in the transaction
+	// of ctx if there is one
+	ReturnRecorded(ctx context.Context, organisationID uuid.UUID, returnID string) (bool, error)
+	// CreateReturn stores a return, in the transaction of ctx if there is one. It returns errReturnRecorded when the
+	// organisation already recorded a return with the same ID
+	CreateReturn(ctx context.Context, r *PaymentReturn) error
+	// ListReturns lists the returns of the organisation, newest first
+	ListReturns(organisationID uuid.UUID) ([]PaymentReturn, error)
+	// ReturnPayment changes the status of the payment to returned along with the reason, in the transaction of ctx if
+	// there is one. It reports false when the payment is no longer accepted or settled
+	ReturnPayment(ctx context.Context, paymentID uuid.UUID, reason string) (bool, error)
+	Transactor
+}
+
+type returnStore struct {
+	statusReportStore
+}
+
+// NewReturnStore returns a ReturnStore backed by the database
+func NewReturnStore(db *gorm.DB) ReturnStore {
+	return &returnStore{
+		statusReportStore{txStore{db: db}},
+	}
+}
+
+// ReturnRecorded looks the return up by its ID
+func (s *returnStore) ReturnRecorded(ctx context.Context, organisationID uuid.UUID, returnID string) (bool, error) {
+	count := 0
+	err := withContext(s.db, ctx).Model(&PaymentReturn{}).Where("organisation_id = ? AND return_id = ?", organisationID, returnID).Count(&count).Error
+	return count > 0, err
+}
+
+// ReturnPayment updates the statuses of the payment if it is still accepted or settled, the row stays locked until
+// the transaction of ctx ends so that another return of the payment waits and then finds it returned
+func (s *returnStore) ReturnPayment(ctx context.Context, paymentID uuid.UUID, reason string) (bool, error) {
+	res := withContext(s.db, ctx).Model(&Payment{}).
+		Where("id = ? AND status IN (?)", paymentID, []string{PaymentStatusAccepted, PaymentStatusSettled}).
+		Updates(map[string]interface{}{"status": PaymentStatusReturned, "scheme_status": returnSchemeStatus, "status_reason": reason})
+	return res.RowsAffected == 1, res.Error
+}
+
+// CreateReturn stores a return, the unique index on the organisation and the ID of the return catches the returns
+// recorded concurrently
+func (s *returnStore) CreateReturn(ctx context.Context, r *PaymentReturn) error {
+	err := withContext(s.db, ctx).Create(r).Error
+	if isUniqueViolation(err) {
+		return errReturnRecorded
+	}
+	return err
+}
+
+// isUniqueViolation reports whether err is the violation of a unique index by Postgres
+func isUniqueViolation(err error) bool {
+	e, ok := err.(*pq.Error)
+	return ok && e.Code.Name() == "unique_violation"
+}
+
+// ListReturns lists the returns of an organisation
+func (s *returnStore) ListReturns(organisationID uuid.UUID) ([]PaymentReturn, error) {
+	returns := []PaymentReturn{}
+	err := s.db.Where("organisation_id = ?", organisationID).Order("id desc").Find(&returns).Error
+	return returns, err
+}
+
+// returnLedger posts the payments returned by the schemes
+type returnLedger struct {
+	ReturnStore
+	ledger LedgerStore
+}
+
+// NewReturnLedger returns a ReturnStore posting the payments to the ledger when they are returned
+func NewReturnLedger(store ReturnStore, ledger LedgerStore) ReturnStore {
+	return &returnLedger{store, ledger}
+}
+
+// ReturnPayment returns the payment and posts it in the same transaction
+func (s *returnLedger) ReturnPayment(ctx context.Context, paymentID uuid.UUID, reason string) (bool, error) {
+	returned, err := s.ReturnStore.ReturnPayment(ctx, paymentID, reason)
+	if err != nil || !returned {
+		return returned, err
+	}
+	return true, postPayment(ctx, s.ledger, paymentID, ledgerEvent(PaymentStatusReturned))
+}
+
+// ReturnService records the returns of the payments sent by the schemes
+type ReturnService interface {
+	RecordReturn(ctx context.Context, req ReturnRequest) (PaymentReturn, error)
+	ImportReturns(ctx context.Context, format string, data []byte) (ReturnImportResult, error)
+	ListReturns(ctx context.Context) ([]PaymentReturn, error)
+	ReturnReport(ctx context.Context, req ReturnReportRequest) ([]ReturnReportLine, error)
+	ListReturnReasonCodes(ctx context.Context) ([]ReturnReasonCode, error)
+}
+
+type returnService struct {
+	store    ReturnStore
+	payments PaymentService
+	now      func() time.Time
+}
+
+// NewReturnService returns the ReturnService returning the payments retrieved through the PaymentService
+func NewReturnService(store ReturnStore, payments PaymentService) ReturnService {
+	return &returnService{
+		store:    store,
+		payments: payments,
+		now:      time.Now,
+	}
+}
+
+// payment finds the payment of the return by its ID, or else by its end-to-end reference
+func (s *returnService) payment(ctx context.Context, organisationID uuid.UUID, req ReturnRequest) (Payment, error) {
+	id := req.PaymentID
+	if id == "" {
+		if req.EndToEndReference == "" {
+			return Payment{}, returnProblem{ReturnInvalid, "a payment_id or an end_to_end_reference is required"}
+		}
+		payments, err := s.store.FindPaymentsByEndToEndReference(ctx, organisationID, req.EndToEndReference)
+		if err != nil {
+			return Payment{}, err
+		}
+		switch len(payments) {
+		case 0:
+			return Payment{}, returnProblem{ReturnNotFound, "no payment has the end-to-end reference " + req.EndToEndReference}
+		case 1:
+			id = payments[0].ID.String()
+		default:
+			return Payment{}, returnProblem{ReturnAmbiguous, "several payments have the end-to-end reference " + req.EndToEndReference}
+		}
+	}
+	if _, err := uuid.FromString(id); err != nil {
+		return Payment{}, returnProblem{ReturnInvalid, "the payment_id is not a UUID"}
+	}
+	payment, err := s.payments.GetPayment(ctx, id)
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) || IsNotFound(err) {
+			return Payment{}, returnProblem{ReturnNotFound, "no payment has the ID " + id}
+		}
+		return Payment{}, err
+	}
+	return payment, nil
+}
+
+// record records a return against its payment and returns the payment. A return is of the whole payment, its amount
+// goes back to the debtor in the ledger. The duplicates and the status of the payment are checked in the transaction
+// returning it, a returnProblem tells why it is not recorded
+func (s *returnService) record(ctx context.Context, p Principal, req ReturnRequest, source string) (PaymentReturn, error) {
+	payment, err := s.payment(ctx, p.OrganisationID, req)
+	if err != nil {
+		return PaymentReturn{}, err
+	}
+	a := payment.Attributes
+	code := req.ReasonCode
+	if code == "" {
+		code = req.SchemeReasonCode
+	}
+	reason, ok := returnReason(a.PaymentScheme, code)
+	switch {
+	case code == "":
+		return PaymentReturn{}, returnProblem{ReturnInvalid, "a reason_code or a scheme_reason_code is required"}
+	case !ok:
+		return PaymentReturn{}, returnProblem{ReturnInvalid, "unknown return reason " + code + " for the " + a.PaymentScheme + " scheme"}
+	}
+	r := PaymentReturn{
+		OrganisationID:    p.OrganisationID,
+		PaymentID:         payment.ID,
+		EndToEndReference: a.EndToEndReference,
+		Scheme:            a.PaymentScheme,
+		ReasonCode:        reason.Code,
+		AdditionalInfo:    req.AdditionalInfo,
+		Amount:            req.Amount,
+		Currency:          req.Currency,
+		ReturnedOn:        req.ReturnedOn,
+		Source:            source,
+		RecordedAt:        s.now().UTC(),
+		RecordedBy:        p.Subject,
+		RequestID:         RequestIDFromContext(ctx),
+	}
+	if req.ReturnID != "" {
+		r.ReturnID = &req.ReturnID
+	}
+	if reason.Code != code {
+		r.SchemeReasonCode = code
+	}
+	if r.Amount == "" {
+		r.Amount = a.Amount
+	}
+	if r.Currency == "" {
+		r.Currency = a.Currency
+	}
+	if r.ReturnedOn == "" {
+		r.ReturnedOn = s.now().UTC().Format(isoDateFormat)
+	}
+	amount, ok := new(big.Rat).SetString(r.Amount)
+	paid, _ := new(big.Rat).SetString(a.Amount)
+	switch {
+	case !ok || (paid != nil && amount.Cmp(paid) != 0):
+		return PaymentReturn{}, returnProblem{ReturnInvalid, "the amount returned must be the amount of the payment, partial returns are not supported"}
+	case r.Currency != a.Currency:
+		return PaymentReturn{}, returnProblem{ReturnInvalid, "the currency returned is not the currency of the payment"}
+	}
+	if _, err := time.Parse(isoDateFormat, r.ReturnedOn); err != nil {
+		return PaymentReturn{}, returnProblem{ReturnInvalid, "returned_on must be a date formatted as YYYY-MM-DD"}
+	}
+	duplicate := returnProblem{ReturnDuplicate, "the return " + req.ReturnID + " is already recorded"}
+	err = s.store.InTransaction(ctx, func(ctx context.Context) error {
+		if req.ReturnID != "" {
+			recorded, err := s.store.ReturnRecorded(ctx, p.OrganisationID, req.ReturnID)
+			if err != nil {
+				return err
+			}
+			if recorded {
+				return duplicate
+			}
+		}
+		returned, err := s.store.ReturnPayment(ctx, payment.ID, r.ReasonCode)
+		if err != nil {
+			return err
+		}
+		if !returned {
+			current, err := s.payments.GetPayment(ctx, payment.ID.String())
+			if err != nil {
+				return err
+			}
+			return returnProblem{ReturnIgnored, "the payment is " + current.Status + ", only accepted and settled payments are returned"}
+		}
+		// a return with the same ID recorded since the check rolls this one back
+		if err := s.store.CreateReturn(ctx, &r); err != errReturnRecorded {
+			return err
+		}
+		return duplicate
+	})
+	if err != nil {
+		return PaymentReturn{}, err
+	}
+	return r, nil
+}
+
+// RecordReturn records a return against a payment of the caller's organisation, which is returned
+func (s *returnService) RecordReturn(ctx context.Context, req ReturnRequest) (PaymentReturn, error) {
+	p, err := checkPermission(ctx, PermissionWritePayments)
+	if err != nil {
+		return PaymentReturn{}, err
+	}
+	r, err := s.record(ctx, p, req, "api")
+	if problem, ok := err.(returnProblem); ok {
+		return PaymentReturn{}, problem.statusError()
+	}
+	return r, err
+}
+
+// ImportReturns records the returns of a pacs.004 message or of a CSV file. Every return gets a result, the ones
+// that cannot be recorded are reported rather than failing the file
+func (s *returnService) ImportReturns(ctx context.Context, format string, data []byte) (ReturnImportResult, error) {
+	p, err := checkPermission(ctx, PermissionWritePayments)
+	if err != nil {
+		return ReturnImportResult{}, err
+	}
+	var requests []ReturnRequest
+	switch format {
+	case FormatPacs004:
+		requests, err = parsePacs004(data)
+	case FormatReturnsCSV:
+		requests, err = parseReturnsCSV(data)
+	default:
+		err = errors.New("err: unsupported returns format " + strconv.Quote(format) + ", use pacs.004 or csv")
+	}
+	if err != nil {
+		return ReturnImportResult{}, StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: err.Error()}
+	}
+	result := ReturnImportResult{Format: format, Returns: []ReturnResult{}}
+	for i, req := range requests {
+		line := req.Line
+		if line == 0 {
+			line = i + 1
+		}
+		r, err := s.record(ctx, p, req, format)
+		if problem, ok := err.(returnProblem); ok {
+			result.Returns = append(result.Returns, ReturnResult{Line: line, Result: problem.result, Problem: problem.message})
+			continue
+		}
+		if err != nil {
+			return ReturnImportResult{}, err
+		}
+		result.Recorded++
+		result.Returns = append(result.Returns, ReturnResult{Line: line, Result: ReturnRecorded, Return: &r})
+	}
+	return result, nil
+}
+
+// ListReturns lists the returns of the caller's organisation
+func (s *returnService) ListReturns(ctx context.Context) ([]PaymentReturn, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.ListReturns(p.OrganisationID)
+}
+
+// ReturnReport counts the returns of the caller's organisation by reason code and sums their amounts by currency,
+// the most frequent reasons first. The returns can be limited to the days between from and to
+func (s *returnService) ReturnReport(ctx context.Context, req ReturnReportRequest) ([]ReturnReportLine, error) {
+	p, err := checkPermission(ctx, PermissionReadPayments)
+	if err != nil {
+		return nil, err
+	}
+	returns, err := s.store.ListReturns(p.OrganisationID)
+	if err != nil {
+		return nil, err
+	}
+	lines := map[string]*ReturnReportLine{}
+	amounts := map[string]*ledgerPositions{}
+	for _, r := range returns {
+		if (req.From != "" && r.ReturnedOn < req.From) || (req.To != "" && r.ReturnedOn > req.To) {
+			continue
+		}
+		line, ok := lines[r.ReasonCode]
+		if !ok {
+			reason, _ := returnReason("", r.ReasonCode)
+			line = &ReturnReportLine{ReasonCode: r.ReasonCode, Name: reason.Name}
+			lines[r.ReasonCode], amounts[r.ReasonCode] = line, newLedgerPositions()
+		}
+		line.Count++
+		if amount, ok := new(big.Rat).SetString(r.Amount); ok {
+			amounts[r.ReasonCode].add("", r.Currency, amount)
+		}
+	}
+	report := []ReturnReportLine{}
+	for code, line := range lines {
+		sums := amounts[code]
+		sort.Slice(sums.keys, func(i, j int) bool { return sums.keys[i].currency < sums.keys[j].currency })
+		line.Amounts = []LedgerBalance{}
+		for _, k := range sums.keys {
+			line.Amounts = append(line.Amounts, LedgerBalance{Currency: k.currency, Balance: decimalString(sums.amounts[k])})
+		}
+		report = append(report, *line)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Count != report[j].Count {
+			return report[i].Count > report[j].Count
+		}
+		return report[i].ReasonCode < report[j].ReasonCode
+	})
+	return report, nil
+}
+
+// ListReturnReasonCodes lists the ISO return reasons and the codes of the schemes
+func (s *returnService) ListReturnReasonCodes(ctx context.Context) ([]ReturnReasonCode, error) {
+	if _, err := checkPermission(ctx, PermissionReadPayments); err != nil {
+		return nil, err
+	}
+	return returnReasonCodes, nil
+}
+
+// ReturnRequest is the request type used to record a return, Line is the line of the return in a file
+type ReturnRequest struct {
+	Line              int    `json:"-"`
+	PaymentID         string `json:"payment_id"`
+	EndToEndReference string `json:"end_to_end_reference"`
+	ReturnID          string `json:"return_id"`
+	ReasonCode        string `json:"reason_code"`
+	SchemeReasonCode  string `json:"scheme_reason_code"`
+	AdditionalInfo    string `json:"additional_info"`
+	Amount            string `json:"amount"`
+	Currency          string `json:"currency"`
+	ReturnedOn        string `json:"returned_on"`
+}
+
+// ImportReturnsRequest is the request type used to upload a file of returns
+type ImportReturnsRequest struct {
+	Format string
+	Data   []byte
+}
+
+// ReturnReportRequest is the request type used to get the report of the returns
+type ReturnReportRequest struct {
+	From string
+	To   string
+}
+
+// MakeRecordReturnEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the RecordReturn method
+func MakeRecordReturnEndpoint(svc ReturnService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ReturnRequest)
+		v, err := svc.RecordReturn(ctx, req)
+		if err != nil {
+			return nil, newStatusError("err: Could not record return \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeImportReturnsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ImportReturns method
+func MakeImportReturnsEndpoint(svc ReturnService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ImportReturnsRequest)
+		v, err := svc.ImportReturns(ctx, req.Format, req.Data)
+		if err != nil {
+			return nil, newStatusError("err: Could not import returns \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeListReturnsEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ListReturns method
+func MakeListReturnsEndpoint(svc ReturnService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		v, err := svc.ListReturns(ctx)
+		if err != nil {
+			return nil, newStatusError("err: Could not list returns \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeReturnReportEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ReturnReport method
+func MakeReturnReportEndpoint(svc ReturnService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ReturnReportRequest)
+		v, err := svc.ReturnReport(ctx, req)
+		if err != nil {
+			return nil, newStatusError("err: Could not report returns \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
+
+// MakeListReturnReasonCodesEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the ListReturnReasonCodes method
+func MakeListReturnReasonCodesEndpoint(svc ReturnService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		v, err := svc.ListReturnReasonCodes(ctx)
+		if err != nil {
+			return nil, newStatusError("err: Could not list return reason codes \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,305 @@
+package paymentsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryReturnStore is a ReturnStore returning the payments of a memoryPaymentService
+type memoryReturnStore struct {
+	payments *memoryPaymentService
+	returns  []PaymentReturn
+}
+
+func (s *memoryReturnStore) FindPaymentsByEndToEndReference(_ context.Context, organisationID uuid.UUID, reference string) ([]Payment, error) {
+	var payments []Payment
+	for _, p := range s.payments.payments {
+		if p.OrganisationID == organisationID && p.Attributes.EndToEndReference == reference {
+			payments = append(payments, p)
+		}
+	}
+	return payments, nil
+}
+
+func (s *memoryReturnStore) ReturnRecorded(_ context.Context, organisationID uuid.UUID, returnID string) (bool, error) {
+	for _, r := range s.returns {
+		if r.OrganisationID == organisationID && r.ReturnID != nil && *r.ReturnID == returnID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryReturnStore) CreateReturn(ctx context.Context, r *PaymentReturn) error {
+	if r.ReturnID != nil {
+		if recorded, _ := s.ReturnRecorded(ctx, r.OrganisationID, *r.ReturnID); recorded {
+			return errReturnRecorded
+		}
+	}
+	r.ID = uint(len(s.returns) + 1)
+	s.returns = append(s.returns, *r)
+	return nil
+}
+
+func (s *memoryReturnStore) ListReturns(organisationID uuid.UUID) ([]PaymentReturn, error) {
+	returns := []PaymentReturn{}
+	for _, r := range s.returns {
+		if r.OrganisationID == organisationID {
+			returns = append(returns, r)
+		}
+	}
+	return returns, nil
+}
+
+func (s *memoryReturnStore) ReturnPayment(_ context.Context, paymentID uuid.UUID, reason string) (bool, error) {
+	p := s.payments.payments[paymentID]
+	if p.Status != PaymentStatusAccepted && p.Status != PaymentStatusSettled {
+		return false, nil
+	}
+	p.Status, p.SchemeStatus, p.StatusReason = PaymentStatusReturned, returnSchemeStatus, reason
+	s.payments.payments[paymentID] = p
+	return true, nil
+}
+
+func (s *memoryReturnStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// newTestReturnService returns a ReturnService of the payments, recording the returns on 2019-04-03
+func newTestReturnService(payments ...Payment) (*returnService, *memoryReturnStore) {
+	store := &memoryReturnStore{payments: newMemoryPaymentService(payments...)}
+	svc := NewReturnService(store, store.payments).(*returnService)
+	svc.now = func() time.Time { return time.Date(2019, 4, 3, 10, 0, 0, 0, time.UTC) }
+	return svc, store
+}
+
+func TestReturnReason(t *testing.T) {
+	r, ok := returnReason("FPS", "AC04")
+	assert.True(t, ok)
+	assert.Equal(t, "ClosedAccountNumber", r.Name)
+	// the codes of a scheme are recorded as their ISO code
+	r, ok = returnReason("BACS", "B")
+	assert.True(t, ok)
+	assert.Equal(t, "AC04", r.Code)
+	_, ok = returnReason("FPS", "B")
+	assert.False(t, ok)
+	_, ok = returnReason("BACS", "XX99")
+	assert.False(t, ok)
+}
+
+func TestRecordReturn(t *testing.T) {
+	p := settledPayment()
+	svc, store := newTestReturnService(p)
+	ctx := roleContext(p.OrganisationID, "ops", RoleCreator)
+
+	_, err := svc.RecordReturn(ctx, ReturnRequest{PaymentID: p.ID.String(), ReasonCode: "AC99"})
+	assert.Equal(t, http.StatusBadRequest, err.(StatusError).Status)
+	_, err = svc.RecordReturn(ctx, ReturnRequest{PaymentID: p.ID.String(), ReasonCode: "AC04", Amount: "100.22"})
+	assert.Contains(t, err.Error(), "the amount returned must be the amount of the payment")
+	_, err = svc.RecordReturn(ctx, ReturnRequest{PaymentID: p.ID.String(), ReasonCode: "AC04", Amount: "50"})
+	assert.Contains(t, err.Error(), "partial returns are not supported")
+	_, err = svc.RecordReturn(ctx, ReturnRequest{PaymentID: p.ID.String(), ReasonCode: "AC04", Currency: "EUR"})
+	assert.Contains(t, err.Error(), "not the currency of the payment")
+	_, err = svc.RecordReturn(ctx, ReturnRequest{EndToEndReference: "unknown", ReasonCode: "AC04"})
+	assert.Equal(t, http.StatusNotFound, err.(StatusError).Status)
+	_, err = svc.RecordReturn(roleContext(p.OrganisationID, "viewer", RoleViewer), ReturnRequest{PaymentID: p.ID.String(), ReasonCode: "AC04"})
+	assert.Equal(t, ErrForbidden, err)
+	assert.Equal(t, PaymentStatusSettled, store.payments.payments[p.ID].Status)
+
+	returnID := "RTR-1"
+	r, err := svc.RecordReturn(ctx, ReturnRequest{EndToEndReference: p.Attributes.EndToEndReference, ReturnID: returnID, ReasonCode: "AC04", AdditionalInfo: "Closed"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentReturn{
+		ID: 1, OrganisationID: p.OrganisationID, PaymentID: p.ID, ReturnID: &returnID, EndToEndReference: p.Attributes.EndToEndReference,
+		Scheme: "FPS", ReasonCode: "AC04", AdditionalInfo: "Closed", Amount: "100.21", Currency: "GBP", ReturnedOn: "2019-04-03",
+		Source: "api", RecordedAt: svc.now(), RecordedBy: "ops",
+	}, r)
+	returned := store.payments.payments[p.ID]
+	assert.Equal(t, PaymentStatusReturned, returned.Status)
+	assert.Equal(t, "RTRN", returned.SchemeStatus)
+	assert.Equal(t, "AC04", returned.StatusReason)
+
+	// a payment is returned once
+	_, err = svc.RecordReturn(ctx, ReturnRequest{PaymentID: p.ID.String(), ReasonCode: "AC04"})
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+	assert.Contains(t, err.Error(), "the payment is returned")
+	_, err = svc.RecordReturn(ctx, ReturnRequest{PaymentID: p.ID.String(), ReturnID: "RTR-1", ReasonCode: "AC04"})
+	assert.Contains(t, err.Error(), "the return RTR-1 is already recorded")
+}
+
+// racingReturnStore misses the returns recorded since the transaction started, as another request recording the same
+// return concurrently
+type racingReturnStore struct {
+	*memoryReturnStore
+}
+
+func (s racingReturnStore) ReturnRecorded(context.Context, uuid.UUID, string) (bool, error) {
+	return false, nil
+}
+
+func TestRecordReturnConcurrentDuplicate(t *testing.T) {
+	p, other := settledPayment(), settledPayment()
+	other.ID, other.OrganisationID = uuid.Must(uuid.NewV4()), p.OrganisationID
+	svc, store := newTestReturnService(p, other)
+	returnID := "RTR-1"
+	store.returns = []PaymentReturn{{ID: 1, OrganisationID: p.OrganisationID, PaymentID: other.ID, ReturnID: &returnID}}
+	svc.store = racingReturnStore{store}
+
+	_, err := svc.RecordReturn(roleContext(p.OrganisationID, "ops", RoleCreator), ReturnRequest{PaymentID: p.ID.String(), ReturnID: returnID, ReasonCode: "AC04"})
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+	assert.Contains(t, err.Error(), "the return RTR-1 is already recorded")
+	assert.Len(t, store.returns, 1)
+
+	assert.True(t, isUniqueViolation(&pq.Error{Code: "23505"}))
+	assert.False(t, isUniqueViolation(&pq.Error{Code: "23503"}))
+	assert.False(t, isUniqueViolation(errors.New("db down")))
+}
+
+func TestRecordReturnAmbiguous(t *testing.T) {
+	p, other := settledPayment(), settledPayment()
+	other.ID, other.OrganisationID = uuid.Must(uuid.NewV4()), p.OrganisationID
+	svc, _ := newTestReturnService(p, other)
+	_, err := svc.RecordReturn(roleContext(p.OrganisationID, "ops", RoleCreator), ReturnRequest{EndToEndReference: p.Attributes.EndToEndReference, ReasonCode: "AC04"})
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+	assert.Contains(t, err.Error(), "several payments")
+}
+
+func TestImportReturnsCSV(t *testing.T) {
+	p, bacs, pending := settledPayment(), settledPayment(), isoPayment()
+	bacs.ID, _ = uuid.NewV4()
+	bacs.OrganisationID, pending.OrganisationID = p.OrganisationID, p.OrganisationID
+	bacs.Attributes.PaymentScheme, bacs.Attributes.EndToEndReference = "BACS", "BACS-1"
+	pending.Status, pending.Attributes.EndToEndReference = PaymentStatusPendingApproval, "PENDING"
+	svc, store := newTestReturnService(p, bacs, pending)
+	ctx := roleContext(p.OrganisationID, "ops", RoleCreator)
+
+	file := "payment_id,end_to_end_reference,scheme_reason_code,reason_code,amount,returned_on\n" +
+		p.ID.String() + ",,,am04,100.210,2019-04-02\n" +
+		",BACS-1,B,,,\n" +
+		",PENDING,,AC01,,\n" +
+		",MISSING,,AC01,,\n" +
+		p.ID.String() + ",,,,,\n"
+	result, err := svc.ImportReturns(ctx, FormatReturnsCSV, []byte(file))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Recorded)
+	var results []string
+	for _, r := range result.Returns {
+		results = append(results, r.Result)
+	}
+	assert.Equal(t, []string{ReturnRecorded, ReturnRecorded, ReturnIgnored, ReturnNotFound, ReturnInvalid}, results)
+	assert.Equal(t, 2, result.Returns[0].Line)
+	assert.Equal(t, "100.210", result.Returns[0].Return.Amount)
+	assert.Equal(t, "csv", result.Returns[0].Return.Source)
+	// the scheme code is kept along with its ISO code
+	assert.Equal(t, "AC04", result.Returns[1].Return.ReasonCode)
+	assert.Equal(t, "B", result.Returns[1].Return.SchemeReasonCode)
+	assert.Equal(t, PaymentStatusReturned, store.payments.payments[bacs.ID].Status)
+	assert.Equal(t, PaymentStatusPendingApproval, store.payments.payments[pending.ID].Status)
+
+	_, err = svc.ImportReturns(ctx, FormatReturnsCSV, []byte("reason_code\nAC01\n"))
+	assert.Equal(t, http.StatusBadRequest, err.(StatusError).Status)
+	_, err = svc.ImportReturns(ctx, "mt103", nil)
+	assert.Contains(t, err.Error(), "unsupported returns format")
+}
+
+func TestImportReturnsPacs004(t *testing.T) {
+	p := settledPayment()
+	svc, store := newTestReturnService(p)
+	message := `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pacs.004.001.09">
+  <PmtRtr>
+    <GrpHdr><MsgId>RTR-MSG-1</MsgId><CreDtTm>2019-04-03T09:00:00</CreDtTm></GrpHdr>
+    <TxInf>
+      <RtrId>RTR-1</RtrId>
+      <OrgnlEndToEndId>` + p.Attributes.EndToEndReference + `</OrgnlEndToEndId>
+      <OrgnlUETR>` + p.ID.String() + `</OrgnlUETR>
+      <RtrdIntrBkSttlmAmt Ccy="GBP">100.21</RtrdIntrBkSttlmAmt>
+      <IntrBkSttlmDt>2019-04-03</IntrBkSttlmDt>
+      <RtrRsnInf><Rsn><Cd>MD07</Cd></Rsn><AddtlInf>Deceased</AddtlInf></RtrRsnInf>
+    </TxInf>
+  </PmtRtr>
+</Document>`
+	result, err := svc.ImportReturns(roleContext(p.OrganisationID, "ops", RoleCreator), FormatPacs004, []byte(message))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Recorded)
+	r := result.Returns[0].Return
+	assert.Equal(t, "RTR-1", *r.ReturnID)
+	assert.Equal(t, "MD07", r.ReasonCode)
+	assert.Equal(t, "Deceased", r.AdditionalInfo)
+	assert.Equal(t, "pacs.004", r.Source)
+	assert.Equal(t, PaymentStatusReturned, store.payments.payments[p.ID].Status)
+
+	_, err = parsePacs004([]byte(strings.Replace(message, "pacs.004.001.09", "pacs.002.001.10", 1)))
+	assert.Contains(t, err.Error(), "not a pacs.004 message")
+	_, err = parsePacs004([]byte(strings.Replace(message, "<RtrRsnInf><Rsn><Cd>MD07</Cd></Rsn><AddtlInf>Deceased</AddtlInf></RtrRsnInf>", "", 1)))
+	assert.Contains(t, err.Error(), "TxInf[0]/RtrRsnInf: is required")
+}
+
+func TestReturnReport(t *testing.T) {
+	org, _ := uuid.NewV4()
+	svc, store := newTestReturnService()
+	add := func(code, amount, currency, day string) {
+		store.returns = append(store.returns, PaymentReturn{OrganisationID: org, ReasonCode: code, Amount: amount, Currency: currency, ReturnedOn: day})
+	}
+	add("AC04", "10.50", "GBP", "2019-04-01")
+	add("AC04", "4.50", "GBP", "2019-04-02")
+	add("AC04", "7", "EUR", "2019-04-02")
+	add("AM04", "1", "GBP", "2019-04-02")
+	add("MD07", "1", "GBP", "2019-04-05")
+	other, _ := uuid.NewV4()
+	store.returns = append(store.returns, PaymentReturn{OrganisationID: other, ReasonCode: "AM04", Amount: "1", Currency: "GBP", ReturnedOn: "2019-04-02"})
+
+	report, err := svc.ReturnReport(roleContext(org, "viewer", RoleViewer), ReturnReportRequest{To: "2019-04-03"})
+	assert.NoError(t, err)
+	assert.Equal(t, []ReturnReportLine{
+		{ReasonCode: "AC04", Name: "ClosedAccountNumber", Count: 3, Amounts: []LedgerBalance{{Currency: "EUR", Balance: "7"}, {Currency: "GBP", Balance: "15"}}},
+		{ReasonCode: "AM04", Name: "InsufficientFunds", Count: 1, Amounts: []LedgerBalance{{Currency: "GBP", Balance: "1"}}},
+	}, report)
+	report, _ = svc.ReturnReport(roleContext(org, "viewer", RoleViewer), ReturnReportRequest{From: "2019-04-02", To: "2019-04-02"})
+	assert.Equal(t, 2, report[0].Count)
+}
+
+func TestReturnsHTTP(t *testing.T) {
+	p := settledPayment()
+	svc, _ := newTestReturnService(p)
+	router := mux.NewRouter()
+	RegisterReturnRoutes(router, svc, 1<<20)
+	do := func(method, url, contentType, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, strings.NewReader(body)).WithContext(roleContext(p.OrganisationID, "ops", RoleCreator))
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("POST", "/v1/returns", "application/json", `{"payment_id":"`+p.ID.String()+`","scheme_reason_code":"AC01"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"reason_code":"AC01"`)
+	rec = do("POST", "/v1/returns", "application/json", `{"payment_id":"`+p.ID.String()+`","reason_code":"AC01"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = do("POST", "/v1/returns/import", "text/csv", "end_to_end_reference,reason_code\nMISSING,AC01\n")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"result":"not_found"`)
+
+	rec = do("GET", "/v1/returns", "", "")
+	returns := []PaymentReturn{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &returns))
+	assert.Len(t, returns, 1)
+	rec = do("GET", "/v1/returns/report?from=2019-04-01", "", "")
+	assert.Contains(t, rec.Body.String(), `"reason_code":"AC01","name":"IncorrectAccountNumber","count":1`)
+	rec = do("GET", "/v1/returns/report?from=April", "", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do("GET", "/v1/returns/reason-codes", "", "")
+	assert.Contains(t, rec.Body.String(), `{"code":"B","name":"AccountClosed","description":"Account closed","scheme":"BACS","iso_code":"AC04"}`)
+}
@@ -0,0 +1,296 @@
+package paymentsapi
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+)
+
+// scheduleInterval is how often the scheduler looks for the scheduled payments that are due
+const scheduleInterval = time.Minute
+
+// schedulerRequestID is the request ID of the changes made by the scheduler, e.g. on the ledger postings
+const schedulerRequestID = "scheduler"
+
+// acceptedStatus returns the status of a payment accepted at now: it is scheduled when it is processed on a later day
+// than today, in UTC
+func acceptedStatus(processingDate Date, now time.Time) string {
+	if processingDate.After(DateOf(now).Time) {
+		return PaymentStatusScheduled
+	}
+	return PaymentStatusAccepted
+}
+
+// scheduledStatus returns the status of a payment created or updated at now: the accepted and the scheduled payments
+// are scheduled or accepted depending on their processing date, the others keep their status
+func scheduledStatus(p Payment, now time.Time) string {
+	switch p.Status {
+	case PaymentStatusAccepted, PaymentStatusScheduled:
+		return acceptedStatus(p.Attributes.ProcessingDate, now)
+	}
+	return p.Status
+}
+
+type schedulingMiddleware struct {
+	next PaymentService
+	now  func() time.Time
+}
+
+// NewPaymentScheduling returns a PaymentService holding the accepted payments with a future processing date as
+// scheduled, the Scheduler accepts them on that day
+func NewPaymentScheduling(next PaymentService) PaymentService {
+	return &schedulingMiddleware{
+		next: next,
+		now:  time.Now,
+	}
+}
+
+// GetPayment is passed through
+func (mw schedulingMiddleware) GetPayment(ctx context.Context, id string) (Payment, error) {
+	return mw.next.GetPayment(ctx, id)
+}
+
+// GetListPayments is passed through
+func (mw schedulingMiddleware) GetListPayments(ctx context.Context) ([]Payment, error) {
+	return mw.next.GetListPayments(ctx)
+}
+
+// CreatePayment schedules the payment when it is processed on a later day
+func (mw schedulingMiddleware) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
+	if p.Status == "" {
+		p.Status = PaymentStatusAccepted
+	}
+	p.Status = scheduledStatus(p, mw.now())
+	return mw.next.CreatePayment(ctx, p)
+}
+
+// UpdatePayment schedules the payment again when its new processing date is a later day, and accepts a scheduled
+// payment moved to today or before. The status is the stored one unless a layer above decided otherwise, the
+// cancelled payments cannot be updated
+func (mw schedulingMiddleware) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	if req.Payment.Status == "" {
+		current, err := mw.next.GetPayment(ctx, req.PaymentID)
+		if err != nil {
+			return UpdatePaymentResponse{}, err
+		}
+		if err := checkPaymentUpdatable(current.Status); err != nil {
+			return UpdatePaymentResponse{}, err
+		}
+		req.Payment.Status = current.Status
+	}
+	req.Payment.Status = scheduledStatus(req.Payment, mw.now())
+	return mw.next.UpdatePayment(ctx, req)
+}
+
+// DeletePayment is passed through
+func (mw schedulingMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	return mw.next.DeletePayment(ctx, id)
+}
+
+// ScheduleStore changes the status of the scheduled payments. The changes are made only if the payment is still
+// scheduled, so that a payment is released or cancelled once however many instances try
+type ScheduleStore interface {
+	// DueScheduledPayments lists the scheduled payments of every organisation processed on day or before
+	DueScheduledPayments(day Date) ([]Payment, error)
+	// ReleasePayment accepts a scheduled payment, in the transaction of ctx if there is one. It reports false when
+	// the payment is no longer scheduled
+	ReleasePayment(ctx context.Context, id uuid.UUID) (bool, error)
+	// CancelPayment cancels a scheduled payment. It reports false when the payment is no longer scheduled
+	CancelPayment(ctx context.Context, id uuid.UUID) (bool, error)
+	Transactor
+}
+
+type scheduleStore struct {
+	txStore
+}
+
+// NewScheduleStore returns a ScheduleStore backed by the database
+func NewScheduleStore(db *gorm.DB) ScheduleStore {
+	return &scheduleStore{txStore{db: db}}
+}
+
+// DueScheduledPayments lists the payments, without their attributes, oldest processing date first
+func (s *scheduleStore) DueScheduledPayments(day Date) ([]Payment, error) {
+	var payments []Payment
+	err := s.db.Select("payments.*").Joins("JOIN attributes ON attributes.id = payments.attributes_id").
+		Where("payments.status = ? AND attributes.processing_date <= ?", PaymentStatusScheduled, day).
+		Order("attributes.processing_date").Find(&payments).Error
+	return payments, err
+}
+
+// ReleasePayment updates the status of the payment if it is still scheduled, the row stays locked until the
+// transaction of ctx ends so that another instance releasing it waits and then finds it accepted
+func (s *scheduleStore) ReleasePayment(ctx context.Context, id uuid.UUID) (bool, error) {
+	res := withContext(s.db, ctx).Model(&Payment{}).Where("id = ? AND status = ?", id, PaymentStatusScheduled).
+		Update("status", PaymentStatusAccepted)
+	return res.RowsAffected == 1, res.Error
+}
+
+// CancelPayment updates the status of the payment if it is still scheduled
+func (s *scheduleStore) CancelPayment(ctx context.Context, id uuid.UUID) (bool, error) {
+	res := withContext(s.db, ctx).Model(&Payment{}).Where("id = ? AND status = ?", id, PaymentStatusScheduled).
+		Update("status", PaymentStatusCancelled)
+	return res.RowsAffected == 1, res.Error
+}
+
+// scheduleLedger posts the payments released by the scheduler
+type scheduleLedger struct {
+	ScheduleStore
+	ledger LedgerStore
+}
+
+// NewScheduleLedger returns a ScheduleStore posting the payments to the ledger when they are released. The scheduled
+// and cancelled payments hold nothing, so cancelling posts nothing
+func NewScheduleLedger(store ScheduleStore, ledger LedgerStore) ScheduleStore {
+	return &scheduleLedger{store, ledger}
+}
+
+// ReleasePayment accepts the payment and posts it in the same transaction
+func (s *scheduleLedger) ReleasePayment(ctx context.Context, id uuid.UUID) (bool, error) {
+	released, err := s.ScheduleStore.ReleasePayment(ctx, id)
+	if err != nil || !released {
+		return released, err
+	}
+	return true, postPayment(ctx, s.ledger, id, LedgerEventCreated)
+}
+
+// Scheduler accepts the scheduled payments on their processing date. Every instance runs one, a payment released by
+// an instance is skipped by the others
+type Scheduler struct {
+	store  ScheduleStore
+	logger log.Logger
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	now    func() time.Time
+}
+
+// NewScheduler returns a Scheduler releasing the payments of store
+func NewScheduler(store ScheduleStore, logger log.Logger) *Scheduler {
+	return &Scheduler{
+		store:  store,
+		logger: logger,
+		stop:   make(chan struct{}),
+		now:    time.Now,
+	}
+}
+
+// Start releases the payments that became due while no instance was running, and then the payments due every day
+func (s *Scheduler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(scheduleInterval)
+		defer ticker.Stop()
+		for {
+			s.ReleaseDuePayments()
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop waits for the payment being released, the payments left are released by the next pass of any instance
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// ReleaseDuePayments accepts the scheduled payments processed today or before, each in its own transaction, and
+// returns how many this instance released
+func (s *Scheduler) ReleaseDuePayments() int {
+	today := DateOf(s.now())
+	payments, err := s.store.DueScheduledPayments(today)
+	if err != nil {
+		s.logger.Log("msg", "could not list the scheduled payments", "err", err)
+		return 0
+	}
+	ctx := NewContextWithRequestID(context.Background(), schedulerRequestID)
+	released := 0
+	for _, p := range payments {
+		select {
+		case <-s.stop:
+			return released
+		default:
+		}
+		var ok bool
+		err := s.store.InTransaction(ctx, func(ctx context.Context) error {
+			var err error
+			ok, err = s.store.ReleasePayment(ctx, p.ID)
+			return err
+		})
+		if err != nil {
+			s.logger.Log("msg", "could not release the scheduled payment", "payment_id", p.ID, "err", err)
+			continue
+		}
+		if ok {
+			released++
+		}
+	}
+	if released > 0 {
+		s.logger.Log("msg", "released the scheduled payments", "day", today, "released", released)
+	}
+	return released
+}
+
+// ScheduleService cancels the scheduled payments
+type ScheduleService interface {
+	CancelPayment(ctx context.Context, id uuid.UUID) (Payment, error)
+}
+
+type scheduleService struct {
+	store    ScheduleStore
+	payments PaymentService
+}
+
+// NewScheduleService returns the ScheduleService cancelling the payments retrieved through the PaymentService
+func NewScheduleService(store ScheduleStore, payments PaymentService) ScheduleService {
+	return &scheduleService{store: store, payments: payments}
+}
+
+// CancelPayment cancels a scheduled payment of the caller's organisation before it is released
+func (s *scheduleService) CancelPayment(ctx context.Context, id uuid.UUID) (Payment, error) {
+	if _, err := checkPermission(ctx, PermissionWritePayments); err != nil {
+		return Payment{}, err
+	}
+	if _, err := s.payments.GetPayment(ctx, id.String()); err != nil {
+		return Payment{}, err
+	}
+	cancelled, err := s.store.CancelPayment(ctx, id)
+	if err != nil {
+		return Payment{}, err
+	}
+	payment, err := s.payments.GetPayment(ctx, id.String())
+	if err != nil {
+		return Payment{}, err
+	}
+	if !cancelled {
+		return Payment{}, StatusError{Status: http.StatusConflict, Kind: KindConflict, Message: "err: the payment is " + payment.Status + ", only scheduled payments can be cancelled"}
+	}
+	return payment, nil
+}
+
+// CancelPaymentRequest is the request type used to cancel a scheduled payment
+type CancelPaymentRequest struct {
+	PaymentID uuid.UUID
+}
+
+// MakeCancelPaymentEndpoint is an endpoint constructor that takes a service and constructs individual endpoints for the CancelPayment method
+func MakeCancelPaymentEndpoint(svc ScheduleService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CancelPaymentRequest)
+		v, err := svc.CancelPayment(ctx, req.PaymentID)
+		if err != nil {
+			return nil, newStatusError("err: Could not cancel payment \n"+err.Error(), err)
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,187 @@
+package paymentsapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryScheduleStore is a ScheduleStore changing the payments of a map shared with the other memory stores, a
+// transaction holds the lock of the whole store
+type memoryScheduleStore struct {
+	mu       sync.Mutex
+	payments map[uuid.UUID]Payment
+}
+
+func (s *memoryScheduleStore) DueScheduledPayments(day Date) ([]Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var payments []Payment
+	for _, p := range s.payments {
+		if p.Status == PaymentStatusScheduled && !p.Attributes.ProcessingDate.After(day.Time) {
+			payments = append(payments, p)
+		}
+	}
+	return payments, nil
+}
+
+func (s *memoryScheduleStore) setStatus(id uuid.UUID, status string) bool {
+	p := s.payments[id]
+	if p.Status != PaymentStatusScheduled {
+		return false
+	}
+	p.Status = status
+	s.payments[id] = p
+	return true
+}
+
+func (s *memoryScheduleStore) ReleasePayment(_ context.Context, id uuid.UUID) (bool, error) {
+	return s.setStatus(id, PaymentStatusAccepted), nil
+}
+
+func (s *memoryScheduleStore) CancelPayment(_ context.Context, id uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setStatus(id, PaymentStatusCancelled), nil
+}
+
+func (s *memoryScheduleStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(ctx)
+}
+
+// scheduledPayment returns a payment with the status, processed on day
+func scheduledPayment(status, day string) Payment {
+	p := isoPayment()
+	p.Status, p.Attributes.ProcessingDate = status, mustDate(day)
+	return p
+}
+
+func TestScheduledStatus(t *testing.T) {
+	now := time.Date(2019, 4, 3, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60))
+	assert.Equal(t, PaymentStatusScheduled, scheduledStatus(scheduledPayment(PaymentStatusAccepted, "2019-04-05"), now))
+	// the days are the days of UTC
+	assert.Equal(t, PaymentStatusAccepted, scheduledStatus(scheduledPayment(PaymentStatusAccepted, "2019-04-04"), now))
+	assert.Equal(t, PaymentStatusAccepted, scheduledStatus(scheduledPayment(PaymentStatusAccepted, "2019-04-01"), now))
+	assert.Equal(t, PaymentStatusPendingApproval, scheduledStatus(scheduledPayment(PaymentStatusPendingApproval, "2019-04-05"), now))
+	assert.Equal(t, PaymentStatusAccepted, scheduledStatus(scheduledPayment(PaymentStatusScheduled, "2019-04-03"), now))
+	assert.Equal(t, PaymentStatusCancelled, scheduledStatus(scheduledPayment(PaymentStatusCancelled, "2019-04-05"), now))
+}
+
+func TestPaymentScheduling(t *testing.T) {
+	payments := newMemoryPaymentService()
+	mw := NewPaymentScheduling(payments).(*schedulingMiddleware)
+	mw.now = func() time.Time { return time.Date(2019, 4, 3, 10, 0, 0, 0, time.UTC) }
+	ctx := context.Background()
+
+	later, err := mw.CreatePayment(ctx, scheduledPayment("", "2019-04-10"))
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusScheduled, payments.payments[later.PaymentID].Status)
+	today, _ := mw.CreatePayment(ctx, scheduledPayment("", "2019-04-03"))
+	assert.Equal(t, PaymentStatusAccepted, payments.payments[today.PaymentID].Status)
+
+	// moving the processing date reschedules the payment
+	_, err = mw.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: later.PaymentID.String(), Payment: scheduledPayment(PaymentStatusAccepted, "2019-04-02")})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusAccepted, payments.payments[later.PaymentID].Status)
+	// without the approval layer the status is the stored one
+	_, err = mw.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: today.PaymentID.String(), Payment: scheduledPayment("", "2019-05-01")})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusScheduled, payments.payments[today.PaymentID].Status)
+
+	cancelled := scheduledPayment(PaymentStatusCancelled, "2019-05-01")
+	payments.payments[cancelled.ID] = cancelled
+	_, err = mw.UpdatePayment(ctx, UpdatePaymentRequest{PaymentID: cancelled.ID.String(), Payment: scheduledPayment("", "2019-05-02")})
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+	assert.Equal(t, "2019-05-01", payments.payments[cancelled.ID].Attributes.ProcessingDate.String())
+}
+
+func TestReleaseDuePayments(t *testing.T) {
+	missed := scheduledPayment(PaymentStatusScheduled, "2019-04-01")
+	due := scheduledPayment(PaymentStatusScheduled, "2019-04-03")
+	later := scheduledPayment(PaymentStatusScheduled, "2019-04-04")
+	cancelled := scheduledPayment(PaymentStatusCancelled, "2019-04-02")
+	ledger := newMemoryLedgerStore(missed, due, later, cancelled)
+	store := NewScheduleLedger(&memoryScheduleStore{payments: ledger.payments}, ledger)
+	now := func() time.Time { return time.Date(2019, 4, 3, 6, 0, 0, 0, time.UTC) }
+
+	// two instances share the due payments, a payment is released once
+	var wg sync.WaitGroup
+	released := make([]int, 2)
+	for i := range released {
+		s := NewScheduler(store, log.NewNopLogger())
+		s.now = now
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			released[i] = s.ReleaseDuePayments()
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 2, released[0]+released[1])
+	assert.Equal(t, PaymentStatusAccepted, ledger.payments[missed.ID].Status)
+	assert.Equal(t, PaymentStatusAccepted, ledger.payments[due.ID].Status)
+	assert.Equal(t, PaymentStatusScheduled, ledger.payments[later.ID].Status)
+	assert.Equal(t, PaymentStatusCancelled, ledger.payments[cancelled.ID].Status)
+
+	// the released payments are posted as created, by the scheduler
+	postings, _ := ledger.ListPostings(context.Background(), due.OrganisationID, due.ID, "")
+	assert.NotEmpty(t, postings)
+	for _, p := range postings {
+		assert.Equal(t, LedgerEventCreated, p.Event)
+		assert.Equal(t, schedulerRequestID, p.RequestID)
+	}
+	postings, _ = ledger.ListPostings(context.Background(), later.OrganisationID, later.ID, "")
+	assert.Empty(t, postings)
+
+	s := NewScheduler(store, log.NewNopLogger())
+	s.now = now
+	assert.Equal(t, 0, s.ReleaseDuePayments())
+}
+
+func TestCancelPayment(t *testing.T) {
+	p := scheduledPayment(PaymentStatusScheduled, "2019-04-10")
+	payments := newMemoryPaymentService(p)
+	svc := NewScheduleService(&memoryScheduleStore{payments: payments.payments}, payments)
+	ctx := roleContext(p.OrganisationID, "ops", RoleCreator)
+
+	_, err := svc.CancelPayment(roleContext(p.OrganisationID, "viewer", RoleViewer), p.ID)
+	assert.Equal(t, ErrForbidden, err)
+	cancelled, err := svc.CancelPayment(ctx, p.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentStatusCancelled, cancelled.Status)
+	_, err = svc.CancelPayment(ctx, p.ID)
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+	assert.Contains(t, err.Error(), "the payment is cancelled, only scheduled payments can be cancelled")
+	_, err = svc.CancelPayment(ctx, uuid.Must(uuid.NewV4()))
+	assert.Error(t, err)
+}
+
+func TestCancelPaymentHTTP(t *testing.T) {
+	p := scheduledPayment(PaymentStatusScheduled, "2019-04-10")
+	payments := newMemoryPaymentService(p)
+	router := mux.NewRouter()
+	RegisterScheduleRoutes(router, NewScheduleService(&memoryScheduleStore{payments: payments.payments}, payments))
+	post := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", url, nil).WithContext(roleContext(p.OrganisationID, "ops", RoleCreator)))
+		return rec
+	}
+
+	rec := post("/v1/payments/" + p.ID.String() + "/cancel")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"status":"cancelled"`)
+	rec = post("/v1/payments/" + p.ID.String() + "/cancel")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = post("/v1/payments/x/cancel")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
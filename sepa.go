@@ -0,0 +1,170 @@
+package paymentsapi
+
+import (
+	"encoding/xml"
+	"math/big"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// FormatSEPA is the pain.001.001.09 message of the SEPA Credit Transfer scheme, with the payments grouped by debtor
+// account and execution date
+const FormatSEPA = "sepa"
+
+// SEPAPaymentScheme is the payment_scheme of the payments sent as SEPA Credit Transfers
+const SEPAPaymentScheme = "SEPA"
+
+// sepaMaxAmount is the largest amount of a SEPA Credit Transfer
+var sepaMaxAmount = big.NewRat(99999999999, 100)
+
+// isSEPAPayment tells the payments sent as SEPA Credit Transfers, the payments of the other schemes are left out of
+// the SEPA files
+func isSEPAPayment(p Payment) bool {
+	return p.Attributes.PaymentScheme == SEPAPaymentScheme
+}
+
+// sepaText transliterates a text to the Latin character set of the SEPA schemes, which is the SWIFT X set
+func sepaText(s string) string {
+	return swiftCharset(s)
+}
+
+// sepaAgent returns the agent of a bank, the banks without a BIC are not provided as the IBAN is enough
+func sepaAgent(bankID, bankIDCode string) *isoAgent {
+	if bankIDCode == isoBankIDCodeBIC && bankID != "" {
+		return &isoAgent{FinInstnID: isoFinancialInstitutionID{BICFI: bankID}}
+	}
+	return nil
+}
+
+// sepaParty returns the party with its name and at most two address lines, transliterated
+func sepaParty(name, address string) *isoParty {
+	party := isoPartyOf(sepaText(name), sepaText(address))
+	return &party
+}
+
+// checkSEPA collects the reasons the payment cannot be sent as a SEPA Credit Transfer
+func checkSEPA(c *isoChecker, path string, p Payment) {
+	a := p.Attributes
+	c.check(p.Status != PaymentStatusPendingApproval, path+"/status", "the payment is pending approval")
+	c.check(a.PaymentType == "Credit", path+"/payment_type", "must be Credit")
+	c.check(a.Currency == "EUR", path+"/currency", "must be EUR")
+	amount, ok := new(big.Rat).SetString(a.Amount)
+	cents := ok && new(big.Rat).Mul(amount, big.NewRat(100, 1)).IsInt()
+	c.check(cents && amount.Sign() > 0 && amount.Cmp(sepaMaxAmount) <= 0, path+"/amount", "must be between 0.01 and 999999999.99 with at most 2 decimals")
+	c.check(a.DebtorParty.AccountNumberCode == isoAccountNumberCodeIBAN && isoIBANPattern.MatchString(a.DebtorParty.AccountNumber), path+"/debtor_party/account_number", "must be an IBAN")
+	c.check(a.BeneficiaryParty.AccountNumberCode == isoAccountNumberCodeIBAN && isoIBANPattern.MatchString(a.BeneficiaryParty.AccountNumber), path+"/beneficiary_party/account_number", "must be an IBAN")
+	if a.DebtorParty.BankIDCode == isoBankIDCodeBIC {
+		c.pattern(path+"/debtor_party/bank_id", a.DebtorParty.BankID, isoBICPattern, "is not a BIC")
+	}
+	if a.BeneficiaryParty.BankIDCode == isoBankIDCodeBIC {
+		c.pattern(path+"/beneficiary_party/bank_id", a.BeneficiaryParty.BankID, isoBICPattern, "is not a BIC")
+	}
+	// the charges are shared following the service level, the other bearers are not allowed
+	c.oneOf(path+"/charges_information/bearer_code", a.ChargesInformation.BearerCode, "SLEV", "SHAR")
+	c.check(a.Forex.OriginalCurrency == "" || a.Forex.OriginalCurrency == "EUR", path+"/fx", "SEPA transfers are not converted")
+	c.check(!a.ProcessingDate.IsZero(), path+"/processing_date", "is required")
+	c.check(utf8.RuneCountInString(a.DebtorParty.Name) <= 70, path+"/debtor_party/name", "is longer than 70 characters")
+	c.check(utf8.RuneCountInString(a.BeneficiaryParty.Name) <= 70, path+"/beneficiary_party/name", "is longer than 70 characters")
+	c.check(len(wrapWords(a.DebtorParty.Address, 70)) <= 2, path+"/debtor_party/address", "does not fit in 2 lines of 70 characters")
+	c.check(len(wrapWords(a.BeneficiaryParty.Address, 70)) <= 2, path+"/beneficiary_party/address", "does not fit in 2 lines of 70 characters")
+	c.text(path+"/end_to_end_reference", a.EndToEndReference, 35, true)
+	c.check(utf8.RuneCountInString(sepaRemittance(a)) <= 140, path+"/reference", "the references are longer than 140 characters")
+}
+
+// sepaRemittance returns the single unstructured remittance information SEPA allows, the reference followed by the
+// numeric reference
+func sepaRemittance(a Attributes) string {
+	switch {
+	case a.Reference == "":
+		return a.NumericReference
+	case a.NumericReference == "":
+		return a.Reference
+	}
+	return a.Reference + " " + a.NumericReference
+}
+
+// exportSEPA renders the payments as a SEPA Credit Transfer initiation. The payments of a debtor account executed on
+// the same day share a payment information block, and the payments breaking the rules of the scheme are reported
+// rather than left out
+func exportSEPA(payments []Payment) ([]byte, error) {
+	if len(payments) == 0 {
+		return nil, errNothingToExport
+	}
+	c := &isoChecker{}
+	for i, p := range payments {
+		checkSEPA(c, "payment["+strconv.Itoa(i)+"]", p)
+	}
+	if len(c.problems) > 0 {
+		return nil, exportError(FormatSEPA, c.problems)
+	}
+
+	msgID, _ := uuid.NewV4()
+	doc := pain001Document{}
+	index := map[string]int{}
+	var amounts []string
+	for _, p := range payments {
+		a := p.Attributes
+		key := a.DebtorParty.AccountNumber + " " + a.ProcessingDate.String()
+		i, ok := index[key]
+		if !ok {
+			piID, _ := uuid.NewV4()
+			debtorAgent := sepaAgent(a.DebtorParty.BankID, a.DebtorParty.BankIDCode)
+			if debtorAgent == nil {
+				debtorAgent = &isoAgent{FinInstnID: isoFinancialInstitutionID{Othr: &isoGenericID{ID: "NOTPROVIDED"}}}
+			}
+			i = len(doc.Initiation.PmtInf)
+			index[key] = i
+			doc.Initiation.PmtInf = append(doc.Initiation.PmtInf, pain001PaymentInformation{
+				PmtInfID:    isoCompactID(piID),
+				PmtMtd:      "TRF",
+				PmtTpInf:    &isoPaymentType{SvcLvl: []isoCode{{Cd: "SEPA"}}},
+				ReqdExctnDt: isoDate{Dt: a.ProcessingDate.String()},
+				Dbtr:        sepaParty(a.DebtorParty.Name, a.DebtorParty.Address),
+				DbtrAcct:    &isoAccount{ID: isoAccountID{IBAN: a.DebtorParty.AccountNumber}},
+				DbtrAgt:     debtorAgent,
+				ChrgBr:      "SLEV",
+			})
+		}
+		tx := pain001Transaction{
+			PmtID:    pain001PaymentID{InstrID: sepaText(a.PayID), EndToEndID: sepaText(a.EndToEndReference)},
+			Amt:      pain001Amount{InstdAmt: &isoAmount{Ccy: a.Currency, Value: a.Amount}},
+			CdtrAgt:  sepaAgent(a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode),
+			Cdtr:     sepaParty(a.BeneficiaryParty.Name, a.BeneficiaryParty.Address),
+			CdtrAcct: &isoAccount{ID: isoAccountID{IBAN: a.BeneficiaryParty.AccountNumber}},
+		}
+		if r := sepaRemittance(a); r != "" {
+			tx.RmtInf = &isoRemittance{Ustrd: []string{sepaText(r)}}
+		}
+		pi := &doc.Initiation.PmtInf[i]
+		pi.CdtTrfTxInf = append(pi.CdtTrfTxInf, tx)
+		amounts = append(amounts, a.Amount)
+	}
+	for i := range doc.Initiation.PmtInf {
+		pi := &doc.Initiation.PmtInf[i]
+		var piAmounts []string
+		for _, tx := range pi.CdtTrfTxInf {
+			piAmounts = append(piAmounts, tx.Amt.InstdAmt.Value)
+		}
+		pi.NbOfTxs, pi.CtrlSum = strconv.Itoa(len(pi.CdtTrfTxInf)), isoSum(piAmounts...)
+	}
+	doc.Initiation.GrpHdr = pain001GroupHeader{
+		MsgID:   isoCompactID(msgID),
+		CreDtTm: time.Now().UTC().Format(time.RFC3339),
+		NbOfTxs: strconv.Itoa(len(payments)),
+		CtrlSum: isoSum(amounts...),
+		InitgPty: isoParty{ID: &isoPartyID{OrgID: isoOrganisationID{Othr: []isoGenericID{
+			{ID: isoCompactID(payments[0].OrganisationID)},
+		}}}},
+	}
+	if problems := doc.check(); len(problems) > 0 {
+		return nil, exportError(FormatSEPA, problems)
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
@@ -0,0 +1,105 @@
+package paymentsapi
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// sepaPayment returns a SEPA credit transfer from the debtor's IBAN to a German IBAN
+func sepaPayment(amount, debtorIBAN, date string) Payment {
+	p := isoPayment()
+	a := &p.Attributes
+	a.PaymentScheme, a.Currency, a.Amount, a.ProcessingDate = SEPAPaymentScheme, "EUR", amount, mustDate(date)
+	a.DebtorParty.AccountNumber = debtorIBAN
+	a.BeneficiaryParty.AccountNumber, a.BeneficiaryParty.AccountNumberCode = "DE89370400440532013000", "IBAN"
+	a.BeneficiaryParty.BankID, a.BeneficiaryParty.BankIDCode = "COBADEFFXXX", "SWBIC"
+	a.BeneficiaryParty.Name = "Jürgen Müller & Söhne"
+	a.ChargesInformation.BearerCode = "SLEV"
+	a.Forex = Forex{}
+	return p
+}
+
+func TestExportSEPA(t *testing.T) {
+	payments := []Payment{
+		sepaPayment("100.21", "GB29NWBK60161331926819", "2017-01-18"),
+		sepaPayment("20", "GB94BARC10201530093459", "2017-01-18"),
+		sepaPayment("0.79", "GB29NWBK60161331926819", "2017-01-18"),
+		sepaPayment("5.50", "GB29NWBK60161331926819", "2017-01-19"),
+	}
+	payments[1].Attributes.DebtorParty.BankIDCode = "GBDSC"
+	data, err := exportSEPA(payments)
+	assert.NoError(t, err)
+	doc := pain001Document{}
+	assert.NoError(t, xml.Unmarshal(data, &doc))
+	assert.Empty(t, doc.check())
+
+	h := doc.Initiation.GrpHdr
+	assert.Equal(t, "4", h.NbOfTxs)
+	assert.Equal(t, "126.5", h.CtrlSum)
+	// the payments are grouped by debtor account and execution date, in the order they come
+	pis := doc.Initiation.PmtInf
+	if assert.Len(t, pis, 3) {
+		assert.Equal(t, "2", pis[0].NbOfTxs)
+		assert.Equal(t, "101", pis[0].CtrlSum)
+		assert.Equal(t, "2017-01-18", pis[0].ReqdExctnDt.Dt)
+		assert.Equal(t, "GB29NWBK60161331926819", pis[0].DbtrAcct.ID.IBAN)
+		assert.Equal(t, "NWBKGB2L", pis[0].DbtrAgt.FinInstnID.BICFI)
+		assert.Equal(t, "SEPA", pis[0].PmtTpInf.SvcLvl[0].Cd)
+		assert.Equal(t, "SLEV", pis[0].ChrgBr)
+		assert.Equal(t, "NOTPROVIDED", pis[1].DbtrAgt.FinInstnID.Othr.ID)
+		assert.Equal(t, "1", pis[2].NbOfTxs)
+		assert.Equal(t, "5.5", pis[2].CtrlSum)
+		assert.Equal(t, "2017-01-19", pis[2].ReqdExctnDt.Dt)
+	}
+	tx := pis[0].CdtTrfTxInf[0]
+	assert.Equal(t, "Jurgen Muller + Sohne", tx.Cdtr.Nm)
+	assert.Equal(t, "DE89370400440532013000", tx.CdtrAcct.ID.IBAN)
+	assert.Equal(t, "COBADEFFXXX", tx.CdtrAgt.FinInstnID.BICFI)
+	assert.Equal(t, []string{"PAYmen 10223453"}, tx.RmtInf.Ustrd)
+	assert.Empty(t, tx.ChrgBr)
+	assert.Nil(t, tx.IntrmyAgt1)
+	assert.Nil(t, tx.Purp)
+}
+
+func TestExportSEPAChecks(t *testing.T) {
+	pounds := sepaPayment("10", "GB29NWBK60161331926819", "2017-01-18")
+	pounds.Attributes.Currency = "GBP"
+	bban := sepaPayment("10.001", "GB29NWBK60161331926819", "2017-01-18")
+	bban.Attributes.BeneficiaryParty.AccountNumber, bban.Attributes.BeneficiaryParty.AccountNumberCode = "31926819", "BBAN"
+	bban.Attributes.ChargesInformation.BearerCode = "DEBT"
+	converted := sepaPayment("10", "GB29NWBK60161331926819", "2017-01-18")
+	converted.Attributes.Forex = Forex{OriginalAmount: "8.50", OriginalCurrency: "GBP", ExchangeRate: "1.1765"}
+	converted.Status = PaymentStatusPendingApproval
+	_, err := exportSEPA([]Payment{pounds, bban, converted})
+	assert.Equal(t, KindInvalidPayload, err.(StatusError).Kind)
+	for _, problem := range []string{
+		"payment[0]/currency: must be EUR",
+		"payment[1]/amount: must be between 0.01 and 999999999.99 with at most 2 decimals",
+		"payment[1]/beneficiary_party/account_number: must be an IBAN",
+		"payment[1]/charges_information/bearer_code: must be one of SLEV, SHAR",
+		"payment[2]/fx: SEPA transfers are not converted",
+		"payment[2]/status: the payment is pending approval",
+	} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestExportSEPAHTTP(t *testing.T) {
+	other := sepaPayment("5", "GB29NWBK60161331926819", "2017-01-18")
+	other.Attributes.PaymentScheme = "FPS"
+	mockService := &MockPaymentService{}
+	mockService.On("GetListPayments", mock.Anything).Return([]Payment{sepaPayment("10", "GB29NWBK60161331926819", "2017-01-18"), other}, nil)
+	router := NewHTTPTransport(mockService)
+
+	// the payments of other schemes are left out
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/payments?format=sepa", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<NbOfTxs>1</NbOfTxs>")
+	assert.Contains(t, rec.Body.String(), "<CtrlSum>10</CtrlSum>")
+}
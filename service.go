@@ -1,6 +1,7 @@
 package paymentsapi
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -16,11 +17,11 @@ import (
 // PaymentService can retrieve a list of all submitted Payments (GetListPayment), get a payment based on a payment ID (GetPayement), create a payment based on a json file and return its ID,
 // update a payment based on the original payment ID and a new payment json file and delete a payment (softdelete - DeletedAt will have a timestamp but the entry will still be available)
 type PaymentService interface {
-	GetPayment(id string) (Payment, error)
-	GetListPayments() ([]Payment, error)
-	CreatePayment(p Payment) (CreatePaymentResponse, error)
-	UpdatePayment(p UpdatePaymentRequest) (UpdatePaymentResponse, error)
-	DeletePayment(id uuid.UUID) (*time.Time, error)
+	GetPayment(ctx context.Context, id string) (Payment, error)
+	GetListPayments(ctx context.Context) ([]Payment, error)
+	CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error)
+	UpdatePayment(ctx context.Context, p UpdatePaymentRequest) (UpdatePaymentResponse, error)
+	DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error)
 }
 
 type paymentService struct {
@@ -42,11 +43,23 @@ func NewDBConnection(file string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewDBConnectionFromConfig(dbConfig)
+}
+
+// NewDBConnectionFromConfig connects to the Postgresql DB and sizes the connection pool with the settings
+func NewDBConnectionFromConfig(dbConfig config.DBConfig) (*gorm.DB, error) {
 	cnnction := parseCnctionParams(dbConfig.Host, dbConfig.Port, dbConfig.DBName, dbConfig.User, dbConfig.Password, dbConfig.Sslmode, dbConfig.Timeout)
 	db, err := gorm.Open(dbConfig.Driver, cnnction)
 	if err != nil {
 		return nil, err
 	}
+	if dbConfig.MaxOpenConns > 0 {
+		db.DB().SetMaxOpenConns(dbConfig.MaxOpenConns)
+	}
+	if dbConfig.MaxIdleConns > 0 {
+		db.DB().SetMaxIdleConns(dbConfig.MaxIdleConns)
+	}
+	db.DB().SetConnMaxLifetime(dbConfig.ConnMaxLifetime)
 	return db, nil
 }
 
@@ -57,7 +70,20 @@ func parseCnctionParams(host string, port int, name string, user string, passwor
 
 // MigrateDB initializes db schema with needed tables
 func MigrateDB(db *gorm.DB) {
-	db.AutoMigrate(&Payment{}, &Attributes{}, &BeneficiaryParty{}, &DebtorParty{}, &SponsorParty{}, &ChargesInformation{}, &Charge{}, &Forex{})
+	db.AutoMigrate(models()...)
+}
+
+// models returns the models stored in the database
+func models() []interface{} {
+	return []interface{}{&Payment{}, &Attributes{}, &BeneficiaryParty{}, &DebtorParty{}, &SponsorParty{}, &ChargesInformation{}, &Charge{}, &Forex{}, &APIKey{}, &ApprovalPolicy{}, &ApprovalRequest{}, &Approval{}, &QuotaUsage{}, &QuotaAmountUsage{}, &Batch{}, &ImportJob{}, &ImportFile{}, &ImportRowError{}, &PaymentStatusReport{}, &Reconciliation{}, &ReconciliationItem{}, &LedgerPosting{}, &Refund{}, &PaymentReturn{}}
+}
+
+type txContextKey struct{}
+
+// NewContextWithTx returns a copy of ctx carrying a database transaction, the payment service runs its queries in the
+// transaction instead of on its own connection
+func NewContextWithTx(ctx context.Context, tx *gorm.DB) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
 }
 
 // CloseDB closes the connection to the database
@@ -68,9 +94,10 @@ func CloseDB(db *gorm.DB) {
 }
 
 // GetPayment retrieves (GET) and displays a payment based on a provided ID
-func (r *paymentService) GetPayment(id string) (Payment, error) {
+func (r *paymentService) GetPayment(ctx context.Context, id string) (Payment, error) {
+	db := withContext(r.db, ctx)
 	p := Payment{}
-	err := r.db.Model(&p).Where("id = ?", id).Preload("Attributes.BeneficiaryParty").Preload("Attributes.ChargesInformation.SenderCharges").Preload("Attributes.DebtorParty").Preload("Attributes.Forex").Preload("Attributes.SponsorParty").Find(&p).Error
+	err := preloadAttributes(db.Model(&p).Where("id = ?", id)).Find(&p).Error
 	//err := r.db.Debug().Model(&p).Where("id = ?", id).Preload("Attributes.BeneficiaryParty").Preload("Attributes.ChargesInformation.SenderCharges").Preload("Attributes.DebtorParty").Preload("Attributes.Forex").Preload("Attributes.SponsorParty").Find(&p).Error
 	if err != nil {
 		return p, err
@@ -79,10 +106,15 @@ func (r *paymentService) GetPayment(id string) (Payment, error) {
 }
 
 // CreatePayment creates a payment (POST) based on a provided payment json file that has all the right information
-func (r *paymentService) CreatePayment(p Payment) (CreatePaymentResponse, error) {
+func (r *paymentService) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
+	db := withContext(r.db, ctx)
 	paymentID, _ := uuid.NewV4()
 	p.ID = paymentID
-	err := r.db.Save(&p).Error
+	if p.Status == "" {
+		p.Status = PaymentStatusAccepted
+	}
+	p.SchemeStatus, p.StatusReason = "", ""
+	err := db.Save(&p).Error
 	//err = r.db.Debug().Save(&p).Error
 	if err != nil {
 		e := CreatePaymentResponse{}
@@ -93,7 +125,8 @@ func (r *paymentService) CreatePayment(p Payment) (CreatePaymentResponse, error)
 }
 
 // UpdatePayment updates (PUT) an already existing payment based on the original payment's ID and and a provided payment json file
-func (r *paymentService) UpdatePayment(req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+func (r *paymentService) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+	db := withContext(r.db, ctx)
 	pa := &Payment{}
 	id, err := uuid.FromString(req.PaymentID)
 	if err != nil {
@@ -106,12 +139,20 @@ func (r *paymentService) UpdatePayment(req UpdatePaymentRequest) (UpdatePaymentR
 	p := req.Payment
 	p.ID = id
 	//if err := r.db.Debug().Model(&p).Where("id = ?", id).Find(&pa).Error; err != nil {
-	if err := r.db.Model(&p).Where("id = ?", id).Find(&pa).Error; err != nil {
+	if err := db.Model(&p).Where("id = ?", id).Find(&pa).Error; err != nil {
 		e := UpdatePaymentResponse{}
 		return e, err
 	}
 
-	err = r.db.Model(&p).Save(&p).Error
+	if err := checkPaymentUpdatable(pa.Status); err != nil {
+		return UpdatePaymentResponse{}, err
+	}
+	// the status is kept unless a layer above decided otherwise
+	if p.Status == "" {
+		p.Status = pa.Status
+	}
+	p.SchemeStatus, p.StatusReason = pa.SchemeStatus, pa.StatusReason
+	err = db.Model(&p).Save(&p).Error
 	//err = r.db.Debug().Model(&p).Save(&p).Error
 	if err != nil {
 		e := UpdatePaymentResponse{}
@@ -124,7 +165,8 @@ func (r *paymentService) UpdatePayment(req UpdatePaymentRequest) (UpdatePaymentR
 // DeletePayment soft deletes (DELETE) an existing payment entry based on a provided payment ID.
 // A soft delete is the act of populating the DeletedAt field from the Payments table with a timestamp
 // which tracks the time the opreation was performed and excludes the entry from other operations
-func (r *paymentService) DeletePayment(id uuid.UUID) (*time.Time, error) {
+func (r *paymentService) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	db := withContext(r.db, ctx)
 	p := &Payment{}
 	delTime := new(time.Time)
 	zeroUUID := "1"
@@ -134,32 +176,39 @@ func (r *paymentService) DeletePayment(id uuid.UUID) (*time.Time, error) {
 		return delTime, ErrNow
 	}
 	//if err := r.db.Debug().Model(p).Where("id = ?", id).Find(p).Error; err != nil {
-	if err := r.db.Model(p).Where("id = ?", id).Find(p).Error; err != nil {
+	if err := db.Model(p).Where("id = ?", id).Find(p).Error; err != nil {
 		return delTime, err
 	}
 	// Delete payment by ID `Soft Delete`
 	//if err := r.db.Debug().Model(p).Where("id = ?", id).Delete(p).Error; err != nil {
-	if err := r.db.Model(p).Where("id = ?", id).Delete(p).Error; err != nil {
+	if err := db.Model(p).Where("id = ?", id).Delete(p).Error; err != nil {
 		return delTime, err
 	}
 	//if err := r.db.Debug().Unscoped().Where("id = ?", id).Find(p).Error; err != nil {
-	if err := r.db.Unscoped().Where("id = ?", id).Find(p).Error; err != nil {
+	if err := db.Unscoped().Where("id = ?", id).Find(p).Error; err != nil {
 		return delTime, err
 	}
 	delTime = p.DeletedAt
 	return delTime, nil
 }
 
-// GetListOfPayments retrieves a list of all the committed payments
-func (r *paymentService) GetListPayments() ([]Payment, error) {
+// GetListOfPayments retrieves a list of the committed payments of the caller's organisation, or of every organisation
+// when ctx carries no principal. The attributes are preloaded with a query per association for the whole list
+func (r *paymentService) GetListPayments(ctx context.Context) ([]Payment, error) {
+	db := withContext(r.db, ctx)
+	if p, ok := PrincipalFromContext(ctx); ok {
+		db = db.Where("organisation_id = ?", p.OrganisationID)
+	}
 	var payments []Payment
-	err := r.db.Find(&payments).Error
+	err := preloadAttributes(db).Find(&payments).Error
 	//err := r.db.Debug().Find(&payments).Error
 	if err != nil {
 		return nil, err
 	}
-	for i, p := range payments {
-		payments[i], _ = r.GetPayment(p.ID.String())
-	}
 	return payments, nil
 }
+
+// preloadAttributes loads the attributes of the payments along with the parties, the charges and the forex
+func preloadAttributes(db *gorm.DB) *gorm.DB {
+	return db.Preload("Attributes.BeneficiaryParty").Preload("Attributes.ChargesInformation.SenderCharges").Preload("Attributes.DebtorParty").Preload("Attributes.Forex").Preload("Attributes.SponsorParty")
+}
@@ -1,8 +1,10 @@
 package paymentsapi
 
 import (
+	"context"
 	"errors"
 	"log"
+	"net/http"
 	"testing"
 	"time"
 
@@ -90,7 +92,7 @@ func mockNewPaymentResponse(id string) []map[string]interface{} {
 			PaymentPurpose:       "course",
 			PaymentScheme:        "FPS",
 			PaymentType:          "Credit",
-			ProcessingDate:       "2017-01-18",
+			ProcessingDate:       mustDate("2017-01-18"),
 			Reference:            "PAYmen",
 			SchemePaymentSubType: "InternetBanking",
 			SchemePaymentType:    "Immediate Pay",
@@ -173,7 +175,7 @@ func mockNewPaymentListResponse() []map[string]interface{} {
 			PaymentPurpose:       "course",
 			PaymentScheme:        "FPS",
 			PaymentType:          "Credit",
-			ProcessingDate:       "2017-01-18",
+			ProcessingDate:       mustDate("2017-01-18"),
 			Reference:            "PAYmen",
 			SchemePaymentSubType: "InternetBanking",
 			SchemePaymentType:    "Immediate Pay",
@@ -241,7 +243,7 @@ func mockNewPaymentListResponse() []map[string]interface{} {
 				PaymentPurpose:       "course",
 				PaymentScheme:        "FPS",
 				PaymentType:          "Credit",
-				ProcessingDate:       "2017-01-18",
+				ProcessingDate:       mustDate("2017-01-18"),
 				Reference:            "PAYmen",
 				SchemePaymentSubType: "InternetBanking",
 				SchemePaymentType:    "Immediate Pay",
@@ -289,7 +291,7 @@ func TestGetPayment(t *testing.T) {
 	})
 
 	s := NewPaymentService(db)
-	p, err := s.GetPayment(id)
+	p, err := s.GetPayment(context.Background(), id)
 
 	assert.NotNil(t, s)
 	assert.NotNil(t, p)
@@ -308,7 +310,7 @@ func TestCreatePayment(t *testing.T) {
 
 	mocket.Catcher.Reset().NewMock().WithQuery("INSERT INTO \"payments\"")
 	s := NewPaymentService(db)
-	rid, err := s.CreatePayment(p)
+	rid, err := s.CreatePayment(context.Background(), p)
 
 	assert.NoError(t, err)
 	assert.NotEmpty(t, rid)
@@ -343,11 +345,35 @@ func TestUpdatePayment(t *testing.T) {
 	})
 
 	s := NewPaymentService(db)
-	_, err := s.UpdatePayment(r)
+	_, err := s.UpdatePayment(context.Background(), r)
 
 	assert.NoError(t, err)
 }
 
+func TestUpdateSettledPayment(t *testing.T) {
+	id := "400a75b8-a0aa-4aad-9366-5c609ae390a7"
+	uuid1, _ := uuid.FromString(id)
+	r := UpdatePaymentRequest{
+		PaymentID: id,
+		Payment:   Payment{ID: uuid1},
+	}
+
+	db := setupTests()
+	defer db.Close()
+
+	mocket.Catcher.Reset().Attach([]*mocket.FakeResponse{
+		{
+			Pattern:  "SELECT * FROM \"payments\"",
+			Response: []map[string]interface{}{{"status": PaymentStatusSettled}},
+		},
+	})
+
+	s := NewPaymentService(db)
+	_, err := s.UpdatePayment(context.Background(), r)
+
+	assert.Equal(t, http.StatusConflict, err.(StatusError).Status)
+}
+
 func TestUpdatePaymentBadID(t *testing.T) {
 	id := "1"
 	uuid1, _ := uuid.FromString(id)
@@ -377,7 +403,7 @@ func TestUpdatePaymentBadID(t *testing.T) {
 	})
 
 	s := NewPaymentService(db)
-	_, err := s.UpdatePayment(r)
+	_, err := s.UpdatePayment(context.Background(), r)
 
 	var ErrAcc = errors.New("err: Could not parse UUID to Updateuuid: incorrect UUID length: 1")
 	assert.Equal(t, err, ErrAcc)
@@ -405,7 +431,7 @@ func TestDeletePayment(t *testing.T) {
 	})
 
 	s := NewPaymentService(db)
-	_, err := s.DeletePayment(uuid)
+	_, err := s.DeletePayment(context.Background(), uuid)
 
 	assert.NoError(t, err)
 }
@@ -432,7 +458,7 @@ func TestDeletePaymentBadID(t *testing.T) {
 	})
 
 	s := NewPaymentService(db)
-	_, err := s.DeletePayment(uuid)
+	_, err := s.DeletePayment(context.Background(), uuid)
 	var ErrNow = errors.New("uuid: incorrect")
 	assert.Equal(t, err, ErrNow)
 }
@@ -451,8 +477,27 @@ func TestGetListPayments(t *testing.T) {
 	})
 
 	s := NewPaymentService(db)
-	p, err := s.GetListPayments()
+	p, err := s.GetListPayments(context.Background())
 
 	assert.NotNil(t, p)
 	assert.NoError(t, err)
 }
+
+func TestGetListPaymentsOfOrganisation(t *testing.T) {
+	db := setupTests()
+	defer db.Close()
+
+	// only the query filtering on the caller's organisation finds the payments
+	mocket.Catcher.Reset().Attach([]*mocket.FakeResponse{
+		{
+			Pattern:  "organisation_id = ",
+			Response: mockNewPaymentListResponse(),
+		},
+	})
+
+	s := NewPaymentService(db)
+	org, _ := uuid.NewV4()
+	p, err := s.GetListPayments(NewContextWithPrincipal(context.Background(), Principal{OrganisationID: org}))
+	assert.NoError(t, err)
+	assert.Len(t, p, len(mockNewPaymentListResponse()))
+}
@@ -0,0 +1,166 @@
+package paymentsapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Client certificates asked for by the HTTP server
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSOptions are the settings of the TLS server, see NewServerTLS
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum version accepted, "1.2" (the default) or "1.3"
+	MinVersion string
+	// CipherSuites are the names of the TLS 1.2 cipher suites accepted, the secure suites of Go when empty
+	CipherSuites []string
+	// ClientCAFile holds the PEM certificates of the CAs the client certificates are verified with
+	ClientCAFile string
+	// ClientAuth is ClientAuthNone (the default), ClientAuthOptional or ClientAuthRequire
+	ClientAuth string
+}
+
+// ServerTLS holds the TLS configuration of the HTTP server. The certificate and the client CAs are read again by
+// Reload, the connections opened afterwards use them
+type ServerTLS struct {
+	opts   TLSOptions
+	config *tls.Config
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	// clientCAs is nil when no client CA is configured
+	clientCAs *x509.CertPool
+}
+
+// NewServerTLS checks the options and reads the certificate and the client CAs
+func NewServerTLS(opts TLSOptions) (*ServerTLS, error) {
+	if opts.MinVersion == "" {
+		opts.MinVersion = "1.2"
+	}
+	minVersion, ok := tlsVersions[opts.MinVersion]
+	if !ok {
+		return nil, errors.New("err: unknown TLS version " + opts.MinVersion)
+	}
+	suites, err := cipherSuites(opts.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth := tls.NoClientCert
+	switch opts.ClientAuth {
+	case ClientAuthNone, "":
+	case ClientAuthOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New("err: client certificates can be asked for with " + ClientAuthNone + ", " + ClientAuthOptional + " or " + ClientAuthRequire)
+	}
+	if clientAuth != tls.NoClientCert && opts.ClientCAFile == "" {
+		return nil, errors.New("err: a client CA file is needed to verify the client certificates")
+	}
+
+	s := &ServerTLS{opts: opts}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	s.config = &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+		ClientAuth:   clientAuth,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   minVersion,
+				CipherSuites: suites,
+				ClientAuth:   clientAuth,
+				Certificates: []tls.Certificate{*s.cert},
+				ClientCAs:    s.clientCAs,
+			}, nil
+		},
+	}
+	return s, nil
+}
+
+// cipherSuites returns the IDs of the named cipher suites, the insecure ones are refused
+func cipherSuites(names []string) ([]uint16, error) {
+	ids := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		ids[s.Name] = s.ID
+	}
+	var suites []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := ids[name]
+		if !ok {
+			return nil, errors.New("err: unknown or insecure cipher suite " + name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// Reload reads the certificate and the client CAs again, the previous ones are kept when they cannot be read
+func (s *ServerTLS) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.opts.CertFile, s.opts.KeyFile)
+	if err != nil {
+		return errors.New("err: could not read the TLS certificate: " + err.Error())
+	}
+	var pool *x509.CertPool
+	if s.opts.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(s.opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return errors.New("err: no certificate found in " + s.opts.ClientCAFile)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert, s.clientCAs = &cert, pool
+	return nil
+}
+
+// Config returns the configuration of the HTTP server, serve it with ListenAndServeTLS("", "")
+func (s *ServerTLS) Config() *tls.Config {
+	return s.config
+}
+
+// Files returns the files read by Reload, they should be watched for changes
+func (s *ServerTLS) Files() []string {
+	files := []string{s.opts.CertFile, s.opts.KeyFile}
+	if s.opts.ClientCAFile != "" {
+		files = append(files, s.opts.ClientCAFile)
+	}
+	return files
+}
+
+// Certificate returns the certificate in use, the leaf is parsed
+func (s *ServerTLS) Certificate() (*x509.Certificate, error) {
+	s.mu.RLock()
+	cert := s.cert
+	s.mu.RUnlock()
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
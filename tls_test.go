@@ -0,0 +1,214 @@
+package paymentsapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA is a throwaway certificate authority issuing the certificates of the TLS tests, its files are written to a
+// temporary directory removed by Close
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// File is the path of the PEM certificate of the CA
+	File string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	dir, err := ioutil.TempDir("", "testca")
+	assert.NoError(t, err)
+	ca := &testCA{t: t, dir: dir}
+	ca.cert, ca.key = ca.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	ca.File = ca.write("ca.pem", "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+// issue signs the template with the CA, or self-signs it when the CA is not created yet
+func (ca *testCA) issue(template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.check(err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	ca.check(err)
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	ca.check(err)
+	cert, err := x509.ParseCertificate(der)
+	ca.check(err)
+	return cert, key
+}
+
+func (ca *testCA) write(name, typ string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	ca.check(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+	return path
+}
+
+// Issue writes a certificate for the common name and its key as name.pem and name-key.pem. The certificate is valid
+// for localhost when server is true, and for client authentication otherwise
+func (ca *testCA) Issue(name, commonName string, server bool) (certFile, keyFile string) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	cert, key := ca.issue(template)
+	der, err := x509.MarshalECPrivateKey(key)
+	ca.check(err)
+	return ca.write(name+".pem", "CERTIFICATE", cert.Raw), ca.write(name+"-key.pem", "EC PRIVATE KEY", der)
+}
+
+// ClientConfig returns the TLS configuration of a client trusting the CA, with the client certificate when one is given
+func (ca *testCA) ClientConfig(certFile, keyFile string) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	c := &tls.Config{RootCAs: pool}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		ca.check(err)
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c
+}
+
+// check stops the test when the CA fails
+func (ca *testCA) check(err error) {
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+}
+
+func (ca *testCA) Close() {
+	os.RemoveAll(ca.dir)
+}
+
+// serveTLS starts a test server answering with the common name of the verified client certificate
+func serveTLS(t *testing.T, s *ServerTLS) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	srv.TLS = s.Config()
+	srv.StartTLS()
+	return srv
+}
+
+func TestServerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.Close()
+	certFile, keyFile := ca.Issue("server", "server-1", true)
+	s, err := NewServerTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"})
+	assert.NoError(t, err)
+	srv := serveTLS(t, s)
+	defer srv.Close()
+
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), ca.ClientConfig("", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+	conn.Close()
+
+	client := ca.ClientConfig("", "")
+	client.MaxVersion = tls.VersionTLS12
+	_, err = tls.Dial("tcp", srv.Listener.Addr().String(), client)
+	assert.Error(t, err)
+
+	// the certificate is replaced by Reload
+	ca.Issue("server", "server-2", true)
+	assert.NoError(t, s.Reload())
+	conn, err = tls.Dial("tcp", srv.Listener.Addr().String(), ca.ClientConfig("", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "server-2", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+	cert, err := s.Certificate()
+	assert.NoError(t, err)
+	assert.Equal(t, "server-2", cert.Subject.CommonName)
+
+	// the previous certificate is kept when the new one cannot be read
+	assert.NoError(t, ioutil.WriteFile(certFile, []byte("garbage"), 0600))
+	assert.Error(t, s.Reload())
+	cert, _ = s.Certificate()
+	assert.Equal(t, "server-2", cert.Subject.CommonName)
+}
+
+func TestServerTLSOptions(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.Close()
+	certFile, keyFile := ca.Issue("server", "server", true)
+
+	_, err := NewServerTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.0"})
+	assert.Error(t, err)
+	_, err = NewServerTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}})
+	assert.Error(t, err)
+	_, err = NewServerTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientAuth: ClientAuthRequire})
+	assert.Error(t, err)
+	_, err = NewServerTLS(TLSOptions{CertFile: certFile, KeyFile: "missing.pem"})
+	assert.Error(t, err)
+
+	s, err := NewServerTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", ""}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, s.Config().CipherSuites)
+	assert.Equal(t, []string{certFile, keyFile}, s.Files())
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	defer ca.Close()
+	certFile, keyFile := ca.Issue("server", "server", true)
+	clientCert, clientKey := ca.Issue("client", "acme", false)
+	s, err := NewServerTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.File, ClientAuth: ClientAuthRequire})
+	assert.NoError(t, err)
+	srv := serveTLS(t, s)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.ClientConfig(clientCert, clientKey)}}
+	res, err := client.Get(srv.URL)
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "acme", string(b))
+
+	// a client without a certificate, or with a certificate of another CA, is refused
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: ca.ClientConfig("", "")}}
+	_, err = client.Get(srv.URL)
+	assert.Error(t, err)
+	other := newTestCA(t)
+	defer other.Close()
+	otherCert, otherKey := other.Issue("client", "acme", false)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: ca.ClientConfig(otherCert, otherKey)}}
+	_, err = client.Get(srv.URL)
+	assert.Error(t, err)
+}
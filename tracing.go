@@ -0,0 +1,233 @@
+package paymentsapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/vstoianovici/paymentsapi/tracing"
+)
+
+// The tracing middleware records a span for every operation of the layer it wraps
+
+// tracingMiddleware is the type of the wrapper around the core service and any other functionality layers
+type tracingMiddleware struct {
+	layer string
+	next  PaymentService
+}
+
+// NewTracing returns a new instance of PaymentService that records a span named "<layer>.<method>" around every
+// operation of next. Spans are only recorded for requests traced by the HTTP tracing middleware
+func NewTracing(layer string, next PaymentService) PaymentService {
+	return &tracingMiddleware{
+		layer: layer,
+		next:  next,
+	}
+}
+
+// GetPayment function is implemented for the tracing layer
+func (mw tracingMiddleware) GetPayment(ctx context.Context, id string) (output Payment, err error) {
+	ctx, span := tracing.StartSpan(ctx, mw.layer+".GetPayment", tracing.SpanKindInternal)
+	span.SetAttribute("payment.id", id)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	return mw.next.GetPayment(ctx, id)
+}
+
+// GetListPayments function is implemented for the tracing layer
+func (mw tracingMiddleware) GetListPayments(ctx context.Context) (output []Payment, err error) {
+	ctx, span := tracing.StartSpan(ctx, mw.layer+".GetListPayments", tracing.SpanKindInternal)
+	defer func() {
+		span.SetAttribute("payments.count", len(output))
+		span.SetError(err)
+		span.Finish()
+	}()
+	return mw.next.GetListPayments(ctx)
+}
+
+// CreatePayment function is implemented for the tracing layer
+func (mw tracingMiddleware) CreatePayment(ctx context.Context, p Payment) (output CreatePaymentResponse, err error) {
+	ctx, span := tracing.StartSpan(ctx, mw.layer+".CreatePayment", tracing.SpanKindInternal)
+	defer func() {
+		span.SetAttribute("payment.id", output.PaymentID.String())
+		span.SetError(err)
+		span.Finish()
+	}()
+	return mw.next.CreatePayment(ctx, p)
+}
+
+// UpdatePayment function is implemented for the tracing layer
+func (mw tracingMiddleware) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (output UpdatePaymentResponse, err error) {
+	ctx, span := tracing.StartSpan(ctx, mw.layer+".UpdatePayment", tracing.SpanKindInternal)
+	span.SetAttribute("payment.id", req.PaymentID)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	return mw.next.UpdatePayment(ctx, req)
+}
+
+// DeletePayment function is implemented for the tracing layer
+func (mw tracingMiddleware) DeletePayment(ctx context.Context, id uuid.UUID) (output *time.Time, err error) {
+	ctx, span := tracing.StartSpan(ctx, mw.layer+".DeletePayment", tracing.SpanKindInternal)
+	span.SetAttribute("payment.id", id.String())
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	return mw.next.DeletePayment(ctx, id)
+}
+
+// httpTracing is the HTTP handler starting the trace of every request
+type httpTracing struct {
+	tracer *tracing.Tracer
+	router *mux.Router
+	next   http.Handler
+}
+
+// NewHTTPTracing returns an HTTP handler that starts a server span for every request, continuing the trace of an
+// incoming W3C traceparent header. The traceparent of the span is sent back in the response headers
+func NewHTTPTracing(next http.Handler, router *mux.Router, tracer *tracing.Tracer) http.Handler {
+	return &httpTracing{
+		tracer: tracer,
+		router: router,
+		next:   next,
+	}
+}
+
+func (mw *httpTracing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if sc, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx = tracing.ContextWithRemoteParent(ctx, sc)
+	}
+	route := r.URL.Path
+	var match mux.RouteMatch
+	if mw.router.Match(r, &match) && match.Route != nil {
+		if tpl, err := match.Route.GetPathTemplate(); err == nil {
+			route = tpl
+		}
+	}
+	ctx, span := mw.tracer.Start(ctx, r.Method+" "+route, tracing.SpanKindServer)
+	if span != nil {
+		w.Header().Set("traceparent", span.Context.Traceparent())
+	}
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.route", route)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	mw.next.ServeHTTP(rec, r.WithContext(ctx))
+	span.SetAttribute("http.status_code", rec.status)
+	if rec.status >= http.StatusInternalServerError {
+		span.SetError(errors.New(http.StatusText(rec.status)))
+	}
+	span.Finish()
+}
+
+// tracedDecoder records a span around the decoding of a request
+func tracedDecoder(name string, dec httptransport.DecodeRequestFunc) httptransport.DecodeRequestFunc {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		_, span := tracing.StartSpan(ctx, "decode."+name, tracing.SpanKindInternal)
+		req, err := dec(ctx, r)
+		span.SetError(err)
+		span.Finish()
+		return req, err
+	}
+}
+
+// gormContextKey is the key of the request's context in the values of a *gorm.DB
+const gormContextKey = "paymentsapi:context"
+
+// withContext returns a *gorm.DB carrying ctx, so that the spans of its queries are children of the span of ctx. The
+// transaction carried by ctx is used if there is one
+func withContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	if ctx == nil {
+		return db
+	}
+	if tx, ok := ctx.Value(txContextKey{}).(*gorm.DB); ok {
+		db = tx
+	}
+	return db.Set(gormContextKey, ctx)
+}
+
+// Transactor runs functions in a database transaction
+type Transactor interface {
+	// InTransaction calls fn with a context carrying a database transaction, which is committed unless fn returns
+	// an error
+	InTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// txStore is embedded by the stores of the database to give them their Transactor, their queries run with
+// withContext so that they join the transaction
+type txStore struct {
+	db *gorm.DB
+}
+
+// InTransaction runs fn in a transaction of the database
+func (s *txStore) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(NewContextWithTx(ctx, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// joinTransaction runs fn in the transaction of ctx if there is one, so that its changes are committed or rolled back
+// with the rest, or else in a transaction of its own
+func (s *txStore) joinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txContextKey{}).(*gorm.DB); ok {
+		return fn(ctx)
+	}
+	return s.InTransaction(ctx, fn)
+}
+
+// RegisterDBTracing registers gorm callbacks recording a client span for every query run with a *gorm.DB carrying
+// the context of a traced request
+func RegisterDBTracing(db *gorm.DB) {
+	before := func(operation string) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			v, ok := scope.Get(gormContextKey)
+			if !ok {
+				return
+			}
+			ctx, _ := v.(context.Context)
+			_, span := tracing.StartSpan(ctx, "db."+operation+" "+scope.TableName(), tracing.SpanKindClient)
+			if span != nil {
+				scope.InstanceSet("paymentsapi:span", span)
+			}
+		}
+	}
+	after := func(scope *gorm.Scope) {
+		v, ok := scope.InstanceGet("paymentsapi:span")
+		if !ok {
+			return
+		}
+		span := v.(*tracing.Span)
+		span.SetAttribute("db.system", "postgresql")
+		span.SetAttribute("db.statement", scope.SQL)
+		if scope.HasError() && !gorm.IsRecordNotFoundError(scope.DB().Error) {
+			span.SetError(scope.DB().Error)
+		}
+		span.Finish()
+	}
+	cb := db.Callback()
+	cb.Create().Before("gorm:begin_transaction").Register("tracing:before_create", before("create"))
+	cb.Create().After("gorm:commit_or_rollback_transaction").Register("tracing:after_create", after)
+	cb.Query().Before("gorm:query").Register("tracing:before_query", before("query"))
+	cb.Query().After("gorm:query").Register("tracing:after_query", after)
+	cb.Update().Before("gorm:begin_transaction").Register("tracing:before_update", before("update"))
+	cb.Update().After("gorm:commit_or_rollback_transaction").Register("tracing:after_update", after)
+	cb.Delete().Before("gorm:begin_transaction").Register("tracing:before_delete", before("delete"))
+	cb.Delete().After("gorm:commit_or_rollback_transaction").Register("tracing:after_delete", after)
+	cb.RowQuery().Before("gorm:row_query").Register("tracing:before_row_query", before("row_query"))
+	cb.RowQuery().After("gorm:row_query").Register("tracing:after_row_query", after)
+}
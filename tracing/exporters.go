@@ -0,0 +1,216 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// writerExporter writes every span as a line of JSON
+type writerExporter struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// NewWriterExporter returns an Exporter writing the spans as JSON lines to w, such as os.Stdout or a file
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{w: w}
+}
+
+type jsonSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       int                    `json:"kind"`
+	Start      time.Time              `json:"start"`
+	Duration   string                 `json:"duration"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// ExportSpans implements Exporter
+func (e *writerExporter) ExportSpans(_ context.Context, spans []*Span) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceID:    s.Context.TraceID.String(),
+			SpanID:     s.Context.SpanID.String(),
+			Name:       s.Name,
+			Kind:       s.Kind,
+			Start:      s.Start.UTC(),
+			Duration:   s.End.Sub(s.Start).String(),
+			Attributes: s.Attributes,
+			Error:      s.Error,
+		}
+		if s.Parent.IsValid() {
+			js.ParentID = s.Parent.String()
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter posts the spans to an OTLP/HTTP collector with the JSON encoding
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an Exporter posting the spans to the OTLP/HTTP endpoint of a collector,
+// e.g. http://localhost:4318/v1/traces. A nil client uses a client with a 10 seconds timeout
+func NewOTLPExporter(endpoint string, client *http.Client) Exporter {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &otlpExporter{
+		endpoint: endpoint,
+		client:   client,
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttributeOf(key string, v interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch val := v.(type) {
+	case string:
+		a.Value.StringValue = &val
+	case bool:
+		a.Value.BoolValue = &val
+	case int:
+		s := strconv.Itoa(val)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(val, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &val
+	default:
+		s := fmt.Sprint(val)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+// otlpRequestOf builds the body of an export request for the spans of the service
+func otlpRequestOf(serviceName string, spans []*Span) otlpRequest {
+	ss := otlpScopeSpans{Scope: otlpScope{Name: "github.com/vstoianovici/paymentsapi/tracing"}}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent.IsValid() {
+			span.ParentSpanID = s.Parent.String()
+		}
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			span.Attributes = append(span.Attributes, otlpAttributeOf(k, s.Attributes[k]))
+		}
+		// status codes: 0 unset, 2 error
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		ss.Spans = append(ss.Spans, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttributeOf("service.name", serviceName)}},
+		ScopeSpans: []otlpScopeSpans{ss},
+	}}}
+}
+
+// ExportSpans implements Exporter
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(otlpRequestOf(spans[0].tracer.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
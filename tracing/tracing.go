@@ -0,0 +1,321 @@
+// Package tracing records trace spans and exports them over OTLP/HTTP (JSON encoding) or as JSON lines to a writer.
+// Trace context is propagated with W3C traceparent headers
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of span, with the values used by OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// String returns the hex encoding of the trace ID
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// IsValid reports whether the trace ID is not all zeros
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// String returns the hex encoding of the span ID
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsValid reports whether the span ID is not all zeros
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext is the part of a span propagated across process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both IDs of the span context are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as a W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent reads a W3C traceparent header, the second result is false if the header is not valid
+func ParseTraceparent(h string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	// version 00 has exactly four fields, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Span is a timed operation of a trace
+type Span struct {
+	tracer *Tracer
+
+	mtx        sync.Mutex
+	Name       string
+	Kind       int
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+	ended      bool
+}
+
+// SetAttribute records a key/value pair on the span. It is safe to call on a nil span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.Attributes[key] = value
+	s.mtx.Unlock()
+}
+
+// SetError marks the span as failed when err is not nil. It is safe to call on a nil span
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.Error = err.Error()
+	s.mtx.Unlock()
+}
+
+// Finish ends the span and hands it to the tracer for export. It is safe to call on a nil span, and only the first
+// call has an effect
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mtx.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// TraceID returns the trace ID of the span, or an empty string for a nil span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.Context.TraceID.String()
+}
+
+type spanContextKey struct{}
+type remoteContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying the span
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// TraceIDFromContext returns the trace ID of the span carried by ctx, or an empty string
+func TraceIDFromContext(ctx context.Context) string {
+	return SpanFromContext(ctx).TraceID()
+}
+
+// ContextWithRemoteParent returns a copy of ctx carrying a span context received from another process,
+// the next span started from ctx becomes its child
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteContextKey{}, sc)
+}
+
+// Exporter sends finished spans to a tracing backend
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+// Tracer starts spans and exports them in batches
+type Tracer struct {
+	ServiceName string
+
+	exporters []Exporter
+	batchSize int
+	onError   func(error)
+
+	mtx     sync.Mutex
+	pending []*Span
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewTracer returns a Tracer exporting the finished spans to the exporters every interval, or sooner when
+// batchSize spans are waiting. With an interval of 0 spans are only exported by Flush
+func NewTracer(serviceName string, interval time.Duration, batchSize int, exporters ...Exporter) *Tracer {
+	t := &Tracer{
+		ServiceName: serviceName,
+		exporters:   exporters,
+		batchSize:   batchSize,
+		onError:     func(error) {},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(t.done)
+		return t
+	}
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.Flush(context.Background())
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// OnError sets the function called with the errors of the exporters
+func (t *Tracer) OnError(f func(error)) {
+	t.onError = f
+}
+
+// Start starts a span, child of the span (local or remote) carried by ctx, and returns a copy of ctx carrying it.
+// It is safe to call on a nil tracer, which returns ctx and a nil span
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.Context.TraceID = parent.Context.TraceID
+		s.Context.Sampled = parent.Context.Sampled
+		s.Parent = parent.Context.SpanID
+	} else if remote, ok := ctx.Value(remoteContextKey{}).(SpanContext); ok && remote.IsValid() {
+		s.Context.TraceID = remote.TraceID
+		s.Context.Sampled = remote.Sampled
+		s.Parent = remote.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = true
+	}
+	rand.Read(s.Context.SpanID[:])
+	return ContextWithSpan(ctx, s), s
+}
+
+// StartSpan starts a child of the span carried by ctx with the same tracer. Without a span in ctx it returns ctx and
+// a nil span, so that code down the stack only records spans for traced requests
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	// spans of traces the caller decided not to sample are dropped
+	if !s.Context.Sampled || len(t.exporters) == 0 {
+		return
+	}
+	t.mtx.Lock()
+	t.pending = append(t.pending, s)
+	full := t.batchSize > 0 && len(t.pending) >= t.batchSize
+	t.mtx.Unlock()
+	if full {
+		go t.Flush(context.Background())
+	}
+}
+
+// Flush exports the finished spans that have not been exported yet
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.mtx.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mtx.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	var firstErr error
+	for _, e := range t.exporters {
+		if err := e.ExportSpans(ctx, spans); err != nil {
+			t.onError(fmt.Errorf("err: Could not export spans: %v", err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Shutdown stops the periodic export and exports the remaining spans
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	select {
+	case <-t.stop:
+	default:
+		close(t.stop)
+	}
+	<-t.done
+	return t.Flush(ctx)
+}
@@ -0,0 +1,147 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryExporter struct {
+	spans []*Span
+}
+
+func (m *memoryExporter) ExportSpans(_ context.Context, spans []*Span) error {
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(h)
+		assert.False(t, ok, h)
+	}
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(t, ok)
+}
+
+func TestTracer(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer("test", 0, 0, exporter)
+
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindServer)
+	childCtx, child := StartSpan(ctx, "child", SpanKindInternal)
+	assert.Equal(t, root.TraceID(), TraceIDFromContext(childCtx))
+	assert.Equal(t, root.Context.SpanID, child.Parent)
+	child.SetError(errors.New("failed"))
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	assert.NoError(t, tracer.Flush(context.Background()))
+	assert.Len(t, exporter.spans, 2)
+	assert.Equal(t, "failed", exporter.spans[0].Error)
+
+	// spans are only started down the stack for traced requests
+	_, span := StartSpan(context.Background(), "untraced", SpanKindInternal)
+	assert.Nil(t, span)
+	span.SetAttribute("k", "v")
+	span.Finish()
+	assert.Equal(t, "", TraceIDFromContext(context.Background()))
+}
+
+func TestTracerRemoteParent(t *testing.T) {
+	exporter := &memoryExporter{}
+	tracer := NewTracer("test", 0, 0, exporter)
+
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span := tracer.Start(ContextWithRemoteParent(context.Background(), sc), "server", SpanKindServer)
+	assert.Equal(t, sc.TraceID, span.Context.TraceID)
+	assert.Equal(t, sc.SpanID, span.Parent)
+	span.Finish()
+
+	// the caller decided not to sample the trace
+	sc.Sampled = false
+	_, span = tracer.Start(ContextWithRemoteParent(context.Background(), sc), "server", SpanKindServer)
+	span.Finish()
+	tracer.Shutdown(context.Background())
+	assert.Len(t, exporter.spans, 1)
+}
+
+func TestWriterExporter(t *testing.T) {
+	var b bytes.Buffer
+	tracer := NewTracer("test", 0, 0, NewWriterExporter(&b))
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindServer)
+	_, child := StartSpan(ctx, "child", SpanKindInternal)
+	child.SetAttribute("payment.id", "1")
+	child.Finish()
+	root.Finish()
+	tracer.Flush(context.Background())
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Len(t, lines, 2)
+	var span map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &span))
+	assert.Equal(t, "child", span["name"])
+	assert.Equal(t, root.Context.SpanID.String(), span["parent_span_id"])
+	assert.Equal(t, map[string]interface{}{"payment.id": "1"}, span["attributes"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(b, &body))
+	}))
+	defer srv.Close()
+
+	tracer := NewTracer("paymentsapi", 0, 0, NewOTLPExporter(srv.URL, nil))
+	_, span := tracer.Start(context.Background(), "GET /v1/payments", SpanKindServer)
+	span.SetAttribute("http.status_code", 500)
+	span.SetError(errors.New("Internal Server Error"))
+	span.Finish()
+	assert.NoError(t, tracer.Flush(context.Background()))
+
+	assert.Len(t, body.ResourceSpans, 1)
+	assert.Equal(t, "paymentsapi", *body.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	s := body.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, span.Context.TraceID.String(), s.TraceID)
+	assert.Equal(t, SpanKindServer, s.Kind)
+	assert.Equal(t, "500", *s.Attributes[0].Value.IntValue)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "Internal Server Error"}, s.Status)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	var exportErr error
+	tracer = NewTracer("paymentsapi", 0, 0, NewOTLPExporter(failing.URL, nil))
+	tracer.OnError(func(err error) { exportErr = err })
+	_, span = tracer.Start(context.Background(), "GET /v1/payments", SpanKindServer)
+	span.Finish()
+	assert.Error(t, tracer.Flush(context.Background()))
+	assert.Error(t, exportErr)
+}
@@ -0,0 +1,104 @@
+package paymentsapi
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	mocket "github.com/Selvatico/go-mocket"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vstoianovici/paymentsapi/tracing"
+)
+
+type memorySpanExporter struct {
+	spans []*tracing.Span
+}
+
+func (m *memorySpanExporter) ExportSpans(_ context.Context, spans []*tracing.Span) error {
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+func TestHTTPTracing(t *testing.T) {
+	id, _ := uuid.NewV4()
+	mockService := &MockPaymentService{}
+	mockService.On("GetPayment", mock.Anything, id.String()).Return(Payment{ID: id}, nil)
+	exporter := &memorySpanExporter{}
+	tracer := tracing.NewTracer("test", 0, 0, exporter)
+	router := NewHTTPTransport(NewTracing("logging", NewTracing("core", mockService)))
+	h := NewHTTPTracing(router, router, tracer)
+
+	r := httptest.NewRequest("GET", "/v1/payments/"+id.String(), nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	tracer.Flush(context.Background())
+
+	names := []string{}
+	for _, s := range exporter.spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.Context.TraceID.String())
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"decode.getPayment", "core.GetPayment", "logging.GetPayment", "GET /v1/payments/{id}"}, names)
+	server := exporter.spans[3]
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.String())
+	assert.Equal(t, 200, server.Attributes["http.status_code"])
+	// the service layers are nested
+	assert.Equal(t, exporter.spans[2].Context.SpanID, exporter.spans[1].Parent)
+	assert.Equal(t, server.Context.Traceparent(), w.Header().Get("traceparent"))
+}
+
+func TestDBTracing(t *testing.T) {
+	db := setupTests()
+	RegisterDBTracing(db)
+	id, _ := uuid.NewV4()
+	mocket.Catcher.Reset().NewMock().WithQuery(`SELECT * FROM "payments"`).WithReply(mockNewPaymentResponse(id.String()))
+	exporter := &memorySpanExporter{}
+	tracer := tracing.NewTracer("test", 0, 0, exporter)
+	ctx, root := tracer.Start(context.Background(), "root", tracing.SpanKindServer)
+
+	NewPaymentService(db).GetPayment(ctx, id.String())
+	root.Finish()
+	tracer.Flush(context.Background())
+
+	queries := 0
+	for _, s := range exporter.spans {
+		if s.Kind == tracing.SpanKindClient {
+			queries++
+			assert.Equal(t, root.Context.SpanID, s.Parent)
+			assert.Contains(t, s.Attributes["db.statement"], "SELECT")
+		}
+	}
+	assert.True(t, queries > 0)
+
+	// queries without a traced context are not recorded
+	exporter.spans = nil
+	NewPaymentService(db).GetPayment(context.Background(), id.String())
+	tracer.Flush(context.Background())
+	assert.Empty(t, exporter.spans)
+}
+
+func TestJoinTransaction(t *testing.T) {
+	db := setupTests()
+	defer db.Close()
+	s := &txStore{db: db}
+
+	// the approval requests and the quota usage of an all-or-nothing batch are recorded in its transaction
+	ctx := NewContextWithTx(context.Background(), db.Begin())
+	var joined context.Context
+	assert.NoError(t, s.joinTransaction(ctx, func(ctx context.Context) error {
+		joined = ctx
+		return nil
+	}))
+	assert.Equal(t, ctx, joined)
+
+	// they have a transaction of their own otherwise
+	assert.NoError(t, s.joinTransaction(context.Background(), func(ctx context.Context) error {
+		_, ok := ctx.Value(txContextKey{}).(*gorm.DB)
+		assert.True(t, ok)
+		return nil
+	}))
+}
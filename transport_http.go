@@ -2,9 +2,16 @@ package paymentsapi
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	uuid "github.com/satori/go.uuid"
@@ -13,41 +20,60 @@ import (
 )
 
 // NewHTTPTransport creates a new JSON over HTTP transport
-func NewHTTPTransport(svc PaymentService) http.Handler {
+func NewHTTPTransport(svc PaymentService) *mux.Router {
+	// errors are sent along with the ID of the request
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
 	// define a way to service a request for the getListPaymentstHandler endpoint
 	getListPaymentstHandler := httptransport.NewServer(
 		MakeGetListPaymentsEndpoint(svc),
-		DecodeGetListPaymentsRequest,
+		tracedDecoder("getListPayments", DecodeGetListPaymentsRequest),
 		EncodeBasicResponse,
+		options...,
+	)
+
+	// define a way to service a request for the exportPaymentsHandler endpoint
+	exportPaymentsHandler := httptransport.NewServer(
+		MakeExportPaymentsEndpoint(svc),
+		tracedDecoder("exportPayments", DecodeExportPaymentsRequest),
+		EncodeExportResponse,
+		options...,
 	)
 
 	// define a way to service a request for the getPaymentHandler endpoint
 	getPaymentHandler := httptransport.NewServer(
 		MakeGetPaymentEndpoint(svc),
-		DecodeGetPaymentRequest,
+		tracedDecoder("getPayment", DecodeGetPaymentRequest),
 		EncodeBasicResponse,
+		options...,
 	)
 	// define a way to service a request for the createPaymentHandler endpoint
 	createPaymentHandler := httptransport.NewServer(
 		MakeCreatePaymentEndpoint(svc),
-		DecodeCreatePaymentRequest,
+		tracedDecoder("createPayment", DecodeCreatePaymentRequest),
 		EncodeCreationResponse,
+		options...,
 	)
 	// define a way to service a request for the updatePaymentHandler endpoint
 	updatePaymentHandler := httptransport.NewServer(
 		MakeUpdatePaymentEndpoint(svc),
-		DecodeUpdatePayementRequest,
+		tracedDecoder("updatePayment", DecodeUpdatePayementRequest),
 		EncodeCreationResponse,
+		options...,
 	)
 	// define a way to service a request for the deletePaymentHandler endpoint
 	deletePaymentHandler := httptransport.NewServer(
 		MakeDeletePaymentEndpoint(svc),
-		DecodeDeletePayementRequest,
+		tracedDecoder("deletePayment", DecodeDeletePayementRequest),
 		EncodeBasicResponse,
+		options...,
 	)
 
 	// Define a new router that will handle API endpoints for all the above defined handlers
 	router := mux.NewRouter()
+	// the payments are exported in a file format when one is asked for
+	router.Handle("/v1/payments", exportPaymentsHandler).Methods("GET").Queries("format", "{format}")
+	router.Handle("/v1/payments/{id}", exportPaymentsHandler).Methods("GET").Queries("format", "{format}")
 	router.Handle("/v1/payments", getListPaymentstHandler).Methods("GET")
 	router.Handle("/v1/payments/{id}", getPaymentHandler).Methods("GET")
 	router.Handle("/v1/payments", createPaymentHandler).Methods("POST")
@@ -56,6 +82,288 @@ func NewHTTPTransport(svc PaymentService) http.Handler {
 	return router
 }
 
+// RegisterApprovalRoutes adds the endpoints of the approval workflow to the router
+func RegisterApprovalRoutes(router *mux.Router, svc ApprovalService) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the approvePaymentHandler endpoint
+	approvePaymentHandler := httptransport.NewServer(
+		MakeApprovePaymentEndpoint(svc),
+		DecodeApprovePaymentRequest,
+		EncodeCreationResponse,
+		options...,
+	)
+	// define a way to service a request for the getApprovalsHandler endpoint
+	getApprovalsHandler := httptransport.NewServer(
+		MakeGetApprovalsEndpoint(svc),
+		DecodeApprovePaymentRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the getApprovalPolicyHandler endpoint
+	getApprovalPolicyHandler := httptransport.NewServer(
+		MakeGetApprovalPolicyEndpoint(svc),
+		DecodeGetListPaymentsRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the setApprovalPolicyHandler endpoint
+	setApprovalPolicyHandler := httptransport.NewServer(
+		MakeSetApprovalPolicyEndpoint(svc),
+		DecodeSetApprovalPolicyRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+
+	router.Handle("/v1/payments/{id}/approvals", approvePaymentHandler).Methods("POST")
+	router.Handle("/v1/payments/{id}/approvals", getApprovalsHandler).Methods("GET")
+	router.Handle("/v1/approval-policy", getApprovalPolicyHandler).Methods("GET")
+	router.Handle("/v1/approval-policy", setApprovalPolicyHandler).Methods("PUT")
+}
+
+// RegisterBatchRoutes adds the endpoint creating batches of payments to the router
+func RegisterBatchRoutes(router *mux.Router, svc BatchService) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the createBatchHandler endpoint
+	createBatchHandler := httptransport.NewServer(
+		MakeCreateBatchEndpoint(svc),
+		tracedDecoder("createBatch", DecodeCreateBatchRequest),
+		EncodeBatchResponse,
+		options...,
+	)
+
+	router.Handle("/v1/payments/batch", createBatchHandler).Methods("POST")
+}
+
+// RegisterImportRoutes adds the endpoints of the imports of files of payments to the router, the uploaded files are
+// limited to maxFileSize bytes
+func RegisterImportRoutes(router *mux.Router, svc ImportService, maxFileSize int64) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the createImportHandler endpoint
+	createImportHandler := httptransport.NewServer(
+		MakeCreateImportEndpoint(svc),
+		tracedDecoder("createImport", DecodeCreateImportRequest(maxFileSize)),
+		EncodeAcceptedResponse,
+		options...,
+	)
+	// define a way to service a request for the getImportHandler endpoint
+	getImportHandler := httptransport.NewServer(
+		MakeGetImportEndpoint(svc),
+		DecodeGetImportRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the cancelImportHandler endpoint
+	cancelImportHandler := httptransport.NewServer(
+		MakeCancelImportEndpoint(svc),
+		DecodeGetImportRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the getImportErrorsHandler endpoint
+	getImportErrorsHandler := httptransport.NewServer(
+		MakeGetImportErrorsEndpoint(svc),
+		DecodeGetImportRequest,
+		EncodeImportErrorsResponse,
+		options...,
+	)
+
+	router.Handle("/v1/imports", createImportHandler).Methods("POST")
+	router.Handle("/v1/imports/{id}", getImportHandler).Methods("GET")
+	router.Handle("/v1/imports/{id}", cancelImportHandler).Methods("DELETE")
+	router.Handle("/v1/imports/{id}/errors", getImportErrorsHandler).Methods("GET")
+}
+
+// RegisterStatusReportRoutes adds the endpoint applying the status reports of the banks to the router
+func RegisterStatusReportRoutes(router *mux.Router, svc StatusReportService, maxFileSize int64) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the applyStatusReportHandler endpoint
+	applyStatusReportHandler := httptransport.NewServer(
+		MakeApplyStatusReportEndpoint(svc),
+		tracedDecoder("applyStatusReport", DecodeApplyStatusReportRequest(maxFileSize)),
+		EncodeBasicResponse,
+		options...,
+	)
+
+	router.Handle("/v1/status-reports", applyStatusReportHandler).Methods("POST")
+}
+
+// RegisterReconciliationRoutes adds the endpoints of the reconciliations of the bank statements to the router, the
+// statements are limited to maxFileSize bytes
+func RegisterReconciliationRoutes(router *mux.Router, svc ReconciliationService, maxFileSize int64) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the reconcileHandler endpoint
+	reconcileHandler := httptransport.NewServer(
+		MakeReconcileEndpoint(svc),
+		tracedDecoder("reconcile", DecodeReconcileRequest(maxFileSize)),
+		EncodeCreationResponse,
+		options...,
+	)
+	// define a way to service a request for the listReconciliationsHandler endpoint
+	listReconciliationsHandler := httptransport.NewServer(
+		MakeListReconciliationsEndpoint(svc),
+		DecodeGetListPaymentsRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the getReconciliationHandler endpoint
+	getReconciliationHandler := httptransport.NewServer(
+		MakeGetReconciliationEndpoint(svc),
+		DecodeGetReconciliationRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the listReviewItemsHandler endpoint
+	listReviewItemsHandler := httptransport.NewServer(
+		MakeListReviewItemsEndpoint(svc),
+		DecodeGetListPaymentsRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the resolveReviewItemHandler endpoint
+	resolveReviewItemHandler := httptransport.NewServer(
+		MakeResolveReviewItemEndpoint(svc),
+		tracedDecoder("resolveReviewItem", DecodeResolveReviewItemRequest),
+		EncodeBasicResponse,
+		options...,
+	)
+
+	router.Handle("/v1/reconciliations", reconcileHandler).Methods("POST")
+	router.Handle("/v1/reconciliations", listReconciliationsHandler).Methods("GET")
+	// the review queue is registered before the reconciliations so that "review" is not read as an ID
+	router.Handle("/v1/reconciliations/review", listReviewItemsHandler).Methods("GET")
+	router.Handle("/v1/reconciliations/review/{id}", resolveReviewItemHandler).Methods("POST")
+	router.Handle("/v1/reconciliations/{id}", getReconciliationHandler).Methods("GET")
+}
+
+// RegisterRefundRoutes adds the endpoint refunding the payments to the router
+func RegisterRefundRoutes(router *mux.Router, svc RefundService) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the refundPaymentHandler endpoint
+	refundPaymentHandler := httptransport.NewServer(
+		MakeRefundPaymentEndpoint(svc),
+		tracedDecoder("refundPayment", DecodeRefundPaymentRequest),
+		EncodeCreationResponse,
+		options...,
+	)
+
+	router.Handle("/v1/payments/{id}/refunds", refundPaymentHandler).Methods("POST")
+}
+
+// RegisterLedgerRoutes adds the endpoints of the balances and the postings of the ledger to the router
+func RegisterLedgerRoutes(router *mux.Router, svc LedgerService) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the getBalancesHandler endpoint
+	getBalancesHandler := httptransport.NewServer(
+		MakeGetBalancesEndpoint(svc),
+		DecodeGetBalancesRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the listPostingsHandler endpoint
+	listPostingsHandler := httptransport.NewServer(
+		MakeListPostingsEndpoint(svc),
+		DecodeListPostingsRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the checkLedgerHandler endpoint
+	checkLedgerHandler := httptransport.NewServer(
+		MakeCheckLedgerEndpoint(svc),
+		DecodeGetListPaymentsRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+
+	router.Handle("/v1/ledger/balances", getBalancesHandler).Methods("GET")
+	router.Handle("/v1/ledger/postings", listPostingsHandler).Methods("GET")
+	router.Handle("/v1/ledger/check", checkLedgerHandler).Methods("GET")
+}
+
+// RegisterReturnRoutes adds the endpoints recording and reporting the returns of the payments to the router, the files
+// of returns are limited to maxFileSize bytes
+func RegisterReturnRoutes(router *mux.Router, svc ReturnService, maxFileSize int64) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the recordReturnHandler endpoint
+	recordReturnHandler := httptransport.NewServer(
+		MakeRecordReturnEndpoint(svc),
+		tracedDecoder("recordReturn", DecodeRecordReturnRequest),
+		EncodeCreationResponse,
+		options...,
+	)
+	// define a way to service a request for the importReturnsHandler endpoint
+	importReturnsHandler := httptransport.NewServer(
+		MakeImportReturnsEndpoint(svc),
+		tracedDecoder("importReturns", DecodeImportReturnsRequest(maxFileSize)),
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the listReturnsHandler endpoint
+	listReturnsHandler := httptransport.NewServer(
+		MakeListReturnsEndpoint(svc),
+		DecodeGetListPaymentsRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the returnReportHandler endpoint
+	returnReportHandler := httptransport.NewServer(
+		MakeReturnReportEndpoint(svc),
+		DecodeReturnReportRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+	// define a way to service a request for the listReturnReasonCodesHandler endpoint
+	listReturnReasonCodesHandler := httptransport.NewServer(
+		MakeListReturnReasonCodesEndpoint(svc),
+		DecodeGetListPaymentsRequest,
+		EncodeBasicResponse,
+		options...,
+	)
+
+	router.Handle("/v1/returns", recordReturnHandler).Methods("POST")
+	router.Handle("/v1/returns", listReturnsHandler).Methods("GET")
+	router.Handle("/v1/returns/import", importReturnsHandler).Methods("POST")
+	router.Handle("/v1/returns/report", returnReportHandler).Methods("GET")
+	router.Handle("/v1/returns/reason-codes", listReturnReasonCodesHandler).Methods("GET")
+}
+
+// RegisterScheduleRoutes adds the endpoint cancelling the scheduled payments to the router
+func RegisterScheduleRoutes(router *mux.Router, svc ScheduleService) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the cancelPaymentHandler endpoint
+	cancelPaymentHandler := httptransport.NewServer(
+		MakeCancelPaymentEndpoint(svc),
+		tracedDecoder("cancelPayment", DecodeCancelPaymentRequest),
+		EncodeBasicResponse,
+		options...,
+	)
+
+	router.Handle("/v1/payments/{id}/cancel", cancelPaymentHandler).Methods("POST")
+}
+
+// RegisterRestoreRoutes adds the endpoint restoring the deleted payments to the router
+func RegisterRestoreRoutes(router *mux.Router, svc RestoreService) {
+	options := []httptransport.ServerOption{httptransport.ServerErrorEncoder(EncodeError)}
+
+	// define a way to service a request for the restorePaymentHandler endpoint
+	restorePaymentHandler := httptransport.NewServer(
+		MakeRestorePaymentEndpoint(svc),
+		tracedDecoder("restorePayment", DecodeRestorePaymentRequest),
+		EncodeBasicResponse,
+		options...,
+	)
+
+	router.Handle("/v1/payments/{id}/restore", restorePaymentHandler).Methods("POST")
+}
+
 // DecodeGetListPaymentsRequest exported to be accessible from outside the package (from main)
 func DecodeGetListPaymentsRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	type empty struct{}
@@ -77,6 +385,22 @@ func DecodeCreatePaymentRequest(_ context.Context, r *http.Request) (interface{}
 	if newErr != nil {
 		return nil, newErr
 	}
+	// the status of a payment is managed by the API
+	req.Payment.Status = ""
+	return req, nil
+}
+
+// DecodeExportPaymentsRequest reads the format of the export, and the payment to export or the comma separated IDs of
+// the payments to export
+func DecodeExportPaymentsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := ExportPaymentsRequest{
+		Format:         r.URL.Query().Get("format"),
+		PaymentID:      mux.Vars(r)["id"],
+		ProcessingDate: r.URL.Query().Get("processing_date"),
+	}
+	if ids := r.URL.Query().Get("ids"); ids != "" {
+		req.PaymentIDs = strings.Split(ids, ",")
+	}
 	return req, nil
 }
 
@@ -90,6 +414,8 @@ func DecodeUpdatePayementRequest(_ context.Context, r *http.Request) (interface{
 	if newErr != nil {
 		return nil, newErr
 	}
+	// the status of a payment is managed by the API
+	req.Payment.Status = ""
 	req.PaymentID = id
 	return req, nil
 }
@@ -105,10 +431,279 @@ func DecodeDeletePayementRequest(_ context.Context, r *http.Request) (interface{
 	return DeletePaymentRequest{PaymentID: id}, nil
 }
 
+// DecodeApprovePaymentRequest exported to be accessible from outside the package (from main)
+func DecodeApprovePaymentRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := uuid.FromString(vars["id"])
+	newErr := treatErr(err, "err: Could not read payment ID")
+	if newErr != nil {
+		return nil, newErr
+	}
+	return ApprovePaymentRequest{PaymentID: id}, nil
+}
+
+// DecodeSetApprovalPolicyRequest exported to be accessible from outside the package (from main)
+func DecodeSetApprovalPolicyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req ApprovalPolicy
+	err := json.NewDecoder(r.Body).Decode(&req)
+	newErr := treatErr(err, "err: Could not read 'approval policy' body")
+	if newErr != nil {
+		return nil, newErr
+	}
+	return req, nil
+}
+
+// DecodeCreateBatchRequest reads the payments of a batch sent as a JSON array, or as NDJSON (one payment per line)
+// with the application/x-ndjson content type. The mode is read from the mode query parameter, all_or_nothing by default
+func DecodeCreateBatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := BatchRequest{
+		IdempotencyKey: r.Header.Get(IdempotencyKeyHeader),
+		Mode:           r.URL.Query().Get("mode"),
+	}
+	if req.Mode == "" {
+		req.Mode = BatchModeAllOrNothing
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	dec := json.NewDecoder(r.Body)
+	if contentType != "application/x-ndjson" && contentType != "application/ndjson" {
+		err := dec.Decode(&req.Payments)
+		if newErr := treatErr(err, "err: Could not read 'create batch' body"); newErr != nil {
+			return nil, newErr
+		}
+		return req, nil
+	}
+	for {
+		var p Payment
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if newErr := treatErr(err, "err: Could not read payment "+strconv.Itoa(len(req.Payments))+" of 'create batch' body"); newErr != nil {
+			return nil, newErr
+		}
+		req.Payments = append(req.Payments, p)
+		if len(req.Payments) > MaxBatchItems {
+			return nil, treatErr(errors.New("too many payments"), "err: Could not read 'create batch' body: ")
+		}
+	}
+	return req, nil
+}
+
+// importFormats are the formats of the files uploaded with each content type
+var importFormats = map[string]string{
+	"application/x-ndjson": ImportFormatJSONL,
+	"application/ndjson":   ImportFormatJSONL,
+	"application/jsonl":    ImportFormatJSONL,
+	"text/csv":             ImportFormatCSV,
+	"application/xml":      FormatPain001,
+	"text/xml":             FormatPain001,
+}
+
+// DecodeCreateImportRequest returns a decoder reading an uploaded file of at most maxFileSize bytes from the body. The
+// format is read from the format query parameter, or else from the content type
+func DecodeCreateImportRequest(maxFileSize int64) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		req := CreateImportRequest{
+			Format:   r.URL.Query().Get("format"),
+			FileName: r.URL.Query().Get("filename"),
+		}
+		if req.Format == "" {
+			contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			req.Format = importFormats[contentType]
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxFileSize))
+		if newErr := treatErr(err, "err: Could not read the uploaded file: "); newErr != nil {
+			return nil, newErr
+		}
+		req.Data = data
+		return req, nil
+	}
+}
+
+// DecodeApplyStatusReportRequest returns a decoder reading the status report sent as the body, up to maxFileSize bytes
+func DecodeApplyStatusReportRequest(maxFileSize int64) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxFileSize))
+		if newErr := treatErr(err, "err: Could not read the status report: "); newErr != nil {
+			return nil, newErr
+		}
+		return ApplyStatusReportRequest{Data: data}, nil
+	}
+}
+
+// statementFormats are the formats of the bank statements uploaded with each content type
+var statementFormats = map[string]string{
+	"application/xml": FormatCamt053,
+	"text/xml":        FormatCamt053,
+	"text/csv":        FormatStatementCSV,
+}
+
+// DecodeReconcileRequest returns a decoder reading a bank statement of at most maxFileSize bytes from the body. The
+// format is read from the format query parameter, or else from the content type
+func DecodeReconcileRequest(maxFileSize int64) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		req := ReconcileRequest{Format: r.URL.Query().Get("format")}
+		if req.Format == "" {
+			contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			req.Format = statementFormats[contentType]
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxFileSize))
+		if newErr := treatErr(err, "err: Could not read the statement: "); newErr != nil {
+			return nil, newErr
+		}
+		req.Data = data
+		return req, nil
+	}
+}
+
+// DecodeGetReconciliationRequest exported to be accessible from outside the package (from main)
+func DecodeGetReconciliationRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := uuid.FromString(vars["id"])
+	newErr := treatErr(err, "err: Could not read reconciliation ID")
+	if newErr != nil {
+		return nil, newErr
+	}
+	return GetReconciliationRequest{ReconciliationID: id}, nil
+}
+
+// DecodeResolveReviewItemRequest reads the item to resolve, the body is optional
+func DecodeResolveReviewItemRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 64)
+	if newErr := treatErr(err, "err: Could not read review item ID"); newErr != nil {
+		return nil, newErr
+	}
+	var req ResolveReviewItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != io.EOF {
+		if newErr := treatErr(err, "err: Could not read 'resolve review item' body"); newErr != nil {
+			return nil, newErr
+		}
+	}
+	req.ItemID = uint(id)
+	return req, nil
+}
+
+// DecodeRefundPaymentRequest reads the payment to refund, the body is optional
+func DecodeRefundPaymentRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := uuid.FromString(vars["id"])
+	if newErr := treatErr(err, "err: Could not read payment ID"); newErr != nil {
+		return nil, newErr
+	}
+	var req RefundPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != io.EOF {
+		if newErr := treatErr(err, "err: Could not read 'refund payment' body"); newErr != nil {
+			return nil, newErr
+		}
+	}
+	req.PaymentID = id
+	return req, nil
+}
+
+// DecodeGetBalancesRequest reads the account of the balances, all the accounts are returned without one
+func DecodeGetBalancesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return GetBalancesRequest{Account: r.URL.Query().Get("account")}, nil
+}
+
+// DecodeListPostingsRequest reads the payment and the account the postings are filtered on
+func DecodeListPostingsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := ListPostingsRequest{Account: r.URL.Query().Get("account")}
+	if id := r.URL.Query().Get("payment_id"); id != "" {
+		paymentID, err := uuid.FromString(id)
+		if newErr := treatErr(err, "err: Could not read payment ID"); newErr != nil {
+			return nil, newErr
+		}
+		req.PaymentID = paymentID
+	}
+	return req, nil
+}
+
+// DecodeRecordReturnRequest reads the return of a payment
+func DecodeRecordReturnRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req ReturnRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if newErr := treatErr(err, "err: Could not read 'record return' body"); newErr != nil {
+		return nil, newErr
+	}
+	return req, nil
+}
+
+// returnFormats are the formats of the files of returns uploaded with each content type
+var returnFormats = map[string]string{
+	"application/xml": FormatPacs004,
+	"text/xml":        FormatPacs004,
+	"text/csv":        FormatReturnsCSV,
+}
+
+// DecodeImportReturnsRequest returns a decoder reading a file of returns of at most maxFileSize bytes from the body.
+// The format is read from the format query parameter, or else from the content type
+func DecodeImportReturnsRequest(maxFileSize int64) httptransport.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (interface{}, error) {
+		req := ImportReturnsRequest{Format: r.URL.Query().Get("format")}
+		if req.Format == "" {
+			contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			req.Format = returnFormats[contentType]
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxFileSize))
+		if newErr := treatErr(err, "err: Could not read the returns: "); newErr != nil {
+			return nil, newErr
+		}
+		req.Data = data
+		return req, nil
+	}
+}
+
+// DecodeReturnReportRequest reads the days the report of the returns is limited to, both are optional
+func DecodeReturnReportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := ReturnReportRequest{From: r.URL.Query().Get("from"), To: r.URL.Query().Get("to")}
+	for _, day := range []string{req.From, req.To} {
+		if day == "" {
+			continue
+		}
+		_, err := time.Parse(isoDateFormat, day)
+		if newErr := treatErr(err, "err: Could not read the days of the report: "); newErr != nil {
+			return nil, newErr
+		}
+	}
+	return req, nil
+}
+
+// DecodeCancelPaymentRequest exported to be accessible from outside the package (from main)
+func DecodeCancelPaymentRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := uuid.FromString(vars["id"])
+	if newErr := treatErr(err, "err: Could not read payment ID"); newErr != nil {
+		return nil, newErr
+	}
+	return CancelPaymentRequest{PaymentID: id}, nil
+}
+
+// DecodeRestorePaymentRequest exported to be accessible from outside the package (from main)
+func DecodeRestorePaymentRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := uuid.FromString(vars["id"])
+	if newErr := treatErr(err, "err: Could not read payment ID"); newErr != nil {
+		return nil, newErr
+	}
+	return RestorePaymentRequest{PaymentID: id}, nil
+}
+
+// DecodeGetImportRequest exported to be accessible from outside the package (from main)
+func DecodeGetImportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	id, err := uuid.FromString(vars["id"])
+	newErr := treatErr(err, "err: Could not read import ID")
+	if newErr != nil {
+		return nil, newErr
+	}
+	return GetImportRequest{ImportID: id}, nil
+}
+
 func treatErr(err error, s string) error {
 	if err != nil {
 		var ErrAcc = errors.New(s)
-		cErr := errors.New(ErrAcc.Error() + err.Error())
+		cErr := StatusError{Status: http.StatusBadRequest, Kind: KindInvalidRequest, Message: ErrAcc.Error() + err.Error()}
 		return cErr
 	}
 	return nil
@@ -120,6 +715,46 @@ func EncodeBasicResponse(_ context.Context, w http.ResponseWriter, response inte
 	return json.NewEncoder(w).Encode(response)
 }
 
+// EncodeBatchResponse sends the results of a batch with the status code of its outcome, a response recorded by a
+// previous request with the same idempotency key is sent with the Idempotent-Replayed header
+func EncodeBatchResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(BatchResponse)
+	if res.Replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(res.HTTPStatus)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// EncodeAcceptedResponse sends a job that will run in the background
+func EncodeAcceptedResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(response)
+}
+
+// EncodeImportErrorsResponse sends the errors of the rows of an import as a CSV report
+func EncodeImportErrorsResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"row", "line", "kind", "errors"})
+	for _, e := range response.([]ImportRowError) {
+		cw.Write([]string{strconv.Itoa(e.Row), strconv.Itoa(e.Line), e.Kind, e.Errors})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// EncodeExportResponse sends an exported file as an attachment
+func EncodeExportResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(ExportResponse)
+	w.Header().Set("Content-Type", res.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": res.FileName}))
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(res.Data)
+	return err
+}
+
 // EncodeCreationResponse exported to be accessible from outside the package (from main)
 func EncodeCreationResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	w.WriteHeader(http.StatusCreated)
@@ -1,7 +1,9 @@
 package paymentsapi
 
 import (
+	"context"
 	"errors"
+	"reflect"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -13,6 +15,17 @@ var tags = map[string]string{
 	"exists":   "should_exist",
 }
 
+// payloadValidator checks the validate tags of the payments, a Date is required to be set
+var payloadValidator = newPayloadValidator()
+
+func newPayloadValidator() *valid.Validate {
+	v := valid.New()
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		return field.Interface().(Date).Time
+	}, Date{})
+	return v
+}
+
 // Validator needs to be exported as it is the return type of NewValidator who is also exported
 type Validator struct {
 	next PaymentService
@@ -24,47 +37,45 @@ func NewValidator(svc PaymentService) (PaymentService, error) {
 }
 
 // GetPayment needs to be exported to be accessed outside of the paymentsapi package
-func (v Validator) GetPayment(id string) (Payment, error) {
+func (v Validator) GetPayment(ctx context.Context, id string) (Payment, error) {
 	if err := validatePaymentID(id); err != nil {
 		return Payment{}, err
 	}
-	return v.next.GetPayment(id)
+	return v.next.GetPayment(ctx, id)
 }
 
 // GetListPayments needs to be exported to be accessed outside of the paymentsapi package
-func (v Validator) GetListPayments() ([]Payment, error) {
-	return v.next.GetListPayments()
+func (v Validator) GetListPayments(ctx context.Context) ([]Payment, error) {
+	return v.next.GetListPayments(ctx)
 }
 
 // CreatePayment needs to be exported to be accessed outside of the paymentsapi package
-func (v Validator) CreatePayment(p Payment) (CreatePaymentResponse, error) {
+func (v Validator) CreatePayment(ctx context.Context, p Payment) (CreatePaymentResponse, error) {
 	err := validatePayload(p)
 	if err != nil {
-		var ErrPay = errors.New("Payload could not be validated")
-		return CreatePaymentResponse{}, ErrPay
+		return CreatePaymentResponse{}, ErrPayloadNotValid
 	}
-	return v.next.CreatePayment(p)
+	return v.next.CreatePayment(ctx, p)
 }
 
 // UpdatePayment needs to be exported to be accessed outside of the paymentsapi package
-func (v Validator) UpdatePayment(req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
+func (v Validator) UpdatePayment(ctx context.Context, req UpdatePaymentRequest) (UpdatePaymentResponse, error) {
 	if err := validatePaymentID(req.PaymentID); err != nil {
 		return UpdatePaymentResponse{}, err
 	}
 	err := validatePayload(req.Payment)
 	if err != nil {
-		var ErrPay = errors.New("Payload could not be validated")
-		return UpdatePaymentResponse{}, ErrPay
+		return UpdatePaymentResponse{}, ErrPayloadNotValid
 	}
-	return v.next.UpdatePayment(req)
+	return v.next.UpdatePayment(ctx, req)
 }
 
 // DeletePayment needs to be exported to be accessed outside of the paymentsapi package
-func (v Validator) DeletePayment(id uuid.UUID) (*time.Time, error) {
+func (v Validator) DeletePayment(ctx context.Context, id uuid.UUID) (*time.Time, error) {
 	if err := validatePaymentID(id.String()); err != nil {
 		return nil, err
 	}
-	return v.next.DeletePayment(id)
+	return v.next.DeletePayment(ctx, id)
 }
 
 func validatePaymentID(id string) error {
@@ -83,10 +94,12 @@ func validatePaymentID(id string) error {
 	return nil
 }
 
+// ValidatePayload checks a payment against the same rules the Validator applies, without calling any service.
+// The returned error lists the fields that failed validation
+func ValidatePayload(p Payment) error {
+	return validatePayload(p)
+}
+
 func validatePayload(p Payment) error {
-	err := valid.New().Struct(p)
-	if err != nil {
-		return err
-	}
-	return nil
+	return payloadValidator.Struct(p)
 }
@@ -1,6 +1,7 @@
 package paymentsapi
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
@@ -57,7 +58,7 @@ func TestValidateGetListPayment(t *testing.T) {
 				mockService.On("GetListPayments", mock.Anything).Return(tt.mockServiceResult.p, tt.mockServiceResult.err)
 			}
 			s, _ := NewValidator(mockService)
-			got, err := s.GetListPayments()
+			got, err := s.GetListPayments(context.Background())
 			if err != nil {
 				assert.Equal(t, err, tt.wantErr)
 			} else {
@@ -107,10 +108,10 @@ func TestValidateGetPayment(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockService := &MockPaymentService{}
 			if tt.mockServiceResult != nil {
-				mockService.On("GetPayment", tt.args.id).Return(tt.mockServiceResult.p, tt.mockServiceResult.err)
+				mockService.On("GetPayment", mock.Anything, tt.args.id).Return(tt.mockServiceResult.p, tt.mockServiceResult.err)
 			}
 			s, _ := NewValidator(mockService)
-			got, err := s.GetPayment(tt.args.id)
+			got, err := s.GetPayment(context.Background(), tt.args.id)
 			if err != nil {
 				assert.Equal(t, err, tt.wantErr)
 			} else {
@@ -179,10 +180,10 @@ func TestValidatUpdatePayment(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockService := &MockPaymentService{}
 			if tt.mockServiceResult != nil {
-				mockService.On("UpdatePayment", tt.args.req).Return(tt.mockServiceResult.res, tt.mockServiceResult.err)
+				mockService.On("UpdatePayment", mock.Anything, tt.args.req).Return(tt.mockServiceResult.res, tt.mockServiceResult.err)
 			}
 			s, _ := NewValidator(mockService)
-			got, err := s.UpdatePayment(tt.args.req)
+			got, err := s.UpdatePayment(context.Background(), tt.args.req)
 			if err != nil {
 				assert.Equal(t, err, tt.wantErr)
 			} else {
@@ -237,10 +238,10 @@ func TestValidateDeletePayment(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockService := &MockPaymentService{}
 			if tt.mockServiceResult != nil {
-				mockService.On("DeletePayment", tt.args.id).Return(tt.mockServiceResult.deleteTime, tt.mockServiceResult.err)
+				mockService.On("DeletePayment", mock.Anything, tt.args.id).Return(tt.mockServiceResult.deleteTime, tt.mockServiceResult.err)
 			}
 			s, _ := NewValidator(mockService)
-			got, err := s.DeletePayment(tt.args.id)
+			got, err := s.DeletePayment(context.Background(), tt.args.id)
 			if err != nil {
 				assert.Equal(t, err, tt.wantErr)
 			} else {
@@ -293,10 +294,10 @@ func TestValidatCreatePayment(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockService := &MockPaymentService{}
 			if tt.mockServiceResult != nil {
-				mockService.On("CreatePayment", tt.args.p).Return(tt.mockServiceResult.p, tt.mockServiceResult.err)
+				mockService.On("CreatePayment", mock.Anything, tt.args.p).Return(tt.mockServiceResult.p, tt.mockServiceResult.err)
 			}
 			s, _ := NewValidator(mockService)
-			got, err := s.CreatePayment(tt.args.p)
+			got, err := s.CreatePayment(context.Background(), tt.args.p)
 			if err != nil {
 				assert.Equal(t, err, tt.wantErr)
 			} else {
@@ -323,6 +324,9 @@ func TestValidatePayload(t *testing.T) {
 	pIncorrect := mockCorruptedPayment("b50a0337-4bfe-4af7-a02e-3d7126a5101d")
 	err = validatePayload(pIncorrect)
 	assert.Error(t, err)
+	p.Attributes.ProcessingDate = Date{}
+	err = validatePayload(p)
+	assert.Error(t, err)
 }
 
 func mockPayment(id string) Payment {
@@ -382,7 +386,7 @@ func mockPayment(id string) Payment {
 			PaymentPurpose:       "course",
 			PaymentScheme:        "FPS",
 			PaymentType:          "Credit",
-			ProcessingDate:       "2017-01-18",
+			ProcessingDate:       mustDate("2017-01-18"),
 			Reference:            "PAYmen",
 			SchemePaymentSubType: "InternetBanking",
 			SchemePaymentType:    "Immediate Pay",